@@ -5,24 +5,33 @@ import (
 	"context"
 	"fmt"
 	_ "io"
-	"log"
+	"log/slog"
 	"mime"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/chromedp/cdproto/emulation"
-
 	"github.com/chromedp/chromedp"
 	"github.com/jhillyerd/enmime"
 	"golang.org/x/net/html"
 )
 
+// RenderedEmail is the result of rendering an email: the screenshot, the page's text and the
+// render variants. Path is empty when rendering failed.
+type RenderedEmail struct {
+	Path     string
+	FileName string
+	Page     domText
+	Variants []RenderedVariant
+	Blocked  []BlockedRequest // with RENDER_NETWORK_ISOLATED, the requests the page made
+}
+
 // RenderEmailHTML renders the email's HTML content in a headless browser and saves a screenshot.
 // It correctly handles embedded images (cid:) by saving them as temporary files and rewriting the HTML.
-func RenderEmailHTML(env *enmime.Envelope, fileName string, sandboxDir string) (string, string) {
+// Each of variants is rendered too and saved next to it as <name>-<variant>.png; variants that
+// fail to render are left out. With RENDER_NETWORK_ISOLATED the page can't reach the network.
+func RenderEmailHTML(ctx context.Context, env *enmime.Envelope, fileName string, sandboxDir string, variants []renderView) RenderedEmail {
 
 	// --- Step 2: Rewrite the HTML to use local file paths for embedded images ---
 	var modifiedHTML string
@@ -52,69 +61,126 @@ func RenderEmailHTML(env *enmime.Envelope, fileName string, sandboxDir string) (
 		// The email has HTML, so we process it to handle embedded images.
 		modifiedHTML, err = rewriteHTMLForRendering(env, sandboxDir)
 		if err != nil {
-			log.Printf("Failed to rewrite HTML for rendering: %v", err)
-			return "", err.Error()
+			slog.ErrorContext(ctx, "rewriting HTML for rendering failed", "err", err)
+			return RenderedEmail{}
 		}
 	}
 
 	// Save the modified HTML to the temporary directory.
 	tempFile := filepath.Join(sandboxDir, "email.html")
 	if err := os.WriteFile(tempFile, []byte(modifiedHTML), 0644); err != nil {
-		log.Printf("Failed to write temp HTML file: %v", err)
-		return "", err.Error()
+		slog.ErrorContext(ctx, "writing temp HTML file failed", "err", err)
+		return RenderedEmail{}
+	}
+
+	// --- Step 3 & 4: Render in headless Chrome and capture the screenshot ---
+	views, blocked, err := screenshotHTMLViews(ctx, tempFile, renderIsolated, append([]renderView{desktopView}, variants...))
+	if err != nil {
+		slog.ErrorContext(ctx, "capturing screenshot failed", "err", err)
+		return RenderedEmail{Blocked: blocked}
+	}
+
+	// --- Step 5: Save the screenshot to the "screenshots" directory ---
+
+	screenshotsDir := filepath.Join(sandboxDir, "screenshots")
+	if err := os.MkdirAll(screenshotsDir, 0755); err != nil {
+		slog.ErrorContext(ctx, "creating screenshots directory failed", "err", err)
+		return RenderedEmail{Blocked: blocked}
 	}
 
-	// --- Step 3: Set up and run the headless browser (Chrome) ---
+	screenshotFileName := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName)) + ".png"
+	screenshotFile := filepath.Join(screenshotsDir, screenshotFileName)
+
+	if err := os.WriteFile(screenshotFile, views[0].Screenshot, 0644); err != nil {
+		slog.ErrorContext(ctx, "saving screenshot failed", "err", err)
+		return RenderedEmail{Blocked: blocked}
+	}
+
+	rendered := RenderedEmail{Path: screenshotFile, FileName: screenshotFileName, Page: views[0].Page, Blocked: blocked}
+	for i, v := range variants {
+		view := views[i+1]
+		if view.Screenshot == nil {
+			continue
+		}
+		name := variantFileName(screenshotFileName, v.Name)
+		path := filepath.Join(screenshotsDir, name)
+		if err := os.WriteFile(path, view.Screenshot, 0644); err != nil {
+			slog.WarnContext(ctx, "saving variant screenshot failed", "variant", v.Name, "err", err)
+			continue
+		}
+		rendered.Variants = append(rendered.Variants, RenderedVariant{Name: v.Name, Path: path, FileName: name, Page: view.Page})
+	}
+	return rendered
+}
+
+// screenshotHTMLFile loads a local HTML file in headless Chrome and returns a full-page PNG.
+// With offline set, every network request is refused, so untrusted HTML (e.g. attachments)
+// can't phone home or pull in remote content while it is rendered. Cancelling ctx closes Chrome.
+func screenshotHTMLFile(ctx context.Context, htmlPath string, offline bool) ([]byte, error) {
+	views, _, err := screenshotHTMLViews(ctx, htmlPath, offline, []renderView{desktopView})
+	if err != nil {
+		return nil, err
+	}
+	return views[0].Screenshot, nil
+}
+
+// renderedView is a view's full-page PNG and the page's text in it.
+type renderedView struct {
+	Screenshot []byte
+	Page       domText
+}
+
+// screenshotHTMLViews renders a local HTML file in each view in turn, in one browser, and
+// returns a full-page PNG per view. Only a failure of the first view is an error; a later view
+// that fails is logged and its screenshot left nil. Offline, it also returns the requests the
+// page made that were refused.
+func screenshotHTMLViews(ctx context.Context, htmlPath string, offline bool, views []renderView) ([]renderedView, []BlockedRequest, error) {
+	defer trackDependency(ctx, "render", time.Now())
 	opts := append(chromedp.DefaultExecAllocatorOptions[:],
 		chromedp.NoSandbox,
 		chromedp.Flag("disable-extensions", true),
 		chromedp.Flag("incognito", true),
 		chromedp.Flag("disable-gpu", true),
 	)
-	allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
+	if offline {
+		// No DNS, and anything addressed by IP (loopback included) goes to a dead proxy.
+		// file:// loads are unaffected, so the page itself still renders.
+		opts = append(opts,
+			chromedp.Flag("host-resolver-rules", "MAP * ~NOTFOUND"),
+			chromedp.ProxyServer("http://127.0.0.1:9"),
+			chromedp.Flag("proxy-bypass-list", "<-loopback>"),
+		)
+	}
+	allocCtx, cancel := chromedp.NewExecAllocator(ctx, opts...)
 	defer cancel()
 
-	ctx, cancel := chromedp.NewContext(allocCtx)
+	browserCtx, cancel := chromedp.NewContext(allocCtx)
 	defer cancel()
-	ctx, cancel = context.WithTimeout(ctx, 90*time.Second)
+	browserCtx, cancel = context.WithTimeout(browserCtx, renderTimeout(len(views)))
 	defer cancel()
-
-	// --- Step 4: Capture the screenshot ---
-	var buf []byte
-	fileURL := "file:///" + filepath.ToSlash(tempFile)
-
-	if err := chromedp.Run(ctx,
-		emulation.SetDeviceMetricsOverride(1280, 1024, 3, false).
-			WithScreenOrientation(&emulation.ScreenOrientation{
-				Type:  emulation.OrientationTypePortraitPrimary,
-				Angle: 0,
-			}),
-
-		chromedp.Navigate(fileURL),
-		chromedp.WaitReady("body", chromedp.ByQuery),
-		chromedp.Sleep(1*time.Second),
-		chromedp.FullScreenshot(&buf, 100),
-	); err != nil {
-		log.Printf("Failed to capture screenshot: %v", err)
-		return "", err.Error()
-	}
-
-	// --- Step 5: Save the screenshot to the "screenshots" directory ---
-
-	screenshotsDir := filepath.Join(sandboxDir, "screenshots")
-	if err := os.MkdirAll(screenshotsDir, 0755); err != nil {
-		log.Printf("Failed to create screenshots directory: %v", err)
-		return "", err.Error()
+	var blocker requestBlocker
+	if offline {
+		// The flags above only make requests fail; intercepting them stops them leaving Chrome
+		// at all and says what they were.
+		if err := chromedp.Run(browserCtx, blocker.intercept(browserCtx)); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	screenshotFileName := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName)) + ".png"
-	screenshotFile := filepath.Join(screenshotsDir, screenshotFileName)
-
-	if err := os.WriteFile(screenshotFile, buf, 0644); err != nil {
-		log.Printf("Failed to save screenshot: %v", err)
-		return "", err.Error()
+	fileURL := "file:///" + filepath.ToSlash(htmlPath)
+	shots := make([]renderedView, len(views))
+	for i, v := range views {
+		var shot renderedView
+		if err := chromedp.Run(browserCtx, v.actions(fileURL, &shot)); err != nil {
+			if i == 0 {
+				return nil, blocker.list(), err
+			}
+			slog.WarnContext(ctx, "rendering variant failed", "variant", v.Name, "err", err)
+			continue
+		}
+		shots[i] = shot
 	}
-	return screenshotFile, screenshotFileName // Return the name
+	return shots, blocker.list(), nil
 }
 
 // rewriteHTMLForRendering finds cid: images, saves them, rewrites src attributes,
@@ -246,42 +312,34 @@ func rewriteHTMLForRendering(env *enmime.Envelope, tempDir string) (string, erro
 	return buf.String(), nil
 }
 
-// OCRImage executes the Tesseract command-line tool on the given image file
-// and returns the extracted text.
-func OCRImage(fileNameImage string) string {
-	if fileNameImage == "" {
-		return ""
-	}
-
-	// Prepare the command to run Tesseract. The "stdout" argument tells
-	// Tesseract to print its output to the console instead of a file.
+// tesseractPath returns the Tesseract executable shipped next to the backend.
+func tesseractPath() string {
 	dir, err := os.Getwd()
 	if err != nil {
-		log.Printf("Failed to get current directory: %v", err)
-		return ""
+		slog.Warn("getting current directory failed", "err", err)
+		return "tesseract"
 	}
+	return filepath.Join(dir, "tesseract.exe")
+}
 
-	// 2. Build the full absolute path to tesseract.exe
-	tesseractPath := filepath.Join(dir, "tesseract.exe")
-
-	// 3. Use the absolute path in the command
-	cmd := exec.Command(tesseractPath, fileNameImage, "stdout")
-
-	// Run the command and capture the combined standard output and standard error.
-	output, err := cmd.CombinedOutput()
+// OCRImage reads the text in the given image file with the configured OCR engine. lang is a
+// Tesseract language list such as "deu+eng"; empty means the engine's default (English). On
+// failure the result has no text and carries the error.
+func OCRImage(ctx context.Context, fileNameImage string, lang string) OCRResult {
+	if fileNameImage == "" {
+		return OCRResult{}
+	}
+	engine, err := currentOCREngine()
 	if err != nil {
-		// If the command fails, log the error and the output for debugging.
-		log.Printf("Error running Tesseract: %v\nOutput: %s", err, string(output))
-		return "" // Return an empty string to indicate failure.
+		slog.ErrorContext(ctx, "OCR engine unavailable", "err", err)
+		return OCRResult{Error: "OCR is unavailable."}
 	}
-
-	// Remove lines containing 'Estimating resolution as' from the output
-	lines := strings.Split(string(output), "\n")
-	var filtered []string
-	for _, line := range lines {
-		if !strings.Contains(line, "Estimating resolution as") {
-			filtered = append(filtered, line)
-		}
+	start := time.Now()
+	result, err := engine.Recognize(ctx, fileNameImage, lang)
+	trackDependency(ctx, "ocr", start)
+	if err != nil {
+		slog.ErrorContext(ctx, "OCR failed", "engine", engine.Name(), "err", err)
+		return OCRResult{Engine: engine.Name(), Error: "OCR failed."}
 	}
-	return strings.Join(filtered, "\n")
+	return result
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/net/html"
+)
+
+// Mail clients strip scripts, and bulk senders know it, so a <script> block in an email is
+// written for the few clients (and browsers opening a saved .eml) that run it. A <meta
+// http-equiv="refresh"> sends whoever opens the HTML straight to another page, and a <base href>
+// quietly resolves every relative link against a domain the links don't show. Each fails its own
+// check; the refresh target and the base URL are scanned with the email's links.
+
+// ActiveContentResult is the activeContentAnalysis event.
+type ActiveContentResult struct {
+	Scripts            int      `json:"scripts"`                // <script> elements
+	ScriptSources      []string `json:"scriptSources"`          // src of external scripts
+	ScriptIndicators   []string `json:"scriptIndicators"`       // obfuscation or exfiltration in inline scripts
+	RefreshURL         string   `json:"refreshUrl,omitempty"`   // target of a meta refresh
+	RefreshDelay       string   `json:"refreshDelay,omitempty"` // seconds before it fires
+	BaseHref           string   `json:"baseHref,omitempty"`     // <base href>
+	RelativeLinks      int      `json:"relativeLinks"`          // links the base tag resolves
+	Message            string   `json:"message"`
+	ScriptScoreImpact  int      `json:"scriptScoreImpact"`
+	RefreshScoreImpact int      `json:"refreshScoreImpact"`
+	BaseScoreImpact    int      `json:"baseScoreImpact"`
+}
+
+var metaRefreshURL = regexp.MustCompile(`(?i)^\s*([\d.]*)\s*[;,]?\s*(?:url\s*=\s*)?['"]?([^'"]*)['"]?\s*$`)
+
+// findActiveContent reports the scripts, meta refresh and base tag in htmlStr. Relative links
+// are only counted when there is a base tag.
+func findActiveContent(htmlStr string) ActiveContentResult {
+	result := ActiveContentResult{ScriptSources: []string{}, ScriptIndicators: []string{}}
+	if strings.TrimSpace(htmlStr) == "" {
+		return result
+	}
+	doc, err := html.Parse(strings.NewReader(htmlStr))
+	if err != nil {
+		return result
+	}
+	var relative int
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "script":
+				result.Scripts++
+				if src := strings.TrimSpace(attrValue(n, "src")); src != "" {
+					result.ScriptSources = append(result.ScriptSources, src)
+				}
+			case "meta":
+				if strings.EqualFold(strings.TrimSpace(attrValue(n, "http-equiv")), "refresh") && result.RefreshURL == "" {
+					if m := metaRefreshURL.FindStringSubmatch(attrValue(n, "content")); m != nil && strings.TrimSpace(m[2]) != "" {
+						result.RefreshDelay = m[1]
+						if result.RefreshDelay == "" {
+							result.RefreshDelay = "0"
+						}
+						result.RefreshURL = strings.TrimSpace(m[2])
+					}
+				}
+			case "base":
+				if href := strings.TrimSpace(attrValue(n, "href")); href != "" && result.BaseHref == "" {
+					result.BaseHref = href
+				}
+			case "a", "area", "img", "form":
+				key := "href"
+				if n.Data == "img" {
+					key = "src"
+				} else if n.Data == "form" {
+					key = "action"
+				}
+				if v := strings.TrimSpace(attrValue(n, key)); v != "" && isRelativeLink(v) {
+					relative++
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	if result.BaseHref != "" {
+		result.RelativeLinks = relative
+	}
+	if result.Scripts > 0 {
+		result.ScriptIndicators = findObfuscatedScript(htmlStr)
+	}
+	return result
+}
+
+// isRelativeLink reports whether a link is resolved against the page's base URL.
+func isRelativeLink(v string) bool {
+	lower := strings.ToLower(v)
+	if strings.HasPrefix(lower, "#") || strings.HasPrefix(lower, "//") {
+		return false
+	}
+	if i := strings.Index(lower, ":"); i > 0 && !strings.ContainsAny(lower[:i], "/?#") {
+		return false // has a scheme: http:, mailto:, cid:, data:...
+	}
+	return true
+}
+
+func attrValue(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// activeContentURLs returns the meta refresh target and base URL of htmlStr, when absolute.
+func activeContentURLs(htmlStr string) []string {
+	found := findActiveContent(htmlStr)
+	var urls []string
+	for _, u := range []string{found.RefreshURL, found.BaseHref} {
+		if strings.HasPrefix(u, "//") {
+			u = "https:" + u
+		}
+		if linkHost(u) != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// performActiveContentAnalysis searches the HTML part as sent, padding and quoted thread included.
+func performActiveContentAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, env *enmime.Envelope) {
+	defer wg.Done()
+	impacts := map[string]int{}
+	for _, c := range activeChecks() {
+		switch c.Name {
+		case "EmailScript", "MetaRefreshRedirect", "BaseTagRewrite":
+			impacts[c.Name] = c.Impact
+		}
+	}
+	result := findActiveContent(env.HTML)
+	var found []string
+	if result.Scripts > 0 {
+		what := fmt.Sprintf("%d script(s)", result.Scripts)
+		if len(result.ScriptIndicators) > 0 {
+			what += " (" + strings.Join(result.ScriptIndicators, ", ") + ")"
+		}
+		found = append(found, what)
+	} else {
+		result.ScriptScoreImpact = impacts["EmailScript"]
+	}
+	if result.RefreshURL != "" {
+		found = append(found, fmt.Sprintf("a meta refresh to %s after %ss", result.RefreshURL, result.RefreshDelay))
+	} else {
+		result.RefreshScoreImpact = impacts["MetaRefreshRedirect"]
+	}
+	if result.BaseHref != "" {
+		found = append(found, fmt.Sprintf("a base tag resolving %d relative link(s) against %s", result.RelativeLinks, result.BaseHref))
+	} else {
+		result.BaseScoreImpact = impacts["BaseTagRewrite"]
+	}
+	if len(found) == 0 {
+		result.Message = "No scripts, meta refresh or base tag in the email."
+	} else {
+		result.Message = "The email's HTML contains " + strings.Join(found, "; ") + ". Legitimate email doesn't use these."
+	}
+	ch <- CheckResult{EventName: "activeContentAnalysis", Payload: result}
+}
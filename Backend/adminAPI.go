@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/net/publicsuffix"
+)
+
+// registerAdminRoutes wires up the operator-only endpoints. They are all guarded by ADMIN_API_KEY.
+func registerAdminRoutes() {
+	http.Handle("/admin/prompts", requireAdmin(http.HandlerFunc(listPromptsHandler)))
+	http.Handle("/admin/prompts/preview", requireAdmin(http.HandlerFunc(previewPromptHandler)))
+	http.Handle("/admin/usage", requireAdmin(http.HandlerFunc(usageHandler)))
+	http.Handle("/admin/urls/allow", requireAdmin(urlListHandler(urlAllowList)))
+	http.Handle("/admin/urls/block", requireAdmin(urlListHandler(urlBlockList)))
+	http.Handle("/admin/attachments/policy", requireAdmin(http.HandlerFunc(attachmentPolicyHandler)))
+	http.Handle("/admin/profiles", requireAdmin(http.HandlerFunc(listProfilesHandler)))
+	http.Handle("/admin/db/refresh", requireAdmin(http.HandlerFunc(dbRefreshHandler)))
+	http.Handle("/admin/orgs", requireAdmin(http.HandlerFunc(orgImportHandler)))
+	http.Handle("/admin/checks", requireAdmin(http.HandlerFunc(checksHandler)))
+	http.Handle("/admin/feedback", requireAdmin(http.HandlerFunc(feedbackListHandler)))
+}
+
+// requireAdmin rejects requests that don't carry the configured admin key in X-Admin-Key.
+// When no key is configured the admin API is disabled entirely.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminAPIKey == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin API is disabled (ADMIN_API_KEY not set)"})
+			return
+		}
+		provided := r.Header.Get("X-Admin-Key")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(adminAPIKey)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid admin key"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON encodes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("writing JSON response failed", "err", err)
+	}
+}
+
+func listPromptsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"directory": promptDir,
+		"active":    promptTemplate,
+		"templates": prompts.names(),
+	})
+}
+
+// dbRefreshHandler starts a rebuild of the company database (POST, answered with 202 while it
+// runs in the background) or reports the state of the last one (GET).
+func dbRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, currentDBRefreshStatus())
+	case http.MethodPost:
+		if err := startDBRefresh(); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, currentDBRefreshStatus())
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// listProfilesHandler lists the tenant profiles from the config file. Bound API keys are not shown.
+func listProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	list := make([]map[string]interface{}, 0, len(profiles))
+	for _, name := range profileNames() {
+		p := profiles[name]
+		list = append(list, map[string]interface{}{"profile": p, "apiKeys": len(p.APIKeys)})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"profiles": list})
+}
+
+// previewPromptHandler renders the prompt that would be sent to Gemini for a base64-encoded EML,
+// without running any analysis. Query options: template, mode (text|rendered), country.
+func previewPromptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes()))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "failed to read request body"})
+		return
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body must be a base64-encoded EML"})
+		return
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "failed to parse email"})
+		return
+	}
+
+	Email := EmailData{Subject: env.GetHeader("Subject"), From: env.GetHeader("From")}
+	Email.Recipients, Email.RecipientNames = emailRecipients(env)
+	if addr, err := mail.ParseAddress(Email.From); err == nil {
+		_, Email.subDomain, _ = strings.Cut(strings.ToLower(addr.Address), "@")
+		if md, err := publicsuffix.EffectiveTLDPlusOne(Email.subDomain); err == nil {
+			Email.Domain = md
+		}
+	}
+
+	name := r.URL.Query().Get("template")
+	if name == "" {
+		name = promptTemplate
+	}
+	country := r.URL.Query().Get("country")
+	if country == "" {
+		country = defaultCountry
+	}
+	initial := r.URL.Query().Get("mode") != "rendered"
+
+	// Nothing is rendered here, so while images are kept from Gemini the email's plain text stands
+	// in for the rendered text.
+	prompt, err := buildPrompt(initial, name, raw, env.Text, Email, country)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"template": name,
+		"mode":     map[bool]string{true: "text", false: "rendered"}[initial],
+		"prompt":   prompt,
+	})
+}
+
+// usageHandler reports Gemini token usage and estimated spend per day and API key. Query: days (default 30).
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if results == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "results store unavailable"})
+		return
+	}
+	days := 30
+	if v, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && v > 0 {
+		days = v
+	}
+	summary, err := results.usageSummary(time.Now().AddDate(0, 0, -days+1))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reading usage summary failed", "err", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to read usage"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"days": days, "usage": summary})
+}
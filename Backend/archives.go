@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/nwaples/rardecode/v2"
+)
+
+// maxArchiveEntries caps how many members are read from any single archive.
+const maxArchiveEntries = 500
+
+// errArchiveBudget is returned once an email's archives have expanded past archiveMaxBytes,
+// which stops decompression bombs from exhausting memory.
+var errArchiveBudget = errors.New("uncompressed size limit reached")
+
+// archiveMember is one file read out of an archive. Content is nil for encrypted members.
+type archiveMember struct {
+	name      string
+	content   []byte
+	encrypted bool
+}
+
+// zipContainerExts are file types stored as zips that are documents or packages rather than
+// archives. Their parts aren't attachments in their own right, so they aren't opened; the file
+// itself is still checked.
+var zipContainerExts = map[string]bool{
+	".docx": true, ".docm": true, ".dotx": true, ".dotm": true, ".xlsx": true, ".xlsm": true,
+	".xltx": true, ".xltm": true, ".pptx": true, ".pptm": true, ".potx": true, ".ppsx": true,
+	".ppsm": true, ".vsdx": true, ".odt": true, ".ods": true, ".odp": true, ".odg": true,
+	".epub": true, ".jar": true, ".war": true, ".ear": true, ".apk": true, ".aab": true,
+	".ipa": true, ".xpi": true, ".crx": true, ".vsix": true, ".nupkg": true, ".whl": true,
+	".appx": true, ".msix": true, ".kmz": true, ".3mf": true,
+}
+
+// archiveKind identifies supported archive formats by magic bytes, falling back to the file
+// name for formats without a reliable signature. It returns "" for anything else, including
+// zip-based documents and packages.
+func archiveKind(name string, content []byte) string {
+	lower := strings.ToLower(name)
+	switch {
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")), bytes.HasPrefix(content, []byte("PK\x05\x06")):
+		if zipContainerExts[path.Ext(lower)] || isOOXML(content) {
+			return ""
+		}
+		return "zip"
+	case bytes.HasPrefix(content, []byte("Rar!\x1a\x07")):
+		return "rar"
+	case bytes.HasPrefix(content, []byte("7z\xbc\xaf\x27\x1c")):
+		return "7z"
+	case bytes.HasPrefix(content, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case len(content) > 262 && string(content[257:262]) == "ustar", strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// readLimited reads r while charging the bytes read against the shared budget.
+func readLimited(r io.Reader, budget *int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, *budget+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > *budget {
+		*budget = 0
+		return nil, errArchiveBudget
+	}
+	*budget -= int64(len(data))
+	return data, nil
+}
+
+// readArchive lists and extracts the members of an archive. encrypted reports whether any part
+// of the archive is password-protected. Members read before an error are still returned.
+func readArchive(kind, name string, content []byte, budget *int64) (members []archiveMember, encrypted bool, err error) {
+	switch kind {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return nil, false, err
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if len(members) >= maxArchiveEntries {
+				return members, encrypted, fmt.Errorf("more than %d entries", maxArchiveEntries)
+			}
+			if f.Flags&0x1 != 0 {
+				encrypted = true
+				members = append(members, archiveMember{name: f.Name, encrypted: true})
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return members, encrypted, err
+			}
+			data, err := readLimited(rc, budget)
+			_ = rc.Close()
+			if err != nil {
+				return members, encrypted, err
+			}
+			members = append(members, archiveMember{name: f.Name, content: data})
+		}
+		return members, encrypted, nil
+
+	case "rar":
+		rr, err := rardecode.NewReader(bytes.NewReader(content))
+		if err != nil {
+			if errors.Is(err, rardecode.ErrArchiveEncrypted) {
+				return nil, true, nil
+			}
+			return nil, false, err
+		}
+		for {
+			hdr, err := rr.Next()
+			if err == io.EOF {
+				return members, encrypted, nil
+			}
+			if errors.Is(err, rardecode.ErrArchiveEncrypted) || errors.Is(err, rardecode.ErrArchivedFileEncrypted) {
+				return members, true, nil
+			}
+			if err != nil {
+				return members, encrypted, err
+			}
+			if hdr.IsDir {
+				continue
+			}
+			if len(members) >= maxArchiveEntries {
+				return members, encrypted, fmt.Errorf("more than %d entries", maxArchiveEntries)
+			}
+			if hdr.Encrypted {
+				encrypted = true
+				members = append(members, archiveMember{name: hdr.Name, encrypted: true})
+				continue
+			}
+			data, err := readLimited(rr, budget)
+			if err != nil {
+				return members, encrypted, err
+			}
+			members = append(members, archiveMember{name: hdr.Name, content: data})
+		}
+
+	case "7z":
+		sr, err := sevenzip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			if strings.Contains(err.Error(), "aes7z") {
+				return nil, true, nil // encrypted headers: not even the names are visible
+			}
+			return nil, false, err
+		}
+		for _, f := range sr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if len(members) >= maxArchiveEntries {
+				return members, encrypted, fmt.Errorf("more than %d entries", maxArchiveEntries)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return members, encrypted, err
+			}
+			data, err := readLimited(rc, budget)
+			_ = rc.Close()
+			if err != nil && strings.Contains(err.Error(), "aes7z") {
+				encrypted = true
+				members = append(members, archiveMember{name: f.Name, encrypted: true})
+				continue
+			}
+			if err != nil {
+				return members, encrypted, err
+			}
+			members = append(members, archiveMember{name: f.Name, content: data})
+		}
+		return members, encrypted, nil
+
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, false, err
+		}
+		data, err := readLimited(gr, budget)
+		if err != nil {
+			return nil, false, err
+		}
+		inner := strings.TrimSuffix(strings.TrimSuffix(path.Base(name), ".gz"), ".tgz")
+		if archiveKind(inner, data) == "tar" || strings.HasSuffix(strings.ToLower(name), ".tgz") {
+			return readArchive("tar", inner, data, budget)
+		}
+		return []archiveMember{{name: inner, content: data}}, false, nil
+
+	case "tar":
+		tr := tar.NewReader(bytes.NewReader(content))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return members, false, nil
+			}
+			if err != nil {
+				return members, false, err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			if len(members) >= maxArchiveEntries {
+				return members, false, fmt.Errorf("more than %d entries", maxArchiveEntries)
+			}
+			data, err := readLimited(tr, budget)
+			if err != nil {
+				return members, false, err
+			}
+			members = append(members, archiveMember{name: hdr.Name, content: data})
+		}
+	}
+	return nil, false, fmt.Errorf("unsupported archive type %q", kind)
+}
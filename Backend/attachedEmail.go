@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An email can carry other emails as message/rfc822 attachments: a phishing message attached to
+// an innocent-looking one, or a chain of forwarded reports. Each attached email is run through
+// the same checks as the email itself, to ATTACHED_EMAIL_MAX_DEPTH levels, and reported on its
+// own; its scores don't change those of the email carrying it.
+
+// AttachedEmailReport is the analysis of one attached email.
+type AttachedEmailReport struct {
+	Path     string                 `json:"path"` // position among attached emails at each level, e.g. "1" or "1.2"
+	Depth    int                    `json:"depth"`
+	FileName string                 `json:"fileName,omitempty"`
+	From     string                 `json:"from"`
+	Subject  string                 `json:"subject"`
+	Domain   string                 `json:"domain"`
+	Checks   map[string]interface{} `json:"checks,omitempty"`
+	Scores   *ScoreResult           `json:"scores,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	// Skipped is set on a report standing in for attached emails that weren't analysed.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// analyseAttachedEmails analyses the emails attached to parent and, depth first, the emails
+// attached to those. path is parent's own position; nil for the uploaded email.
+func analyseAttachedEmails(ctx context.Context, parent emailAnalysis, maxScore float64, profile *Profile, path []int) []AttachedEmailReport {
+	if parent.env == nil || attachedEmailMaxDepth <= 0 {
+		return nil
+	}
+	var reports []AttachedEmailReport
+	n := 0
+	for _, p := range append(append(parent.env.Attachments, parent.env.Inlines...), parent.env.OtherParts...) {
+		if !strings.EqualFold(p.ContentType, "message/rfc822") || len(p.Content) == 0 {
+			continue
+		}
+		n++
+		childPath := append(append([]int(nil), path...), n)
+		if len(childPath) > attachedEmailMaxDepth {
+			return append(reports, AttachedEmailReport{
+				Path: formatAttachedPath(childPath), Depth: len(childPath),
+				Skipped: fmt.Sprintf("emails attached more than %d levels deep aren't analysed", attachedEmailMaxDepth),
+			})
+		}
+		if n > attachedEmailMax {
+			return append(reports, AttachedEmailReport{
+				Path: formatAttachedPath(childPath), Depth: len(childPath),
+				Skipped: fmt.Sprintf("only the first %d attached emails are analysed", attachedEmailMax),
+			})
+		}
+		if err := ctx.Err(); err != nil {
+			return reports
+		}
+		report, child := analyseAttachedEmail(ctx, parent, p.FileName, p.Content, maxScore, profile, childPath)
+		reports = append(reports, report)
+		if child != nil {
+			reports = append(reports, analyseAttachedEmails(ctx, *child, maxScore, profile, childPath)...)
+		}
+	}
+	return reports
+}
+
+// analyseAttachedEmail runs the checks on one attached email in a sandbox directory of its own.
+// It also returns the email's analysis so its own attachments can be analysed, or nil when it
+// couldn't be parsed.
+func analyseAttachedEmail(ctx context.Context, parent emailAnalysis, name string, eml []byte, maxScore float64, profile *Profile, path []int) (AttachedEmailReport, *emailAnalysis) {
+	report := AttachedEmailReport{Path: formatAttachedPath(path), Depth: len(path), FileName: name}
+	dir, err := os.MkdirTemp(parent.sandboxDir, "attached-*")
+	if err != nil {
+		slog.ErrorContext(ctx, "creating attached email sandbox failed", "err", err)
+		report.Error = "failed to create sandbox directory"
+		return report, nil
+	}
+	fileName := filepath.Join(dir, "original.eml")
+	if err := os.WriteFile(fileName, eml, 0644); err != nil {
+		slog.ErrorContext(ctx, "writing attached email failed", "err", err)
+		report.Error = "failed to store email"
+		return report, nil
+	}
+	env, fileName, Email, err := parseEmail(ctx, fileName, dir)
+	if err != nil {
+		slog.WarnContext(ctx, "parsing attached email failed", "path", report.Path, "err", err)
+		report.Error = "failed to parse email"
+		return report, nil
+	}
+	Email.RequestID, Email.ctx = parent.email.RequestID, parent.email.ctx
+	Email.Profile, Email.PhoneRegions, Email.URLScan = parent.email.Profile, parent.email.PhoneRegions, parent.email.URLScan
+	report.From, report.Subject, report.Domain = Email.From, Email.Subject, Email.Domain
+	slog.InfoContext(ctx, "analysing attached email", "path", report.Path, "from", Email.From, "domain", Email.Domain)
+
+	child := emailAnalysis{
+		env: env, email: Email, fileName: fileName, sandboxDir: dir, countryCode: parent.countryCode,
+		db: parent.db, enabledChecks: parent.enabledChecks, dbReadNanos: parent.dbReadNanos,
+	}
+	// The attached email's progress events (URL scans, check stages) aren't streamed; its results
+	// are sent together in its report.
+	events := make(chan CheckResult)
+	drained := make(chan struct{})
+	go func() {
+		for range events {
+		}
+		close(drained)
+	}()
+	report.Checks = runChecks(ctx, child, events)
+	close(events)
+	<-drained
+
+	scores := calculateFinalScores(report.Checks, maxScore, profile)
+	report.Scores = &scores
+	return report, &child
+}
+
+// formatAttachedPath writes path as dotted positions, e.g. "1.2".
+func formatAttachedPath(path []int) string {
+	parts := make([]string, len(path))
+	for i, p := range path {
+		parts[i] = strconv.Itoa(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// addAttached adds the AI calls made for an attached email to the report, under its path.
+func (u *UsageReport) addAttached(report AttachedEmailReport) {
+	child := summariseUsage(u.AnalysisID, report.Checks)
+	for name, stats := range child.Calls {
+		u.Calls["attachedEmail:"+report.Path+":"+name] = stats
+	}
+	u.PromptTokens += child.PromptTokens
+	u.OutputTokens += child.OutputTokens
+	u.TotalTokens += child.TotalTokens
+	u.EstimatedCostUSD += child.EstimatedCostUSD
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AttachmentRule is one entry of the attachment policy. Kind is "extension" (e.g. ".iso") or
+// "mime" (e.g. "application/x-msdownload"); Action is "deny" or "allow". Denied files with a
+// "low" severity are reported but don't cost points.
+type AttachmentRule struct {
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Action    string    `json:"action"`
+	Severity  string    `json:"severity"`
+	Note      string    `json:"note,omitempty"`
+	Builtin   bool      `json:"builtin,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+}
+
+const (
+	policyKindExtension = "extension"
+	policyKindMIME      = "mime"
+	policyDeny          = "deny"
+	policyAllow         = "allow"
+)
+
+// defaultAttachmentRules is the built-in deny list. Stored rules for the same value override it,
+// so an operator can allow one of these or change its severity.
+var defaultAttachmentRules = []AttachmentRule{
+	{Kind: policyKindExtension, Value: ".mobileconfig", Action: policyDeny, Severity: "high"},
+	{Kind: policyKindExtension, Value: ".exe", Action: policyDeny, Severity: "high"},
+	{Kind: policyKindExtension, Value: ".dmg", Action: policyDeny, Severity: "high"},
+	{Kind: policyKindExtension, Value: ".sh", Action: policyDeny, Severity: "high"},
+	{Kind: policyKindExtension, Value: ".bat", Action: policyDeny, Severity: "high"},
+	{Kind: policyKindExtension, Value: ".js", Action: policyDeny, Severity: "high"},
+	{Kind: policyKindExtension, Value: ".vbs", Action: policyDeny, Severity: "high"},
+}
+
+// attachmentPolicy is the effective rule set, keyed by kind then normalised value.
+type attachmentPolicy map[string]map[string]AttachmentRule
+
+// normalisePolicyValue lower-cases a rule value and gives extensions their leading dot.
+func normalisePolicyValue(kind, value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if kind == policyKindExtension && value != "" && !strings.HasPrefix(value, ".") {
+		value = "." + value
+	}
+	return value
+}
+
+// loadAttachmentPolicy merges the stored rules over the built-in defaults. It is read per
+// analysis so admin changes apply immediately.
+func loadAttachmentPolicy() attachmentPolicy {
+	policy := attachmentPolicy{policyKindExtension: {}, policyKindMIME: {}}
+	for _, r := range defaultAttachmentRules {
+		r.Builtin = true
+		policy[r.Kind][r.Value] = r
+	}
+	if results == nil {
+		return policy
+	}
+	stored, err := results.attachmentRules()
+	if err != nil {
+		slog.Error("reading attachment policy failed", "err", err)
+		return policy
+	}
+	for _, r := range stored {
+		if _, ok := policy[r.Kind]; ok {
+			policy[r.Kind][r.Value] = r
+		}
+	}
+	return policy
+}
+
+// match returns the deny rule that applies to a file, if any. An allow rule on either the
+// extension or the MIME type wins over a deny on the other.
+func (p attachmentPolicy) match(name, contentType string) (AttachmentRule, bool) {
+	var candidates []AttachmentRule
+	if r, ok := p[policyKindExtension][strings.ToLower(filepath.Ext(name))]; ok {
+		candidates = append(candidates, r)
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if r, ok := p[policyKindMIME][strings.ToLower(mediaType)]; ok {
+			candidates = append(candidates, r)
+		}
+	}
+	var deny *AttachmentRule
+	for i, r := range candidates {
+		if r.Action == policyAllow {
+			return AttachmentRule{}, false
+		}
+		if deny == nil {
+			deny = &candidates[i]
+		}
+	}
+	if deny == nil {
+		return AttachmentRule{}, false
+	}
+	return *deny, true
+}
+
+// rules lists the effective policy, built-in entries included.
+func (p attachmentPolicy) rules() []AttachmentRule {
+	rules := []AttachmentRule{}
+	for _, kind := range []string{policyKindExtension, policyKindMIME} {
+		for _, r := range p[kind] {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+func (s *resultsStore) attachmentRules() ([]AttachmentRule, error) {
+	rows, err := s.db.Query(`SELECT kind, value, action, severity, COALESCE(note, ''), created_at FROM attachment_policy ORDER BY kind, value`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			slog.Warn("closing attachment policy rows failed", "err", err)
+		}
+	}(rows)
+	rules := []AttachmentRule{}
+	for rows.Next() {
+		var r AttachmentRule
+		if err := rows.Scan(&r.Kind, &r.Value, &r.Action, &r.Severity, &r.Note, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (s *resultsStore) putAttachmentRule(r AttachmentRule) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO attachment_policy (kind, value, action, severity, note, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		r.Kind, r.Value, r.Action, r.Severity, r.Note, time.Now().UTC())
+	return err
+}
+
+func (s *resultsStore) removeAttachmentRule(kind, value string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM attachment_policy WHERE kind = ? AND value = ?`, kind, value)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// attachmentPolicyHandler serves the attachment policy: GET lists the effective rules, POST
+// {kind, value, action, severity, note} adds or replaces one, DELETE ?kind=&value= removes a
+// stored rule (built-in defaults come back once their override is removed).
+func attachmentPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if results == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "results store unavailable"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"rules": loadAttachmentPolicy().rules()})
+	case http.MethodPost, http.MethodPut:
+		var rule AttachmentRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body must be JSON: {\"kind\": \"extension|mime\", \"value\": \"...\", \"action\": \"deny|allow\", \"severity\": \"low|medium|high\"}"})
+			return
+		}
+		if rule.Kind != policyKindExtension && rule.Kind != policyKindMIME {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "kind must be \"extension\" or \"mime\""})
+			return
+		}
+		if rule.Action != policyDeny && rule.Action != policyAllow {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "action must be \"deny\" or \"allow\""})
+			return
+		}
+		if rule.Severity == "" {
+			rule.Severity = "high"
+		}
+		if rule.Severity != "low" && rule.Severity != "medium" && rule.Severity != "high" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "severity must be low, medium or high"})
+			return
+		}
+		rule.Value = normalisePolicyValue(rule.Kind, rule.Value)
+		if rule.Value == "" || rule.Value == "." {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "value is required"})
+			return
+		}
+		if err := results.putAttachmentRule(rule); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"kind": rule.Kind, "value": rule.Value, "action": rule.Action})
+	case http.MethodDelete:
+		kind := r.URL.Query().Get("kind")
+		value := normalisePolicyValue(kind, r.URL.Query().Get("value"))
+		removed, err := results.removeAttachmentRule(kind, value)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !removed {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "rule not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": kind, "removed": value})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// Bounces (delivery status notifications) and out-of-office replies are written by a mail
+// server, not by the company or person in the From header, so the Gemini verdicts on them are
+// worth reading with that in mind. parseEmail recognises them from a delivery-status part, the
+// Auto-Submitted and X-Autoreply headers, or an auto-reply subject on a reply, and the analysis
+// is annotated. Every one of those is written by the sender, so nothing is switched off and the
+// maximum score is unchanged; a phish could otherwise dress itself as a bounce to skip the AI
+// checks. The returned original, when the bounce attaches it, is analysed as an attached email.
+
+// AutomatedMessage describes a bounce or auto-reply.
+type AutomatedMessage struct {
+	Kind       string   `json:"kind"`    // bounce or autoReply
+	Signals    []string `json:"signals"` // what gave it away
+	Recipients []string `json:"recipients,omitempty"`
+	Status     string   `json:"status,omitempty"` // DSN status code of the first recipient, e.g. 5.1.1
+	Action     string   `json:"action,omitempty"` // failed, delayed, delivered...
+	Message    string   `json:"message"`
+}
+
+const (
+	automatedBounce    = "bounce"
+	automatedAutoReply = "autoReply"
+)
+
+var (
+	bounceSubject    = regexp.MustCompile(`(?i)(undeliverable|undelivered mail|delivery status notification|mail delivery (failed|failure|subsystem)|returned mail|delivery has failed|failure notice)`)
+	autoReplySubject = regexp.MustCompile(`(?i)^\s*(automatic reply|auto[- ]?reply|auto[- ]?response|out of (the )?office|autosvar|abwesenheitsnotiz|réponse automatique|respuesta automática)\b`)
+	bounceSenders    = map[string]bool{"mailer-daemon": true, "postmaster": true}
+)
+
+// detectAutomatedMessage returns what makes env a bounce or an auto-reply, or nil.
+func detectAutomatedMessage(env *enmime.Envelope) *AutomatedMessage {
+	var localPart string
+	if addr, err := mail.ParseAddress(env.GetHeader("From")); err == nil {
+		localPart, _, _ = strings.Cut(strings.ToLower(addr.Address), "@")
+	}
+	subject := env.GetHeader("Subject")
+
+	bounce := &AutomatedMessage{Kind: automatedBounce}
+	if ct := strings.ToLower(env.GetHeader("Content-Type")); strings.Contains(ct, "multipart/report") && strings.Contains(ct, "delivery-status") {
+		bounce.Signals = append(bounce.Signals, "multipart/report; report-type=delivery-status")
+	}
+	for _, p := range append(append(env.Attachments, env.Inlines...), env.OtherParts...) {
+		if ct := strings.ToLower(p.ContentType); ct == "message/delivery-status" || ct == "message/global-delivery-status" {
+			bounce.Signals = append(bounce.Signals, ct+" part")
+			readDeliveryStatus(bounce, string(p.Content))
+			break
+		}
+	}
+	if len(bounce.Signals) > 0 {
+		if bounceSenders[localPart] {
+			bounce.Signals = append(bounce.Signals, "sent by "+localPart)
+		}
+		return bounce.describe()
+	}
+
+	reply := &AutomatedMessage{Kind: automatedAutoReply}
+	if as := strings.ToLower(strings.TrimSpace(env.GetHeader("Auto-Submitted"))); strings.HasPrefix(as, "auto-replied") {
+		reply.Signals = append(reply.Signals, "Auto-Submitted: "+as)
+	}
+	for _, h := range []string{"X-Autoreply", "X-Autorespond", "X-Autoresponse"} {
+		if env.GetHeader(h) != "" {
+			reply.Signals = append(reply.Signals, h+" header")
+		}
+	}
+	if autoReplySubject.MatchString(subject) && env.GetHeader("In-Reply-To") != "" {
+		reply.Signals = append(reply.Signals, "auto-reply subject on a reply")
+	}
+	if len(reply.Signals) > 0 {
+		return reply.describe()
+	}
+	// Bounces from servers that don't send a DSN part only have their sender and subject.
+	if bounceSenders[localPart] && bounceSubject.MatchString(subject) {
+		bounce.Signals = []string{"sent by " + localPart, "bounce subject"}
+		bounce.Message = fmt.Sprintf("This looks like a bounce from %s, but has no delivery status report.", localPart)
+		return bounce
+	}
+	return nil
+}
+
+// readDeliveryStatus takes the recipients and the first status and action from a
+// message/delivery-status body.
+func readDeliveryStatus(m *AutomatedMessage, body string) {
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for sc.Scan() {
+		name, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "final-recipient", "original-recipient":
+			if _, addr, ok := strings.Cut(value, ";"); ok {
+				value = strings.TrimSpace(addr)
+			}
+			if value != "" && !containsFold(m.Recipients, value) {
+				m.Recipients = append(m.Recipients, value)
+			}
+		case "status":
+			if m.Status == "" {
+				m.Status = value
+			}
+		case "action":
+			if m.Action == "" {
+				m.Action = strings.ToLower(value)
+			}
+		}
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *AutomatedMessage) describe() *AutomatedMessage {
+	what := "an automatic reply"
+	if m.Kind == automatedBounce {
+		what = "a delivery status notification (bounce)"
+		if m.Status != "" {
+			what += fmt.Sprintf(" with status %s", m.Status)
+		}
+	}
+	m.Message = fmt.Sprintf("This looks like %s, written by a mail server rather than the sender. The headers that say so can be forged, so every check still runs.", what)
+	return m
+}
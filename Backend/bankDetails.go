@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Invoice fraud asks for the next payment to go to a "new" account: "we have changed banks,
+// please update your records with the details below". The email is otherwise ordinary business
+// correspondence, often from a compromised supplier mailbox, so Gemini tends to find it
+// realistic and the domain checks pass. BankDetailChange is a penalty rather than a check that
+// awards points: an email that both gives bank details (a checksum-valid IBAN or US routing
+// number, or a sort code or account number next to its label) and says the payment details have
+// changed loses its points, and every other email loses nothing. It runs with checkPaymentScam.
+
+// BankAccountDetail is one bank identifier found in the email.
+type BankAccountDetail struct {
+	Kind  string `json:"kind"` // iban, sortCode, accountNumber, routingNumber or swift
+	Value string `json:"value"`
+	Valid bool   `json:"valid"` // the checksum verifies (IBAN, routing number); labelled ones are always valid
+}
+
+// BankDetailChangeResult is the bankDetailAnalysis event.
+type BankDetailChangeResult struct {
+	Details       []BankAccountDetail `json:"details"`
+	ChangePhrases []string            `json:"changePhrases"`
+	ChangeRequest bool                `json:"changeRequest"` // bank details together with change language
+	Message       string              `json:"message"`
+	ScoreImpact   int                 `json:"scoreImpact"` // 0, or the (negative) impact of BankDetailChange
+}
+
+// penaltyEvents are the results that score 0 when nothing was found, so that isn't a failure.
+var penaltyEvents = map[string]bool{"bankDetailAnalysis": true}
+
+// ibanLengths is the length of an IBAN in each country that issues them (SWIFT IBAN registry).
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22, "BH": 22, "BR": 29,
+	"BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22, "DK": 18, "DO": 28, "EE": 20, "EG": 29,
+	"ES": 24, "FI": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23, "GL": 18, "GR": 27, "GT": 28,
+	"HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23, "IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20,
+	"LB": 28, "LC": 32, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24, "ME": 22, "MK": 19,
+	"MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24, "PL": 28, "PS": 29, "PT": 25, "QA": 29,
+	"RO": 24, "RS": 22, "SA": 24, "SC": 31, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25, "SV": 28,
+	"TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+var (
+	ibanCandidate = regexp.MustCompile(`(?i)\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,4})?\b`)
+	// Sort codes, account and routing numbers are only plain digits, so they count next to their
+	// label only.
+	sortCodeLabelled      = regexp.MustCompile(`(?i)\bsort\s*code\s*(?:no\.?|number)?\s*[:#]?\s*(\d{2}[- ]?\d{2}[- ]?\d{2})\b`)
+	accountNumberLabelled = regexp.MustCompile(`(?i)\b(?:account|acct|a/c)\.?\s*(?:no\.?|number|#)\s*[:#]?\s*(\d{6,12})\b`)
+	routingLabelled       = regexp.MustCompile(`(?i)\b(?:routing|aba|rtn)\s*(?:no\.?|number|#)?\s*[:#]?\s*(\d{9})\b`)
+	swiftLabelled         = regexp.MustCompile(`\b(?i:swift|bic)(?i:\s*code)?\s*[:#]?\s*([A-Z]{6}[A-Z0-9]{2}(?:[A-Z0-9]{3})?)\b`)
+
+	bankChangePhrases = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)\b(new|updated|changed?|revised|different)\s+(bank(ing)?|payment|remittance|account|beneficiary)\s+(details|information|info|account|instructions)`),
+		regexp.MustCompile(`(?i)\b(we\s+have|we've|we\s+had\s+to|recently)\s+(changed|updated|switched|moved)\s+(our\s+)?(bank|banking|account|bankers)`),
+		regexp.MustCompile(`(?i)\b(update|amend|change)\s+(your\s+records|(our|the)\s+(bank|payment|banking|account)\s+(details|information|account))`),
+		regexp.MustCompile(`(?i)\b(all\s+)?(future|further|outstanding|pending)\s+(payments?|invoices?|remittances?)\s+(should|must|need\s+to|to)\s+be\s+(made|sent|paid|transferred|remitted)`),
+		regexp.MustCompile(`(?i)\b(do\s+not|don't|please\s+stop|no\s+longer)\s+(pay|send|use|remit)\b[^.\n]{0,30}\b(old|previous|former|usual)\s+(account|bank)`),
+		regexp.MustCompile(`(?i)\b(account|bank)\s+(is|was|has\s+been)\s+(currently\s+)?(under\s+(audit|review|maintenance)|frozen|closed|suspended|on\s+hold)`),
+	}
+)
+
+// validIBAN checks an IBAN's country length and ISO 7064 mod-97 checksum.
+func validIBAN(iban string) bool {
+	iban = strings.ToUpper(strings.ReplaceAll(iban, " ", ""))
+	if n, ok := ibanLengths[iban[:2]]; !ok || n != len(iban) {
+		return false
+	}
+	var digits strings.Builder
+	for _, r := range iban[4:] + iban[:4] {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			fmt.Fprintf(&digits, "%d", r-'A'+10)
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// trimIBAN cuts a candidate after the n characters of its country's IBAN: the groups of four
+// ibanCandidate matches also take in the words after an IBAN ("BE68 5390 0754 7034 with thanks").
+func trimIBAN(candidate string, n int) string {
+	count := 0
+	for i, r := range candidate {
+		if r == ' ' {
+			continue
+		}
+		if count == n {
+			return strings.TrimSpace(candidate[:i])
+		}
+		count++
+	}
+	return candidate
+}
+
+// validRoutingNumber checks an ABA routing number's 3-7-1 weighted checksum.
+func validRoutingNumber(s string) bool {
+	if len(s) != 9 {
+		return false
+	}
+	weights := []int{3, 7, 1}
+	sum := 0
+	for i, r := range s {
+		sum += int(r-'0') * weights[i%3]
+	}
+	return sum%10 == 0
+}
+
+// findBankDetails returns the bank identifiers in text.
+func findBankDetails(text string) []BankAccountDetail {
+	seen := map[string]bool{}
+	details := []BankAccountDetail{}
+	add := func(kind, value string, valid bool) {
+		if key := kind + ":" + value; !seen[key] {
+			seen[key] = true
+			details = append(details, BankAccountDetail{Kind: kind, Value: value, Valid: valid})
+		}
+	}
+	for _, m := range ibanCandidate.FindAllString(text, -1) {
+		iban := strings.ToUpper(m)
+		// Only strings starting with a country that issues IBANs; "AB12 ..." is likely anything else.
+		if n, ok := ibanLengths[iban[:2]]; ok {
+			iban = trimIBAN(iban, n)
+			add("iban", iban, validIBAN(iban))
+		}
+	}
+	for _, m := range sortCodeLabelled.FindAllStringSubmatch(text, -1) {
+		add("sortCode", m[1], true)
+	}
+	for _, m := range accountNumberLabelled.FindAllStringSubmatch(text, -1) {
+		add("accountNumber", m[1], true)
+	}
+	for _, m := range routingLabelled.FindAllStringSubmatch(text, -1) {
+		add("routingNumber", m[1], validRoutingNumber(m[1]))
+	}
+	for _, m := range swiftLabelled.FindAllStringSubmatch(text, -1) {
+		add("swift", strings.ToUpper(m[1]), true)
+	}
+	return details
+}
+
+// scanBankDetailChange looks for bank details and payment-change language in text.
+func scanBankDetailChange(text string) BankDetailChangeResult {
+	result := BankDetailChangeResult{Details: findBankDetails(text), ChangePhrases: []string{}}
+	for _, re := range bankChangePhrases {
+		if m := re.FindString(text); m != "" {
+			result.ChangePhrases = append(result.ChangePhrases, m)
+		}
+	}
+	valid := false
+	for _, d := range result.Details {
+		// A SWIFT code names the bank, not an account.
+		valid = valid || d.Valid && d.Kind != "swift"
+	}
+	result.ChangeRequest = valid && len(result.ChangePhrases) > 0
+	return result
+}
+
+func performBankDetailAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "BankDetailChange" {
+			check = c
+			break
+		}
+	}
+
+	result := scanBankDetailChange(Email.Subject + "\n" + Email.textWithImages())
+	switch {
+	case result.ChangeRequest:
+		result.Message = "The email gives bank details and says the payment details have changed. Confirm any change by phone with a contact you already know before paying."
+		result.ScoreImpact = min(check.Impact, 0)
+	case len(result.Details) > 0:
+		result.Message = "The email contains bank details but doesn't say they have changed."
+	default:
+		result.Message = "No bank details found."
+	}
+	ch <- CheckResult{EventName: "bankDetailAnalysis", Payload: result}
+}
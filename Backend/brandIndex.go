@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// brandIndex is an in-memory copy of the protected_brands table, keyed so that checkDomainReal
+// only computes edit distances for brands that can be one edit away instead of every row.
+type brandIndex struct {
+	byName   map[string]string   // Unicode SLD to the brand as stored
+	byDelete map[string][]string // each Unicode SLD, and the SLD with any one rune removed, to brands
+	version  string              // CompanyStore.Version the index was built from
+	loadedAt time.Time
+}
+
+// brands is nil until the first load finishes; checkDomainReal queries the table meanwhile.
+var brands atomic.Pointer[brandIndex]
+
+// oneRuneDeletions returns s with each of its runes removed in turn. Two strings within edit
+// distance 1 always share s itself or one of these, which is what the index is keyed on.
+func oneRuneDeletions(s string) []string {
+	runes := []rune(s)
+	out := make([]string, 0, len(runes))
+	for i := range runes {
+		out = append(out, string(runes[:i])+string(runes[i+1:]))
+	}
+	return out
+}
+
+// loadBrandIndex reads protected_brands from the company database.
+func loadBrandIndex(ctx context.Context, store CompanyStore, version string) (*brandIndex, error) {
+	all, err := store.AllBrands(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &brandIndex{byName: map[string]string{}, byDelete: map[string][]string{}, version: version, loadedAt: time.Now()}
+	for _, brand := range all {
+		uni, _ := idna.ToUnicode(brand)
+		if _, dup := idx.byName[uni]; dup {
+			continue
+		}
+		idx.byName[uni] = brand
+		idx.byDelete[uni] = append(idx.byDelete[uni], brand)
+		for _, key := range oneRuneDeletions(uni) {
+			idx.byDelete[key] = append(idx.byDelete[key], brand)
+		}
+	}
+	return idx, nil
+}
+
+// refreshBrandIndex rebuilds the index when the database has changed since the last load. A
+// Postgres or MySQL database can't tell, so its index is rebuilt every time.
+func refreshBrandIndex(ctx context.Context) {
+	store := companyStore()
+	if store == nil {
+		slog.Warn("brand index not loaded", "err", "company database unavailable")
+		return
+	}
+	version, err := store.Version(ctx)
+	if err != nil {
+		slog.Warn("brand index not loaded", "err", err)
+		return
+	}
+	if cur := brands.Load(); cur != nil && version != "" && cur.version == version {
+		return
+	}
+	start := time.Now()
+	idx, err := loadBrandIndex(ctx, store, version)
+	if err != nil {
+		slog.Error("loading brand index failed", "err", err)
+		return
+	}
+	brands.Store(idx)
+	slog.Info("brand index loaded", "brands", len(idx.byName), "keys", len(idx.byDelete), "took", time.Since(start))
+}
+
+// runBrandIndex loads the index and then checks for a new database every interval.
+func runBrandIndex(interval time.Duration) {
+	for {
+		refreshBrandIndex(context.Background())
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// brandToken returns the brand stored under one of the tokens, if any.
+func (idx *brandIndex) brandToken(tokens []string) (string, bool) {
+	for _, t := range tokens {
+		if brand, ok := idx.byName[t]; ok {
+			return brand, true
+		}
+	}
+	return "", false
+}
+
+// typoCandidates returns the brands sld is a typosquat of, closest first, along with how many
+// candidates were compared. The candidates share a deletion key with sld or with sld with its
+// lookalike characters folded, which covers every brand one typo away from either.
+func (idx *brandIndex) typoCandidates(sld string) ([]string, int) {
+	keys := append(oneRuneDeletions(sld), sld)
+	if folded := foldLookalikes(sld); folded != sld {
+		keys = append(append(keys, oneRuneDeletions(folded)...), folded)
+	}
+	seen := map[string]bool{}
+	dist := map[string]float64{}
+	var matches []string
+	for _, key := range keys {
+		for _, brand := range idx.byDelete[key] {
+			if seen[brand] {
+				continue
+			}
+			seen[brand] = true
+			brandUni, _ := idna.ToUnicode(brand)
+			if d, ok := isTyposquat(sld, brandUni); ok {
+				dist[brand] = d
+				matches = append(matches, brand)
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if dist[matches[i]] != dist[matches[j]] {
+			return dist[matches[i]] < dist[matches[j]]
+		}
+		return matches[i] < matches[j]
+	})
+	return matches, len(seen)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/net/publicsuffix"
+)
+
+// CalendarInvite is the useful subset of one VEVENT from a text/calendar part.
+type CalendarInvite struct {
+	Summary     string   `json:"summary"`
+	Organizer   string   `json:"organizer"`
+	Attendees   []string `json:"attendees"`
+	Location    string   `json:"location,omitempty"`
+	Start       string   `json:"start,omitempty"`
+	URLs        []string `json:"urls"`
+	Suspicious  bool     `json:"suspicious"`
+	Explanation string   `json:"explanation,omitempty"`
+}
+
+type CalendarAnalysisResult struct {
+	Invites     []CalendarInvite `json:"invites"`
+	Message     string           `json:"message"`
+	ScoreImpact int              `json:"scoreImpact"`
+}
+
+// unfoldICS joins RFC 5545 folded lines (continuations start with a space or tab).
+func unfoldICS(raw string) []string {
+	raw = strings.ReplaceAll(raw, "\r\n", "\n")
+	var lines []string
+	for _, line := range strings.Split(raw, "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// unescapeICS resolves the TEXT value escapes of RFC 5545 §3.3.11.
+func unescapeICS(v string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(v)
+}
+
+// calendarAddress strips the mailto: scheme from ORGANIZER/ATTENDEE values.
+func calendarAddress(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 7 && strings.EqualFold(v[:7], "mailto:") {
+		v = v[7:]
+	}
+	return strings.ToLower(v)
+}
+
+// parseICS extracts the events of an iCalendar document.
+func parseICS(raw string) []CalendarInvite {
+	var invites []CalendarInvite
+	var cur *CalendarInvite
+	for _, line := range unfoldICS(raw) {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		prop, _, _ := strings.Cut(name, ";") // drop parameters such as CN=
+		prop = strings.ToUpper(strings.TrimSpace(prop))
+		switch {
+		case prop == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			cur = &CalendarInvite{Attendees: []string{}, URLs: []string{}}
+			continue
+		case prop == "END" && strings.EqualFold(value, "VEVENT"):
+			if cur != nil {
+				invites = append(invites, *cur)
+			}
+			cur = nil
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		switch prop {
+		case "SUMMARY":
+			cur.Summary = unescapeICS(value)
+		case "ORGANIZER":
+			cur.Organizer = calendarAddress(value)
+		case "ATTENDEE":
+			cur.Attendees = append(cur.Attendees, calendarAddress(value))
+		case "LOCATION":
+			cur.Location = unescapeICS(value)
+		case "DTSTART":
+			cur.Start = value
+		case "URL":
+			cur.URLs = append(cur.URLs, strings.TrimSpace(value))
+		case "DESCRIPTION", "X-ALT-DESC":
+			cur.URLs = append(cur.URLs, getURL(unescapeICS(value))...)
+		}
+	}
+	for i := range invites {
+		if invites[i].Location != "" {
+			invites[i].URLs = append(invites[i].URLs, getURL(invites[i].Location)...)
+		}
+		invites[i].URLs = dedupeStrings(invites[i].URLs)
+	}
+	return invites
+}
+
+// dedupeStrings removes repeated values while keeping the first occurrence order.
+func dedupeStrings(values []string) []string {
+	seen := make(map[string]struct{}, len(values))
+	out := []string{}
+	for _, v := range values {
+		if _, dup := seen[v]; dup || v == "" {
+			continue
+		}
+		seen[v] = struct{}{}
+		out = append(out, v)
+	}
+	return out
+}
+
+// findCalendarInvites walks every MIME part for text/calendar bodies and .ics attachments.
+func findCalendarInvites(env *enmime.Envelope) []CalendarInvite {
+	var invites []CalendarInvite
+	var walk func(p *enmime.Part)
+	walk = func(p *enmime.Part) {
+		if p == nil {
+			return
+		}
+		if strings.HasPrefix(strings.ToLower(p.ContentType), "text/calendar") || strings.EqualFold(filepath.Ext(p.FileName), ".ics") {
+			invites = append(invites, parseICS(string(p.Content))...)
+		}
+		for c := p.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(env.Root)
+	return invites
+}
+
+// assessInvite flags invites that carry links but don't come from the sender's own domain,
+// the pattern used to slip phishing links into a calendar where they look like a meeting.
+func assessInvite(inv *CalendarInvite, senderDomain string) {
+	if len(inv.URLs) == 0 {
+		return
+	}
+	organizerDomain := ""
+	if addr, err := mail.ParseAddress(inv.Organizer); err == nil {
+		_, host, _ := strings.Cut(addr.Address, "@")
+		organizerDomain, _ = publicsuffix.EffectiveTLDPlusOne(host)
+	}
+	switch {
+	case organizerDomain == "":
+		inv.Suspicious = true
+		inv.Explanation = "Invite contains links but has no valid organizer."
+	case senderDomain != "" && organizerDomain != senderDomain:
+		inv.Suspicious = true
+		inv.Explanation = fmt.Sprintf("Invite contains links and its organizer (%s) is not from the sending domain (%s).", organizerDomain, senderDomain)
+	}
+}
+
+func performCalendarAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "CalendarInvitePhishing" {
+			check = c
+			break
+		}
+	}
+
+	result := CalendarAnalysisResult{Invites: []CalendarInvite{}}
+	suspicious := 0
+	for _, inv := range Email.CalendarInvites {
+		assessInvite(&inv, Email.Domain)
+		if inv.Suspicious {
+			suspicious++
+		}
+		result.Invites = append(result.Invites, inv)
+	}
+	switch {
+	case len(result.Invites) == 0:
+		result.Message = "No calendar invites."
+		result.ScoreImpact = check.Impact
+	case suspicious > 0:
+		result.Message = fmt.Sprintf("%d calendar invite(s) contain links from an unverified organizer.", suspicious)
+	default:
+		result.Message = fmt.Sprintf("%d calendar invite(s) found; none look suspicious.", len(result.Invites))
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "calendarAnalysis", Payload: result}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/glaslos/ssdeep"
+)
+
+// Every saved analysis gets an ssdeep hash of its normalised body and joins the campaign of the
+// most similar email saved in the last CAMPAIGN_WINDOW, if that scores at least
+// CAMPAIGN_SIMILARITY (0-100), or starts a campaign of its own. GET /campaigns (admin key) lists
+// the campaigns with more than one email, so an admin can see that 40 users reported the same
+// phish even though each copy had a different recipient, tracking link and reference number.
+// An analysis that joins an existing campaign ends its stream with a campaignMatch event, and
+// CAMPAIGN_WEBHOOK_URL, if set, is told about each campaign once, when it reaches
+// CAMPAIGN_WEBHOOK_AFTER emails, rather than about every email in it.
+
+// minFingerprintLength is the shortest normalised body worth hashing: ssdeep can't tell short
+// texts apart from each other.
+const minFingerprintLength = 200
+
+const (
+	// campaignCandidates caps how many recent hashes a new one is compared with.
+	campaignCandidates = 5000
+	// campaignWebhookTimeout bounds one webhook notification.
+	campaignWebhookTimeout = 10 * time.Second
+)
+
+var (
+	fingerprintURL    = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+	fingerprintEmail  = regexp.MustCompile(`[\w.+-]+@[\w-]+(?:\.[\w-]+)+`)
+	fingerprintNumber = regexp.MustCompile(`\d+`)
+)
+
+func init() {
+	// Email bodies are mostly below ssdeep's 4 KiB minimum; the normalised text still hashes well.
+	ssdeep.Force = true
+}
+
+// normaliseBody reduces a body to what copies of one campaign have in common: links, addresses
+// and numbers become placeholders, and case and whitespace are folded.
+func normaliseBody(text string) string {
+	text = fingerprintURL.ReplaceAllString(text, "URL")
+	text = fingerprintEmail.ReplaceAllString(text, "EMAIL")
+	text = fingerprintNumber.ReplaceAllString(text, "0")
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// bodyFingerprint is the ssdeep hash of the normalised body, or "" when it is too short.
+func bodyFingerprint(text string) string {
+	norm := normaliseBody(text)
+	if len(norm) < minFingerprintLength {
+		return ""
+	}
+	hash, err := ssdeep.FuzzyBytes([]byte(norm))
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// hashBlockSize is the block size an ssdeep hash starts with; hashes are only comparable when
+// their block sizes are equal or differ by a factor of two.
+func hashBlockSize(hash string) int {
+	size, _, _ := strings.Cut(hash, ":")
+	n, _ := strconv.Atoi(size)
+	return n
+}
+
+// CampaignMembership is where an analysis was filed.
+type CampaignMembership struct {
+	CampaignID string `json:"campaignId,omitempty"`
+	Similarity int    `json:"similarity"` // to the closest earlier email; 0 for a new campaign
+	MatchedID  string `json:"matchedAnalysisId,omitempty"`
+}
+
+// clusterAnalysis stores the fingerprint of a saved analysis and files it under a campaign.
+func (s *resultsStore) clusterAnalysis(analysisID, apiKey, fingerprint string, at time.Time) (CampaignMembership, error) {
+	m := CampaignMembership{CampaignID: analysisID}
+	size := hashBlockSize(fingerprint)
+	rows, err := s.db.Query(`SELECT analysis_id, ssdeep, campaign_id FROM body_hashes
+		WHERE block_size IN (?, ?, ?) AND created_at >= ? AND analysis_id != ?
+		ORDER BY created_at DESC LIMIT ?`,
+		size/2, size, size*2, at.Add(-campaignWindow).UTC(), analysisID, campaignCandidates)
+	if err != nil {
+		return m, err
+	}
+	for rows.Next() {
+		var id, hash, campaign string
+		if err := rows.Scan(&id, &hash, &campaign); err != nil {
+			_ = rows.Close()
+			return m, err
+		}
+		score, err := ssdeep.Distance(fingerprint, hash)
+		if err == nil && score >= campaignSimilarity && score > m.Similarity {
+			m = CampaignMembership{CampaignID: campaign, Similarity: score, MatchedID: id}
+		}
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return m, err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO body_hashes (analysis_id, api_key, ssdeep, block_size, campaign_id, similarity, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		analysisID, apiKey, fingerprint, size, m.CampaignID, m.Similarity, at.UTC())
+	return m, err
+}
+
+// CampaignMatch is the payload of the campaignMatch event, sent when an analysis joins a
+// campaign that earlier emails started.
+type CampaignMatch struct {
+	CampaignMembership
+	Emails    int       `json:"emails"`    // including this one
+	Reporters int       `json:"reporters"` // distinct API keys
+	FirstSeen time.Time `json:"firstSeen"`
+}
+
+// campaignStats counts the emails and reporters of a campaign and finds its first email.
+func (s *resultsStore) campaignStats(id string) (emails, reporters int, first time.Time, err error) {
+	err = s.db.QueryRow(`SELECT COUNT(*), COUNT(DISTINCT api_key) FROM body_hashes WHERE campaign_id = ?`, id).Scan(&emails, &reporters)
+	if err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	err = s.db.QueryRow(`SELECT created_at FROM body_hashes WHERE campaign_id = ? ORDER BY created_at LIMIT 1`, id).Scan(&first)
+	return emails, reporters, first, err
+}
+
+// forReporter is the match as the key that submitted the email may see it. A campaign spans
+// tenants, so the IDs of analyses other keys (or anonymous callers) ran are left out and only
+// the counts remain.
+func (s *resultsStore) forReporter(m CampaignMatch, apiKey string) CampaignMatch {
+	own := func(id string) bool {
+		if id == "" || apiKey == "anonymous" {
+			return false
+		}
+		var key string
+		err := s.db.QueryRow(`SELECT api_key FROM body_hashes WHERE analysis_id = ?`, id).Scan(&key)
+		return err == nil && key == apiKey
+	}
+	if !own(m.MatchedID) {
+		m.MatchedID = ""
+	}
+	if !own(m.CampaignID) {
+		m.CampaignID = ""
+	}
+	return m
+}
+
+// claimCampaignAlert records that the webhook is being notified of a campaign. It returns false
+// when it already was, so each campaign is announced once however many emails join it.
+func (s *resultsStore) claimCampaignAlert(id string, at time.Time) (bool, error) {
+	res, err := s.db.Exec(`INSERT OR IGNORE INTO campaign_alerts (campaign_id, notified_at) VALUES (?, ?)`, id, at.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// releaseCampaignAlert forgets a claim whose notification failed, so the next email retries it.
+func (s *resultsStore) releaseCampaignAlert(id string) error {
+	_, err := s.db.Exec(`DELETE FROM campaign_alerts WHERE campaign_id = ?`, id)
+	return err
+}
+
+// fileUnderCampaign clusters a saved analysis by its body text. It returns the campaign it
+// joined, or nil when it starts one of its own or isn't clustered; the webhook is notified when
+// the campaign reaches CAMPAIGN_WEBHOOK_AFTER emails.
+func fileUnderCampaign(ctx context.Context, rec AnalysisRecord, text string) *CampaignMatch {
+	fp := bodyFingerprint(text)
+	if results == nil || campaignSimilarity <= 0 || fp == "" {
+		return nil
+	}
+	m, err := results.clusterAnalysis(rec.ID, rec.APIKey, fp, rec.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(ctx, "clustering analysis failed", "analysis_id", rec.ID, "err", err)
+		return nil
+	}
+	// The campaign is counted with this email in it, so a threshold of 1 announces a campaign as
+	// soon as its first email starts it.
+	match := &CampaignMatch{CampaignMembership: m}
+	if match.Emails, match.Reporters, match.FirstSeen, err = results.campaignStats(m.CampaignID); err != nil {
+		slog.ErrorContext(ctx, "counting campaign failed", "campaign_id", m.CampaignID, "err", err)
+	} else if campaignWebhookURL != "" && match.Emails >= campaignWebhookAfter {
+		go notifyCampaign(*match, rec)
+	}
+	if m.MatchedID == "" {
+		return nil
+	}
+	slog.InfoContext(ctx, "analysis matches a campaign", "analysis_id", rec.ID, "campaign_id", m.CampaignID,
+		"similarity", m.Similarity, "emails", match.Emails)
+	return match
+}
+
+// CampaignAlert is the body posted to CAMPAIGN_WEBHOOK_URL.
+type CampaignAlert struct {
+	Event      string        `json:"event"` // always "campaign"
+	Campaign   CampaignMatch `json:"campaign"`
+	AnalysisID string        `json:"analysisId"` // the email that made it reach the threshold
+	Subject    string        `json:"subject"`
+	From       string        `json:"from"`
+	Verdict    string        `json:"verdict"`
+}
+
+// notifyCampaign posts the campaign to the webhook, unless it was announced before.
+func notifyCampaign(match CampaignMatch, rec AnalysisRecord) {
+	claimed, err := results.claimCampaignAlert(match.CampaignID, time.Now())
+	if err != nil || !claimed {
+		if err != nil {
+			slog.Error("claiming campaign alert failed", "campaign_id", match.CampaignID, "err", err)
+		}
+		return
+	}
+	alert := CampaignAlert{
+		Event: "campaign", Campaign: match, AnalysisID: rec.ID,
+		Subject: rec.Subject, From: rec.From, Verdict: siemVerdict(rec.Scores),
+	}
+	if err := postCampaignAlert(alert); err != nil {
+		slog.Error("notifying campaign webhook failed", "campaign_id", match.CampaignID, "err", err)
+		if err := results.releaseCampaignAlert(match.CampaignID); err != nil {
+			slog.Error("releasing campaign alert failed", "campaign_id", match.CampaignID, "err", err)
+		}
+		return
+	}
+	slog.Info("campaign webhook notified", "campaign_id", match.CampaignID, "emails", match.Emails)
+}
+
+func postCampaignAlert(alert CampaignAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), campaignWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, campaignWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Campaign is one cluster of similar emails.
+type Campaign struct {
+	ID        string         `json:"id"` // the analysis that started it
+	Emails    int            `json:"emails"`
+	Reporters int            `json:"reporters"` // distinct API keys that submitted it
+	FirstSeen time.Time      `json:"firstSeen"`
+	LastSeen  time.Time      `json:"lastSeen"`
+	Subjects  []string       `json:"subjects"` // distinct subjects, at most maxCampaignSamples
+	Senders   []string       `json:"senders"`  // distinct From headers, at most maxCampaignSamples
+	Verdicts  map[string]int `json:"verdicts"`
+	Analyses  []string       `json:"analyses"` // newest first, at most maxCampaignAnalyses
+}
+
+const (
+	maxCampaignSamples  = 5
+	maxCampaignAnalyses = 100
+)
+
+// campaigns lists the campaigns with at least minEmails emails seen since since, most recently
+// active first.
+func (s *resultsStore) campaigns(since time.Time, minEmails, limit int) ([]Campaign, error) {
+	rows, err := s.db.Query(`SELECT campaign_id, COUNT(*), COUNT(DISTINCT api_key)
+		FROM body_hashes GROUP BY campaign_id HAVING COUNT(*) >= ? AND MAX(created_at) >= ?
+		ORDER BY MAX(created_at) DESC LIMIT ?`, minEmails, since.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	list := []Campaign{}
+	for rows.Next() {
+		var c Campaign
+		if err := rows.Scan(&c.ID, &c.Emails, &c.Reporters); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if err := s.fillCampaign(&list[i]); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// fillCampaign adds the dates, subjects, senders, verdicts and analyses of c's emails.
+func (s *resultsStore) fillCampaign(c *Campaign) error {
+	rows, err := s.db.Query(`SELECT a.id, h.created_at, a.subject, a.from_header, a.scores_json FROM body_hashes h
+		JOIN analyses a ON a.id = h.analysis_id WHERE h.campaign_id = ? ORDER BY h.created_at DESC`, c.ID)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	c.Subjects, c.Senders, c.Verdicts, c.Analyses = []string{}, []string{}, map[string]int{}, []string{}
+	seen := map[string]bool{}
+	sample := func(list *[]string, kind, v string) {
+		if v != "" && !seen[kind+v] && len(*list) < maxCampaignSamples {
+			seen[kind+v] = true
+			*list = append(*list, v)
+		}
+	}
+	for rows.Next() {
+		var id string
+		var at time.Time
+		var subject, from, scoresJSON sql.NullString
+		if err := rows.Scan(&id, &at, &subject, &from, &scoresJSON); err != nil {
+			return err
+		}
+		if c.LastSeen.IsZero() {
+			c.LastSeen = at
+		}
+		c.FirstSeen = at
+		sample(&c.Subjects, "s", subject.String)
+		sample(&c.Senders, "f", from.String)
+		var scores ScoreResult
+		if scoresJSON.Valid && json.Unmarshal([]byte(scoresJSON.String), &scores) == nil {
+			c.Verdicts[siemVerdict(scores)]++
+		}
+		if len(c.Analyses) < maxCampaignAnalyses {
+			c.Analyses = append(c.Analyses, id)
+		}
+	}
+	return rows.Err()
+}
+
+// campaignsHandler lists campaigns (?days= of activity, default 30; ?min= emails, default 2;
+// ?limit=, default 50, at most 500).
+func campaignsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if results == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "results store unavailable"})
+		return
+	}
+	days, minEmails, limit := 30, 2, 50
+	if v, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && v > 0 {
+		days = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("min")); err == nil && v > 0 {
+		minEmails = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, 500)
+	}
+	list, err := results.campaigns(time.Now().AddDate(0, 0, -days), minEmails, limit)
+	if err != nil {
+		slog.Error("listing campaigns failed", "err", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list campaigns"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"campaigns": list, "days": days})
+}
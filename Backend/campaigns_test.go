@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCampaignWebhookThresholdOne(t *testing.T) {
+	store, err := openResultsStore(filepath.Join(t.TempDir(), "results.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.db.Close() })
+
+	alerts := make(chan CampaignAlert, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert CampaignAlert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("decoding the alert: %v", err)
+		}
+		alerts <- alert
+	}))
+	t.Cleanup(hook.Close)
+
+	savedResults, savedURL, savedAfter := results, campaignWebhookURL, campaignWebhookAfter
+	savedSimilarity, savedWindow := campaignSimilarity, campaignWindow
+	results, campaignWebhookURL, campaignWebhookAfter = store, hook.URL, 1
+	campaignSimilarity, campaignWindow = 70, time.Hour
+	t.Cleanup(func() {
+		results, campaignWebhookURL, campaignWebhookAfter = savedResults, savedURL, savedAfter
+		campaignSimilarity, campaignWindow = savedSimilarity, savedWindow
+	})
+
+	text := strings.Repeat("Your mailbox is almost full. Verify your account today to keep receiving email. ", 5)
+	rec := AnalysisRecord{ID: "first", APIKey: "key-a", CreatedAt: time.Now(), Subject: "Mailbox full"}
+	if match := fileUnderCampaign(context.Background(), rec, text); match != nil {
+		t.Fatalf("the first email joined campaign %q", match.CampaignID)
+	}
+
+	select {
+	case alert := <-alerts:
+		if alert.Campaign.CampaignID != "first" || alert.Campaign.Emails != 1 || alert.AnalysisID != "first" {
+			t.Errorf("alert = %+v, want campaign first with 1 email", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't notified of the new campaign")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check impacts and descriptions can be changed at runtime through /admin/checks. The changes are
+// stored in the results database and applied over AllChecks (as the config file's scoring section
+// left it) at startup and after every change, so they survive restarts without a rebuild.
+
+// maxCheckImpact bounds the impact the admin API accepts for one check.
+const maxCheckImpact = 100
+
+// liveChecks holds the checks in use. It is replaced as a whole, so a lookup never sees a
+// half-applied change.
+var liveChecks atomic.Pointer[[]Check]
+
+// checkSettingsMu serialises changes, so two updates can't each pass validation on their own and
+// together leave a broken set.
+var checkSettingsMu sync.Mutex
+
+// activeChecks returns the checks with the stored overrides applied.
+func activeChecks() []Check {
+	if p := liveChecks.Load(); p != nil {
+		return *p
+	}
+	return AllChecks
+}
+
+// CheckSetting is a stored override of one check; nil fields keep the configured value.
+type CheckSetting struct {
+	Name        string    `json:"name"`
+	Impact      *int      `json:"impact,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt,omitempty"`
+}
+
+// checkView is one check as GET /admin/checks shows it.
+type checkView struct {
+	Name             string     `json:"name"`
+	Description      string     `json:"description"`
+	Impact           int        `json:"impact"`
+	ConfiguredImpact int        `json:"configuredImpact"` // from AllChecks and the config file's scoring section
+	Overridden       bool       `json:"overridden"`
+	UpdatedAt        *time.Time `json:"updatedAt,omitempty"`
+}
+
+// applyCheckSettings returns a copy of base with the settings applied in order. Settings for
+// checks that no longer exist are ignored.
+func applyCheckSettings(base []Check, settings []CheckSetting) []Check {
+	checks := append([]Check(nil), base...)
+	for _, s := range settings {
+		for i := range checks {
+			if checks[i].Name != s.Name {
+				continue
+			}
+			if s.Impact != nil {
+				checks[i].Impact = *s.Impact
+			}
+			if s.Description != nil {
+				checks[i].Description = *s.Description
+			}
+		}
+	}
+	return checks
+}
+
+// validateChecks rejects a set of checks that scoring can't work with: impacts out of range, empty
+// descriptions, or no points left to award with every check enabled, for the server-wide weights
+// or for any profile.
+func validateChecks(checks []Check) error {
+	impacts := map[string]int{}
+	for _, c := range checks {
+		if c.Impact < -maxCheckImpact || c.Impact > maxCheckImpact {
+			return fmt.Errorf("%s: impact must be between %d and %d", c.Name, -maxCheckImpact, maxCheckImpact)
+		}
+		if c.Description == "" {
+			return fmt.Errorf("%s: description must not be empty", c.Name)
+		}
+		impacts[c.Name] = c.Impact
+	}
+	if MaxScoreFor(nil, &Profile{Scoring: impacts}) <= 0 {
+		return fmt.Errorf("the maximum score would be 0")
+	}
+	for name, p := range profiles {
+		merged := map[string]int{}
+		for k, v := range impacts {
+			merged[k] = v
+		}
+		for k, v := range p.Scoring {
+			merged[k] = v
+		}
+		if MaxScoreFor(p.Checks, &Profile{Scoring: merged}) <= 0 {
+			return fmt.Errorf("the maximum score of profile %q would be 0", name)
+		}
+	}
+	return nil
+}
+
+// reloadChecks applies the stored settings over AllChecks.
+func reloadChecks() error {
+	if results == nil {
+		return nil
+	}
+	settings, err := results.checkSettings()
+	if err != nil {
+		return err
+	}
+	checks := applyCheckSettings(AllChecks, settings)
+	if err := validateChecks(checks); err != nil {
+		// The config file changed under the stored settings; keep scoring as configured.
+		return fmt.Errorf("stored check settings ignored: %w", err)
+	}
+	liveChecks.Store(&checks)
+	return nil
+}
+
+func (s *resultsStore) checkSettings() ([]CheckSetting, error) {
+	rows, err := s.db.Query(`SELECT name, impact, description, updated_at FROM check_settings ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var settings []CheckSetting
+	for rows.Next() {
+		var st CheckSetting
+		var impact sql.NullInt64
+		var description sql.NullString
+		if err := rows.Scan(&st.Name, &impact, &description, &st.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if impact.Valid {
+			v := int(impact.Int64)
+			st.Impact = &v
+		}
+		if description.Valid {
+			st.Description = &description.String
+		}
+		settings = append(settings, st)
+	}
+	return settings, rows.Err()
+}
+
+// putCheckSettings stores the settings in one transaction, merging each with the stored one.
+func (s *resultsStore) putCheckSettings(settings []CheckSetting) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, st := range settings {
+		if _, err := tx.Exec(`INSERT INTO check_settings (name, impact, description, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(name) DO UPDATE SET impact = COALESCE(excluded.impact, impact),
+				description = COALESCE(excluded.description, description), updated_at = excluded.updated_at`,
+			st.Name, st.Impact, st.Description, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *resultsStore) removeCheckSetting(name string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM check_settings WHERE name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// checkViews lists the active checks, sorted by name.
+func checkViews() ([]checkView, error) {
+	settings, err := results.checkSettings()
+	if err != nil {
+		return nil, err
+	}
+	stored := map[string]CheckSetting{}
+	for _, s := range settings {
+		stored[s.Name] = s
+	}
+	configured := map[string]int{}
+	for _, c := range AllChecks {
+		configured[c.Name] = c.Impact
+	}
+	views := []checkView{}
+	for _, c := range activeChecks() {
+		v := checkView{Name: c.Name, Description: c.Description, Impact: c.Impact, ConfiguredImpact: configured[c.Name]}
+		if s, ok := stored[c.Name]; ok {
+			v.Overridden = true
+			v.UpdatedAt = &s.UpdatedAt
+		}
+		views = append(views, v)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views, nil
+}
+
+// checksHandler serves the scoring settings: GET lists every check with its impact and the
+// maximum score with all checks enabled, PUT [{name, impact, description}, ...] changes one or
+// more checks at once, DELETE ?name= reverts a check to its configured values.
+func checksHandler(w http.ResponseWriter, r *http.Request) {
+	if results == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "results store unavailable"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var settings []CheckSetting
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil || len(settings) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body must be a JSON list: [{\"name\": \"RealismCheck\", \"impact\": 20, \"description\": \"...\"}]"})
+			return
+		}
+		for _, s := range settings {
+			if !checkExists(s.Name) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown check %q", s.Name)})
+				return
+			}
+			if s.Impact == nil && s.Description == nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("%s: set impact, description or both", s.Name)})
+				return
+			}
+		}
+		checkSettingsMu.Lock()
+		defer checkSettingsMu.Unlock()
+		stored, err := results.checkSettings()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := validateChecks(applyCheckSettings(AllChecks, append(stored, settings...))); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := results.putCheckSettings(settings); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := reloadChecks(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		slog.Info("check settings changed", "checks", len(settings))
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		checkSettingsMu.Lock()
+		defer checkSettingsMu.Unlock()
+		remaining, err := results.checkSettings()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		kept := remaining[:0]
+		for _, s := range remaining {
+			if s.Name != name {
+				kept = append(kept, s)
+			}
+		}
+		if err := validateChecks(applyCheckSettings(AllChecks, kept)); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		removed, err := results.removeCheckSetting(name)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if !removed {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no stored setting for that check"})
+			return
+		}
+		if err := reloadChecks(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		slog.Info("check setting reverted", "check", name)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	views, err := checkViews()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"checks": views, "maxScore": MaxScoreFor(nil, nil)})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// A local clamd gives attachments an antivirus scan without sending them to a cloud service.
+// Files are streamed over clamd's INSTREAM command, so clamd needs no access to the sandbox.
+
+// clamdChunk is the size of the chunks a file is streamed in; clamd's StreamMaxLength limits the
+// file as a whole.
+const clamdChunk = 64 << 10
+
+// clamdEnabled reports whether CLAMD_ADDRESS is set.
+func clamdEnabled() bool {
+	return clamdAddress != ""
+}
+
+// dialClamd connects to CLAMD_ADDRESS: "unix:/path", a bare socket path, "tcp:host:port" or
+// "host:port".
+func dialClamd(ctx context.Context) (net.Conn, error) {
+	network, addr := "tcp", clamdAddress
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "/"):
+		network = "unix"
+	default:
+		addr = strings.TrimPrefix(addr, "tcp:")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(clamdTimeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// clamdCommand sends a null-terminated command and returns clamd's reply without the terminator.
+func clamdCommand(ctx context.Context, command string, body []byte) (string, error) {
+	conn, err := dialClamd(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte("z" + command + "\x00")); err != nil {
+		return "", err
+	}
+	if command == "INSTREAM" {
+		var size [4]byte
+		for len(body) > 0 {
+			n := min(len(body), clamdChunk)
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(size[:]); err != nil {
+				return "", err
+			}
+			if _, err := conn.Write(body[:n]); err != nil {
+				return "", err
+			}
+			body = body[n:]
+		}
+		binary.BigEndian.PutUint32(size[:], 0)
+		if _, err := conn.Write(size[:]); err != nil {
+			return "", err
+		}
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+// scanClamd streams content to clamd and returns the name of the signature it matched, or "" when
+// the file is clean.
+func scanClamd(ctx context.Context, content []byte) (string, error) {
+	defer trackDependency(ctx, "clamav", time.Now())
+	reply, err := clamdCommand(ctx, "INSTREAM", content)
+	if err != nil {
+		return "", fmt.Errorf("clamd: %w", err)
+	}
+	// "stream: OK", "stream: Eicar-Test-Signature FOUND" or "<reason> ERROR"
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// pingClamd checks that clamd answers.
+func pingClamd(ctx context.Context) error {
+	reply, err := clamdCommand(ctx, "PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
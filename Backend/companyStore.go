@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// CompanyStore is the known-company dataset: the websites of Wikidata organisations (plus
+// imported ones), the protected brand SLDs and the dictionary allow list. SQLite keeps it in a
+// local file; Postgres and MySQL let several checker replicas share one copy.
+type CompanyStore interface {
+	Backend() string
+	// KnownDomain looks domain up in the websites table and sld in the allow list.
+	KnownDomain(ctx context.Context, domain, sld string) (string, bool, error)
+	AllowListed(ctx context.Context, word string) (bool, error)
+	// BrandsIn returns the brands that occur anywhere in text.
+	BrandsIn(ctx context.Context, text string) ([]string, error)
+	BrandsOfLength(ctx context.Context, minLen, maxLen int) ([]string, error)
+	AllBrands(ctx context.Context) ([]string, error)
+	// CompanyDomains returns the domains listed for an organisation name.
+	CompanyDomains(ctx context.Context, name string) ([]string, error)
+	// OrgAliases returns the imported organisation names, each with its domains.
+	OrgAliases(ctx context.Context) (map[string][]string, error)
+	WebsiteCount(ctx context.Context) (int, error)
+	// Version changes whenever the data may have; "" means it can't tell.
+	Version(ctx context.Context) (string, error)
+	EnsureSchema(ctx context.Context) error
+	ImportOrgs(ctx context.Context, imp orgImport) (websites, brands int, err error)
+	ImportedSources(ctx context.Context) ([]map[string]interface{}, error)
+	// ReplaceWikidata swaps the Wikidata rows for those of a company database built in SQLite,
+	// keeping imported rows.
+	ReplaceWikidata(ctx context.Context, src *sql.DB) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// sqlCompanyStore implements CompanyStore on database/sql, with the few statements that differ
+// between SQLite, Postgres and MySQL chosen by driver.
+type sqlCompanyStore struct {
+	db     *sql.DB
+	driver string // "sqlite", "postgres" or "mysql"
+	path   string // SQLite file
+}
+
+var (
+	companyStoreMu  sync.RWMutex
+	companyStoreCur CompanyStore
+)
+
+// companyStoreGrace is how long a replaced store stays open for analyses that already hold it.
+const companyStoreGrace = 10 * time.Minute
+
+// openCompanyStore connects to the database named by COMPANY_DB_DRIVER and COMPANY_DB_DSN.
+func openCompanyStore() (CompanyStore, error) {
+	s := &sqlCompanyStore{driver: companyDBDriver}
+	dsn := companyDBDSN
+	if s.driver == "sqlite" {
+		if _, err := os.Stat(companyDBPath); err != nil {
+			return nil, err
+		}
+		s.path = companyDBPath
+		dsn = "file:" + companyDBPath + "?_pragma=busy_timeout(5000)"
+	}
+	db, err := sql.Open(s.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+	return s, nil
+}
+
+// companyStore returns the open company store, or nil when it couldn't be opened.
+func companyStore() CompanyStore {
+	companyStoreMu.RLock()
+	defer companyStoreMu.RUnlock()
+	return companyStoreCur
+}
+
+// reopenCompanyStore opens the store again, after the SQLite file was replaced or to retry a
+// failed open. The old handle is closed once running analyses have had time to finish.
+func reopenCompanyStore() error {
+	s, err := openCompanyStore()
+	if err != nil {
+		return err
+	}
+	companyStoreMu.Lock()
+	old := companyStoreCur
+	companyStoreCur = s
+	companyStoreMu.Unlock()
+	if old != nil {
+		time.AfterFunc(companyStoreGrace, func() { _ = old.Close() })
+	}
+	return nil
+}
+
+func (s *sqlCompanyStore) Backend() string { return s.driver }
+
+func (s *sqlCompanyStore) Close() error { return s.db.Close() }
+
+// q rewrites ? placeholders as $1, $2, ... for Postgres.
+func (s *sqlCompanyStore) q(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// insertIgnore is an INSERT that skips rows whose key already exists.
+func (s *sqlCompanyStore) insertIgnore(table, cols string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", strings.Count(cols, ",")+1), ", ")
+	switch s.driver {
+	case "postgres":
+		return s.q("INSERT INTO " + table + " (" + cols + ") VALUES (" + placeholders + ") ON CONFLICT DO NOTHING")
+	case "mysql":
+		return "INSERT IGNORE INTO " + table + " (" + cols + ") VALUES (" + placeholders + ")"
+	}
+	return "INSERT OR IGNORE INTO " + table + " (" + cols + ") VALUES (" + placeholders + ")"
+}
+
+const websiteCols = "item, item_label, website, type_label, domain, subdomain, source"
+
+// upsertWebsite inserts a websites row, replacing one with the same item and website.
+func (s *sqlCompanyStore) upsertWebsite() string {
+	switch s.driver {
+	case "postgres":
+		return s.q(`INSERT INTO websites (` + websiteCols + `) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (item, website) DO UPDATE SET item_label = EXCLUDED.item_label, type_label = EXCLUDED.type_label,
+			domain = EXCLUDED.domain, subdomain = EXCLUDED.subdomain, source = EXCLUDED.source`)
+	case "mysql":
+		return `REPLACE INTO websites (` + websiteCols + `) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	}
+	return `INSERT OR REPLACE INTO websites (` + websiteCols + `) VALUES (?, ?, ?, ?, ?, ?, ?)`
+}
+
+func (s *sqlCompanyStore) column(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var out []string
+	for rows.Next() {
+		var v sql.NullString
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		if v.Valid {
+			out = append(out, v.String)
+		}
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlCompanyStore) KnownDomain(ctx context.Context, domain, sld string) (string, bool, error) {
+	var exists string
+	err := s.db.QueryRowContext(ctx, s.q(`
+       SELECT domain FROM websites WHERE domain = ?
+       UNION
+       SELECT word FROM allow_list WHERE word = ?`), domain, sld).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return exists, err == nil, err
+}
+
+func (s *sqlCompanyStore) AllowListed(ctx context.Context, word string) (bool, error) {
+	var w string
+	err := s.db.QueryRowContext(ctx, s.q(`SELECT word FROM allow_list WHERE word = ?`), word).Scan(&w)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlCompanyStore) BrandsIn(ctx context.Context, text string) ([]string, error) {
+	pattern := `'%' || sld || '%'`
+	if s.driver == "mysql" {
+		pattern = `CONCAT('%', sld, '%')`
+	}
+	return s.column(ctx, `SELECT sld FROM protected_brands WHERE ? LIKE `+pattern, text)
+}
+
+func (s *sqlCompanyStore) BrandsOfLength(ctx context.Context, minLen, maxLen int) ([]string, error) {
+	length := "LENGTH"
+	if s.driver == "mysql" {
+		length = "CHAR_LENGTH" // LENGTH counts bytes in MySQL
+	}
+	return s.column(ctx, `SELECT sld FROM protected_brands WHERE `+length+`(sld) BETWEEN ? AND ?`, minLen, maxLen)
+}
+
+func (s *sqlCompanyStore) AllBrands(ctx context.Context) ([]string, error) {
+	return s.column(ctx, `SELECT sld FROM protected_brands`)
+}
+
+func (s *sqlCompanyStore) CompanyDomains(ctx context.Context, name string) ([]string, error) {
+	return s.column(ctx, `SELECT domain FROM websites WHERE item_label = ?`, name)
+}
+
+func (s *sqlCompanyStore) OrgAliases(ctx context.Context) (map[string][]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT alias, domain FROM org_aliases`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	aliases := map[string][]string{}
+	for rows.Next() {
+		var alias, domain string
+		if err := rows.Scan(&alias, &domain); err != nil {
+			return nil, err
+		}
+		aliases[alias] = append(aliases[alias], domain)
+	}
+	return aliases, rows.Err()
+}
+
+func (s *sqlCompanyStore) WebsiteCount(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM websites`).Scan(&n)
+	return n, err
+}
+
+func (s *sqlCompanyStore) Version(ctx context.Context) (string, error) {
+	if s.driver != "sqlite" {
+		return "", nil
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return "", err
+	}
+	return info.ModTime().String(), nil
+}
+
+// Ping runs a trivial query, so a missing, empty or corrupt database is caught rather than
+// only an unreachable one.
+func (s *sqlCompanyStore) Ping(ctx context.Context) error {
+	var one int
+	return s.db.QueryRowContext(ctx, `SELECT 1 FROM websites LIMIT 1`).Scan(&one)
+}
+
+// companyServerSchema creates the tables on an empty Postgres or MySQL database. MySQL needs
+// bounded VARCHAR keys, and its indexes are declared inline.
+var companyServerSchema = map[string][]string{
+	"postgres": {
+		`CREATE TABLE IF NOT EXISTS websites (item TEXT NOT NULL, item_label TEXT, website TEXT NOT NULL, type_label TEXT,
+			domain TEXT, subdomain TEXT, source TEXT NOT NULL DEFAULT 'wikidata', PRIMARY KEY (item, website))`,
+		`ALTER TABLE websites ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'wikidata'`,
+		`CREATE INDEX IF NOT EXISTS websites_domain ON websites (domain)`,
+		`CREATE INDEX IF NOT EXISTS websites_item_label ON websites (item_label)`,
+		`CREATE INDEX IF NOT EXISTS websites_source ON websites (source)`,
+		`CREATE TABLE IF NOT EXISTS allow_list (word TEXT PRIMARY KEY)`,
+		`CREATE TABLE IF NOT EXISTS protected_brands (sld TEXT PRIMARY KEY, sensitivity INTEGER DEFAULT 2,
+			source TEXT NOT NULL DEFAULT 'wikidata')`,
+		`ALTER TABLE protected_brands ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'wikidata'`,
+		`CREATE TABLE IF NOT EXISTS org_aliases (alias TEXT NOT NULL, domain TEXT NOT NULL, source TEXT NOT NULL,
+			PRIMARY KEY (alias, domain, source))`,
+	},
+	"mysql": {
+		`CREATE TABLE IF NOT EXISTS websites (item VARCHAR(255) NOT NULL, item_label VARCHAR(512), website VARCHAR(512) NOT NULL,
+			type_label VARCHAR(255), domain VARCHAR(255), subdomain VARCHAR(255), source VARCHAR(64) NOT NULL DEFAULT 'wikidata',
+			PRIMARY KEY (item, website), INDEX websites_domain (domain), INDEX websites_item_label (item_label),
+			INDEX websites_source (source)) CHARACTER SET utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS allow_list (word VARCHAR(255) PRIMARY KEY) CHARACTER SET utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS protected_brands (sld VARCHAR(255) PRIMARY KEY, sensitivity INT DEFAULT 2,
+			source VARCHAR(64) NOT NULL DEFAULT 'wikidata') CHARACTER SET utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS org_aliases (alias VARCHAR(255) NOT NULL, domain VARCHAR(255) NOT NULL,
+			source VARCHAR(64) NOT NULL, PRIMARY KEY (alias, domain, source)) CHARACTER SET utf8mb4`,
+	},
+}
+
+// EnsureSchema creates the tables on a server database, or adds the source columns and the
+// alias table to a SQLite file built before imports existed.
+func (s *sqlCompanyStore) EnsureSchema(ctx context.Context) error {
+	if stmts, ok := companyServerSchema[s.driver]; ok {
+		for _, stmt := range stmts {
+			if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("company schema: %w", err)
+			}
+		}
+		return nil
+	}
+	for _, table := range []string{"websites", "protected_brands"} {
+		cols, err := s.column(ctx, `SELECT name FROM pragma_table_info(?)`, table)
+		if err != nil {
+			return err
+		}
+		hasSource := false
+		for _, c := range cols {
+			hasSource = hasSource || c == "source"
+		}
+		if !hasSource {
+			if _, err := s.db.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN source TEXT NOT NULL DEFAULT '`+wikidataSource+`'`); err != nil {
+				return fmt.Errorf("add source column to %s: %w", table, err)
+			}
+		}
+	}
+	if _, err := s.db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS websites_source ON websites (source)`); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS org_aliases (alias TEXT NOT NULL, domain TEXT NOT NULL,
+		source TEXT NOT NULL, PRIMARY KEY (alias, domain, source))`)
+	return err
+}
+
+// ReplaceWikidata copies every row of a SQLite company database into the store as Wikidata
+// data, in one transaction, leaving imported organisations and brands in place.
+func (s *sqlCompanyStore) ReplaceWikidata(ctx context.Context, src *sql.DB) (err error) {
+	if err := s.EnsureSchema(ctx); err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	for _, table := range []string{"websites", "protected_brands"} {
+		if _, err := tx.ExecContext(ctx, s.q(`DELETE FROM `+table+` WHERE source = ?`), wikidataSource); err != nil {
+			return err
+		}
+	}
+	copies := []struct {
+		query, insert string
+		withSource    bool
+	}{
+		{`SELECT item, item_label, website, type_label, domain, subdomain FROM websites`,
+			s.insertIgnore("websites", websiteCols), true},
+		{`SELECT sld, sensitivity FROM protected_brands`, s.insertIgnore("protected_brands", "sld, sensitivity, source"), true},
+		{`SELECT word FROM allow_list`, s.insertIgnore("allow_list", "word"), false},
+	}
+	for _, c := range copies {
+		if err := copyRows(ctx, src, tx, c.query, c.insert, c.withSource); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// copyRows inserts every row of query on src into tx, appending the Wikidata source column
+// when withSource is set.
+func copyRows(ctx context.Context, src *sql.DB, tx *sql.Tx, query, insert string, withSource bool) error {
+	rows, err := src.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, insert)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+	values := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		args := append([]interface{}{}, values...)
+		if withSource {
+			args = append(args, wikidataSource)
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// importCompanyDB loads a SQLite company database (such as wikidata_websites4.db) into the
+// configured server database, for the -import-company-db flag.
+func importCompanyDB(ctx context.Context, path string) error {
+	if companyDBDriver == "sqlite" {
+		return errors.New("-import-company-db needs COMPANY_DB_DRIVER set to postgres or mysql")
+	}
+	src, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+	store := companyStore()
+	if store == nil {
+		return errors.New("company database unavailable")
+	}
+	start := time.Now()
+	if err := store.ReplaceWikidata(ctx, src); err != nil {
+		return err
+	}
+	n, _ := store.WebsiteCount(ctx)
+	slog.Info("company database imported", "from", path, "websites", n, "took", time.Since(start))
+	return nil
+}
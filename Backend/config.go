@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configEnv maps each setting in the YAML config file to the environment variable that holds it.
+// The file only supplies values: a variable already set in the environment (or .env) wins, so
+// any setting can still be overridden per deployment.
+var configEnv = map[string]string{
+	"server.addr":                         "LISTEN_ADDR",
+	"server.tls_cert":                     "TLS_CERT_FILE",
+	"server.tls_key":                      "TLS_KEY_FILE",
+	"server.autocert_domains":             "AUTOCERT_DOMAINS",
+	"server.autocert_email":               "AUTOCERT_EMAIL",
+	"server.autocert_cache":               "AUTOCERT_CACHE",
+	"server.autocert_http_addr":           "AUTOCERT_HTTP_ADDR",
+	"server.admin_api_key":                "ADMIN_API_KEY",
+	"server.max_eml_mb":                   "MAX_EML_MB",
+	"server.rate_limit_per_minute":        "RATE_LIMIT_PER_MINUTE",
+	"server.rate_limit_global_per_minute": "RATE_LIMIT_GLOBAL_PER_MINUTE",
+	"server.max_concurrent_per_key":       "MAX_CONCURRENT_PER_KEY",
+	"server.max_concurrent_analyses":      "MAX_CONCURRENT_ANALYSES",
+
+	"api_keys.gemini":             "GEMINI_API_KEY",
+	"api_keys.google_search":      "GOOGLE_SEARCH_API_KEY",
+	"api_keys.google_search_cx":   "GOOGLE_SEARCH_CX",
+	"api_keys.places":             "PLACES_API_KEY",
+	"api_keys.companies_house":    "COMPANIES_HOUSE_API_KEY",
+	"api_keys.opencorporates":     "OPENCORPORATES_API_TOKEN",
+	"api_keys.virustotal":         "VTotal_API_KEY",
+	"api_keys.urlscan":            "URLSCAN_API_KEY",
+	"api_keys.cloudflare_account": "CLOUDFLARE_ACCOUNT_ID",
+	"api_keys.cloudflare_token":   "CLOUDFLARE_API_TOKEN",
+	"api_keys.safe_browsing":      "SAFE_BROWSING_API_KEY",
+	"api_keys.phishtank":          "PHISHTANK_APP_KEY",
+	"api_keys.google_vision":      "GOOGLE_VISION_API_KEY",
+
+	"ai.model":                 "AI_MODEL",
+	"ai.fallback_model":        "AI_FALLBACK_MODEL",
+	"ai.max_retries":           "AI_MAX_RETRIES",
+	"ai.cache_max_entries":     "AI_CACHE_MAX_ENTRIES",
+	"ai.price_input_per_mtok":  "AI_PRICE_INPUT_PER_MTOK",
+	"ai.price_output_per_mtok": "AI_PRICE_OUTPUT_PER_MTOK",
+	"ai.main_prompt":           "MAIN_PROMPT",
+	"ai.prompt_template":       "PROMPT_TEMPLATE",
+
+	"directories.emails":         "EMAIL_DIR",
+	"directories.screenshots":    "SCREENSHOT_DIR",
+	"directories.prompts":        "PROMPT_DIR",
+	"directories.results_db":     "RESULTS_DB",
+	"directories.threat_feed_db": "THREAT_FEED_DB",
+	"directories.tranco_file":    "TRANCO_FILE",
+	"directories.geoip_db":       "GEOIP_DB",
+	"directories.geoip_asn_db":   "GEOIP_ASN_DB",
+	"directories.mocks":          "MOCK_DIR",
+	"directories.golden":         "GOLDEN_DIR",
+
+	"company_db.driver": "COMPANY_DB_DRIVER",
+	"company_db.dsn":    "COMPANY_DB_DSN",
+
+	"timeouts.ai":                  "AI_TIMEOUT",
+	"timeouts.ai_initial_backoff":  "AI_INITIAL_BACKOFF",
+	"timeouts.ai_cache_ttl":        "AI_CACHE_TTL",
+	"timeouts.prompt_reload":       "PROMPT_RELOAD_INTERVAL",
+	"timeouts.threat_feed_refresh": "THREAT_FEED_INTERVAL",
+	"timeouts.tranco_refresh":      "TRANCO_REFRESH",
+	"timeouts.brand_index_refresh": "BRAND_INDEX_REFRESH",
+	"timeouts.db_refresh":          "DB_REFRESH_INTERVAL",
+	"timeouts.sse_keepalive":       "SSE_KEEPALIVE_INTERVAL",
+	"timeouts.sse_retry":           "SSE_RETRY",
+	"timeouts.sse_resume_window":   "SSE_RESUME_WINDOW",
+	"timeouts.results_retention":   "RESULTS_RETENTION",
+	"timeouts.analysis_abandon":    "ANALYSIS_ABANDON_TIMEOUT",
+
+	"features.urlscan":                   "URLSCAN_ENABLED",
+	"features.url_scanners":              "URL_SCANNERS",
+	"features.urlscan_visibility":        "URLSCAN_VISIBILITY",
+	"features.urlscan_country":           "URLSCAN_COUNTRY",
+	"features.gemini":                    "GEMINI_ENABLED",
+	"features.google_search":             "GOOGLE_SEARCH_ENABLED",
+	"features.remote_images":             "REMOTE_IMAGES_ENABLED",
+	"features.render_network_isolated":   "RENDER_NETWORK_ISOLATED",
+	"features.render_variants":           "RENDER_VARIANTS",
+	"features.threat_feeds":              "THREAT_FEEDS_ENABLED",
+	"features.tranco":                    "TRANCO_ENABLED",
+	"features.strip_quoted_replies":      "STRIP_QUOTED_REPLIES",
+	"features.ui":                        "UI_ENABLED",
+	"yara.rules_dir":                     "YARA_RULES_DIR",
+	"yara.command":                       "YARA_COMMAND",
+	"scripts.rules_dir":                  "SCRIPT_RULES_DIR",
+	"clamav.address":                     "CLAMD_ADDRESS",
+	"clamav.timeout":                     "CLAMD_TIMEOUT",
+	"spam_engines.spamd_address":         "SPAMD_ADDRESS",
+	"spam_engines.rspamd_url":            "RSPAMD_URL",
+	"spam_engines.rspamd_password":       "RSPAMD_PASSWORD",
+	"spam_engines.timeout":               "SPAM_ENGINE_TIMEOUT",
+	"siem.syslog_address":                "SIEM_SYSLOG_ADDRESS",
+	"siem.format":                        "SIEM_FORMAT",
+	"siem.splunk_hec_url":                "SPLUNK_HEC_URL",
+	"siem.splunk_hec_token":              "SPLUNK_HEC_TOKEN",
+	"siem.splunk_sourcetype":             "SPLUNK_HEC_SOURCETYPE",
+	"siem.timeout":                       "SIEM_TIMEOUT",
+	"features.safe_browsing_trust_clean": "SAFE_BROWSING_TRUST_CLEAN",
+	"features.defang_output":             "DEFANG_OUTPUT",
+	"features.landing_page_max":          "LANDING_PAGE_MAX",
+	"features.pii_redaction":             "PII_REDACTION",
+	"features.pii_redaction_images":      "PII_REDACTION_IMAGES",
+	"features.auto_install_deps":         "AUTO_INSTALL_DEPS",
+	"features.rendered_text_source":      "RENDERED_TEXT_SOURCE",
+	"features.ocr_engine":                "OCR_ENGINE",
+
+	"thresholds.redirect_hops":            "REDIRECT_HOP_THRESHOLD",
+	"thresholds.urlscan_quota_per_minute": "URLSCAN_QUOTA_PER_MINUTE",
+	"thresholds.urlscan_quota_per_day":    "URLSCAN_QUOTA_PER_DAY",
+	"thresholds.vtotal_quota_per_minute":  "VTOTAL_QUOTA_PER_MINUTE",
+	"thresholds.vtotal_quota_per_day":     "VTOTAL_QUOTA_PER_DAY",
+	"thresholds.tracking_pixels":          "TRACKING_PIXEL_THRESHOLD",
+	"thresholds.archive_max_depth":        "ARCHIVE_MAX_DEPTH",
+	"thresholds.attached_email_depth":     "ATTACHED_EMAIL_MAX_DEPTH",
+	"thresholds.attached_email_max":       "ATTACHED_EMAIL_MAX",
+	"thresholds.archive_max_mb":           "ARCHIVE_MAX_MB",
+	"thresholds.db_refresh_max_per_type":  "DB_REFRESH_MAX_PER_TYPE",
+	"thresholds.feedback_suppress_after":  "FEEDBACK_SUPPRESS_AFTER",
+	"thresholds.campaign_similarity":      "CAMPAIGN_SIMILARITY",
+	"thresholds.campaign_window":          "CAMPAIGN_WINDOW",
+	"thresholds.campaign_webhook_after":   "CAMPAIGN_WEBHOOK_AFTER",
+	"campaigns.webhook_url":               "CAMPAIGN_WEBHOOK_URL",
+	"dnsbl_zones":                         "DNSBL_ZONES",
+	"trusted_forwarders":                  "TRUSTED_FORWARDERS",
+	"trusted_authserv_ids":                "TRUSTED_AUTHSERV_IDS",
+	"trusted_mx_hosts":                    "TRUSTED_MX_HOSTS",
+	"phone_regions":                       "PHONE_REGIONS",
+
+	"logging.format": "LOG_FORMAT",
+	"logging.level":  "LOG_LEVEL",
+
+	"default_country": "DEFAULT_COUNTRY",
+}
+
+// configProblems collects invalid settings found while loading the configuration. The server
+// refuses to start while there are any, instead of running with half its settings defaulted.
+var configProblems []string
+
+func configProblem(format string, args ...interface{}) {
+	configProblems = append(configProblems, fmt.Sprintf(format, args...))
+}
+
+// configScoring holds the "scoring" section: check name to impact, applied over AllChecks.
+var configScoring map[string]int
+
+// loadConfigFile reads the YAML config file (CONFIG_FILE, default config.yaml) and exports its
+// settings as environment variables that aren't already set. A variable set to "" (a blank line
+// such as "GEMINI_API_KEY=" left in .env) counts as unset, so it doesn't hide the file's value.
+// The scoring and profiles sections are kept as they are. A missing default file is not an
+// error; a missing file named explicitly is.
+func loadConfigFile() error {
+	path := os.Getenv("CONFIG_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = "config.yaml"
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			return nil
+		}
+		return fmt.Errorf("config file: %w", err)
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	if scoring, ok := raw["scoring"]; ok {
+		delete(raw, "scoring")
+		m, ok := scoring.(map[string]interface{})
+		if !ok && scoring != nil {
+			configProblem("%s: scoring must be a map of check name to impact", path)
+		}
+		configScoring = map[string]int{}
+		for name, v := range m {
+			impact, ok := v.(int)
+			if !ok {
+				configProblem("%s: scoring.%s must be an integer", path, name)
+				continue
+			}
+			configScoring[name] = impact
+		}
+	}
+
+	if node, ok := raw["profiles"]; ok {
+		delete(raw, "profiles")
+		loadProfiles(node, path)
+	}
+
+	settings := map[string]string{}
+	flattenConfig("", raw, settings)
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env, known := configEnv[key]
+		if !known {
+			configProblem("%s: unknown setting %q", path, key)
+			continue
+		}
+		if os.Getenv(env) == "" {
+			if err := os.Setenv(env, settings[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flattenConfig turns nested YAML sections into dotted keys with the string form the
+// environment variables use: booleans become TRUE/FALSE and lists are comma-separated.
+func flattenConfig(prefix string, node map[string]interface{}, out map[string]string) {
+	for k, v := range node {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch val := v.(type) {
+		case map[string]interface{}:
+			flattenConfig(key, val, out)
+		case []interface{}:
+			items := make([]string, 0, len(val))
+			for _, item := range val {
+				items = append(items, fmt.Sprint(item))
+			}
+			out[key] = strings.Join(items, ",")
+		case bool:
+			out[key] = strings.ToUpper(strconv.FormatBool(val))
+		case nil:
+			out[key] = ""
+		default:
+			out[key] = fmt.Sprint(val)
+		}
+	}
+}
+
+// applyScoring overrides the impact of the checks named in the config's scoring section.
+func applyScoring() {
+	for name, impact := range configScoring {
+		found := false
+		for i := range AllChecks {
+			if AllChecks[i].Name == name {
+				AllChecks[i].Impact = impact
+				found = true
+			}
+		}
+		if !found {
+			configProblem("scoring: unknown check %q", name)
+		}
+	}
+}
+
+// validateConfig checks settings whose invalid values would otherwise be silently replaced.
+func validateConfig() {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("PII_REDACTION"))) {
+	case "", piiRedactionOff, piiRedactionStandard, piiRedactionStrict:
+	default:
+		configProblem("PII_REDACTION must be off, standard or strict")
+	}
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT"))) {
+	case "", "text", "json":
+	default:
+		configProblem("LOG_FORMAT must be text or json")
+	}
+	if len(defaultCountry) != 2 {
+		configProblem("DEFAULT_COUNTRY must be a two-letter country code, got %q", defaultCountry)
+	}
+	for name, v := range map[string]int{
+		"MAX_EML_MB": int(maxEMLBytes >> 20), "ARCHIVE_MAX_DEPTH": archiveMaxDepth, "LANDING_PAGE_MAX": landingPageMax,
+		"ATTACHED_EMAIL_MAX_DEPTH": attachedEmailMaxDepth, "ATTACHED_EMAIL_MAX": attachedEmailMax,
+		"AI_MAX_RETRIES": aiMaxRetries, "REDIRECT_HOP_THRESHOLD": redirectHopThreshold, "DB_REFRESH_MAX_PER_TYPE": dbRefreshMaxPerType,
+	} {
+		if v < 0 {
+			configProblem("%s must not be negative", name)
+		}
+	}
+	if maxEMLBytes == 0 {
+		configProblem("MAX_EML_MB must be at least 1")
+	}
+	if _, ok := ocrEngines[ocrEngineName]; !ok && ocrEngineName != "tesseract" {
+		configProblem("OCR_ENGINE must be tesseract, tesseract-cli or vision (libtesseract needs a -tags gosseract build), got %q", ocrEngineName)
+	}
+	switch companyDBDriver {
+	case "sqlite":
+	case "postgres", "mysql":
+		if strings.TrimSpace(companyDBDSN) == "" {
+			configProblem("COMPANY_DB_DRIVER=%s needs COMPANY_DB_DSN", companyDBDriver)
+		}
+	default:
+		configProblem("COMPANY_DB_DRIVER must be sqlite, postgres or mysql, got %q", companyDBDriver)
+	}
+	if yaraEnabled() {
+		if files, err := yaraRuleFiles(yaraRulesDir); err != nil {
+			configProblem("YARA_RULES_DIR: %v", err)
+		} else if len(files) == 0 {
+			configProblem("YARA_RULES_DIR %s has no .yar or .yara files", yaraRulesDir)
+		}
+	}
+	if scriptRulesEnabled() {
+		if err := validateScriptRules(scriptRulesDir); err != nil {
+			configProblem("SCRIPT_RULES_DIR: %v", err)
+		}
+	}
+	if campaignSimilarity < 0 || campaignSimilarity > 100 {
+		configProblem("CAMPAIGN_SIMILARITY must be between 0 and 100, got %d", campaignSimilarity)
+	}
+	if campaignWebhookURL != "" && !strings.HasPrefix(campaignWebhookURL, "http://") && !strings.HasPrefix(campaignWebhookURL, "https://") {
+		configProblem("CAMPAIGN_WEBHOOK_URL must be an http or https URL, got %q", campaignWebhookURL)
+	}
+	if siemFormat != "json" && siemFormat != "cef" {
+		configProblem("SIEM_FORMAT must be json or cef, got %q", siemFormat)
+	}
+	if splunkHECURL != "" && strings.TrimSpace(splunkHECToken) == "" {
+		configProblem("SPLUNK_HEC_URL needs SPLUNK_HEC_TOKEN")
+	}
+	if opts, err := checkURLScanOptions(urlscanDefaults); err != nil {
+		configProblem("URLSCAN_VISIBILITY/URLSCAN_COUNTRY: %v", err)
+	} else {
+		urlscanDefaults = opts
+	}
+	if ocrEngineName == "vision" && strings.TrimSpace(googleVisionAPIKey) == "" {
+		configProblem("OCR_ENGINE=vision needs GOOGLE_VISION_API_KEY")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Besides phone numbers, the contact methods an email gives are its email addresses and postal
+// addresses. An address on a domain the claimed company doesn't own ("reply to
+// acme-billing@gmail.com") is a classic sign of impersonation, so CorrectContactEmail is only
+// awarded when every address in the body is on one of the company's domains (or there are
+// none). With PLACES_API_KEY, postal addresses are looked up with the Google Places API, and
+// CorrectPostalAddress is awarded, as for phone numbers, when one of them is the claimed
+// company's place (or there are none). Without a key addresses are only listed, and the check
+// is out of the maximum score.
+
+// ContactEmailValidation is one email address from the body.
+type ContactEmailValidation struct {
+	Address        string `json:"address"`
+	Domain         string `json:"domain"`
+	MatchesCompany bool   `json:"matchesCompany"`
+}
+
+// PostalAddressValidation is one postal address from the body.
+type PostalAddressValidation struct {
+	Address          string `json:"address"`
+	IsValid          bool   `json:"isValid"`                    // a place of the claimed company is at this address
+	FormattedAddress string `json:"formattedAddress,omitempty"` // as Google Places knows it
+	PlaceName        string `json:"placeName,omitempty"`
+}
+
+// maxContactAddresses caps how many postal addresses are looked up per email.
+const maxContactAddresses = 3
+
+var (
+	contactEmailRegex = regexp.MustCompile(`(?i)\b[a-z0-9._%+-]+@(?:[a-z0-9-]+\.)+[a-z]{2,}\b`)
+	// A street line: a house number, one to four words and a street type, e.g. "221B Baker Street".
+	streetRegex = regexp.MustCompile(`\b\d{1,5}[A-Za-z]?,?\s+(?:[A-Z][\w'.-]*\s+){1,4}(?i:Street|St|Road|Rd|Avenue|Ave|Boulevard|Blvd|Lane|Ln|Drive|Dr|Way|Court|Ct|Place|Pl|Square|Sq|Terrace|Parkway|Pkwy|Highway|Hwy|Close|Crescent|Row|Hill|Gardens)\b\.?`)
+	// A line that carries a postcode: UK, US state + ZIP, or the four/five digits before a town
+	// used across Europe.
+	postcodeLineRegex = regexp.MustCompile(`(?i)\b[A-Z]{1,2}\d[A-Z\d]?\s*\d[A-Z]{2}\b|\b[A-Z]{2}\s+\d{5}(?:-\d{4})?\b|^\s*\d{4,5}\s+\p{L}`)
+)
+
+// extractContactEmails returns the distinct email addresses in text, leaving out the
+// recipients' own.
+func extractContactEmails(text string, recipients []string) []string {
+	skip := map[string]bool{}
+	for _, r := range recipients {
+		skip[strings.ToLower(r)] = true
+	}
+	var found []string
+	for _, m := range contactEmailRegex.FindAllString(text, -1) {
+		addr := strings.ToLower(strings.Trim(m, "."))
+		if skip[addr] {
+			continue
+		}
+		skip[addr] = true
+		found = append(found, addr)
+	}
+	return found
+}
+
+// mailtoAddresses returns the addresses of the mailto: links in htmlStr. The rest of the markup
+// isn't searched for addresses: attributes such as src="logo@2x.png" look like them.
+func mailtoAddresses(htmlStr string) []string {
+	var addrs []string
+	for _, l := range extractLinksFromHTML(htmlStr) {
+		href := strings.TrimSpace(l.URL)
+		if len(href) < 7 || !strings.EqualFold(href[:7], "mailto:") {
+			continue
+		}
+		to, _, _ := strings.Cut(href[7:], "?")
+		if decoded, err := url.PathUnescape(to); err == nil {
+			to = decoded
+		}
+		addrs = append(addrs, strings.Split(to, ",")...)
+	}
+	return addrs
+}
+
+// extractPostalAddresses returns the street addresses in text, each with the rest of its line
+// and, when the next line is a postcode and town, that line too.
+func extractPostalAddresses(text string) []string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	seen := map[string]bool{}
+	var found []string
+	for i, line := range lines {
+		loc := streetRegex.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		addr := strings.Trim(strings.TrimSpace(line[loc[0]:]), ",;")
+		if !postcodeLineRegex.MatchString(addr) && i+1 < len(lines) && postcodeLineRegex.MatchString(lines[i+1]) {
+			addr += ", " + strings.TrimSpace(lines[i+1])
+		}
+		addr = strings.Join(strings.Fields(addr), " ")
+		if len(addr) > 150 {
+			addr = addr[:150]
+		}
+		if key := strings.ToLower(addr); !seen[key] {
+			seen[key] = true
+			found = append(found, addr)
+		}
+	}
+	return found
+}
+
+// companyEmailDomains are the domains the claimed organisation sends from: its domains in the
+// company database and those of its aliases, plus the sender's own once it has been verified.
+func companyEmailDomains(ctx context.Context, store CompanyStore, org string, senderVerified bool, Email EmailData) []string {
+	var domains []string
+	if senderVerified && Email.Domain != "" {
+		domains = append(domains, Email.Domain)
+	}
+	if org == "" || store == nil {
+		return domains
+	}
+	if ds, err := store.CompanyDomains(ctx, org); err != nil {
+		Email.logger().Warn("reading company domains failed", "err", err)
+	} else {
+		domains = append(domains, ds...)
+	}
+	if ds, err := aliasDomains(ctx, store, org); err != nil {
+		Email.logger().Warn("reading organisation aliases failed", "err", err)
+	} else {
+		domains = append(domains, ds...)
+	}
+	return domains
+}
+
+// placesEnabled reports whether postal addresses can be looked up.
+func placesEnabled() bool {
+	return placesAPIKey != ""
+}
+
+// placeResult is a place returned by the Places API text search.
+type placeResult struct {
+	FormattedAddress string `json:"formattedAddress"`
+	DisplayName      struct {
+		Text string `json:"text"`
+	} `json:"displayName"`
+}
+
+// searchPlaces runs a Google Places (New) text search, biased towards the analysis country.
+func searchPlaces(ctx context.Context, query, countryCode string) ([]placeResult, error) {
+	defer trackDependency(ctx, "places", time.Now())
+	body, err := json.Marshal(map[string]interface{}{
+		"textQuery":      query,
+		"regionCode":     strings.ToUpper(countryCode),
+		"maxResultCount": 5,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://places.googleapis.com/v1/places:searchText", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goog-Api-Key", placesAPIKey)
+	req.Header.Set("X-Goog-FieldMask", "places.displayName,places.formattedAddress")
+
+	client := newClientWithDefaultHeaders()
+	client.Timeout = 10 * time.Second
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("places search: %w", err)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if cerr := resp.Body.Close(); cerr != nil {
+		slog.WarnContext(ctx, "closing response body failed", "err", cerr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read places response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("places error: %s: %s", resp.Status, string(respBody))
+	}
+	var result struct {
+		Places []placeResult `json:"places"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("decode places response: %w", err)
+	}
+	return result.Places, nil
+}
+
+// addressAgrees reports whether every token of the claimed address that carries a digit (house
+// number, postcode) appears in the place's formatted address, so a company's real office
+// elsewhere doesn't vouch for a made-up address.
+func addressAgrees(formatted, claimed string) bool {
+	formatted = strings.ToLower(formatted)
+	tokens := strings.FieldsFunc(strings.ToLower(claimed), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+	checked := false
+	for _, t := range tokens {
+		if strings.ContainsAny(t, "0123456789") {
+			if !strings.Contains(formatted, t) {
+				return false
+			}
+			checked = true
+		}
+	}
+	return checked
+}
+
+// validatePostalAddress looks the address up together with the organisation's name and reports
+// the first place that is the organisation's and at that address.
+func validatePostalAddress(ctx context.Context, address, org, countryCode string) (PostalAddressValidation, error) {
+	v := PostalAddressValidation{Address: address}
+	places, err := searchPlaces(ctx, org+", "+address, countryCode)
+	if err != nil {
+		return v, err
+	}
+	want := normaliseOrgName(org)
+	for _, p := range places {
+		if want != "" && strings.Contains(normaliseOrgName(p.DisplayName.Text), want) && addressAgrees(p.FormattedAddress, address) {
+			v.IsValid, v.FormattedAddress, v.PlaceName = true, p.FormattedAddress, p.DisplayName.Text
+			return v, nil
+		}
+	}
+	if len(places) > 0 {
+		v.FormattedAddress = places[0].FormattedAddress
+	}
+	return v, nil
+}
+
+// validateContactDetails checks the email and postal addresses in text against the organisation
+// Gemini identified, filling in the contact method analysis next to its phone numbers.
+func validateContactDetails(result *ContentAnalysisResult, text string, whoResult EmailAnalysis, db CompanyStore, countryCode string, Email EmailData) {
+	ctx := Email.requestContext()
+	contact := &result.ContactMethodAnalysis
+	var emailCheck, addressCheck Check
+	for _, c := range activeChecks() {
+		switch c.Name {
+		case "CorrectContactEmail":
+			emailCheck = c
+		case "CorrectPostalAddress":
+			addressCheck = c
+		}
+	}
+
+	contact.Emails = []ContactEmailValidation{}
+	domains := companyEmailDomains(ctx, db, whoResult.OrganizationName, result.CompanyVerification.Verified, Email)
+	allMatch := true
+	for _, addr := range extractContactEmails(text, Email.Recipients) {
+		v := ContactEmailValidation{Address: addr, Domain: addr[strings.LastIndex(addr, "@")+1:]}
+		for _, d := range domains {
+			if domainCovers(d, v.Domain) {
+				v.MatchesCompany = true
+				break
+			}
+		}
+		allMatch = allMatch && v.MatchesCompany
+		contact.Emails = append(contact.Emails, v)
+	}
+	if allMatch {
+		contact.EmailScoreImpact = emailCheck.Impact
+	}
+
+	// As for phone numbers: strict PII redaction forbids looking addresses up, so they count as
+	// if there were none, and without a Places key the check is out of the maximum score.
+	addresses := extractPostalAddresses(text)
+	if len(addresses) > maxContactAddresses {
+		addresses = addresses[:maxContactAddresses]
+	}
+	contact.Addresses = []PostalAddressValidation{}
+	if !placesEnabled() {
+		for _, addr := range addresses {
+			contact.Addresses = append(contact.Addresses, PostalAddressValidation{Address: addr})
+		}
+		return
+	}
+	if len(addresses) == 0 || piiRedactionMode == piiRedactionStrict {
+		contact.AddressScoreImpact = addressCheck.Impact
+		return
+	}
+	for _, addr := range addresses {
+		v := PostalAddressValidation{Address: addr}
+		if whoResult.OrganizationName != "" {
+			var err error
+			if v, err = validatePostalAddress(ctx, addr, whoResult.OrganizationName, countryCode); err != nil {
+				Email.logger().Warn("looking up postal address failed", "err", err)
+			}
+		}
+		if v.IsValid {
+			contact.AddressScoreImpact = addressCheck.Impact
+		}
+		contact.Addresses = append(contact.Addresses, v)
+	}
+}
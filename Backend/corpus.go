@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The corpus runner (-corpus DIR) puts every .eml in DIR through the full pipeline and compares
+// its scores, verdict and check outcomes with the golden JSON stored for it in -golden-dir, so a
+// change to the checks or weights can be judged by how it moves a labelled set of emails.
+// -update-golden writes the current results as the new golden files. A golden file may carry an
+// "expectedVerdict" set by hand; it is kept on update and reported when the pipeline disagrees.
+// Run it with -mock for results that don't depend on Gemini or the scanners.
+
+// goldenResult is what is kept of one email's analysis.
+type goldenResult struct {
+	File               string                 `json:"file"`
+	ExpectedVerdict    string                 `json:"expectedVerdict,omitempty"` // the verdict the email should get, set by hand
+	Verdict            string                 `json:"verdict"`
+	NormalPercentage   float64                `json:"normalPercentage"`
+	RenderedPercentage float64                `json:"renderedPercentage"`
+	Checks             map[string]goldenCheck `json:"checks"`
+}
+
+// goldenCheck is the outcome of one check event: its status, if it has one, and the points it
+// awarded, summed over every scoreImpact field in the payload.
+type goldenCheck struct {
+	Status string `json:"status,omitempty"`
+	Points *int   `json:"points,omitempty"`
+}
+
+func (c goldenCheck) String() string {
+	s := c.Status
+	if c.Points != nil {
+		s = strings.TrimSpace(fmt.Sprintf("%s (%+d)", s, *c.Points))
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// checkOutcome reads a check event's payload. ok is false for events that aren't check results.
+func checkOutcome(data []byte) (check goldenCheck, ok bool) {
+	var payload map[string]interface{}
+	if json.Unmarshal(data, &payload) != nil {
+		return check, false
+	}
+	check.Status, _ = payload["status"].(string)
+	if points, found := sumScoreImpacts(payload); found {
+		check.Points = &points
+	}
+	return check, check.Status != "" || check.Points != nil
+}
+
+// sumScoreImpacts adds up the "scoreImpact" and "...ScoreImpact" numbers anywhere in v.
+func sumScoreImpacts(v interface{}) (sum int, found bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if n, isNumber := value.(float64); isNumber && (key == "scoreImpact" || strings.HasSuffix(key, "ScoreImpact")) {
+				sum += int(n)
+				found = true
+			} else if s, f := sumScoreImpacts(value); f {
+				sum += s
+				found = true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if s, f := sumScoreImpacts(value); f {
+				sum += s
+				found = true
+			}
+		}
+	}
+	return sum, found
+}
+
+// analyseCorpusFile runs one email through streamEmailHandler and keeps the outcome.
+func analyseCorpusFile(path string) (goldenResult, error) {
+	result := goldenResult{File: filepath.Base(path), Checks: map[string]goldenCheck{}}
+	eml, err := os.ReadFile(path)
+	if err != nil {
+		return result, err
+	}
+	req := httptest.NewRequest(http.MethodPost, "/process-eml-stream", strings.NewReader(base64.StdEncoding.EncodeToString(eml)))
+	rec := httptest.NewRecorder()
+	streamEmailHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		return result, fmt.Errorf("%d: %s", rec.Code, strings.TrimSpace(rec.Body.String()))
+	}
+	checks, final, err := readAnalysisStream(rec.Body.String())
+	if err != nil {
+		return result, err
+	}
+	result.Checks = checks
+	result.Verdict = siemVerdict(*final)
+	result.NormalPercentage = math.Round(final.NormalPercentage*100) / 100
+	result.RenderedPercentage = math.Round(final.RenderedPercentage*100) / 100
+	return result, nil
+}
+
+// readAnalysisStream reads the outcome of every check and the final scores from the complete SSE
+// stream of one analysis.
+func readAnalysisStream(stream string) (map[string]goldenCheck, *ScoreResult, error) {
+	checks := map[string]goldenCheck{}
+	var final *ScoreResult
+	for _, block := range strings.Split(stream, "\n\n") {
+		var name string
+		var data []byte
+		for _, line := range strings.Split(block, "\n") {
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				name = v
+			} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+				data = []byte(v)
+			}
+		}
+		switch name {
+		case "", "attachedEmail", "forwardWrapper": // attached emails don't count towards the score
+		case "error", "cancelled":
+			return nil, nil, fmt.Errorf("analysis ended with %s: %s", name, data)
+		case "finalScores":
+			final = &ScoreResult{}
+			if err := json.Unmarshal(data, final); err != nil {
+				return nil, nil, fmt.Errorf("decoding finalScores: %w", err)
+			}
+		default:
+			// Check results report a status and/or points; progress and bookkeeping events don't.
+			if check, ok := checkOutcome(data); ok {
+				checks[name] = check
+			}
+		}
+	}
+	if final == nil {
+		return nil, nil, errors.New("the stream ended without finalScores")
+	}
+	return checks, final, nil
+}
+
+// compareGolden lists how got differs from want. Percentages may move by tolerance points.
+func compareGolden(want, got goldenResult, tolerance float64) []string {
+	var drift []string
+	if want.Verdict != got.Verdict {
+		drift = append(drift, fmt.Sprintf("verdict: %s -> %s", want.Verdict, got.Verdict))
+	}
+	if math.Abs(want.NormalPercentage-got.NormalPercentage) > tolerance {
+		drift = append(drift, fmt.Sprintf("normalPercentage: %.2f -> %.2f", want.NormalPercentage, got.NormalPercentage))
+	}
+	if math.Abs(want.RenderedPercentage-got.RenderedPercentage) > tolerance {
+		drift = append(drift, fmt.Sprintf("renderedPercentage: %.2f -> %.2f", want.RenderedPercentage, got.RenderedPercentage))
+	}
+	names := make([]string, 0, len(want.Checks)+len(got.Checks))
+	for name := range want.Checks {
+		names = append(names, name)
+	}
+	for name := range got.Checks {
+		if _, ok := want.Checks[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, inWant := want.Checks[name]
+		g, inGot := got.Checks[name]
+		switch {
+		case !inGot:
+			drift = append(drift, fmt.Sprintf("%s: %s -> missing", name, w))
+		case !inWant:
+			drift = append(drift, fmt.Sprintf("%s: new, %s", name, g))
+		case w.String() != g.String():
+			drift = append(drift, fmt.Sprintf("%s: %s -> %s", name, w, g))
+		}
+	}
+	return drift
+}
+
+// corpusOptions are the -corpus flags.
+type corpusOptions struct {
+	dir       string
+	goldenDir string
+	update    bool
+	tolerance float64
+}
+
+// runCorpus runs the corpus and writes the report to out. It returns the exit code: 1 when an
+// email drifted from its golden file, has none, or failed, unless the golden files are being
+// updated.
+func runCorpus(opts corpusOptions, out io.Writer) int {
+	// Corpus runs aren't saved or forwarded, and they use a complete brand index.
+	results = nil
+	siemSyslogAddress, splunkHECURL = "", ""
+	refreshBrandIndex(context.Background())
+
+	files, err := filepath.Glob(filepath.Join(opts.dir, "*.eml"))
+	if err != nil || len(files) == 0 {
+		fmt.Fprintf(out, "no .eml files in %s\n", opts.dir)
+		return 1
+	}
+	sort.Strings(files)
+	if opts.update {
+		if err := os.MkdirAll(opts.goldenDir, 0755); err != nil {
+			fmt.Fprintf(out, "creating %s: %v\n", opts.goldenDir, err)
+			return 1
+		}
+	}
+
+	var drifted, missing, failed, labelled, agreed, unwritten int
+	for _, file := range files {
+		name := filepath.Base(file)
+		got, err := analyseCorpusFile(file)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "ERROR  %s: %v\n", name, err)
+			continue
+		}
+		goldenPath := filepath.Join(opts.goldenDir, strings.TrimSuffix(name, filepath.Ext(name))+".json")
+		var want goldenResult
+		data, err := os.ReadFile(goldenPath)
+		haveGolden := err == nil && json.Unmarshal(data, &want) == nil
+		got.ExpectedVerdict = want.ExpectedVerdict
+		if got.ExpectedVerdict != "" {
+			labelled++
+			if got.ExpectedVerdict == got.Verdict {
+				agreed++
+			}
+		}
+
+		switch drift := compareGolden(want, got, opts.tolerance); {
+		case !haveGolden:
+			missing++
+			fmt.Fprintf(out, "NEW    %s: %s (%.2f%% / %.2f%%)\n", name, got.Verdict, got.NormalPercentage, got.RenderedPercentage)
+		case len(drift) > 0:
+			drifted++
+			fmt.Fprintf(out, "DRIFT  %s\n", name)
+			for _, d := range drift {
+				fmt.Fprintf(out, "         %s\n", d)
+			}
+		default:
+			fmt.Fprintf(out, "ok     %s: %s\n", name, got.Verdict)
+		}
+		if got.ExpectedVerdict != "" && got.ExpectedVerdict != got.Verdict {
+			fmt.Fprintf(out, "         expected %s, got %s\n", got.ExpectedVerdict, got.Verdict)
+		}
+
+		if opts.update {
+			data, err := json.MarshalIndent(got, "", "  ")
+			if err == nil {
+				err = os.WriteFile(goldenPath, append(data, '\n'), 0644)
+			}
+			if err != nil {
+				fmt.Fprintf(out, "         writing %s: %v\n", goldenPath, err)
+				unwritten++
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "\n%d emails: %d unchanged, %d drifted, %d without golden file, %d failed\n",
+		len(files), len(files)-drifted-missing-failed, drifted, missing, failed)
+	if labelled > 0 {
+		fmt.Fprintf(out, "expected verdicts: %d of %d agree (%.0f%%)\n", agreed, labelled, 100*float64(agreed)/float64(labelled))
+	}
+	if opts.update {
+		fmt.Fprintf(out, "golden files updated in %s\n", opts.goldenDir)
+		if failed+unwritten > 0 {
+			return 1
+		}
+		return 0
+	}
+	if drifted+missing+failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "save the current results of testdata/corpus as the golden files")
+
+// TestGoldenCorpus puts the emails in testdata/corpus through the pipeline, with the mock
+// fixtures answering for Gemini and the scanners, and compares each one with its golden file in
+// testdata/golden. The company database is built from testdata/companies.sql. Rendering, OCR and
+// HTML attachments depend on Chrome and Tesseract being installed, so the default profile turns
+// them off. No check may end in "Error": a broken dependency mustn't pass as an unchanged
+// result. After an intended change, go test -run TestGoldenCorpus -update-golden rewrites the
+// golden files.
+func TestGoldenCorpus(t *testing.T) {
+	useFixtureCompanyDB(t, "testdata/companies.sql")
+	transport := http.DefaultTransport
+	if err := enableMocks("mocks", false); err != nil {
+		t.Fatal(err)
+	}
+	savedProfiles := profiles
+	profiles = map[string]*Profile{"default": {Name: "default", Country: "gb", Checks: map[string]bool{
+		"checkRenderedAnalysis": false, "checkHtmlAttachments": false, "checkImageText": false,
+	}}}
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+		profiles = savedProfiles
+	})
+
+	var out bytes.Buffer
+	opts := corpusOptions{dir: "testdata/corpus", goldenDir: "testdata/golden", update: *updateGolden, tolerance: 0.5}
+	if code := runCorpus(opts, &out); code != 0 {
+		t.Errorf("the corpus doesn't match testdata/golden:\n%s", out.String())
+	}
+	t.Log("\n" + out.String())
+
+	files, err := filepath.Glob("testdata/golden/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var golden goldenResult
+		if err := json.Unmarshal(data, &golden); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		for name, check := range golden.Checks {
+			if check.Status == "Error" {
+				t.Errorf("%s: %s ended in Error", golden.File, name)
+			}
+		}
+	}
+}
+
+// useFixtureCompanyDB makes a SQLite company database of script's rows the open company store
+// for the rest of the test.
+func useFixtureCompanyDB(t *testing.T, script string) {
+	rows, err := os.ReadFile(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "companies.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmts := range []string{companyDBSchema, string(rows), companyDBIndexes} {
+		if _, err := db.ExecContext(context.Background(), stmts); err != nil {
+			_ = db.Close()
+			t.Fatalf("building the company database: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	savedPath, savedDriver := companyDBPath, companyDBDriver
+	companyDBPath, companyDBDriver = path, "sqlite"
+	if err := reopenCompanyStore(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		companyStoreMu.Lock()
+		store := companyStoreCur
+		companyStoreCur = nil
+		companyStoreMu.Unlock()
+		if store != nil {
+			_ = store.Close()
+		}
+		companyDBPath, companyDBDriver = savedPath, savedDriver
+	})
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// The company database is rebuilt from Wikidata the same way "Get Companies.py", "Convert
+// Database.py" and "Populate Database.py" build it, into a new file next to the live one that
+// replaces it with a rename only once it is complete and plausible. Requests that already have
+// the old file open keep reading it.
+
+const (
+	wikidataEndpoint  = "https://query.wikidata.org/sparql"
+	wikidataUserAgent = "Email_Checker company database refresh (github.com/Adam-Developing/Email_Checker)"
+	allowListURL      = "https://raw.githubusercontent.com/first20hours/google-10000-english/master/google-10000-english.txt"
+	wikidataBatchSize = 50000
+	wikidataRetries   = 5
+	// A rebuild with fewer websites than this share of the current file is assumed to have
+	// hit a Wikidata outage and is discarded.
+	dbRefreshMinRatio = 0.5
+)
+
+// wikidataTypes are the organisation types fetched, as in "Get Companies.py".
+var wikidataTypes = []struct{ label, id string }{
+	{"Business", "Q4830453"}, {"Company", "Q783794"}, {"Public company", "Q891723"},
+	{"Private company", "Q5621421"}, {"musical group", "Q215380"}, {"Multinational corporation", "Q161726"},
+	{"State‑owned enterprise", "Q270791"}, {"Holding company", "Q219577"}, {"Conglomerate Category", "Q7050751"},
+	{"Conglomerate", "Q778575"}, {"Nonprofit organization", "Q163740"}, {"Brand", "Q431289"},
+	{"Organisation", "Q43229"},
+	{"Shop", "Q213441"}, {"Supermarket", "Q180846"}, {"Supermarket chain", "Q18043413"},
+	{"Retail chain", "Q507619"}, {"E‑commerce company", "Q484847"}, {"Mobile application", "Q620615"},
+	{"Loyalty programme", "Q1426546"}, {"Shopping mall", "Q31374404"}, {"shopping center", "Q11315"},
+	{"Restaurant", "Q11707"}, {"Restaurant chain", "Q18534542"}, {"Fast-food restaurant chain", "Q18509232"},
+	{"Café", "Q30022"}, {"Bar", "Q187456"}, {"Pub", "Q212198"},
+	{"Bank", "Q22687"}, {"Investment bank", "Q319845"}, {"Insurance company", "Q2143354"},
+	{"Investment company", "Q1752459"},
+	{"Technology company", "Q18388277"}, {"service on Internet", "Q1668024"}, {"software company", "Q1058914"},
+	{"record label", "Q18127"}, {"media company", "Q1331793"}, {"Telecommunications company", "Q2401749"},
+	{"Automotive manufacturer", "Q786820"}, {"Aerospace manufacturer", "Q936518"},
+	{"Pharmaceutical company", "Q19644607"}, {"Mining company", "Q2990216"},
+	{"Energy company", "Q1341478"}, {"Oil company", "Q14941854"}, {"Electric utility", "Q1326624"},
+	{"Airline", "Q46970"},
+	{"film production company", "Q1762059"}, {"Entertainment company", "Q20739124"}, {"broadcaster", "Q15265344"},
+	{"Educational institution", "Q2385804"}, {"University", "Q3918"}, {"School", "Q3914"},
+	{"secondary school", "Q159334"}, {"further education college", "Q21822439"},
+	{"Hospital", "Q16917"}, {"Museum", "Q33506"}, {"Library", "Q7075"}, {"Government agency", "Q327333"},
+	{"Political party", "Q7278"}, {"Trade union", "Q49780"}, {"Website", "Q35127"},
+	{"Social media platform", "Q202833"}, {"Online database", "Q7094076"}, {"Company register", "Q1394657"},
+	{"Business directory", "Q897682"}, {"Yellow Pages", "Q934552"},
+	{"Law firm", "Q613142"}, {"Bar Association", "Q1865205"}, {"International Bar Association", "Q763532"},
+	{"Legal Bar", "Q17015569"}, {"barrister", "Q808967"},
+}
+
+const companyDBSchema = `
+CREATE TABLE websites (
+	item TEXT, item_label TEXT, website TEXT, type_label TEXT, domain TEXT, subdomain TEXT,
+	source TEXT NOT NULL DEFAULT 'wikidata',
+	PRIMARY KEY (item, website)
+);
+CREATE TABLE allow_list (word TEXT PRIMARY KEY);
+CREATE TABLE protected_brands (sld TEXT PRIMARY KEY, sensitivity INTEGER DEFAULT 2, source TEXT NOT NULL DEFAULT 'wikidata');
+CREATE TABLE org_aliases (alias TEXT NOT NULL, domain TEXT NOT NULL, source TEXT NOT NULL, PRIMARY KEY (alias, domain, source));
+`
+
+// companyDBIndexes are created after the bulk insert, which is much faster than maintaining them.
+const companyDBIndexes = `
+CREATE INDEX IF NOT EXISTS websites_domain ON websites (domain);
+CREATE INDEX IF NOT EXISTS websites_item_label ON websites (item_label);
+CREATE INDEX IF NOT EXISTS websites_source ON websites (source);
+`
+
+// DBRefreshStatus describes the last (or running) rebuild of the company database.
+type DBRefreshStatus struct {
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"startedAt,omitempty"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	Websites   int       `json:"websites"`
+	Brands     int       `json:"brands"`
+	FailedType []string  `json:"failedTypes,omitempty"` // types skipped after repeated Wikidata errors
+	Error      string    `json:"error,omitempty"`
+}
+
+var (
+	dbRefreshMu     sync.Mutex
+	dbRefreshStatus DBRefreshStatus
+)
+
+var errDBRefreshRunning = errors.New("a company database refresh is already running")
+
+// startDBRefresh begins a rebuild in the background unless one is already running.
+func startDBRefresh() error {
+	dbRefreshMu.Lock()
+	defer dbRefreshMu.Unlock()
+	if dbRefreshStatus.Running {
+		return errDBRefreshRunning
+	}
+	dbRefreshStatus = DBRefreshStatus{Running: true, StartedAt: time.Now().UTC()}
+	go func() {
+		status, err := refreshCompanyDB(context.Background())
+		if err != nil {
+			status.Error = err.Error()
+			slog.Error("company database refresh failed", "err", err)
+		} else {
+			slog.Info("company database refreshed", "websites", status.Websites, "brands", status.Brands)
+			refreshBrandIndex(context.Background())
+		}
+		dbRefreshMu.Lock()
+		status.StartedAt = dbRefreshStatus.StartedAt
+		status.FinishedAt = time.Now().UTC()
+		dbRefreshStatus = status
+		dbRefreshMu.Unlock()
+	}()
+	return nil
+}
+
+func currentDBRefreshStatus() DBRefreshStatus {
+	dbRefreshMu.Lock()
+	defer dbRefreshMu.Unlock()
+	return dbRefreshStatus
+}
+
+// runDBRefresh rebuilds the company database whenever the file is older than maxAge, checking
+// once an hour. A Postgres or MySQL database has no file, so it is rebuilt maxAge after this
+// process last did. A zero maxAge disables scheduled refreshes.
+func runDBRefresh(maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+	started := time.Now()
+	for {
+		last := started
+		if companyDBDriver == "sqlite" {
+			info, err := os.Stat(companyDBPath)
+			if err != nil {
+				time.Sleep(time.Hour)
+				continue
+			}
+			last = info.ModTime()
+		} else if finished := currentDBRefreshStatus().FinishedAt; finished.After(last) {
+			last = finished
+		}
+		if time.Since(last) > maxAge {
+			if err := startDBRefresh(); err != nil && !errors.Is(err, errDBRefreshRunning) {
+				slog.Error("starting company database refresh failed", "err", err)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// refreshCompanyDB rebuilds the configured company database. A SQLite file is rebuilt beside
+// itself and renamed into place; a Postgres or MySQL database is built as a temporary SQLite
+// file whose rows then replace the Wikidata rows of the shared database.
+func refreshCompanyDB(ctx context.Context) (DBRefreshStatus, error) {
+	if companyDBDriver == "sqlite" {
+		status, err := rebuildCompanyDB(ctx, companyDBPath, countWebsites(ctx, companyDBPath))
+		if err != nil {
+			return status, err
+		}
+		return status, reopenCompanyStore()
+	}
+	store := companyStore()
+	if store == nil {
+		return DBRefreshStatus{}, errors.New("company database unavailable")
+	}
+	current, err := store.WebsiteCount(ctx)
+	if err != nil {
+		return DBRefreshStatus{}, err
+	}
+	tmpPath := filepath.Join(os.TempDir(), "company_db_refresh.db")
+	_ = os.Remove(tmpPath)
+	defer func() { _ = os.Remove(tmpPath) }()
+	status, err := rebuildCompanyDB(ctx, tmpPath, current)
+	if err != nil {
+		return status, err
+	}
+	src, err := sql.Open("sqlite", "file:"+tmpPath+"?mode=ro")
+	if err != nil {
+		return status, err
+	}
+	defer func() { _ = src.Close() }()
+	return status, store.ReplaceWikidata(ctx, src)
+}
+
+// rebuildCompanyDB builds a new company database next to path and renames it over path. It
+// refuses when the new one has under half of current, the websites in the live database.
+func rebuildCompanyDB(ctx context.Context, path string, current int) (DBRefreshStatus, error) {
+	var status DBRefreshStatus
+	tmpPath := path + ".new"
+	_ = os.Remove(tmpPath)
+	db, err := sql.Open("sqlite", tmpPath)
+	if err != nil {
+		return status, err
+	}
+	db.SetMaxOpenConns(1)
+	built := false
+	defer func() {
+		_ = db.Close()
+		if !built {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	if _, err := db.ExecContext(ctx, companyDBSchema); err != nil {
+		return status, fmt.Errorf("create schema: %w", err)
+	}
+
+	for _, t := range wikidataTypes {
+		if err := fetchWikidataType(ctx, db, t.label, t.id); err != nil {
+			slog.Warn("wikidata type skipped", "type", t.label, "err", err)
+			status.FailedType = append(status.FailedType, t.label)
+		}
+	}
+
+	carryOverCurrent(ctx, db, path)
+	if err := fillAllowList(ctx, db); err != nil {
+		return status, fmt.Errorf("allow list: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO protected_brands (sld)
+		SELECT DISTINCT substr(domain, 1, instr(domain, '.') - 1) FROM websites
+		WHERE instr(domain, '.') > 4`); err != nil { // SLDs of more than 3 characters
+		return status, fmt.Errorf("protected brands: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, companyDBIndexes); err != nil {
+		return status, fmt.Errorf("create indexes: %w", err)
+	}
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM websites`).Scan(&status.Websites); err != nil {
+		return status, err
+	}
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM protected_brands`).Scan(&status.Brands); err != nil {
+		return status, err
+	}
+
+	if status.Websites == 0 {
+		return status, errors.New("no websites fetched from Wikidata")
+	}
+	if float64(status.Websites) < float64(current)*dbRefreshMinRatio {
+		return status, fmt.Errorf("new database has %d websites against %d in the current one; keeping the current one", status.Websites, current)
+	}
+	if err := db.Close(); err != nil {
+		return status, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return status, err
+	}
+	built = true
+	return status, nil
+}
+
+// countWebsites returns the number of websites in an existing company database, or 0.
+func countWebsites(ctx context.Context, path string) int {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0
+	}
+	defer func() { _ = db.Close() }()
+	var n int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM websites`).Scan(&n)
+	return n
+}
+
+// sparqlBinding is one result row: variable name to value.
+type sparqlBinding map[string]struct {
+	Value string `json:"value"`
+}
+
+type sparqlResponse struct {
+	Results struct {
+		Bindings []sparqlBinding `json:"bindings"`
+	} `json:"results"`
+}
+
+// fetchWikidataType pages through every organisation of one type with an official website
+// and inserts them.
+func fetchWikidataType(ctx context.Context, db *sql.DB, label, id string) error {
+	for offset := 0; offset < dbRefreshMaxPerType; offset += wikidataBatchSize {
+		query := fmt.Sprintf(`SELECT ?item ?itemLabel ?website WHERE {
+  ?item wdt:P31 wd:%s .
+  ?item p:P856/ps:P856 ?website .
+  SERVICE wikibase:label { bd:serviceParam wikibase:language "en". }
+}
+ORDER BY ?item
+LIMIT %d
+OFFSET %d`, id, wikidataBatchSize, offset)
+		bindings, err := querySPARQL(ctx, query)
+		if err != nil {
+			return err
+		}
+		if len(bindings) == 0 {
+			break
+		}
+		if err := insertWebsites(ctx, db, label, bindings); err != nil {
+			return err
+		}
+		if len(bindings) < wikidataBatchSize {
+			break
+		}
+	}
+	return nil
+}
+
+// querySPARQL runs one query against the Wikidata endpoint, retrying with backoff.
+func querySPARQL(ctx context.Context, query string) ([]sparqlBinding, error) {
+	var lastErr error
+	for attempt := 0; attempt < wikidataRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second << (attempt - 1)):
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			wikidataEndpoint+"?format=json&query="+url.QueryEscape(query), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", wikidataUserAgent)
+		req.Header.Set("Accept", "application/sparql-results+json")
+		resp, err := (&http.Client{Timeout: 5 * time.Minute}).Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var parsed sparqlResponse
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("unexpected status %s", resp.Status)
+		} else if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+			lastErr = err
+		} else {
+			_ = resp.Body.Close()
+			return parsed.Results.Bindings, nil
+		}
+		_ = resp.Body.Close()
+	}
+	return nil, lastErr
+}
+
+func insertWebsites(ctx context.Context, db *sql.DB, label string, bindings []sparqlBinding) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO websites
+		(item, item_label, website, type_label, domain, subdomain) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, b := range bindings {
+		website := b["website"].Value
+		domain, subdomain := splitWebsiteDomain(website)
+		if _, err := stmt.ExecContext(ctx, b["item"].Value, b["itemLabel"].Value, website, label, domain, subdomain); err != nil {
+			_ = stmt.Close()
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := stmt.Close(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitWebsiteDomain returns the registrable domain of a website URL and, unless it is just
+// "www", the full host as its subdomain. Unrecognised hosts get an empty domain, as in
+// "Convert Database.py".
+func splitWebsiteDomain(website string) (string, sql.NullString) {
+	u, err := url.Parse(strings.TrimSpace(website))
+	if err != nil || u.Hostname() == "" {
+		return "", sql.NullString{}
+	}
+	host := strings.ToLower(u.Hostname())
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return "", sql.NullString{}
+	}
+	if host == domain || host == "www."+domain {
+		return domain, sql.NullString{}
+	}
+	return domain, sql.NullString{String: host, Valid: true}
+}
+
+// carryOverCurrent copies what Wikidata doesn't provide from the current database: imported
+// organisations and brands, and the allow list words, so a failed word list download loses
+// nothing.
+func carryOverCurrent(ctx context.Context, db *sql.DB, currentPath string) {
+	if _, err := os.Stat(currentPath); err != nil {
+		return
+	}
+	if _, err := db.ExecContext(ctx, `ATTACH DATABASE ? AS current`, "file:"+currentPath+"?mode=ro"); err != nil {
+		slog.Warn("opening the current company database failed", "err", err)
+		return
+	}
+	defer func() { _, _ = db.ExecContext(ctx, `DETACH DATABASE current`) }()
+	for what, stmt := range map[string]string{
+		"allow list": `INSERT OR IGNORE INTO allow_list SELECT word FROM current.allow_list`,
+		"imported websites": `INSERT OR REPLACE INTO websites (item, item_label, website, type_label, domain, subdomain, source)
+			SELECT item, item_label, website, type_label, domain, subdomain, source FROM current.websites WHERE source <> 'wikidata'`,
+		"imported brands": `INSERT OR IGNORE INTO protected_brands (sld, sensitivity, source)
+			SELECT sld, sensitivity, source FROM current.protected_brands WHERE source <> 'wikidata'`,
+		"organisation aliases": `INSERT OR IGNORE INTO org_aliases SELECT alias, domain, source FROM current.org_aliases`,
+	} {
+		// A database from before imports has no source column or aliases, and nothing to carry over.
+		if _, err := db.ExecContext(ctx, stmt); err != nil && !strings.Contains(err.Error(), "no such column") &&
+			!strings.Contains(err.Error(), "no such table") {
+			slog.Warn("copying from the current company database failed", "what", what, "err", err)
+		}
+	}
+}
+
+// fillAllowList loads the common-word list that guards against flagging dictionary words as
+// typos.
+func fillAllowList(ctx context.Context, db *sql.DB) error {
+	body, err := fetchFeedBody(ctx, allowListURL)
+	if err != nil {
+		slog.Warn("allow list download failed, keeping the current words", "err", err)
+		return nil
+	}
+	defer func(Body io.ReadCloser) { _ = Body.Close() }(body)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		// Short words are left to exact brand matching.
+		if word := strings.ToLower(strings.TrimSpace(scanner.Text())); len(word) > 2 {
+			if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO allow_list (word) VALUES (?)`, word); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
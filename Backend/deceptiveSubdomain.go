@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DeceptiveSubdomain is a host that shows a trusted domain or brand in front of an unrelated
+// registrable domain, such as paypal.com.security-update.net or paypal-login.example.net, so
+// that a reader who only looks at the start of the address sees the brand.
+type DeceptiveSubdomain struct {
+	Host   string `json:"host"`
+	Shown  string `json:"shown"`  // the known domain or brand in the subdomain
+	Domain string `json:"domain"` // the registrable domain the host belongs to
+}
+
+// findDeceptiveSubdomain returns what host's subdomain impersonates, or nil. Subdomains of a
+// known organisation's own domain are never deceptive, and a brand name only counts when it
+// isn't a dictionary word, since words like "mail" are also the SLDs of listed companies.
+func findDeceptiveSubdomain(ctx context.Context, store CompanyStore, host string) *DeceptiveSubdomain {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if store == nil || host == "" || isIPLiteralHost(host) {
+		return nil
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil || domain == host {
+		return nil
+	}
+	if _, known, err := store.KnownDomain(ctx, domain, ""); err != nil || known {
+		return nil
+	}
+	prefix := strings.TrimSuffix(host, "."+domain)
+	found := func(shown string) *DeceptiveSubdomain {
+		return &DeceptiveSubdomain{Host: host, Shown: shown, Domain: domain}
+	}
+
+	// A whole known domain in the subdomain: paypal.com.security-update.net.
+	labels := strings.Split(prefix, ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if etld1, err := publicsuffix.EffectiveTLDPlusOne(candidate); err != nil || etld1 != candidate {
+			continue
+		}
+		if _, icann := publicsuffix.PublicSuffix(candidate); !icann {
+			continue // e.g. "login.secure": not a real TLD
+		}
+		if _, known, err := store.KnownDomain(ctx, candidate, ""); err == nil && known {
+			return found(candidate)
+		}
+	}
+
+	// A protected brand as a label or part of one: paypal-login.example.net.
+	tokens := strings.FieldsFunc(prefix, func(r rune) bool { return r == '.' || r == '-' || r == '_' })
+	isBrand := func(token string) bool { return false }
+	if idx := brands.Load(); idx != nil {
+		isBrand = func(token string) bool { _, ok := idx.byName[token]; return ok }
+	} else if listed, err := store.BrandsIn(ctx, prefix); err == nil {
+		set := map[string]bool{}
+		for _, b := range listed {
+			uni, _ := idna.ToUnicode(b)
+			set[uni] = true
+		}
+		isBrand = func(token string) bool { return set[token] }
+	}
+	sld := strings.Split(domain, ".")[0]
+	for _, t := range tokens {
+		t, _ = idna.ToUnicode(t)
+		if len([]rune(t)) <= 3 || t == sld || !isBrand(t) {
+			continue
+		}
+		if word, err := store.AllowListed(ctx, t); err == nil && !word {
+			return found(t)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// With DEFANG_OUTPUT=TRUE, or ?defang=true on a request, the URLs, domains and IPs of the
+// urlScanUpdate, urlAnalysis, iocs, executableAnalysis (links in PDFs), calendarAnalysis,
+// mailingListAnalysis, embeddedFormAnalysis, obfuscationPadding, activeContentAnalysis,
+// remoteContentAnalysis, imageTextAnalysis and imageFileAnalysis events, and the requests the
+// isolated renderer blocked in renderedAnalysis (and of the same results inside
+// attachedEmail reports) are streamed defanged: hxxps://example[.]com/path, 203[.]0[.]113[.]7. Ticket systems
+// and chat tools that auto-link whatever they're pasted then can't turn them back into live
+// links. Messages and errors quote links and domains too, so their text is defanged as well.
+// Only the stream is defanged: the saved analysis keeps the real indicators, so the STIX
+// export and the report work as before. ?defang=false switches it off for one request.
+
+// defangRequested reports whether the events of this request are to be defanged.
+func defangRequested(r *http.Request) bool {
+	switch strings.ToLower(r.URL.Query().Get("defang")) {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+	return defangOutput
+}
+
+// defangPayload returns a defanged copy of an event payload; payloads without indicators are
+// returned as they are.
+func defangPayload(payload interface{}) interface{} {
+	switch p := payload.(type) {
+	case URLScanUpdate:
+		return p.defanged()
+	case URLAnalysisResult:
+		return p.defanged()
+	case IOCSummary:
+		return p.defanged()
+	case AttachedEmailReport:
+		return p.defanged()
+	case ExecutableAnalysisResult:
+		return p.defanged()
+	case CalendarAnalysisResult:
+		return p.defanged()
+	case MailingListResult:
+		return p.defanged()
+	case EmbeddedFormResult:
+		return p.defanged()
+	case ScoreResult:
+		return p.defanged()
+	case ObfuscationPaddingResult:
+		return p.defanged()
+	case ActiveContentResult:
+		return p.defanged()
+	case RemoteContentResult:
+		return p.defanged()
+	case ImageTextResult:
+		return p.defanged()
+	case ImageFileResult:
+		return p.defanged()
+	case ContentAnalysisResult:
+		return p.defanged()
+	}
+	return payload
+}
+
+// defangAll returns a defanged copy of list.
+func defangAll(list []string, defang func(string) string) []string {
+	out := make([]string, len(list))
+	for i, v := range list {
+		out[i] = defang(v)
+	}
+	return out
+}
+
+// textIndicator matches a link, a domain name or an IPv4 address in free text.
+var textIndicator = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"']+|\b(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z][a-z0-9-]*[a-z0-9]\b|\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+
+// defangText defangs the links, domains and IPs quoted in a message or error.
+func defangText(text string) string {
+	return textIndicator.ReplaceAllStringFunc(text, defangURL)
+}
+
+func (u URLScanUpdate) defanged() URLScanUpdate {
+	u.URL, u.Error = defangURL(u.URL), defangText(u.Error)
+	return u
+}
+
+func (p *LandingPageReport) defanged() *LandingPageReport {
+	if p == nil {
+		return nil
+	}
+	page := *p
+	page.FinalURL, page.Title, page.Error = defangURL(page.FinalURL), defangText(page.Title), defangText(page.Error)
+	page.Forms = defangForms(page.Forms)
+	return &page
+}
+
+// defangForms returns a copy of forms with their actions defanged.
+func defangForms(forms []FormReport) []FormReport {
+	if forms == nil {
+		return nil
+	}
+	out := make([]FormReport, len(forms))
+	for i, f := range forms {
+		f.Action = defangURL(f.Action)
+		out[i] = f
+	}
+	return out
+}
+
+// defanged copies the result with every link, host and redirect hop defanged. Report links
+// point at the scanners' own pages and are left as they are.
+func (res URLAnalysisResult) defanged() URLAnalysisResult {
+	res.Message = defangText(res.Message)
+	if res.UrlVerdicts != nil {
+		verdicts := make([]Verdict, len(res.UrlVerdicts))
+		for i, v := range res.UrlVerdicts {
+			v.URL = defangURL(v.URL)
+			v.LandingPage = v.LandingPage.defanged()
+			verdicts[i] = v
+		}
+		res.UrlVerdicts = verdicts
+	}
+	if res.RedirectChains != nil {
+		chains := make([]RedirectChain, len(res.RedirectChains))
+		for i, c := range res.RedirectChains {
+			c.Start, c.Final, c.Summary = defangURL(c.Start), defangURL(c.Final), defangHost(c.Summary)
+			hops := make([]RedirectHop, len(c.Hops))
+			for j, h := range c.Hops {
+				h.URL, h.Domain = defangURL(h.URL), defangHost(h.Domain)
+				hops[j] = h
+			}
+			c.Hops = hops
+			chains[i] = c
+		}
+		res.RedirectChains = chains
+	}
+	if res.LinkMismatches != nil {
+		mismatches := make([]LinkMismatch, len(res.LinkMismatches))
+		for i, m := range res.LinkMismatches {
+			// The text of a mismatch is a URL or domain itself.
+			m.Text, m.Href = defangURL(m.Text), defangURL(m.Href)
+			m.TextDomain, m.ActualDomain = defangHost(m.TextDomain), defangHost(m.ActualDomain)
+			mismatches[i] = m
+		}
+		res.LinkMismatches = mismatches
+	}
+	if res.HeuristicFindings != nil {
+		findings := make([]URLHeuristicFinding, len(res.HeuristicFindings))
+		for i, f := range res.HeuristicFindings {
+			f.URL = defangURL(f.URL)
+			f.Reasons = defangAll(f.Reasons, defangText)
+			f.Deceptive = f.Deceptive.defanged()
+			findings[i] = f
+		}
+		res.HeuristicFindings = findings
+	}
+	if res.Certificates != nil {
+		certs := make([]TLSCertInfo, len(res.Certificates))
+		for i, c := range res.Certificates {
+			c.Host, c.Subject = defangHost(c.Host), defangHost(c.Subject)
+			c.Error, c.VerificationNote = defangText(c.Error), defangText(c.VerificationNote)
+			certs[i] = c
+		}
+		res.Certificates = certs
+	}
+	if res.HostingGeo != nil {
+		located := make([]HostGeo, len(res.HostingGeo))
+		for i, h := range res.HostingGeo {
+			h.Host, h.IP = defangHost(h.Host), defangHost(h.IP)
+			located[i] = h
+		}
+		res.HostingGeo = located
+	}
+	if res.LinkDomains != nil {
+		ranks := make([]DomainRank, len(res.LinkDomains))
+		for i, d := range res.LinkDomains {
+			d.Domain = defangHost(d.Domain)
+			ranks[i] = d
+		}
+		res.LinkDomains = ranks
+	}
+	return res
+}
+
+func (d *DeceptiveSubdomain) defanged() *DeceptiveSubdomain {
+	if d == nil {
+		return nil
+	}
+	c := *d
+	c.Host, c.Shown, c.Domain = defangHost(c.Host), defangHost(c.Shown), defangHost(c.Domain)
+	return &c
+}
+
+// defanged copies the summary with its sender, hosts, IPs and URLs defanged; the subject and
+// attachment hashes aren't indicators that can be clicked.
+func (s IOCSummary) defanged() IOCSummary {
+	s.Sender, s.SenderDomain, s.OriginIP = defangHost(s.Sender), defangHost(s.SenderDomain), defangHost(s.OriginIP)
+	if s.OriginGeo != nil {
+		geo := *s.OriginGeo
+		geo.IP = defangHost(geo.IP)
+		s.OriginGeo = &geo
+	}
+	s.URLs = defangAll(s.URLs, defangURL)
+	s.Domains = defangAll(s.Domains, defangHost)
+	s.IPs = defangAll(s.IPs, defangHost)
+	return s
+}
+
+// defanged copies the report with its sender, the results of its own checks and its error
+// defanged.
+func (a AttachedEmailReport) defanged() AttachedEmailReport {
+	a.From, a.Domain, a.Error = defangHost(a.From), defangHost(a.Domain), defangText(a.Error)
+	if a.Scores != nil {
+		scores := a.Scores.defanged()
+		a.Scores = &scores
+	}
+	if a.Checks != nil {
+		checks := make(map[string]interface{}, len(a.Checks))
+		for name, payload := range a.Checks {
+			checks[name] = defangPayload(payload)
+		}
+		a.Checks = checks
+	}
+	return a
+}
+
+// defanged copies the result with the links found in PDF attachments, and the errors, defanged.
+func (res ExecutableAnalysisResult) defanged() ExecutableAnalysisResult {
+	res.Message = defangText(res.Message)
+	if res.Files != nil {
+		files := make([]AttachmentReport, len(res.Files))
+		for i, f := range res.Files {
+			f.VTError, f.ClamAVError, f.ArchiveError = defangText(f.VTError), defangText(f.ClamAVError), defangText(f.ArchiveError)
+			if f.PDF != nil {
+				pdf := *f.PDF
+				pdf.URLs = defangAll(pdf.URLs, defangURL)
+				f.PDF = &pdf
+			}
+			files[i] = f
+		}
+		res.Files = files
+	}
+	return res
+}
+
+// defanged copies the result with the invites' links, location, organizer, attendees and text
+// defanged.
+func (res CalendarAnalysisResult) defanged() CalendarAnalysisResult {
+	res.Message = defangText(res.Message)
+	if res.Invites != nil {
+		invites := make([]CalendarInvite, len(res.Invites))
+		for i, inv := range res.Invites {
+			inv.URLs = defangAll(inv.URLs, defangURL)
+			inv.Location = defangURL(inv.Location) // often a meeting link
+			inv.Organizer = defangHost(inv.Organizer)
+			inv.Attendees = defangAll(inv.Attendees, defangHost)
+			inv.Summary, inv.Explanation = defangText(inv.Summary), defangText(inv.Explanation)
+			invites[i] = inv
+		}
+		res.Invites = invites
+	}
+	return res
+}
+
+// defanged copies the result with the unsubscribe targets, Return-Path, list ID and domains
+// defanged.
+func (res MailingListResult) defanged() MailingListResult {
+	res.Unsubscribe = defangAll(res.Unsubscribe, defangURL)
+	res.ReturnPath, res.ListID = defangHost(res.ReturnPath), defangHost(res.ListID)
+	res.UnsubscribeDomains = defangAll(res.UnsubscribeDomains, defangHost)
+	res.UnrelatedDomains = defangAll(res.UnrelatedDomains, defangHost)
+	res.Message = defangText(res.Message)
+	return res
+}
+
+// defanged copies the result with the forms' actions and the domains they submit to defanged.
+func (res EmbeddedFormResult) defanged() EmbeddedFormResult {
+	res.Forms = defangForms(res.Forms)
+	res.ActionDomains = defangAll(res.ActionDomains, defangHost)
+	res.Message = defangText(res.Message)
+	return res
+}
+
+// defanged copies the scores with the sender of a suppression defanged.
+func (s ScoreResult) defanged() ScoreResult {
+	if s.Suppressed != nil {
+		suppressed := *s.Suppressed
+		suppressed.Sender = defangHost(suppressed.Sender)
+		s.Suppressed = &suppressed
+	}
+	return s
+}
+
+// defanged copies the result with the links hidden behind the padding, and the text after it,
+// defanged.
+func (res ObfuscationPaddingResult) defanged() ObfuscationPaddingResult {
+	if res.Padding != nil {
+		padding := *res.Padding
+		padding.URLs = defangAll(padding.URLs, defangURL)
+		res.Padding = &padding
+	}
+	res.Sample, res.Message = defangText(res.Sample), defangText(res.Message)
+	return res
+}
+
+// defanged copies the result with the script sources, meta refresh target and base URL defanged.
+func (res ActiveContentResult) defanged() ActiveContentResult {
+	res.ScriptSources = defangAll(res.ScriptSources, defangURL)
+	res.ScriptIndicators = defangAll(res.ScriptIndicators, defangText)
+	res.RefreshURL, res.BaseHref = defangURL(res.RefreshURL), defangURL(res.BaseHref)
+	res.Message = defangText(res.Message)
+	return res
+}
+
+// defanged copies the result with the remote content's domains and URLs defanged.
+func (res RemoteContentResult) defanged() RemoteContentResult {
+	if res.Domains != nil {
+		domains := make([]RemoteDomain, len(res.Domains))
+		for i, d := range res.Domains {
+			d.Domain, d.URLs = defangHost(d.Domain), defangAll(d.URLs, defangURL)
+			domains[i] = d
+		}
+		res.Domains = domains
+	}
+	res.UnrelatedDomains = defangAll(res.UnrelatedDomains, defangHost)
+	res.Message = defangText(res.Message)
+	return res
+}
+
+// defanged copies the result with the links and text read from the images defanged.
+func (res ImageTextResult) defanged() ImageTextResult {
+	if res.Images != nil {
+		images := make([]ImageText, len(res.Images))
+		for i, img := range res.Images {
+			img.URLs = defangAll(img.URLs, defangURL)
+			img.Excerpt, img.Error = defangText(img.Excerpt), defangText(img.Error)
+			images[i] = img
+		}
+		res.Images = images
+	}
+	res.Message = defangText(res.Message)
+	return res
+}
+
+// defanged copies the result with the links appended to the images and their metadata defanged.
+func (res ImageFileResult) defanged() ImageFileResult {
+	if res.Images != nil {
+		images := make([]ImageFileReport, len(res.Images))
+		for i, img := range res.Images {
+			img.URLs = defangAll(img.URLs, defangURL)
+			if img.Metadata != nil {
+				metadata := make(map[string]string, len(img.Metadata))
+				for k, v := range img.Metadata {
+					metadata[k] = defangText(v)
+				}
+				img.Metadata = metadata
+			}
+			images[i] = img
+		}
+		res.Images = images
+	}
+	res.Message = defangText(res.Message)
+	return res
+}
+
+// defanged copies the result with the requests the isolated renderer blocked defanged.
+func (res ContentAnalysisResult) defanged() ContentAnalysisResult {
+	if res.BlockedRequests != nil {
+		blocked := make([]BlockedRequest, len(res.BlockedRequests))
+		for i, b := range res.BlockedRequests {
+			b.URL = defangURL(b.URL)
+			blocked[i] = b
+		}
+		res.BlockedRequests = blocked
+	}
+	return res
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// liveIndicator matches the test link or its domain where they haven't been defanged.
+var liveIndicator = regexp.MustCompile(`(?i)(https?://)?evil\.example`)
+
+// notIndicators are the payload fields that never hold a link, host or address (hashes, file
+// names and types, verdict labels, the subject), and the scanners' own report pages and the
+// screenshot paths, which are left as they are on purpose.
+var notIndicators = map[string]bool{
+	"status": true, "severity": true, "source": true, "categories": true, "report": true, "vtReport": true,
+	"screenshot": true, "sha256": true, "sha1": true, "md5": true, "fileName": true, "containedIn": true,
+	"contentType": true, "detectedType": true, "detectionRatio": true, "archiveType": true,
+	"policySeverity": true, "clamav": true, "modules": true, "autoExec": true, "suspicious": true,
+	"activeContent": true, "method": true, "credentialFields": true, "cardFields": true, "issuer": true,
+	"asOrg": true, "country": true, "subject": true, "esp": true, "precedence": true, "start": true, "refreshDelay": true, "relation": true, "file": true,
+	"format": true, "gps": true, "appendedKind": true, "findings": true, "type": true,
+	"path": true, "skipped": true, "analysisId": true, "profile": true, "reason": true,
+}
+
+// fillStrings sets every string reachable from v to s, giving slices and string maps one element
+// and allocating pointers, so that a forgotten field shows up in the defanged output.
+func fillStrings(v reflect.Value, s string, depth int) {
+	if depth > 6 {
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		fillStrings(v.Elem(), s, depth+1)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillStrings(v.Index(0), s, depth+1)
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String && v.Type().Elem().Kind() == reflect.String {
+			v.Set(reflect.MakeMap(v.Type()))
+			v.SetMapIndex(reflect.ValueOf("key").Convert(v.Type().Key()), reflect.ValueOf(s).Convert(v.Type().Elem()))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fillStrings(v.Field(i), s, depth+1)
+			}
+		}
+	}
+}
+
+// filled returns a T whose every string is a live indicator.
+func filled[T any]() T {
+	var v T
+	fillStrings(reflect.ValueOf(&v).Elem(), "https://evil.example/login", 0)
+	return v
+}
+
+// liveStrings lists the JSON paths under which payload still carries a live indicator.
+func liveStrings(path string, v interface{}) []string {
+	var live []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if !notIndicators[k] {
+				live = append(live, liveStrings(path+"."+k, child)...)
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			live = append(live, liveStrings(path+"[]", child)...)
+		}
+	case string:
+		if liveIndicator.MatchString(v) {
+			live = append(live, path+": "+v)
+		}
+	}
+	return live
+}
+
+func TestDefangPayload(t *testing.T) {
+	payloads := map[string]interface{}{
+		"urlScanUpdate":        filled[URLScanUpdate](),
+		"urlAnalysis":          filled[URLAnalysisResult](),
+		"iocs":                 filled[IOCSummary](),
+		"executableAnalysis":   filled[ExecutableAnalysisResult](),
+		"calendarAnalysis":     filled[CalendarAnalysisResult](),
+		"mailingListAnalysis":  filled[MailingListResult](),
+		"embeddedFormAnalysis": filled[EmbeddedFormResult](),
+		"finalScores":          filled[ScoreResult](),
+		"obfuscationPadding":   filled[ObfuscationPaddingResult](),
+		"activeContent":        filled[ActiveContentResult](),
+		"remoteContent":        filled[RemoteContentResult](),
+		"imageText":            filled[ImageTextResult](),
+		"imageFiles":           filled[ImageFileResult](),
+		// Only the blocked requests of the rendered analysis are indicators of the email's.
+		"renderedAnalysis": ContentAnalysisResult{BlockedRequests: filled[[]BlockedRequest]()},
+	}
+	attached := filled[AttachedEmailReport]()
+	attached.Checks = map[string]interface{}{}
+	for name, payload := range payloads {
+		attached.Checks[name] = payload
+	}
+	payloads["attachedEmail"] = attached
+
+	for name, payload := range payloads {
+		data, err := json.Marshal(defangPayload(payload))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		live := liveStrings(name, decoded)
+		sort.Strings(live)
+		if len(live) > 0 {
+			t.Errorf("live indicators left after defanging:\n%s", strings.Join(live, "\n"))
+		}
+	}
+}
+
+func TestDefangText(t *testing.T) {
+	tests := map[string]string{
+		"The unsubscribe link goes to evil.example, not shop.example.": "The unsubscribe link goes to evil[.]example, not shop[.]example.",
+		"Get https://evil.example/login?a=b: timeout":                  "Get hxxps://evil[.]example/login?a=b: timeout",
+		"lookup mail.evil.example on 203.0.113.7:53: no such host":     "lookup mail[.]evil[.]example on 203[.]0[.]113[.]7:53: no such host",
+		"Score 7.2, e.g. 3 of 4 engines.":                              "Score 7.2, e.g. 3 of 4 engines.",
+	}
+	for in, want := range tests {
+		if got := defangText(in); got != want {
+			t.Errorf("defangText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
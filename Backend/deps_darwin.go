@@ -3,14 +3,14 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 )
 
 func setupDependencies() {
 	if !commandExists("brew") {
-		log.Println("Homebrew not found. Cannot auto-install dependencies.")
+		slog.Warn("Homebrew not found, cannot auto-install dependencies")
 		return
 	}
 
@@ -29,14 +29,14 @@ func setupDependencies() {
 	}
 
 	if len(depsToInstall) > 0 {
-		log.Printf("Installing via Homebrew: %v...", depsToInstall)
+		slog.Info("installing via Homebrew", "packages", depsToInstall)
 		args := append([]string{"install"}, depsToInstall...)
 		cmd := exec.Command("brew", args...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		cmd.Stdin = os.Stdin
 		if err := cmd.Run(); err != nil {
-			log.Printf("Homebrew install failed: %v", err)
+			slog.Error("Homebrew install failed", "err", err)
 		}
 	}
 }
@@ -4,7 +4,7 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 )
@@ -21,7 +21,7 @@ func setupDependencies() {
 			if askForConfirmation(msg) {
 				installLinuxPackage(pkg)
 			} else {
-				log.Printf("Skipping installation of %s. Some features may not work.", pkg)
+				slog.Warn("skipping installation, some features may not work", "package", pkg)
 			}
 		}
 	}
@@ -39,16 +39,16 @@ func installLinuxPackage(pkg string) {
 
 	for _, mgr := range managers {
 		if _, err := exec.LookPath(mgr.check); err == nil {
-			log.Printf("Installing %s using %s...", pkg, mgr.check)
+			slog.Info("installing package", "package", pkg, "manager", mgr.check)
 			cmd := exec.Command(mgr.installCmd[0], mgr.installCmd[1:]...)
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 			cmd.Stdin = os.Stdin
 			if err := cmd.Run(); err != nil {
-				log.Printf("Failed to install %s: %v", pkg, err)
+				slog.Error("installing package failed", "package", pkg, "err", err)
 			}
 			return
 		}
 	}
-	log.Printf("No supported package manager found. Please install %s manually.", pkg)
+	slog.Warn("no supported package manager found, install manually", "package", pkg)
 }
@@ -3,7 +3,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 )
@@ -17,10 +17,10 @@ func setupDependencies() {
 			} else if commandExists("choco", "choco.exe") {
 				runChoco("imagemagick")
 			} else {
-				log.Println("No supported Windows package manager (winget or choco) found. Please install ImageMagick manually from https://imagemagick.org/")
+				slog.Warn("no supported Windows package manager (winget or choco) found; install ImageMagick manually from https://imagemagick.org/")
 			}
 		} else {
-			log.Println("Skipping ImageMagick. Rendered analysis may fail.")
+			slog.Warn("skipping ImageMagick, rendered analysis may fail")
 		}
 	}
 
@@ -32,17 +32,17 @@ func setupDependencies() {
 			} else if commandExists("choco", "choco.exe") {
 				runChoco("tesseract")
 			} else {
-				log.Println("No supported Windows package manager (winget or choco) found. Please install Tesseract manually from https://github.com/tesseract-ocr/tesseract")
+				slog.Warn("no supported Windows package manager (winget or choco) found; install Tesseract manually from https://github.com/tesseract-ocr/tesseract")
 			}
 		} else {
-			log.Println("Skipping Tesseract. OCR features will be disabled.")
+			slog.Warn("skipping Tesseract, OCR features will be disabled")
 		}
 	}
 }
 
 func runWinget(id string) {
 	if _, err := exec.LookPath("winget"); err != nil {
-		log.Printf("winget not found: %v", err)
+		slog.Warn("winget not found", "err", err)
 		return
 	}
 	cmd := exec.Command("winget", "install", "--id", id, "-e", "--source", "winget", "--accept-package-agreements", "--accept-source-agreements")
@@ -50,15 +50,15 @@ func runWinget(id string) {
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	if err := cmd.Run(); err != nil {
-		log.Printf("Failed to install %s via winget: %v", id, err)
+		slog.Error("winget install failed", "package", id, "err", err)
 	} else {
-		log.Println("Install complete. You may need to restart the app to detect the new PATH.")
+		slog.Info("install complete, you may need to restart the app to detect the new PATH")
 	}
 }
 
 func runChoco(pkg string) {
 	if _, err := exec.LookPath("choco"); err != nil {
-		log.Printf("choco not found: %v", err)
+		slog.Warn("choco not found", "err", err)
 		return
 	}
 	cmd := exec.Command("choco", "install", pkg, "-y")
@@ -66,8 +66,8 @@ func runChoco(pkg string) {
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	if err := cmd.Run(); err != nil {
-		log.Printf("Failed to install %s via choco: %v", pkg, err)
+		slog.Error("choco install failed", "package", pkg, "err", err)
 	} else {
-		log.Println("Install complete. You may need to restart the app to detect the new PATH.")
+		slog.Info("install complete, you may need to restart the app to detect the new PATH")
 	}
 }
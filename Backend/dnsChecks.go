@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// MailDNSResult reports whether a sender domain can actually receive mail.
+type MailDNSResult struct {
+	Host     string   `json:"host"`
+	Exists   bool     `json:"exists"`
+	MX       []string `json:"mx"`
+	HasA     bool     `json:"hasA"`
+	NullMX   bool     `json:"nullMx"` // RFC 7505 "0 ." record: the domain explicitly accepts no mail
+	Parked   bool     `json:"parked"`
+	CanMail  bool     `json:"canReceiveMail"`
+	LookupOK bool     `json:"lookupOk"`         // false when DNS itself failed, so the result says nothing
+	Status   string   `json:"status,omitempty"` // "Error" when the lookup failed; it then scores nothing
+	Error    string   `json:"error,omitempty"`
+}
+
+// parkingHosts are nameserver/MX suffixes of domain-parking services. A sender domain served by
+// one of these is almost certainly not a real organisation's mail domain.
+var parkingHosts = []string{
+	"sedoparking.com", "parkingcrew.net", "bodis.com", "above.com", "dan.com",
+	"afternic.com", "parklogic.com", "namedrive.com", "domainparkingserver.net",
+	"parked.com", "uniregistrymarket.link", "hugedomains.com",
+}
+
+func isParkingHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, p := range parkingHosts {
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotFound reports whether a DNS error means the name has no such records (as opposed to a
+// resolver failure).
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// checkMailDNS looks up MX records for host, falling back to A/AAAA as RFC 5321 does, and checks
+// the registrable domain's nameservers for parking services.
+func checkMailDNS(ctx context.Context, host string) MailDNSResult {
+	res := MailDNSResult{Host: host, MX: []string{}}
+	if host == "" {
+		res.Status, res.Error = "Error", "no sender domain"
+		return res
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	resolver := net.DefaultResolver
+
+	mxs, err := resolver.LookupMX(ctx, host)
+	switch {
+	case err == nil:
+		res.Exists = true
+		for _, mx := range mxs {
+			if mx.Host == "." || mx.Host == "" {
+				res.NullMX = true
+				continue
+			}
+			res.MX = append(res.MX, strings.TrimSuffix(mx.Host, "."))
+			if isParkingHost(mx.Host) {
+				res.Parked = true
+			}
+		}
+	case !isNotFound(err):
+		res.Status, res.Error = "Error", err.Error()
+		return res
+	}
+
+	if len(res.MX) == 0 && !res.NullMX {
+		addrs, err := resolver.LookupHost(ctx, host)
+		switch {
+		case err == nil:
+			res.Exists = true
+			res.HasA = len(addrs) > 0
+		case !isNotFound(err):
+			res.Status, res.Error = "Error", err.Error()
+			return res
+		}
+	}
+
+	if registrable, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		if nss, err := resolver.LookupNS(ctx, registrable); err == nil {
+			res.Exists = true
+			for _, ns := range nss {
+				if isParkingHost(ns.Host) {
+					res.Parked = true
+				}
+			}
+		}
+	}
+
+	res.LookupOK = true
+	res.CanMail = !res.NullMX && !res.Parked && (len(res.MX) > 0 || res.HasA)
+	return res
+}
+
+// receivedFromIP matches the bracketed connecting address in a Received header's "from" clause,
+// e.g. "from mail.example.com (mail.example.com [203.0.113.5])" or "[IPv6:2001:db8::1]".
+var receivedFromIP = regexp.MustCompile(`\[(?:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+// isPublicIP reports whether ip is routable on the internet (not private, loopback, link-local...).
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// originatingIP returns the first public IP found in the "from" clauses of the Received headers,
+// newest first: the server that handed the message to the recipient's infrastructure. Hops
+// further down the chain are supplied by the sender and can't be trusted.
+func originatingIP(received []string) string {
+	if ips := receivedIPs(received); len(ips) > 0 {
+		return ips[0]
+	}
+	return ""
+}
+
+// receivedIPs returns every distinct public IP in the "from" clauses of the Received headers,
+// newest first. Unlike originatingIP this includes the hops the sender could have forged.
+func receivedIPs(received []string) []string {
+	seen := map[string]bool{}
+	var ips []string
+	for _, h := range received {
+		h = strings.Join(strings.Fields(h), " ")
+		from := h
+		if i := strings.Index(strings.ToLower(h), " by "); i >= 0 {
+			from = h[:i]
+		}
+		if !strings.HasPrefix(strings.ToLower(from), "from ") {
+			continue
+		}
+		for _, m := range receivedFromIP.FindAllStringSubmatch(from, -1) {
+			if ip := net.ParseIP(m[1]); isPublicIP(ip) && !seen[ip.String()] {
+				seen[ip.String()] = true
+				ips = append(ips, ip.String())
+			}
+		}
+	}
+	return ips
+}
+
+// DNSBLListing is one blocklist that lists the sender IP.
+type DNSBLListing struct {
+	Zone   string `json:"zone"`
+	Result string `json:"result"` // the 127.0.0.x return code
+	Reason string `json:"reason,omitempty"`
+}
+
+type SenderIPAnalysisResult struct {
+	IP          string         `json:"ip"`
+	Listed      bool           `json:"listed"`
+	Listings    []DNSBLListing `json:"listings"`
+	Message     string         `json:"message"`
+	ScoreImpact int            `json:"scoreImpact"`
+
+	Geo         *GeoInfo `json:"geo,omitempty"`         // informational: where the IP is
+	GeoMismatch bool     `json:"geoMismatch,omitempty"` // outside the country of the sender domain's TLD
+}
+
+// dnsblQueryName builds the reversed-address query name for a DNSBL zone (RFC 5782): reversed
+// octets for IPv4, reversed nibbles for IPv6.
+func dnsblQueryName(ip net.IP, zone string) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", v4[3], v4[2], v4[1], v4[0], zone)
+	}
+	v6 := ip.To16()
+	var b strings.Builder
+	for i := len(v6) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", v6[i]&0x0f, v6[i]>>4)
+	}
+	return b.String() + zone
+}
+
+// lookupDNSBLs queries every configured zone in parallel and returns the ones listing ip.
+func lookupDNSBLs(ctx context.Context, ip net.IP) []DNSBLListing {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	listings := []DNSBLListing{}
+	for _, zone := range dnsblZones {
+		wg.Add(1)
+		go func(zone string) {
+			defer wg.Done()
+			name := dnsblQueryName(ip, zone)
+			addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+			if err != nil || len(addrs) == 0 {
+				return // NXDOMAIN means not listed
+			}
+			code := addrs[0]
+			// 127.255.255.x are Spamhaus error codes (e.g. queries via a public resolver), not listings.
+			if !strings.HasPrefix(code, "127.") || strings.HasPrefix(code, "127.255.255.") {
+				return
+			}
+			listing := DNSBLListing{Zone: zone, Result: code}
+			if txt, err := net.DefaultResolver.LookupTXT(ctx, name); err == nil && len(txt) > 0 {
+				listing.Reason = txt[0]
+			}
+			mu.Lock()
+			listings = append(listings, listing)
+			mu.Unlock()
+		}(zone)
+	}
+	wg.Wait()
+	return listings
+}
+
+func performSenderIPAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, rCtx context.Context, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "SenderIPListed" {
+			check = c
+			break
+		}
+	}
+
+	result := SenderIPAnalysisResult{IP: Email.OriginIP, Listings: []DNSBLListing{}}
+	ip := net.ParseIP(Email.OriginIP)
+	result.Geo = lookupGeo(ip)
+	claimed := claimedCountry(Email.Domain)
+	result.GeoMismatch = geoMismatch(result.Geo, claimed)
+	geoNote := func() string {
+		if result.GeoMismatch {
+			return fmt.Sprintf(" It is in %s, but the sender's domain is in %s.", result.Geo, claimed)
+		}
+		if result.Geo != nil {
+			return fmt.Sprintf(" It is in %s.", result.Geo)
+		}
+		return ""
+	}
+	if ip == nil || len(dnsblZones) == 0 {
+		result.Message = "No public sending IP found in the Received headers."
+		if ip != nil {
+			result.Message = "No DNSBL zones configured." + geoNote()
+		} else if len(dnsblZones) == 0 {
+			result.Message = "No DNSBL zones configured."
+		}
+		result.ScoreImpact = check.Impact
+		ch <- CheckResult{EventName: "senderIPAnalysis", Payload: result}
+		return
+	}
+
+	result.Listings = lookupDNSBLs(rCtx, ip)
+	result.Listed = len(result.Listings) > 0
+	if result.Listed {
+		zones := make([]string, 0, len(result.Listings))
+		for _, l := range result.Listings {
+			zones = append(zones, l.Zone)
+		}
+		result.Message = fmt.Sprintf("Sending IP %s is listed on %s.", result.IP, strings.Join(zones, ", "))
+	} else {
+		result.Message = fmt.Sprintf("Sending IP %s is not on any of %d blocklists.", result.IP, len(dnsblZones))
+		result.ScoreImpact = check.Impact
+	}
+	result.Message += geoNote()
+	ch <- CheckResult{EventName: "senderIPAnalysis", Payload: result}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/net/html"
+	"golang.org/x/net/publicsuffix"
+)
+
+// A form in the email itself asks for the password or card number in the mail client, without
+// a link to a lookalike site that URL scanning could catch. The email's HTML is searched for
+// forms and loose inputs, as attached HTML pages are; one with a password or card field fails
+// the EmbeddedCredentialForm check. Every form's action is also scanned with the email's links,
+// so the collecting server is judged like any other URL.
+
+// EmbeddedFormResult is the embeddedFormAnalysis event.
+type EmbeddedFormResult struct {
+	Forms         []FormReport `json:"forms"`         // forms asking for passwords, card or login details
+	ActionDomains []string     `json:"actionDomains"` // registrable domains the email's forms submit to
+	Harvesting    bool         `json:"harvesting"`    // a form asks for a password or card details
+	Message       string       `json:"message"`
+	ScoreImpact   int          `json:"scoreImpact"`
+}
+
+// formActionURLs returns the absolute http(s) URLs the forms in htmlStr submit to, including
+// the formaction of their buttons.
+func formActionURLs(htmlStr string) []string {
+	if strings.TrimSpace(htmlStr) == "" {
+		return nil
+	}
+	doc, err := html.Parse(strings.NewReader(htmlStr))
+	if err != nil {
+		return nil
+	}
+	var urls []string
+	seen := map[string]bool{}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			for _, a := range n.Attr {
+				if !(a.Key == "action" && n.Data == "form") && !(a.Key == "formaction" && (n.Data == "button" || n.Data == "input")) {
+					continue
+				}
+				u := strings.TrimSpace(a.Val)
+				if strings.HasPrefix(u, "//") {
+					u = "https:" + u
+				}
+				if linkHost(u) != "" && !seen[u] {
+					seen[u] = true
+					urls = append(urls, u)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return urls
+}
+
+// performEmbeddedFormAnalysis searches the HTML part as sent: Email.HTML has had its padding and
+// quoted thread cut off, and a form can hide in either.
+func performEmbeddedFormAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, env *enmime.Envelope) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "EmbeddedCredentialForm" {
+			check = c
+			break
+		}
+	}
+	result := EmbeddedFormResult{Forms: findCredentialForms(env.HTML), ActionDomains: []string{}}
+	if result.Forms == nil {
+		result.Forms = []FormReport{}
+	}
+	seen := map[string]bool{}
+	for _, u := range formActionURLs(env.HTML) {
+		host := linkHost(u)
+		if d, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+			host = d
+		}
+		if !seen[host] {
+			seen[host] = true
+			result.ActionDomains = append(result.ActionDomains, host)
+		}
+	}
+	var passwords, cards int
+	for _, f := range result.Forms {
+		passwords += f.PasswordFields
+		cards += len(f.CardFields)
+	}
+	result.Harvesting = passwords > 0 || cards > 0
+	switch {
+	case result.Harvesting:
+		var asks []string
+		if passwords > 0 {
+			asks = append(asks, "a password")
+		}
+		if cards > 0 {
+			asks = append(asks, "card details")
+		}
+		result.Message = fmt.Sprintf("The email contains a form asking for %s.", strings.Join(asks, " and "))
+		if len(result.ActionDomains) > 0 {
+			result.Message += fmt.Sprintf(" It submits to %s.", strings.Join(result.ActionDomains, ", "))
+		}
+	case len(result.Forms) > 0:
+		result.Message = "The email contains a form asking for login details, but no password or card fields."
+		result.ScoreImpact = check.Impact
+	default:
+		result.Message = "No credential forms in the email."
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "embeddedFormAnalysis", Payload: result}
+}
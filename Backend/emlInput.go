@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+// Error codes returned in the "code" member of JSON error responses and SSE error events, so
+// clients can tell a bad upload from a server fault without parsing the message.
+const (
+	errCodeTooLarge       = "payload_too_large"
+	errCodeBadEncoding    = "invalid_base64"
+	errCodeInvalidEmail   = "invalid_email"
+	errCodeInternal       = "internal_error"
+	errCodeInvalidProfile = "invalid_profile"
+	errCodeNotFound       = "not_found"
+	errCodeInvalidRequest = "invalid_request"
+	errCodeConflict       = "conflict"
+)
+
+// writeJSONError writes a structured error response: {"error": msg, "code": code}.
+func writeJSONError(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg, "code": code})
+}
+
+// maxRequestBytes is the largest base64 body accepted for an EML of maxEMLBytes: base64 grows
+// the data by 4/3, plus room for line breaks some clients insert every 76 characters.
+func maxRequestBytes() int64 {
+	encoded := (maxEMLBytes + 2) / 3 * 4
+	return encoded + encoded/76*2 + 1024
+}
+
+// readEMLBody reads and decodes the base64 EML in the request body, enforcing the size limit.
+// The returned status and code describe the failure for the JSON error response.
+func readEMLBody(w http.ResponseWriter, r *http.Request) ([]byte, int, string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes()))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, errCodeTooLarge, fmt.Errorf("email exceeds the %d MB limit", maxEMLBytes>>20)
+		}
+		return nil, http.StatusBadRequest, errCodeInvalidEmail, fmt.Errorf("failed to read request body: %w", err)
+	}
+	// Tolerate line-wrapped base64 as produced by most encoders.
+	cleaned := strings.NewReplacer("\r", "", "\n", "", " ", "", "\t", "").Replace(string(body))
+	if cleaned == "" {
+		return nil, http.StatusBadRequest, errCodeInvalidEmail, errors.New("request body is empty")
+	}
+	eml, err := base64.StdEncoding.DecodeString(cleaned)
+	if err != nil {
+		return nil, http.StatusBadRequest, errCodeBadEncoding, errors.New("body must be a base64-encoded EML")
+	}
+	if int64(len(eml)) > maxEMLBytes {
+		return nil, http.StatusRequestEntityTooLarge, errCodeTooLarge, fmt.Errorf("email exceeds the %d MB limit", maxEMLBytes>>20)
+	}
+	if err := validateEML(eml); err != nil {
+		return nil, http.StatusUnprocessableEntity, errCodeInvalidEmail, err
+	}
+	return eml, 0, "", nil
+}
+
+// validateEML checks that data is an RFC 5322 message before any analysis is started: a header
+// section that parses, containing at least one of the headers every real email carries.
+func validateEML(data []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("not a valid email: %w", err)
+	}
+	for _, h := range []string{"From", "Date", "Subject", "Message-Id", "Received"} {
+		if msg.Header.Get(h) != "" {
+			return nil
+		}
+	}
+	return errors.New("not a valid email: no From, Date, Subject, Message-ID or Received header")
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Business email compromise often comes from a free-mail or lookalike account whose display name
+// is the tenant's CEO: "Jane Doe <jane.doe.ceo@gmail.com>". None of the other checks can tell,
+// as the sender's domain is perfectly ordinary. A tenant can therefore upload its executives and
+// internal domains at /executives (admins for any profile with ?profile=, tenants with an API
+// key bound to their profile for their own), and ExecutiveImpersonation fails an email whose
+// display name is one of the executives while the address is outside the internal domains and
+// isn't one of that executive's own addresses. The check only runs, and only counts towards the
+// maximum score, for profiles that have uploaded a directory.
+
+// Executive is one person whose name is worth impersonating.
+type Executive struct {
+	Name   string   `json:"name"`
+	Emails []string `json:"emails,omitempty"` // their own addresses outside the internal domains, e.g. a personal one
+}
+
+// ExecutiveDirectory is what a tenant uploads.
+type ExecutiveDirectory struct {
+	Profile         string      `json:"profile"` // "" for emails analysed without a profile
+	Executives      []Executive `json:"executives"`
+	InternalDomains []string    `json:"internalDomains"` // cover their subdomains
+	UpdatedAt       time.Time   `json:"updatedAt"`
+}
+
+// ExecutiveImpersonationResult is the executiveImpersonation event.
+type ExecutiveImpersonationResult struct {
+	DisplayName   string `json:"displayName"`
+	Sender        string `json:"sender"`
+	Executive     string `json:"executive,omitempty"` // the executive the display name matches
+	Internal      bool   `json:"internal"`            // sent from an internal domain or the executive's own address
+	Impersonation bool   `json:"impersonation"`
+	Message       string `json:"message"`
+	ScoreImpact   int    `json:"scoreImpact"`
+}
+
+// executiveDirectories holds every uploaded directory by profile name. It is replaced as a whole
+// after each change, so the checks read it without locking.
+var executiveDirectories atomic.Pointer[map[string]ExecutiveDirectory]
+
+// executiveDirectoryFor returns the directory of the profile (nil for the server-wide one), or
+// nil when it has none.
+func executiveDirectoryFor(p *Profile) *ExecutiveDirectory {
+	dirs := executiveDirectories.Load()
+	if dirs == nil {
+		return nil
+	}
+	if d, ok := (*dirs)[p.name()]; ok && len(d.Executives) > 0 {
+		return &d
+	}
+	return nil
+}
+
+// reloadExecutiveDirectories reads the directories from the results store.
+func reloadExecutiveDirectories() error {
+	if results == nil {
+		return nil
+	}
+	rows, err := results.db.Query(`SELECT directory_json FROM executive_directories`)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	dirs := map[string]ExecutiveDirectory{}
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return err
+		}
+		var d ExecutiveDirectory
+		if err := json.Unmarshal([]byte(raw), &d); err != nil {
+			return err
+		}
+		dirs[d.Profile] = d
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	executiveDirectories.Store(&dirs)
+	return nil
+}
+
+// personNameNoise are titles and roles dropped from display names before comparing them.
+var personNameNoise = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "miss": true, "dr": true, "prof": true, "sir": true, "dame": true,
+	"ceo": true, "cfo": true, "coo": true, "cto": true, "md": true, "jr": true, "sr": true,
+}
+
+// personNameTokens lower-cases name, turns "Doe, Jane" into "jane doe" and returns its words
+// without titles.
+func personNameTokens(name string) []string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if parts := strings.Split(name, ","); len(parts) == 2 && !strings.Contains(name, "@") {
+		name = parts[1] + " " + parts[0]
+	}
+	words := strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) })
+	kept := words[:0]
+	for _, w := range words {
+		if !personNameNoise[w] {
+			kept = append(kept, w)
+		}
+	}
+	return kept
+}
+
+// displayNameIs reports whether a display name names the executive: it contains their first and
+// last name, in any order ("Jane Doe", "Doe, Jane", "Jane A. Doe (CEO)", "jane.doe@acme.com").
+func displayNameIs(displayName, executive string) bool {
+	exec := personNameTokens(executive)
+	if len(exec) < 2 {
+		return false
+	}
+	have := map[string]bool{}
+	for _, w := range personNameTokens(displayName) {
+		have[w] = true
+	}
+	return have[exec[0]] && have[exec[len(exec)-1]]
+}
+
+// checkExecutiveImpersonation compares the From header with the directory.
+func checkExecutiveImpersonation(from string, dir *ExecutiveDirectory, check Check) ExecutiveImpersonationResult {
+	result := ExecutiveImpersonationResult{ScoreImpact: check.Impact}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		result.Message = "The From header could not be parsed."
+		return result
+	}
+	result.DisplayName, result.Sender = addr.Name, strings.ToLower(addr.Address)
+	senderDomain := result.Sender[strings.LastIndex(result.Sender, "@")+1:]
+	for _, d := range dir.InternalDomains {
+		if domainCovers(d, senderDomain) {
+			result.Internal = true
+			break
+		}
+	}
+	if addr.Name == "" {
+		result.Message = "The sender has no display name."
+		return result
+	}
+	for _, e := range dir.Executives {
+		if !displayNameIs(addr.Name, e.Name) {
+			continue
+		}
+		result.Executive = e.Name
+		for _, own := range e.Emails {
+			if strings.EqualFold(own, result.Sender) {
+				result.Internal = true
+			}
+		}
+		if result.Internal {
+			result.Message = fmt.Sprintf("The display name is %s, sending from one of their known addresses.", e.Name)
+			return result
+		}
+		result.Impersonation = true
+		result.ScoreImpact = 0
+		result.Message = fmt.Sprintf("The display name claims to be %s, but the email was sent from %s, outside your organisation.", e.Name, result.Sender)
+		return result
+	}
+	result.Message = "The display name isn't one of your executives."
+	return result
+}
+
+func performExecutiveAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "ExecutiveImpersonation" {
+			check = c
+			break
+		}
+	}
+	dir := executiveDirectoryFor(Email.Profile)
+	if dir == nil {
+		return
+	}
+	ch <- CheckResult{EventName: "executiveImpersonation", Payload: checkExecutiveImpersonation(Email.From, dir, check)}
+}
+
+// parseExecutiveDirectory reads an upload: JSON as ExecutiveDirectory, or CSV with a header row
+// naming the columns name, email and domain, several values in one cell separated by ";". A row
+// may carry just a domain.
+func parseExecutiveDirectory(r *http.Request, body io.Reader) (ExecutiveDirectory, error) {
+	var dir ExecutiveDirectory
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		cr := csv.NewReader(body)
+		cr.FieldsPerRecord = -1
+		cr.TrimLeadingSpace = true
+		records, err := cr.ReadAll()
+		if err != nil {
+			return dir, fmt.Errorf("invalid CSV: %w", err)
+		}
+		if len(records) == 0 {
+			return dir, errors.New("empty CSV")
+		}
+		cols := map[string]int{}
+		for i, h := range records[0] {
+			cols[strings.ToLower(strings.TrimSpace(h))] = i
+		}
+		cell := func(rec []string, col string) []string {
+			i, ok := cols[col]
+			if !ok || i >= len(rec) {
+				return nil
+			}
+			return splitCell(rec[i])
+		}
+		for _, rec := range records[1:] {
+			if names := cell(rec, "name"); len(names) > 0 {
+				dir.Executives = append(dir.Executives, Executive{Name: names[0], Emails: cell(rec, "email")})
+			}
+			dir.InternalDomains = append(dir.InternalDomains, cell(rec, "domain")...)
+		}
+	} else if err := json.NewDecoder(body).Decode(&dir); err != nil {
+		return dir, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	for i, e := range dir.Executives {
+		e.Name = strings.Join(strings.Fields(e.Name), " ")
+		if len(personNameTokens(e.Name)) < 2 {
+			return dir, fmt.Errorf("executive %q needs a first and a last name", e.Name)
+		}
+		for j, addr := range e.Emails {
+			parsed, err := mail.ParseAddress(addr)
+			if err != nil {
+				return dir, fmt.Errorf("executive %s: invalid email %q", e.Name, addr)
+			}
+			e.Emails[j] = strings.ToLower(parsed.Address)
+		}
+		dir.Executives[i] = e
+	}
+	seen := map[string]bool{}
+	domains := []string{}
+	for _, d := range dir.InternalDomains {
+		d = strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), ".")), "*.")
+		if !strings.Contains(d, ".") || strings.ContainsAny(d, "/@ ") {
+			return dir, fmt.Errorf("invalid domain %q", d)
+		}
+		if !seen[d] {
+			seen[d] = true
+			domains = append(domains, d)
+		}
+	}
+	dir.InternalDomains = domains
+	if dir.Executives == nil {
+		dir.Executives = []Executive{}
+	}
+	return dir, nil
+}
+
+// executivesHandler manages a profile's directory: GET returns it, PUT (or POST) replaces it,
+// DELETE removes it. The admin key picks the profile with ?profile= (none for emails analysed
+// without one); otherwise the X-API-Key must be bound to a profile, which is the one managed.
+func executivesHandler(w http.ResponseWriter, r *http.Request) {
+	if results == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "results store unavailable"})
+		return
+	}
+	var profile string
+	if isAdminRequest(r) {
+		profile = strings.TrimSpace(r.URL.Query().Get("profile"))
+		if _, ok := profiles[profile]; profile != "" && !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown profile %q", profile)})
+			return
+		}
+	} else if p := boundProfile(r); p != nil {
+		profile = p.Name
+	} else {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "needs the admin key or an API key bound to a profile"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		dir := ExecutiveDirectory{Profile: profile, Executives: []Executive{}, InternalDomains: []string{}}
+		if dirs := executiveDirectories.Load(); dirs != nil {
+			if d, ok := (*dirs)[profile]; ok {
+				dir = d
+			}
+		}
+		writeJSON(w, http.StatusOK, dir)
+	case http.MethodPut, http.MethodPost:
+		dir, err := parseExecutiveDirectory(r, http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		dir.Profile, dir.UpdatedAt = profile, time.Now().UTC()
+		raw, err := json.Marshal(dir)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if _, err := results.db.Exec(`INSERT OR REPLACE INTO executive_directories (profile, directory_json, updated_at) VALUES (?, ?, ?)`,
+			profile, string(raw), dir.UpdatedAt); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := reloadExecutiveDirectories(); err != nil {
+			slog.Error("reloading executive directories failed", "err", err)
+		}
+		writeJSON(w, http.StatusOK, dir)
+	case http.MethodDelete:
+		if _, err := results.db.Exec(`DELETE FROM executive_directories WHERE profile = ?`, profile); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := reloadExecutiveDirectories(); err != nil {
+			slog.Error("reloading executive directories failed", "err", err)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"deleted": profile})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
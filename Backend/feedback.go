@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users can tell the server a saved analysis got it wrong with POST /results/{id}/feedback. The
+// feedback is stored with the verdict and the points every check awarded, so GET /admin/feedback
+// gives what's needed to tune the weights. Once one API key has reported a sender as a false
+// positive FEEDBACK_SUPPRESS_AFTER times, that key's emails from the sender are no longer flagged:
+// finalScores carries "suppressed" and the verdict forwarded to the SIEM is "Looks Safe". The From
+// address is easy to spoof, so suppression only applies to emails that one of our own servers
+// (TRUSTED_AUTHSERV_IDS) reports as passing DMARC for the sender's domain, and reports from callers
+// without a key never count. Without TRUSTED_AUTHSERV_IDS nothing is suppressed.
+
+const (
+	feedbackFalsePositive = "false_positive" // flagged, but legitimate
+	feedbackFalseNegative = "false_negative" // passed, but malicious
+
+	maxFeedbackReason = 2000
+)
+
+// Feedback is one user's verdict on a saved analysis.
+type Feedback struct {
+	AnalysisID         string         `json:"analysisId"`
+	APIKey             string         `json:"apiKey"`
+	Kind               string         `json:"kind"`
+	Reason             string         `json:"reason"`
+	Sender             string         `json:"sender"`
+	Verdict            string         `json:"verdict"` // the verdict the analysis gave
+	NormalPercentage   float64        `json:"normalPercentage"`
+	RenderedPercentage float64        `json:"renderedPercentage"`
+	Features           map[string]int `json:"features"` // points awarded, by check event
+	CreatedAt          time.Time      `json:"createdAt"`
+}
+
+// FeedbackSuppression is the "suppressed" section of finalScores.
+type FeedbackSuppression struct {
+	Sender         string `json:"sender"`
+	FalsePositives int    `json:"falsePositives"` // reports against earlier analyses of the sender
+}
+
+// senderAddress is the From address as feedback is keyed: lower-cased, without the display name.
+func senderAddress(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return strings.ToLower(addr.Address)
+	}
+	return strings.ToLower(strings.TrimSpace(from))
+}
+
+// feedbackFeatures is the points each check of a saved analysis awarded.
+func feedbackFeatures(checks map[string]interface{}) map[string]int {
+	features := map[string]int{}
+	for name, payload := range checks {
+		if name == "iocs" || name == "attachedEmails" {
+			continue
+		}
+		// Saved checks are read back from JSON; live ones are converted the same way.
+		var generic interface{} = payload
+		if b, err := json.Marshal(payload); err == nil {
+			_ = json.Unmarshal(b, &generic)
+		}
+		if points, ok := sumScoreImpacts(generic); ok {
+			features[name] = points
+		}
+	}
+	return features
+}
+
+func (s *resultsStore) saveFeedback(f Feedback) error {
+	features, err := json.Marshal(f.Features)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO feedback (analysis_id, api_key, kind, reason, sender, verdict, normal_percentage, rendered_percentage, features_json, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		f.AnalysisID, f.APIKey, f.Kind, f.Reason, f.Sender, f.Verdict, f.NormalPercentage, f.RenderedPercentage, string(features), f.CreatedAt.UTC())
+	return err
+}
+
+// senderFalsePositives counts the analyses of sender that apiKey reported as false positives.
+func (s *resultsStore) senderFalsePositives(sender, apiKey string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(DISTINCT analysis_id) FROM feedback WHERE sender = ? AND api_key = ? AND kind = ?`,
+		sender, apiKey, feedbackFalsePositive).Scan(&n)
+	return n, err
+}
+
+// canSuppress reports whether apiKey's false-positive reports can suppress a sender.
+func canSuppress(apiKey string) bool {
+	return feedbackSuppressAfter > 0 && apiKey != "" && apiKey != "anonymous"
+}
+
+// listFeedback returns feedback, newest first; an empty kind lists both kinds.
+func (s *resultsStore) listFeedback(kind string, limit, offset int) ([]Feedback, error) {
+	query := `SELECT analysis_id, api_key, kind, reason, sender, verdict, normal_percentage, rendered_percentage, features_json, created_at FROM feedback`
+	args := []interface{}{}
+	if kind != "" {
+		query += ` WHERE kind = ?`
+		args = append(args, kind)
+	}
+	query += ` ORDER BY created_at DESC LIMIT ? OFFSET ?`
+	rows, err := s.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	list := []Feedback{}
+	for rows.Next() {
+		var f Feedback
+		var features sql.NullString
+		if err := rows.Scan(&f.AnalysisID, &f.APIKey, &f.Kind, &f.Reason, &f.Sender, &f.Verdict,
+			&f.NormalPercentage, &f.RenderedPercentage, &features, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		if features.Valid {
+			_ = json.Unmarshal([]byte(features.String), &f.Features)
+		}
+		list = append(list, f)
+	}
+	return list, rows.Err()
+}
+
+// feedbackSuppression reports whether a flagged email from this sender is to be let through
+// because of apiKey's earlier false-positive reports. It returns nil when it isn't, when scores
+// doesn't flag the email in the first place, or when the email doesn't pass DMARC for the From
+// domain (dmarcPass, from Email.DMARCPass) by an Authentication-Results header of one of
+// TRUSTED_AUTHSERV_IDS. Headers the sender can write never lead to suppression.
+func feedbackSuppression(from, apiKey, dmarcPass string, scores ScoreResult) *FeedbackSuppression {
+	if results == nil || len(trustedAuthservIDs) == 0 || !canSuppress(apiKey) || siemVerdict(scores) == "Looks Safe" {
+		return nil
+	}
+	sender := senderAddress(from)
+	_, domain, ok := strings.Cut(sender, "@")
+	if !ok || dmarcPass == "" || domain != dmarcPass {
+		return nil
+	}
+	n, err := results.senderFalsePositives(sender, apiKey)
+	if err != nil {
+		slog.Warn("counting false-positive reports failed", "sender", sender, "err", err)
+		return nil
+	}
+	if n < feedbackSuppressAfter {
+		return nil
+	}
+	return &FeedbackSuppression{Sender: sender, FalsePositives: n}
+}
+
+// feedbackHandler records the caller's feedback on one of their saved analyses. The body is
+// {"kind": "false_positive" | "false_negative", "reason": "..."}; kind defaults to false_positive.
+// Posting again replaces the caller's earlier feedback on the analysis.
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	rec, ok := loadResult(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Kind   string `json:"kind"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, `body must be JSON: {"kind": "false_positive|false_negative", "reason": "..."}`)
+		return
+	}
+	if body.Kind == "" {
+		body.Kind = feedbackFalsePositive
+	}
+	if body.Kind != feedbackFalsePositive && body.Kind != feedbackFalseNegative {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, `kind must be "false_positive" or "false_negative"`)
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "reason is required")
+		return
+	}
+	if len(body.Reason) > maxFeedbackReason {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("reason is longer than %d bytes", maxFeedbackReason))
+		return
+	}
+
+	f := Feedback{
+		AnalysisID:         rec.ID,
+		APIKey:             clientKeyID(r),
+		Kind:               body.Kind,
+		Reason:             body.Reason,
+		Sender:             senderAddress(rec.From),
+		Verdict:            siemVerdict(rec.Scores),
+		NormalPercentage:   rec.Scores.NormalPercentage,
+		RenderedPercentage: rec.Scores.RenderedPercentage,
+		Features:           feedbackFeatures(rec.Checks),
+		CreatedAt:          time.Now(),
+	}
+	if err := results.saveFeedback(f); err != nil {
+		slog.Error("saving feedback failed", "id", rec.ID, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "failed to save feedback")
+		return
+	}
+	slog.Info("feedback recorded", "analysis_id", rec.ID, "kind", f.Kind, "sender", f.Sender)
+	response := map[string]interface{}{"feedback": f}
+	if n, err := results.senderFalsePositives(f.Sender, f.APIKey); err == nil {
+		response["senderFalsePositives"] = n
+		response["senderSuppressed"] = canSuppress(f.APIKey) && n >= feedbackSuppressAfter
+	}
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// feedbackListHandler lists the stored feedback for weight tuning (?kind=, ?limit= default 100,
+// at most 1000, ?offset=).
+func feedbackListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if results == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "results store unavailable"})
+		return
+	}
+	limit, offset := 100, 0
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, 1000)
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && v > 0 {
+		offset = v
+	}
+	list, err := results.listFeedback(r.URL.Query().Get("kind"), limit, offset)
+	if err != nil {
+		slog.Error("listing feedback failed", "err", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list feedback"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"feedback": list, "limit": limit, "offset": offset})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// fileSignatures maps leading magic bytes to a coarse content type.
+var fileSignatures = []struct {
+	magic []byte
+	kind  string
+}{
+	{[]byte("MZ"), "pe"},
+	{[]byte("\x7fELF"), "elf"},
+	{[]byte{0xFE, 0xED, 0xFA, 0xCE}, "macho"},
+	{[]byte{0xFE, 0xED, 0xFA, 0xCF}, "macho"},
+	{[]byte{0xCE, 0xFA, 0xED, 0xFE}, "macho"},
+	{[]byte{0xCF, 0xFA, 0xED, 0xFE}, "macho"},
+	{[]byte{0xCA, 0xFE, 0xBA, 0xBE}, "macho"}, // universal binary
+	{[]byte("#!"), "script"},
+	{[]byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}, "ole"},
+	{[]byte("PK\x03\x04"), "zip"},
+	{[]byte("PK\x05\x06"), "zip"},
+	{[]byte("Rar!\x1a\x07"), "rar"},
+	{[]byte("7z\xbc\xaf\x27\x1c"), "7z"},
+	{[]byte{0x1f, 0x8b}, "gzip"},
+	{[]byte("%PDF-"), "pdf"},
+	{[]byte("\x89PNG\r\n\x1a\n"), "png"},
+	{[]byte{0xFF, 0xD8, 0xFF}, "jpeg"},
+	{[]byte("GIF8"), "gif"},
+	{[]byte("{\\rtf"), "rtf"},
+}
+
+// executableKinds are sniffed types that run code directly.
+var executableKinds = map[string]struct{}{"pe": {}, "elf": {}, "macho": {}, "script": {}}
+
+// containerKinds can smuggle executables or macros and are worth flagging when disguised.
+var containerKinds = map[string]struct{}{"ole": {}, "zip": {}, "rar": {}, "7z": {}, "gzip": {}}
+
+// expectedKinds lists the sniffed types a file extension is allowed to contain.
+var expectedKinds = map[string][]string{
+	".pdf":  {"pdf"},
+	".png":  {"png"},
+	".jpg":  {"jpeg"},
+	".jpeg": {"jpeg"},
+	".gif":  {"gif"},
+	".txt":  {""},
+	".csv":  {""},
+	".htm":  {""},
+	".html": {""},
+	".rtf":  {"rtf"},
+	".doc":  {"ole", "rtf"}, // Word happily opens RTF saved as .doc
+	".xls":  {"ole"},
+	".ppt":  {"ole"},
+	".msg":  {"ole"},
+	".msi":  {"ole"},
+	".docx": {"zip"}, ".docm": {"zip"}, ".xlsx": {"zip"}, ".xlsm": {"zip"},
+	".pptx": {"zip"}, ".pptm": {"zip"}, ".odt": {"zip"}, ".ods": {"zip"},
+	".zip": {"zip"}, ".jar": {"zip"}, ".apk": {"zip"},
+	".rar": {"rar"},
+	".7z":  {"7z"},
+	".gz":  {"gzip"}, ".tgz": {"gzip"},
+	".exe": {"pe"}, ".dll": {"pe"}, ".scr": {"pe"}, ".sys": {"pe"}, ".com": {"pe"},
+	".sh": {"script"}, ".py": {"script"}, ".pl": {"script"}, ".command": {"script"},
+}
+
+// sniffFileType returns the coarse type of content from its magic bytes, or "" when unknown.
+func sniffFileType(content []byte) string {
+	for _, sig := range fileSignatures {
+		if !bytes.HasPrefix(content, sig.magic) {
+			continue
+		}
+		if sig.kind == "pe" && !hasPEHeader(content) {
+			continue // plain text can start with "MZ" too
+		}
+		return sig.kind
+	}
+	return ""
+}
+
+// hasPEHeader checks that the DOS header's e_lfanew points at a "PE\0\0" signature.
+func hasPEHeader(content []byte) bool {
+	if len(content) < 64 {
+		return false
+	}
+	off := int(binary.LittleEndian.Uint32(content[60:64]))
+	return off > 0 && off+4 <= len(content) && string(content[off:off+4]) == "PE\x00\x00"
+}
+
+// kindsForContentType maps a declared MIME type to the sniffed types it may hold. It returns nil
+// for generic types such as application/octet-stream that promise nothing.
+func kindsForContentType(contentType string) []string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case mediaType == "application/pdf":
+		return []string{"pdf"}
+	case mediaType == "image/png":
+		return []string{"png"}
+	case mediaType == "image/jpeg", mediaType == "image/jpg":
+		return []string{"jpeg"}
+	case mediaType == "image/gif":
+		return []string{"gif"}
+	case strings.HasPrefix(mediaType, "text/"):
+		return []string{"", "rtf"}
+	case mediaType == "application/msword", mediaType == "application/vnd.ms-excel", mediaType == "application/vnd.ms-powerpoint":
+		return []string{"ole", "rtf"}
+	case strings.HasPrefix(mediaType, "application/vnd.openxmlformats-officedocument."):
+		return []string{"zip"}
+	}
+	return nil
+}
+
+// sniffMismatch compares the sniffed type of content with what its name and declared Content-Type
+// promise. It returns the sniffed type, whether it contradicts the declaration, and whether the
+// contradiction is dangerous (an executable or container disguised as something else).
+func sniffMismatch(name, contentType string, content []byte) (kind string, mismatch, dangerous bool) {
+	kind = sniffFileType(content)
+	contains := func(kinds []string) bool {
+		for _, k := range kinds {
+			if k == kind {
+				return true
+			}
+		}
+		return false
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	if kinds, ok := expectedKinds[ext]; ok && !contains(kinds) {
+		mismatch = true
+	}
+	if kinds := kindsForContentType(contentType); kinds != nil && !contains(kinds) {
+		mismatch = true
+	}
+	if _, exec := executableKinds[kind]; exec {
+		// Executable content is dangerous under any name that doesn't admit to being executable.
+		if kinds, ok := expectedKinds[ext]; !ok || !contains(kinds) {
+			mismatch, dangerous = true, true
+		}
+	}
+	if _, container := containerKinds[kind]; container && mismatch {
+		dangerous = true
+	}
+	return kind, mismatch, dangerous
+}
+
+// fileKindLabel renders a sniffed type for messages.
+func fileKindLabel(kind string) string {
+	switch kind {
+	case "pe":
+		return "a Windows executable"
+	case "elf":
+		return "a Linux executable"
+	case "macho":
+		return "a macOS executable"
+	case "script":
+		return "a script"
+	case "ole":
+		return "an Office/OLE document"
+	case "":
+		return "unrecognised data"
+	}
+	return "a " + strings.ToUpper(kind) + " file"
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/jaytaylor/html2text"
+	"github.com/jhillyerd/enmime"
+)
+
+// Users often forward a suspicious email to the checker instead of saving the .eml. The
+// forwarding wrapper then says little about the email (its sender is the user), so the
+// forwarded message is analysed in its place. Only a wrapper with a forward subject ("Fwd:",
+// "FW:", …) or sent by one of TRUSTED_FORWARDERS counts as a forward: a reply quoting the message
+// it answers, or a phishing email carrying an innocent one, is analysed as it is. The wrapper is
+// still run through the checks and reported in the forwardWrapper event.
+
+// ForwardInfo describes the wrapper a forwarded email was taken out of.
+type ForwardInfo struct {
+	Method       string `json:"method"` // "attachment" (message/rfc822) or "inline" (quoted in the body)
+	ForwardedBy  string `json:"forwardedBy"`
+	OuterSubject string `json:"outerSubject"`
+	// Inline forwards only keep the sender, subject, date, recipients and plain text of the
+	// original: headers such as Received and the HTML are lost.
+	HeadersOnlyQuoted bool `json:"headersOnlyQuoted,omitempty"`
+
+	wrapper []byte // the forwarding email itself, analysed after the forwarded one
+}
+
+// forwardSubject matches the subject prefixes mail clients add when forwarding.
+var forwardSubject = regexp.MustCompile(`(?i)^\s*(?:fwd?|fw|wg|tr|rv|enc)\s*:`)
+
+// forwardMarker matches the line mail clients put above an inline forwarded message: Gmail's
+// "---------- Forwarded message ---------", Outlook's "-----Original Message-----" or rule,
+// Apple Mail's "Begin forwarded message:" and their common translations.
+var forwardMarker = regexp.MustCompile(`(?im)^[ \t>]*(?:-{3,}\s*(?:forwarded message|original message|weitergeleitete nachricht|urspr[üu]ngliche nachricht|message transf[ée]r[ée]|message d'origine|mensaje reenviado|mensaje original|messaggio inoltrato)\s*-{3,}|begin forwarded message:|_{20,})[ \t]*$`)
+
+// forwardHeader matches one header line of an inline forwarded message.
+var forwardHeader = regexp.MustCompile(`(?i)^[ \t>]*\**(from|von|de|da|date|sent|datum|gesendet|envoyé|enviado|inviato|subject|betreff|objet|asunto|oggetto|to|an|à|para|a|cc)\**\s*:\s*(.*)$`)
+
+// forwardHeaderNames maps the header names of forwardHeader to the ones written to the
+// rebuilt message.
+var forwardHeaderNames = map[string]string{
+	"from": "From", "von": "From", "de": "From", "da": "From",
+	"date": "Date", "sent": "Date", "datum": "Date", "gesendet": "Date", "envoyé": "Date", "enviado": "Date", "inviato": "Date",
+	"subject": "Subject", "betreff": "Subject", "objet": "Subject", "asunto": "Subject", "oggetto": "Subject",
+	"to": "To", "an": "To", "à": "To", "para": "To", "a": "To",
+	"cc": "Cc",
+}
+
+// outlookMailto matches Outlook's quoted form of an address, "Name [mailto:addr]".
+var outlookMailto = regexp.MustCompile(`(?i)\[mailto:([^\]]+)\]`)
+
+// trustedForwarder reports whether from is one of TRUSTED_FORWARDERS, given as addresses or
+// domains (e.g. the mailbox users report phishing to).
+func trustedForwarder(from string) bool {
+	sender := senderAddress(from)
+	if sender == "" {
+		return false
+	}
+	_, domain, _ := strings.Cut(sender, "@")
+	for _, t := range trustedForwarders {
+		t = strings.ToLower(t)
+		if t == sender || t == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// unwrapForwarded returns the forwarded message inside eml and how it was found, or nil when
+// eml isn't a forward.
+func unwrapForwarded(eml []byte) ([]byte, *ForwardInfo) {
+	env, err := enmime.ReadEnvelope(bytes.NewReader(eml))
+	if err != nil {
+		return nil, nil
+	}
+	info := &ForwardInfo{ForwardedBy: env.GetHeader("From"), OuterSubject: env.GetHeader("Subject")}
+	if !forwardSubject.MatchString(info.OuterSubject) && !trustedForwarder(info.ForwardedBy) {
+		return nil, nil
+	}
+
+	var attached [][]byte
+	for _, p := range append(append(env.Attachments, env.Inlines...), env.OtherParts...) {
+		if strings.EqualFold(p.ContentType, "message/rfc822") && len(p.Content) > 0 {
+			attached = append(attached, p.Content)
+		}
+	}
+	if len(attached) == 1 {
+		info.Method, info.wrapper = "attachment", eml
+		return attached[0], info
+	}
+
+	text := env.Text
+	if strings.TrimSpace(text) == "" && env.HTML != "" {
+		text, _ = html2text.FromString(env.HTML, html2text.Options{OmitLinks: true})
+	}
+	if inner := inlineForward(text); inner != nil {
+		info.Method, info.wrapper = "inline", eml
+		info.HeadersOnlyQuoted = true
+		return inner, info
+	}
+	return nil, nil
+}
+
+// inlineForward rebuilds the message quoted below the first forward marker in text, or returns
+// nil when there is none or it has no From line.
+func inlineForward(text string) []byte {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	loc := forwardMarker.FindStringIndex(text)
+	if loc == nil {
+		return nil
+	}
+	lines := strings.Split(text[loc[1]:], "\n")
+	headers := map[string]string{}
+	var order []string
+	i := 0
+	for ; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			if len(headers) == 0 {
+				continue // blank lines between the marker and the headers
+			}
+			break
+		}
+		m := forwardHeader.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		name := forwardHeaderNames[strings.ToLower(m[1])]
+		if _, dup := headers[name]; !dup {
+			order = append(order, name)
+		}
+		headers[name] = strings.TrimSpace(outlookMailto.ReplaceAllString(m[2], "<$1>"))
+	}
+	if headers["From"] == "" {
+		return nil
+	}
+	if _, err := mail.ParseAddress(headers["From"]); err != nil && strings.Contains(headers["From"], "@") {
+		// e.g. "PayPal service@paypal.com" without brackets
+		if f := strings.Fields(headers["From"]); len(f) > 1 {
+			headers["From"] = strings.Join(f[:len(f)-1], " ") + " <" + strings.Trim(f[len(f)-1], "<>") + ">"
+		}
+	}
+	body := strings.TrimSpace(strings.Join(lines[i:], "\n"))
+
+	var b strings.Builder
+	for _, name := range order {
+		value := mime.QEncoding.Encode("utf-8", headers[name])
+		if addrs, err := mail.ParseAddressList(headers[name]); err == nil && name != "Subject" && name != "Date" {
+			quoted := make([]string, len(addrs))
+			for j, a := range addrs {
+				quoted[j] = a.String() // encodes only the display name
+			}
+			value = strings.Join(quoted, ", ")
+		}
+		b.WriteString(name + ": " + value + "\r\n")
+	}
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// AICallStats describes how a Gemini request was eventually satisfied (or why it wasn't).
+type AICallStats struct {
+	Model        string `json:"model"`
+	Attempts     int    `json:"attempts"`
+	Retries      int    `json:"retries"`
+	UsedFallback bool   `json:"usedFallback"`
+	CacheHit     bool   `json:"cacheHit"`
+
+	PromptTokens     int64   `json:"promptTokens"`
+	OutputTokens     int64   `json:"outputTokens"`
+	TotalTokens      int64   `json:"totalTokens"`
+	EstimatedCostUSD float64 `json:"estimatedCostUsd"`
+}
+
+// UsageReport is streamed as the "usage" event once all AI-backed checks have finished.
+type UsageReport struct {
+	AnalysisID       string                 `json:"analysisId"`
+	Calls            map[string]AICallStats `json:"calls"`
+	PromptTokens     int64                  `json:"promptTokens"`
+	OutputTokens     int64                  `json:"outputTokens"`
+	TotalTokens      int64                  `json:"totalTokens"`
+	EstimatedCostUSD float64                `json:"estimatedCostUsd"`
+}
+
+// modelPricing lists USD prices per million input and output tokens, matched by longest model-name prefix.
+// AI_PRICE_INPUT_PER_MTOK / AI_PRICE_OUTPUT_PER_MTOK override these for every model.
+var modelPricing = map[string][2]float64{
+	"gemini-2.5-pro":        {1.25, 10.00},
+	"gemini-2.5-flash-lite": {0.10, 0.40},
+	"gemini-2.5-flash":      {0.30, 2.50},
+	"gemini-2.0-flash-lite": {0.075, 0.30},
+	"gemini-2.0-flash":      {0.10, 0.40},
+	"gemini-1.5-pro":        {1.25, 5.00},
+	"gemini-1.5-flash":      {0.075, 0.30},
+}
+
+// estimateCost returns the approximate USD cost of a call given its token counts.
+func estimateCost(model string, promptTokens, outputTokens int64) float64 {
+	var price [2]float64
+	matched := ""
+	for prefix, p := range modelPricing {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(matched) {
+			matched, price = prefix, p
+		}
+	}
+	if aiPriceInputPerMTok > 0 {
+		price[0] = aiPriceInputPerMTok
+	}
+	if aiPriceOutputPerMTok > 0 {
+		price[1] = aiPriceOutputPerMTok
+	}
+	return (float64(promptTokens)*price[0] + float64(outputTokens)*price[1]) / 1_000_000
+}
+
+// recordTokenUsage copies the response's token counts into stats and prices them.
+func recordTokenUsage(stats *AICallStats, res *genai.GenerateContentResponse) {
+	if res == nil || res.UsageMetadata == nil {
+		return
+	}
+	u := res.UsageMetadata
+	stats.PromptTokens = int64(u.PromptTokenCount)
+	stats.OutputTokens = int64(u.CandidatesTokenCount) + int64(u.ThoughtsTokenCount)
+	stats.TotalTokens = int64(u.TotalTokenCount)
+	stats.EstimatedCostUSD = estimateCost(stats.Model, stats.PromptTokens, stats.OutputTokens)
+}
+
+// summariseUsage totals the AI stats of every content analysis that ran for one request.
+func summariseUsage(analysisID string, data map[string]interface{}) UsageReport {
+	report := UsageReport{AnalysisID: analysisID, Calls: map[string]AICallStats{}}
+	add := func(name string, stats AICallStats) {
+		if stats.Model == "" {
+			return
+		}
+		report.Calls[name] = stats
+		report.PromptTokens += stats.PromptTokens
+		report.OutputTokens += stats.OutputTokens
+		report.TotalTokens += stats.TotalTokens
+		report.EstimatedCostUSD += stats.EstimatedCostUSD
+	}
+	for _, name := range []string{"textAnalysis", "renderedAnalysis"} {
+		if d, ok := data[name].(ContentAnalysisResult); ok {
+			add(name, d.AIStats)
+			if d.VisualImpersonation != nil {
+				add("visualImpersonation", d.VisualImpersonation.AIStats)
+			}
+		}
+	}
+	if d, ok := data["htmlAttachmentAnalysis"].(HTMLAttachmentAnalysisResult); ok {
+		for _, a := range d.Attachments {
+			add("htmlAttachment:"+a.FileName, a.AIStats)
+		}
+	}
+	return report
+}
+
+type aiCacheEntry struct {
+	analysis EmailAnalysis
+	model    string
+	expires  time.Time
+}
+
+// aiResponseCache holds recent EmailAnalysis results keyed by a hash of everything sent to
+// Gemini, so re-renders and resubmissions of the same email don't pay for a second call.
+var aiResponseCache = struct {
+	sync.Mutex
+	entries map[string]aiCacheEntry
+}{entries: make(map[string]aiCacheEntry)}
+
+// aiCacheKey hashes the analysis mode together with every text and inline-image part of the request.
+func aiCacheKey(mode string, contents []*genai.Content) string {
+	h := sha256.New()
+	h.Write([]byte(mode))
+	for _, c := range contents {
+		for _, p := range c.Parts {
+			if p == nil {
+				continue
+			}
+			h.Write([]byte{0})
+			h.Write([]byte(p.Text))
+			if p.InlineData != nil {
+				h.Write([]byte(p.InlineData.MIMEType))
+				h.Write(p.InlineData.Data)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedAnalysis returns a previously stored analysis for key, if it hasn't expired.
+func cachedAnalysis(key string) (EmailAnalysis, AICallStats, bool) {
+	if aiCacheTTL <= 0 {
+		return EmailAnalysis{}, AICallStats{}, false
+	}
+	aiResponseCache.Lock()
+	defer aiResponseCache.Unlock()
+	entry, ok := aiResponseCache.entries[key]
+	if !ok {
+		return EmailAnalysis{}, AICallStats{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(aiResponseCache.entries, key)
+		return EmailAnalysis{}, AICallStats{}, false
+	}
+	return entry.analysis, AICallStats{Model: entry.model, CacheHit: true}, true
+}
+
+// storeAnalysis caches an analysis, evicting expired entries (and then the oldest) when full.
+func storeAnalysis(key string, analysis EmailAnalysis, model string) {
+	if aiCacheTTL <= 0 || aiCacheMaxEntries <= 0 {
+		return
+	}
+	aiResponseCache.Lock()
+	defer aiResponseCache.Unlock()
+	if len(aiResponseCache.entries) >= aiCacheMaxEntries {
+		now := time.Now()
+		var oldestKey string
+		var oldest time.Time
+		for k, e := range aiResponseCache.entries {
+			if now.After(e.expires) {
+				delete(aiResponseCache.entries, k)
+				continue
+			}
+			if oldestKey == "" || e.expires.Before(oldest) {
+				oldestKey, oldest = k, e.expires
+			}
+		}
+		if len(aiResponseCache.entries) >= aiCacheMaxEntries && oldestKey != "" {
+			delete(aiResponseCache.entries, oldestKey)
+		}
+	}
+	aiResponseCache.entries[key] = aiCacheEntry{analysis: analysis, model: model, expires: time.Now().Add(aiCacheTTL)}
+}
+
+// retryableStatusCodes are the HTTP codes Gemini returns for transient failures.
+var retryableStatusCodes = map[int]struct{}{
+	429: {}, 500: {}, 502: {}, 503: {}, 504: {},
+}
+
+// isRetryableAIError reports whether err looks transient and worth retrying on the same model.
+func isRetryableAIError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		_, ok := retryableStatusCodes[apiErr.Code]
+		return ok
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// generateWithRetry calls Gemini with exponential backoff on transient errors. If the primary
+// model keeps failing, the fallback model is tried before giving up. The whole exchange is
+// bounded by aiTimeout.
+func generateWithRetry(ctx context.Context, client *genai.Client, model, fallback string, contents []*genai.Content, cfg *genai.GenerateContentConfig) (*genai.GenerateContentResponse, AICallStats, error) {
+	var stats AICallStats
+	defer trackDependency(ctx, "gemini", time.Now())
+	ctx, cancel := context.WithTimeout(ctx, aiTimeout)
+	defer cancel()
+
+	models := []string{model}
+	if fallback != "" && fallback != model {
+		models = append(models, fallback)
+	}
+
+	var lastErr error
+	for i, model := range models {
+		backoff := aiInitialBackoff
+		for attempt := 0; attempt <= aiMaxRetries; attempt++ {
+			stats.Attempts++
+			stats.Retries = stats.Attempts - 1
+			stats.Model = model
+			stats.UsedFallback = i > 0
+
+			res, err := client.Models.GenerateContent(ctx, model, contents, cfg)
+			if err == nil {
+				recordTokenUsage(&stats, res)
+				return res, stats, nil
+			}
+			lastErr = err
+			if !isRetryableAIError(err) || attempt == aiMaxRetries {
+				break
+			}
+			slog.WarnContext(ctx, "Gemini call failed, retrying", "model", model, "attempt", attempt+1, "backoff", backoff, "err", err)
+			select {
+			case <-ctx.Done():
+				return nil, stats, fmt.Errorf("gemini deadline exceeded after %d attempts: %w", stats.Attempts, lastErr)
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if i+1 < len(models) {
+			slog.WarnContext(ctx, "Gemini model gave up, falling back", "model", model, "fallback", models[i+1], "err", lastErr)
+		}
+	}
+	return nil, stats, fmt.Errorf("gemini request failed after %d attempts: %w", stats.Attempts, lastErr)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// With GEOIP_DB (a MaxMind GeoLite2/GeoIP2 Country or City database) and optionally GEOIP_ASN_DB
+// (GeoLite2-ASN), the sending IP and the IPs hosting the email's links are looked up locally:
+// their country and autonomous system are added to senderIPAnalysis and urlAnalysis and to the
+// iocs event. When the sender's domain is under a country-code TLD, an IP in another country is
+// flagged as a geographic mismatch: a ".de" bank doesn't usually send from, or host its login
+// page in, another country. Mismatches are informational and don't change the score, since mail
+// and web hosting in a global cloud are common for legitimate senders too.
+
+// GeoInfo is where an IP is, according to the local databases.
+type GeoInfo struct {
+	IP      string `json:"ip"`
+	Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"asOrg,omitempty"`
+}
+
+// String formats the location for messages, e.g. "DE, AS3320 Deutsche Telekom AG".
+func (g GeoInfo) String() string {
+	parts := []string{}
+	if g.Country != "" {
+		parts = append(parts, g.Country)
+	}
+	if g.ASN != 0 {
+		parts = append(parts, strings.TrimSpace(fmt.Sprintf("AS%d %s", g.ASN, g.ASOrg)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// HostGeo is the location of one link host.
+type HostGeo struct {
+	Host string `json:"host"`
+	GeoInfo
+	Mismatch bool `json:"mismatch,omitempty"` // in another country than the sender domain's TLD
+}
+
+// maxGeoHosts caps how many link hosts are resolved and located per email.
+const maxGeoHosts = 20
+
+var (
+	geoCountryDB *geoip2.Reader
+	geoASNDB     *geoip2.Reader
+)
+
+// geoIPEnabled reports whether a country database is loaded.
+func geoIPEnabled() bool {
+	return geoCountryDB != nil
+}
+
+// openGeoIP opens the configured databases; a database that can't be opened is left out.
+func openGeoIP() {
+	if geoIPDBPath != "" {
+		if db, err := geoip2.Open(geoIPDBPath); err != nil {
+			slog.Warn("GeoIP database unavailable", "path", geoIPDBPath, "err", err)
+		} else {
+			geoCountryDB = db
+		}
+	}
+	if geoIPASNDBPath != "" {
+		if db, err := geoip2.Open(geoIPASNDBPath); err != nil {
+			slog.Warn("GeoIP ASN database unavailable", "path", geoIPASNDBPath, "err", err)
+		} else {
+			geoASNDB = db
+		}
+	}
+}
+
+// lookupGeo locates ip, or returns nil when there's no database or it knows nothing of the IP.
+func lookupGeo(ip net.IP) *GeoInfo {
+	if ip == nil || geoCountryDB == nil {
+		return nil
+	}
+	info := GeoInfo{IP: ip.String()}
+	// A City database answers Country lookups as well.
+	if c, err := geoCountryDB.Country(ip); err == nil {
+		info.Country = c.Country.IsoCode
+	}
+	if geoASNDB != nil {
+		if a, err := geoASNDB.ASN(ip); err == nil {
+			info.ASN, info.ASOrg = a.AutonomousSystemNumber, a.AutonomousSystemOrganization
+		}
+	}
+	if info.Country == "" && info.ASN == 0 {
+		return nil
+	}
+	return &info
+}
+
+// genericCCTLDs are country-code TLDs marketed to everyone, which say nothing about where the
+// organisation is.
+var genericCCTLDs = map[string]bool{
+	"ai": true, "cc": true, "co": true, "fm": true, "gg": true, "io": true, "ly": true, "me": true,
+	"nu": true, "sh": true, "tk": true, "to": true, "tv": true, "ws": true,
+}
+
+// claimedCountry is the country a sender domain's TLD names, e.g. "DE" for example.de and "GB"
+// for example.co.uk, or "" for generic TLDs.
+func claimedCountry(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	tld := domain[strings.LastIndex(domain, ".")+1:]
+	if len(tld) != 2 || genericCCTLDs[tld] || tld == "eu" {
+		return ""
+	}
+	if tld == "uk" {
+		return "GB"
+	}
+	return strings.ToUpper(tld)
+}
+
+// geoMismatch reports whether g lies outside the country the sender domain claims.
+func geoMismatch(g *GeoInfo, claimed string) bool {
+	return g != nil && claimed != "" && g.Country != "" && g.Country != claimed
+}
+
+// locateLinkHosts resolves the hosts of urls and locates the first address of each, flagging
+// those outside the claimed country.
+func locateLinkHosts(ctx context.Context, urls []string, claimed string) []HostGeo {
+	if !geoIPEnabled() {
+		return nil
+	}
+	hosts := map[string]struct{}{}
+	for _, raw := range urls {
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" && len(hosts) < maxGeoHosts {
+			hosts[strings.ToLower(u.Hostname())] = struct{}{}
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		located = []HostGeo{}
+	)
+	for host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			ip := net.ParseIP(host)
+			if ip == nil {
+				addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+				if err != nil || len(addrs) == 0 {
+					return
+				}
+				ip = addrs[0]
+			}
+			g := lookupGeo(ip)
+			if g == nil {
+				return
+			}
+			mu.Lock()
+			located = append(located, HostGeo{Host: host, GeoInfo: *g, Mismatch: geoMismatch(g, claimed)})
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	sort.Slice(located, func(i, j int) bool { return located[i].Host < located[j].Host })
+	return located
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DependencyCheck is the state of one thing the analyser needs. A failed critical dependency
+// makes the service unready; a failed non-critical one only degrades some checks.
+type DependencyCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Critical bool   `json:"critical"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// companyDBPath is the SQLite company database; COMPANY_DB_DSN overrides it when
+// COMPANY_DB_DRIVER is sqlite.
+var companyDBPath = "wikidata_websites4.db"
+
+// chromeNames are the executables chromedp can drive, in PATH or at their usual install paths.
+var chromeNames = []string{
+	"google-chrome", "google-chrome-stable", "chromium", "chromium-browser", "msedge", "chrome.exe", "msedge.exe",
+	"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+	`C:\Program Files\Google\Chrome\Application\chrome.exe`,
+}
+
+// checkCompanyDB runs a trivial query on the company database, so a missing, empty or corrupt
+// database is caught rather than only an unreachable one.
+func checkCompanyDB(ctx context.Context) error {
+	store := companyStore()
+	if store == nil {
+		if err := reopenCompanyStore(); err != nil {
+			return err
+		}
+		store = companyStore()
+	}
+	if companyDBDriver == "sqlite" {
+		if _, err := os.Stat(companyDBPath); err != nil {
+			return err
+		}
+	}
+	return store.Ping(ctx)
+}
+
+// companyDBName describes the company database for health reports, without the DSN's password.
+func companyDBName() string {
+	if companyDBDriver == "sqlite" {
+		return companyDBPath
+	}
+	return companyDBDriver
+}
+
+// dependencyChecks inspects the databases, external binaries, API keys and prompt the analysis
+// pipeline relies on.
+func dependencyChecks(ctx context.Context) []DependencyCheck {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var checks []DependencyCheck
+	add := func(name string, critical bool, err error) {
+		c := DependencyCheck{Name: name, OK: err == nil, Critical: critical}
+		if err != nil {
+			c.Detail = err.Error()
+		}
+		checks = append(checks, c)
+	}
+
+	add("company database ("+companyDBName()+")", true, checkCompanyDB(ctx))
+	if results == nil {
+		add("results database", false, fmt.Errorf("not open; analyses are not persisted"))
+	} else {
+		add("results database", false, results.db.PingContext(ctx))
+	}
+
+	binaries := []struct {
+		name     string
+		names    []string
+		critical bool
+	}{
+		// Only image-heavy emails are OCRed unless RENDERED_TEXT_SOURCE=ocr.
+		{"Tesseract OCR", []string{"tesseract", "tesseract.exe"}, usesTesseractCLI() && renderedTextSource == renderedTextOCR},
+		{"ImageMagick (fallback image conversion)", []string{"magick", "magick.exe"}, false},
+		{"Chromium-based browser", chromeNames, false},
+	}
+	for _, bin := range binaries {
+		var err error
+		if !commandExists(bin.names...) {
+			err = fmt.Errorf("not found (tried %s)", strings.Join(bin.names, ", "))
+		}
+		add(bin.name, bin.critical, err)
+	}
+	if yaraEnabled() {
+		var err error
+		if yaraLibScan != nil {
+			// Scanning nothing still compiles the rules, so broken ones show up here.
+			var rules []string
+			if rules, err = yaraRuleFiles(yaraRulesDir); err == nil {
+				_, err = yaraLibScan(ctx, rules, nil)
+			}
+		} else if !commandExists(yaraCommand) {
+			err = fmt.Errorf("%s not found (YARA_RULES_DIR is set)", yaraCommand)
+		}
+		add("YARA", true, err)
+	}
+	if clamdEnabled() {
+		add("ClamAV ("+clamdAddress+")", true, pingClamd(ctx))
+	}
+	if spamdAddress != "" {
+		add("SpamAssassin ("+spamdAddress+")", true, pingSpamd(ctx))
+	}
+	if rspamdURL != "" {
+		add("Rspamd ("+rspamdURL+")", true, pingRspamd(ctx))
+	}
+
+	// Keys are only required for the integrations that are switched on.
+	keys := []struct {
+		value   string
+		name    string
+		reason  string
+		enabled bool
+	}{
+		{geminiKey, "GEMINI_API_KEY", "Gemini content analysis", geminiEnabled},
+		{googleSearchAPIKey, "GOOGLE_SEARCH_API_KEY", "Google Custom Search", googleSearchEnabled},
+		{googleSearchCX, "GOOGLE_SEARCH_CX", "Google Custom Search CX", googleSearchEnabled},
+		{VTotalAPIKey, "VTotal_API_KEY", "VirusTotal URL scanning (URLSCAN_ENABLED is TRUE)", isURLScanEnabled && urlScannerSelected("virustotal")},
+		{URLScanAPIKey, "URLSCAN_API_KEY", "urlscan.io scanning (URL_SCANNERS names urlscan)", isURLScanEnabled && urlScannerSelected("urlscan")},
+		{cloudflareAccountID, "CLOUDFLARE_ACCOUNT_ID", "Cloudflare URL scanning (URL_SCANNERS names radar)", isURLScanEnabled && urlScannerSelected("radar")},
+		{cloudflareAPIToken, "CLOUDFLARE_API_TOKEN", "Cloudflare URL scanning (URL_SCANNERS names radar)", isURLScanEnabled && urlScannerSelected("radar")},
+		{googleVisionAPIKey, "GOOGLE_VISION_API_KEY", "Google Vision OCR (OCR_ENGINE is vision)", ocrEngineName == "vision"},
+	}
+	for _, k := range keys {
+		if !k.enabled {
+			continue
+		}
+		var err error
+		if strings.TrimSpace(k.value) == "" {
+			err = fmt.Errorf("environment variable %s is not set (%s)", k.name, k.reason)
+		}
+		add(k.name, true, err)
+	}
+
+	var promptErr error
+	if strings.TrimSpace(mainPrompt) == "" {
+		if _, err := os.Stat(filepath.Join(promptDir, promptTemplate+".tmpl")); err != nil {
+			promptErr = fmt.Errorf("MAIN_PROMPT is not set and no %s.tmpl template exists in %s", promptTemplate, promptDir)
+		}
+	}
+	add("AI prompt", true, promptErr)
+	return checks
+}
+
+// healthzHandler is the liveness probe: the process is up and serving HTTP.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler is the readiness probe. It answers 503 while any critical dependency is
+// missing, and reports "degraded" when only optional ones are.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := dependencyChecks(r.Context())
+	status, code := "ready", http.StatusOK
+	for _, c := range checks {
+		switch {
+		case !c.OK && c.Critical:
+			status, code = "unready", http.StatusServiceUnavailable
+		case !c.OK && status == "ready":
+			status = "degraded"
+		}
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Text that a reader can't see but spam filters and language models read is a common way to
+// smuggle a phishing email past them: benign words in white on white, at font-size 0, in a
+// display:none block or squeezed together with negative letter-spacing, or zero-width
+// characters splitting "PayPal" so that keyword filters don't recognise it. The system prompt
+// tells Gemini to ignore such tricks; this check measures them. It walks the HTML body working
+// out each text's inherited inline style, and an email that hides none earns the HiddenContent
+// points. Preheaders (a short display:none preview line) are common in legitimate mail, so
+// blocks hidden from layout only count from hiddenBlockMinChars characters.
+
+const (
+	hiddenNone       = ""
+	hiddenLayout     = "hiddenBlock"   // display:none, visibility:hidden, opacity:0, collapsed boxes
+	hiddenTinyFont   = "tinyFont"      // font-size of 1px or less
+	hiddenSameColour = "sameColour"    // text colour (almost) the background colour
+	hiddenSpacing    = "letterSpacing" // letters squeezed together or spread apart
+	hiddenOffscreen  = "offscreen"     // pushed off the page with text-indent or positioning
+	hiddenZeroWidth  = "zeroWidth"     // zero-width characters inside words
+)
+
+// hiddenTechniques are the techniques in the order they are reported.
+var hiddenTechniques = []string{hiddenLayout, hiddenTinyFont, hiddenSameColour, hiddenSpacing, hiddenOffscreen, hiddenZeroWidth}
+
+const (
+	hiddenBlockMinChars = 200
+	zeroWidthMin        = 5
+	// hiddenMinLetters is how many letters a text needs for its hiding to count, so that
+	// spacer characters and &nbsp; don't.
+	hiddenMinLetters = 3
+	maxHiddenSamples = 10
+	// colourTolerance is how far apart (per channel, 0-255) text and background may be and
+	// still count as the same colour.
+	colourTolerance = 24
+)
+
+// HiddenTextSample is a piece of hidden text.
+type HiddenTextSample struct {
+	Technique string `json:"technique"`
+	Text      string `json:"text"`
+}
+
+// HiddenContentResult is the hiddenContentAnalysis event.
+type HiddenContentResult struct {
+	Hidden      bool               `json:"hidden"`
+	Techniques  map[string]int     `json:"techniques"` // characters hidden by each technique
+	ZeroWidth   int                `json:"zeroWidth"`  // zero-width characters inside words
+	Samples     []HiddenTextSample `json:"samples"`
+	Message     string             `json:"message"`
+	ScoreImpact int                `json:"scoreImpact"`
+}
+
+// zeroWidthChars are invisible characters that can split a word without changing how it looks.
+var zeroWidthChars = map[rune]bool{
+	'\u200b': true, '\u200c': true, '\u200d': true, '\u2060': true, '\ufeff': true, '\u00ad': true, '\u034f': true, '\u180e': true,
+}
+
+// countZeroWidth counts the zero-width characters that sit between two letters. Padding such as
+// the &zwnj;&nbsp; runs after preheaders, and joiners in emoji, aren't between letters.
+func countZeroWidth(s string) int {
+	runes := []rune(s)
+	n := 0
+	for i, r := range runes {
+		if !zeroWidthChars[r] {
+			continue
+		}
+		before, after := i-1, i+1
+		for before >= 0 && zeroWidthChars[runes[before]] {
+			before--
+		}
+		for after < len(runes) && zeroWidthChars[runes[after]] {
+			after++
+		}
+		if before >= 0 && after < len(runes) && unicode.IsLetter(runes[before]) && unicode.IsLetter(runes[after]) {
+			n++
+		}
+	}
+	return n
+}
+
+// textStyle is the inherited style a text is shown with.
+type textStyle struct {
+	hidden    string    // hiddenLayout or hiddenOffscreen when an ancestor hides its content
+	fontSize  float64   // px
+	colour    [3]uint8  // text colour
+	bg        *[3]uint8 // background colour; nil when it is an image or unknown
+	spacing   float64   // letter-spacing, px
+	hasColour bool
+}
+
+var rootTextStyle = textStyle{fontSize: 16, colour: [3]uint8{0, 0, 0}, bg: &[3]uint8{255, 255, 255}, hasColour: true}
+
+// parseStyle splits an inline style into lower-case property/value pairs.
+func parseStyle(style string) map[string]string {
+	props := map[string]string{}
+	for _, decl := range strings.Split(style, ";") {
+		name, value, ok := strings.Cut(decl, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(strings.ToLower(value)), "!important"))
+		props[strings.TrimSpace(strings.ToLower(name))] = value
+	}
+	return props
+}
+
+var cssLength = regexp.MustCompile(`^(-?[0-9]*\.?[0-9]+)(px|pt|em|rem|%)?$`)
+
+// parseLength converts a CSS length to px; em and % are relative to parent.
+func parseLength(v string, parent float64) (float64, bool) {
+	m := cssLength.FindStringSubmatch(strings.TrimSpace(v))
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	switch m[2] {
+	case "pt":
+		return n * 4 / 3, true
+	case "em":
+		return n * parent, true
+	case "rem":
+		return n * 16, true
+	case "%":
+		return n * parent / 100, true
+	case "":
+		return n, n == 0 // unitless lengths are only valid as 0
+	}
+	return n, true
+}
+
+var namedColours = map[string][3]uint8{
+	"white": {255, 255, 255}, "black": {0, 0, 0}, "red": {255, 0, 0}, "green": {0, 128, 0}, "blue": {0, 0, 255},
+	"yellow": {255, 255, 0}, "gray": {128, 128, 128}, "grey": {128, 128, 128}, "silver": {192, 192, 192},
+	"whitesmoke": {245, 245, 245}, "snow": {255, 250, 250}, "ivory": {255, 255, 240}, "navy": {0, 0, 128},
+}
+
+var rgbColour = regexp.MustCompile(`^rgba?\(\s*(\d+)[\s,]+(\d+)[\s,]+(\d+)\s*(?:[,/]\s*([0-9.]+%?))?\s*\)$`)
+
+// parseColour reads a CSS or HTML colour. transparent reports ok with a nil colour.
+func parseColour(v string) (*[3]uint8, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "transparent" {
+		return nil, true
+	}
+	if c, ok := namedColours[v]; ok {
+		return &c, true
+	}
+	if m := rgbColour.FindStringSubmatch(v); m != nil {
+		var c [3]uint8
+		for i := range 3 {
+			n, _ := strconv.Atoi(m[i+1])
+			c[i] = uint8(min(n, 255))
+		}
+		if alpha := m[4]; alpha != "" {
+			if a, err := strconv.ParseFloat(strings.TrimSuffix(alpha, "%"), 64); err == nil && (a == 0) {
+				return nil, true
+			}
+		}
+		return &c, true
+	}
+	hex := strings.TrimPrefix(v, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return nil, false
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, false
+	}
+	return &[3]uint8{uint8(n >> 16), uint8(n >> 8), uint8(n)}, true
+}
+
+// sameColour reports whether two colours are indistinguishable to a reader.
+func sameColour(a, b [3]uint8) bool {
+	for i := range 3 {
+		if math.Abs(float64(a[i])-float64(b[i])) > colourTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// childStyle applies an element's attributes and inline style to the style it inherits. With
+// stylesheets, a class may set the background, so under a class it is unknown unless an inline
+// style sets it.
+func childStyle(n *html.Node, s textStyle, stylesheets bool) textStyle {
+	if stylesheets && hasAttr(n, "class") {
+		s.bg = nil
+	}
+	props := map[string]string{}
+	imageBackground := false
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "style":
+			props = parseStyle(a.Val)
+		case "hidden":
+			s.hidden = hiddenLayout
+		case "background":
+			imageBackground = strings.TrimSpace(a.Val) != ""
+		case "bgcolor":
+			if c, ok := parseColour(a.Val); ok && c != nil {
+				s.bg = c
+			}
+		case "color":
+			if n.Data == "font" {
+				if c, ok := parseColour(a.Val); ok && c != nil {
+					s.colour, s.hasColour = *c, true
+				}
+			}
+		}
+	}
+	if v := props["display"]; v == "none" {
+		s.hidden = hiddenLayout
+	}
+	if v := props["visibility"]; v == "hidden" || v == "collapse" {
+		s.hidden = hiddenLayout
+	}
+	if v, err := strconv.ParseFloat(props["opacity"], 64); err == nil && v <= 0.05 {
+		s.hidden = hiddenLayout
+	}
+	if overflow := props["overflow"]; overflow == "hidden" {
+		for _, p := range []string{"max-height", "height", "max-width", "width"} {
+			if v, ok := parseLength(props[p], s.fontSize); ok && v <= 1 {
+				s.hidden = hiddenLayout
+			}
+		}
+	}
+	for _, p := range []string{"text-indent", "left", "top", "margin-left", "margin-top"} {
+		if v, ok := parseLength(props[p], s.fontSize); ok && v <= -500 {
+			if s.hidden == hiddenNone {
+				s.hidden = hiddenOffscreen
+			}
+		}
+	}
+	if v, ok := parseLength(props["font-size"], s.fontSize); ok {
+		s.fontSize = v
+	}
+	if v, ok := parseLength(props["letter-spacing"], s.fontSize); ok {
+		s.spacing = v
+	}
+	if v, ok := props["color"]; ok {
+		if c, ok := parseColour(v); ok {
+			if c == nil {
+				// transparent text is as invisible as text in the background colour
+				s.colour, s.hasColour = [3]uint8{}, false
+				s.hidden = hiddenLayout
+			} else {
+				s.colour, s.hasColour = *c, true
+			}
+		}
+	}
+	for _, p := range []string{"background-color", "background"} {
+		v, ok := props[p]
+		if !ok {
+			continue
+		}
+		if strings.Contains(v, "url(") || strings.Contains(v, "gradient(") {
+			s.bg = nil // the colour behind the text can't be known
+			continue
+		}
+		if c, ok := parseColour(v); ok && c != nil {
+			s.bg = c
+		} else if p == "background" {
+			// shorthand with more than a colour: use its first colour, if any
+			for _, part := range strings.Fields(v) {
+				if c, ok := parseColour(part); ok && c != nil {
+					s.bg = c
+					break
+				}
+			}
+		}
+	}
+	if v := strings.TrimSpace(props["background-image"]); v != "" && v != "none" {
+		imageBackground = true
+	}
+	if imageBackground {
+		s.bg = nil // an image is painted over any background colour, so the colour behind the text can't be known
+	}
+	return s
+}
+
+// hidingTechnique is how a text shown with s is hidden from the reader, if it is.
+func hidingTechnique(s textStyle) string {
+	switch {
+	case s.hidden != hiddenNone:
+		return s.hidden
+	case s.fontSize <= 1:
+		return hiddenTinyFont
+	case s.hasColour && s.bg != nil && sameColour(s.colour, *s.bg):
+		return hiddenSameColour
+	case s.spacing <= -0.2*s.fontSize || s.spacing >= 2*s.fontSize:
+		return hiddenSpacing
+	}
+	return hiddenNone
+}
+
+// analyseHiddenContent finds the text in htmlBody that a reader can't see; text is the body as
+// plain text, for zero-width characters in emails without HTML.
+func analyseHiddenContent(htmlBody, text string, Email EmailData) HiddenContentResult {
+	result := HiddenContentResult{Techniques: map[string]int{}, Samples: []HiddenTextSample{}}
+	if strings.TrimSpace(htmlBody) == "" {
+		result.ZeroWidth = countZeroWidth(text)
+	} else if doc, err := html.Parse(strings.NewReader(htmlBody)); err == nil {
+		stylesheets := strings.Contains(strings.ToLower(htmlBody), "<style")
+		var walk func(n *html.Node, s textStyle)
+		walk = func(n *html.Node, s textStyle) {
+			switch n.Type {
+			case html.ElementNode:
+				switch n.Data {
+				case "head", "style", "script", "title", "template", "noscript":
+					return
+				}
+				s = childStyle(n, s, stylesheets)
+			case html.TextNode:
+				technique := hidingTechnique(s)
+				if technique == hiddenNone {
+					result.ZeroWidth += countZeroWidth(n.Data)
+					return
+				}
+				t := strings.Join(strings.Fields(n.Data), " ")
+				letters := 0
+				for _, r := range t {
+					if unicode.IsLetter(r) || unicode.IsDigit(r) {
+						letters++
+					}
+				}
+				if letters < hiddenMinLetters {
+					return
+				}
+				result.Techniques[technique] += utf8.RuneCountInString(t)
+				if len(result.Samples) < maxHiddenSamples {
+					if r := []rune(t); len(r) > 80 {
+						t = string(r[:80]) + "…"
+					}
+					result.Samples = append(result.Samples, HiddenTextSample{Technique: technique, Text: redactPII(t, Email)})
+				}
+				return
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c, s)
+			}
+		}
+		walk(doc, rootTextStyle)
+	}
+	if result.ZeroWidth > 0 {
+		result.Techniques[hiddenZeroWidth] = result.ZeroWidth
+	}
+
+	var found []string
+	for _, technique := range hiddenTechniques {
+		n, ok := result.Techniques[technique]
+		switch {
+		case !ok:
+		case technique == hiddenLayout && n < hiddenBlockMinChars:
+		case technique == hiddenZeroWidth && n < zeroWidthMin:
+		default:
+			found = append(found, hiddenTechniqueNames[technique])
+		}
+	}
+	result.Hidden = len(found) > 0
+	if result.Hidden {
+		result.Message = fmt.Sprintf("The email hides content from its reader: %s.", strings.Join(found, ", "))
+	} else {
+		result.Message = "No hidden text found."
+	}
+	return result
+}
+
+var hiddenTechniqueNames = map[string]string{
+	hiddenLayout:     "hidden blocks",
+	hiddenTinyFont:   "zero-size text",
+	hiddenSameColour: "text in the background colour",
+	hiddenSpacing:    "extreme letter-spacing",
+	hiddenOffscreen:  "text pushed off the page",
+	hiddenZeroWidth:  "zero-width characters inside words",
+}
+
+func performHiddenContentAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "HiddenContent" {
+			check = c
+			break
+		}
+	}
+	result := analyseHiddenContent(Email.HTML, Email.Text, Email)
+	if !result.Hidden {
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "hiddenContentAnalysis", Payload: result}
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// HTMLAttachmentReport is the outcome of analysing one HTML attachment.
+type HTMLAttachmentReport struct {
+	FileName         string       `json:"fileName"`
+	Forms            []FormReport `json:"forms"`
+	LoginForm        bool         `json:"loginForm"`
+	ScriptIndicators []string     `json:"scriptIndicators"`
+	Organization     string       `json:"organization,omitempty"`
+	Summary          string       `json:"summary,omitempty"`
+	Realistic        *bool        `json:"realistic,omitempty"`
+	RealisticReason  string       `json:"realisticReason,omitempty"`
+	AIStats          AICallStats  `json:"aiStats"`
+	Suspicious       bool         `json:"suspicious"`
+	Error            string       `json:"error,omitempty"`
+}
+
+type HTMLAttachmentAnalysisResult struct {
+	Attachments []HTMLAttachmentReport `json:"attachments"`
+	Message     string                 `json:"message"`
+	ScoreImpact int                    `json:"scoreImpact"`
+}
+
+// isHTMLAttachment reports whether a MIME part is an attached HTML page (not the email body).
+func isHTMLAttachment(p *enmime.Part) bool {
+	if p.FileName == "" {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(p.FileName)) {
+	case ".htm", ".html", ".shtml", ".xhtml", ".mht", ".mhtml":
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(p.ContentType)
+	return mediaType == "text/html"
+}
+
+// analyseHTMLAttachment inspects one HTML attachment statically, renders it with networking
+// disabled, and sends the screenshot through the same OCR/AI path as the rendered email.
+func analyseHTMLAttachment(index int, p *enmime.Part, fileName, sandboxDir, countryCode string, Email EmailData) HTMLAttachmentReport {
+	page := string(p.Content)
+	rep := HTMLAttachmentReport{
+		FileName:         p.FileName,
+		Forms:            findCredentialForms(page),
+		ScriptIndicators: findObfuscatedScript(page),
+	}
+	if rep.Forms == nil {
+		rep.Forms = []FormReport{}
+	}
+	for _, f := range rep.Forms {
+		if f.PasswordFields > 0 {
+			rep.LoginForm = true
+		}
+	}
+
+	dir := filepath.Join(sandboxDir, "html-attachments")
+	screenshotsDir := filepath.Join(sandboxDir, "screenshots")
+	for _, d := range []string{dir, screenshotsDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			rep.Error = err.Error()
+			return rep
+		}
+	}
+	pagePath := filepath.Join(dir, fmt.Sprintf("attachment-%d.html", index))
+	if err := os.WriteFile(pagePath, p.Content, 0644); err != nil {
+		rep.Error = err.Error()
+		return rep
+	}
+	buf, err := screenshotHTMLFile(Email.requestContext(), pagePath, true)
+	if err != nil {
+		Email.logger().Error("rendering HTML attachment failed", "file", p.FileName, "err", err)
+		rep.Error = "Failed to render attachment."
+		return rep
+	}
+	screenshotFileName := fmt.Sprintf("attachment-%d.png", index)
+	screenshotFile := filepath.Join(screenshotsDir, screenshotFileName)
+	if err := os.WriteFile(screenshotFile, buf, 0644); err != nil {
+		rep.Error = err.Error()
+		return rep
+	}
+
+	pageText := OCRImage(Email.requestContext(), screenshotFile, Email.Language.Tesseract).Text
+	if pageText == "" {
+		Email.logger().Warn("no text extracted from HTML attachment", "file", p.FileName)
+		return rep
+	}
+	whoResult, aiStats, err := whoTheyAre(false, fileName, sandboxDir, Email, []string{screenshotFileName}, pageText, countryCode)
+	rep.AIStats = aiStats
+	if errors.Is(err, errGeminiDisabled) {
+		return rep // the structural checks above still count
+	}
+	if err != nil {
+		Email.logger().Error("HTML attachment analysis failed", "file", p.FileName, "err", err)
+		rep.Error = "Failed to analyse attachment screenshot."
+		return rep
+	}
+	if whoResult.OrganizationFound {
+		rep.Organization = whoResult.OrganizationName
+	}
+	rep.Summary = whoResult.SummaryOfEmail
+	rep.Realistic = &whoResult.Realistic
+	rep.RealisticReason = whoResult.RealisticReason
+	return rep
+}
+
+func performHTMLAttachmentAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, fileName string, env *enmime.Envelope, sandboxDir string, countryCode string, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "HTMLAttachmentPhishing" {
+			check = c
+			break
+		}
+	}
+
+	result := HTMLAttachmentAnalysisResult{Attachments: []HTMLAttachmentReport{}}
+	var flagged []string
+	for i, p := range append(env.Attachments, env.OtherParts...) {
+		if !isHTMLAttachment(p) {
+			continue
+		}
+		rep := analyseHTMLAttachment(i, p, fileName, sandboxDir, countryCode, Email)
+		var reasons []string
+		if rep.LoginForm {
+			reasons = append(reasons, "a login form")
+		}
+		if len(rep.ScriptIndicators) >= 2 {
+			reasons = append(reasons, "obfuscated JavaScript")
+		}
+		if rep.Realistic != nil && !*rep.Realistic {
+			reasons = append(reasons, "content judged unrealistic")
+		}
+		if len(reasons) > 0 {
+			rep.Suspicious = true
+			flagged = append(flagged, fmt.Sprintf("%s (%s)", rep.FileName, strings.Join(reasons, ", ")))
+		}
+		result.Attachments = append(result.Attachments, rep)
+	}
+
+	switch {
+	case len(result.Attachments) == 0:
+		result.Message = "No HTML attachments."
+		result.ScoreImpact = check.Impact
+	case len(flagged) > 0:
+		result.Message = "Suspicious HTML attachment(s): " + strings.Join(flagged, "; ") + "."
+	default:
+		result.Message = fmt.Sprintf("%d HTML attachment(s) analysed; no credential phishing indicators found.", len(result.Attachments))
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "htmlAttachmentAnalysis", Payload: result}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+)
+
+type TrackingAnalysisResult struct {
+	Count       int      `json:"count"`
+	Pixels      []string `json:"pixels"`
+	Heavy       bool     `json:"heavy"`
+	Message     string   `json:"message"`
+	ScoreImpact int      `json:"scoreImpact"`
+}
+
+// isHiddenStyle reports whether an inline style makes an element invisible or (near) zero-sized.
+func isHiddenStyle(style string) bool {
+	style = strings.ToLower(strings.ReplaceAll(style, " ", ""))
+	for _, marker := range []string{
+		"display:none", "visibility:hidden", "opacity:0;", "width:0", "height:0",
+		"width:1px", "height:1px", "max-height:0", "max-width:0",
+	} {
+		if strings.Contains(style, marker) {
+			return true
+		}
+	}
+	return strings.HasSuffix(style, "opacity:0")
+}
+
+// isTinyDimension reports whether a width/height attribute value is 0 or 1 pixel.
+func isTinyDimension(v string) bool {
+	v = strings.TrimSuffix(strings.TrimSpace(strings.ToLower(v)), "px")
+	return v == "0" || v == "1"
+}
+
+// findTrackingPixels returns the sources of remote images that are 1x1 or hidden from view.
+func findTrackingPixels(htmlStr string) []string {
+	var pixels []string
+	z := html.NewTokenizer(strings.NewReader(htmlStr))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return pixels
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "img" || !hasAttr {
+				continue
+			}
+			var src, width, height, style string
+			for {
+				key, val, more := z.TagAttr()
+				switch string(key) {
+				case "src":
+					src = strings.TrimSpace(string(val))
+				case "width":
+					width = string(val)
+				case "height":
+					height = string(val)
+				case "style":
+					style = string(val)
+				}
+				if !more {
+					break
+				}
+			}
+			lower := strings.ToLower(src)
+			if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") && !strings.HasPrefix(lower, "//") {
+				continue // only remote images can report an open back to the sender
+			}
+			if (isTinyDimension(width) && isTinyDimension(height)) || isHiddenStyle(style) {
+				pixels = append(pixels, src)
+			}
+		}
+	}
+}
+
+func performTrackingAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "TrackingPixelsFound" {
+			check = c
+			break
+		}
+	}
+
+	result := TrackingAnalysisResult{Count: len(Email.TrackingPixels), Pixels: Email.TrackingPixels}
+	if result.Pixels == nil {
+		result.Pixels = []string{}
+	}
+	result.Heavy = result.Count >= trackingPixelThreshold
+	switch {
+	case result.Heavy && Email.MailingList.newsletter(Email.Domain):
+		result.Message = fmt.Sprintf("Found %d invisible tracking images, usual for a newsletter from %s.", result.Count, Email.MailingList.ESP)
+		result.ScoreImpact = check.Impact
+	case result.Heavy:
+		result.Message = fmt.Sprintf("Found %d invisible tracking images, a pattern common in bulk and spam campaigns.", result.Count)
+	case result.Count > 0:
+		result.Message = fmt.Sprintf("Found %d invisible tracking image(s).", result.Count)
+		result.ScoreImpact = check.Impact
+	default:
+		result.Message = "No tracking pixels found."
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "trackingAnalysis", Payload: result}
+}
+
+// FormReport describes an HTML form (or loose inputs) that collects credentials.
+type FormReport struct {
+	Action           string   `json:"action"`
+	Method           string   `json:"method,omitempty"` // GET or POST; none for loose inputs
+	PasswordFields   int      `json:"passwordFields"`
+	CredentialFields []string `json:"credentialFields"`     // names of user/email/login inputs
+	CardFields       []string `json:"cardFields,omitempty"` // names of card number, expiry and CVV inputs
+}
+
+var (
+	credentialFieldName = regexp.MustCompile(`(?i)(user|email|e-mail|login|account|pass|pwd|pin|otp)`)
+	cardFieldName       = regexp.MustCompile(`(?i)(card|cc-?num|cvv|cvc|csc|expir|exp-?date|security-?code)`)
+)
+
+// findCredentialForms returns the forms that ask for a password, card details or login
+// details. Password and card inputs outside any <form> (submitted by script) are reported as a
+// form with no action.
+func findCredentialForms(htmlStr string) []FormReport {
+	doc, err := html.Parse(strings.NewReader(htmlStr))
+	if err != nil {
+		return nil
+	}
+	var forms []FormReport
+	loose := FormReport{}
+	var walk func(n *html.Node, form *FormReport)
+	walk = func(n *html.Node, form *FormReport) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "form":
+				f := FormReport{Method: "GET", CredentialFields: []string{}}
+				for _, a := range n.Attr {
+					switch a.Key {
+					case "action":
+						f.Action = strings.TrimSpace(a.Val)
+					case "method":
+						if strings.EqualFold(strings.TrimSpace(a.Val), "post") {
+							f.Method = "POST"
+						}
+					}
+				}
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					walk(c, &f)
+				}
+				if f.PasswordFields > 0 || len(f.CredentialFields) > 0 || len(f.CardFields) > 0 {
+					forms = append(forms, f)
+				}
+				return
+			case "input":
+				target := form
+				if target == nil {
+					target = &loose
+				}
+				var typ, name, autocomplete string
+				for _, a := range n.Attr {
+					switch a.Key {
+					case "type":
+						typ = strings.ToLower(a.Val)
+					case "name", "id":
+						if name == "" {
+							name = a.Val
+						}
+					case "autocomplete":
+						autocomplete = strings.ToLower(a.Val)
+					}
+				}
+				switch {
+				case typ == "password":
+					target.PasswordFields++
+				case typ == "hidden", typ == "submit", typ == "button", typ == "checkbox", typ == "radio":
+				case strings.HasPrefix(autocomplete, "cc-") || cardFieldName.MatchString(name):
+					target.CardFields = append(target.CardFields, name)
+				case typ == "email" || credentialFieldName.MatchString(name):
+					target.CredentialFields = append(target.CredentialFields, name)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, form)
+		}
+	}
+	walk(doc, nil)
+	if loose.PasswordFields > 0 || len(loose.CardFields) > 0 {
+		if loose.CredentialFields == nil {
+			loose.CredentialFields = []string{}
+		}
+		forms = append(forms, loose)
+	}
+	return forms
+}
+
+var (
+	scriptHexEscape  = regexp.MustCompile(`\\x[0-9A-Fa-f]{2}|\\u[0-9A-Fa-f]{4}|%[0-9A-Fa-f]{2}`)
+	scriptLongBlob   = regexp.MustCompile(`[A-Za-z0-9+/=]{400,}`)
+	scriptIndicators = []struct {
+		pattern *regexp.Regexp
+		label   string
+	}{
+		{regexp.MustCompile(`\beval\s*\(`), "eval"},
+		{regexp.MustCompile(`\b(unescape|decodeURIComponent)\s*\(`), "unescape"},
+		{regexp.MustCompile(`\batob\s*\(`), "base64 decoding (atob)"},
+		{regexp.MustCompile(`String\.fromCharCode`), "String.fromCharCode"},
+		{regexp.MustCompile(`document\.write\s*\(`), "document.write"},
+		{regexp.MustCompile(`\b(fetch|XMLHttpRequest|sendBeacon)\b`), "sends data to a server"},
+		{regexp.MustCompile(`(window\.|document\.)?location(\.href)?\s*=|location\.replace\s*\(`), "redirects the page"},
+	}
+)
+
+// findObfuscatedScript returns indicators of obfuscated or data-exfiltrating JavaScript in the
+// page's <script> blocks.
+func findObfuscatedScript(htmlStr string) []string {
+	var scripts strings.Builder
+	z := html.NewTokenizer(strings.NewReader(htmlStr))
+	inScript := false
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		switch tt {
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			inScript = string(name) == "script"
+		case html.EndTagToken:
+			inScript = false
+		case html.TextToken:
+			if inScript {
+				scripts.Write(z.Text())
+				scripts.WriteByte('\n')
+			}
+		}
+	}
+	code := scripts.String()
+	indicators := []string{}
+	if code == "" {
+		return indicators
+	}
+	for _, ind := range scriptIndicators {
+		if ind.pattern.MatchString(code) {
+			indicators = append(indicators, ind.label)
+		}
+	}
+	if len(scriptHexEscape.FindAllStringIndex(code, 51)) > 50 {
+		indicators = append(indicators, "heavy hex/unicode escaping")
+	}
+	if scriptLongBlob.MatchString(code) {
+		indicators = append(indicators, "long encoded string")
+	}
+	return indicators
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// An image attachment can carry more than its picture. Its EXIF and text chunks say which
+// camera, program and person made it and sometimes where; a zip, script or executable appended
+// after the picture data still opens as an image (a polyglot), and droppers fetch the payload
+// from there; links can be tucked into comments. parseEmail inspects each of the email's image
+// parts: the metadata is reported, URLs in the bytes (other than metadata namespaces) are
+// scanned with the email's links, and the copies saved to the attachments sandbox, which go to
+// Gemini, have the metadata and anything appended stripped. An image with an archive, code or
+// links appended, or far larger than its pixels need, fails ImagePolyglot.
+
+const (
+	imageMetadataMaxValue = 200
+	// imageSlackBytes is what metadata, an ICC profile and thumbnails can reasonably add.
+	imageSlackBytes = 64 << 10
+	// imageMaxBytesPerPixel is 16-bit RGBA uncompressed; no image format needs more.
+	imageMaxBytesPerPixel = 8
+	imageMaxURLs          = 20
+)
+
+// ImageFileReport is what one image attachment holds besides its picture.
+type ImageFileReport struct {
+	FileName      string            `json:"fileName"`
+	Format        string            `json:"format"` // jpeg, png or gif
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Size          int               `json:"size"`
+	BytesPerPixel float64           `json:"bytesPerPixel"`
+	Metadata      map[string]string `json:"metadata"` // EXIF tags, PNG text chunks and comments
+	GPS           string            `json:"gps,omitempty"`
+	AppendedBytes int               `json:"appendedBytes"` // after the end of the image data
+	AppendedKind  string            `json:"appendedKind,omitempty"`
+	URLs          []string          `json:"urls"`
+	Findings      []string          `json:"findings"` // appendedPayload, appendedURLs or oversized
+}
+
+// walkableImageFormats are the formats whose structure is walked to find where the picture ends.
+var walkableImageFormats = map[string]bool{"jpeg": true, "png": true, "gif": true}
+
+// embeddedURL matches links in binary data.
+var embeddedURL = regexp.MustCompile(`https?://[A-Za-z0-9][A-Za-z0-9.\-]*[A-Za-z0-9](?::\d+)?(?:/[A-Za-z0-9\-._~%!$&'()*+,;=:@/?#]*)?`)
+
+// metadataNamespaceHosts appear in every XMP packet and ICC profile.
+var metadataNamespaceHosts = []string{"ns.adobe.com", "www.w3.org", "purl.org", "iptc.org", "www.iptc.org", "cipa.jp", "www.color.org", "ns.useplus.org", "ns.google.com", "ns.microsoft.com"}
+
+// imageEmbeddedURLs returns the links in b that aren't metadata namespaces.
+func imageEmbeddedURLs(b []byte) []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, m := range embeddedURL.FindAll(b, -1) {
+		u := strings.TrimRight(string(m), ".,;)'")
+		host := linkHost(u)
+		if host == "" || seen[u] {
+			continue
+		}
+		namespace := false
+		for _, ns := range metadataNamespaceHosts {
+			if host == ns || strings.HasSuffix(host, "."+ns) {
+				namespace = true
+				break
+			}
+		}
+		if !namespace && len(urls) < imageMaxURLs {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// imageLayout is where an image's data ends and what metadata it carries.
+type imageLayout struct {
+	end      int    // offset just past the end of the image data; -1 when it was never found
+	exif     []byte // TIFF structure from a JPEG APP1 or PNG eXIf
+	text     map[string]string
+	metadata [][2]int // byte ranges (start, end) of segments or chunks that only hold metadata
+}
+
+// jpegLayout walks the JPEG's segments to the EOI marker after the last scan.
+func jpegLayout(b []byte) imageLayout {
+	l := imageLayout{end: -1, text: map[string]string{}}
+	i := 2
+	for i+4 <= len(b) {
+		if b[i] != 0xFF {
+			return l
+		}
+		m := b[i+1]
+		switch {
+		case m == 0xD9:
+			l.end = i + 2
+			return l
+		case m == 0xFF:
+			i++
+			continue
+		case m == 0x01 || (m >= 0xD0 && m <= 0xD7):
+			i += 2
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return l
+		}
+		seg := b[i+4 : i+2+n]
+		switch {
+		case m == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")):
+			l.exif = seg[6:]
+			l.metadata = append(l.metadata, [2]int{i, i + 2 + n})
+		case m == 0xE1, m == 0xED: // XMP, Photoshop IPTC
+			l.metadata = append(l.metadata, [2]int{i, i + 2 + n})
+		case m == 0xFE:
+			l.text["Comment"] = string(seg)
+			l.metadata = append(l.metadata, [2]int{i, i + 2 + n})
+		}
+		i += 2 + n
+		if m == 0xDA {
+			// Entropy-coded data runs to the next marker that isn't a stuffed byte or a restart.
+			for i+1 < len(b) && (b[i] != 0xFF || b[i+1] == 0 || (b[i+1] >= 0xD0 && b[i+1] <= 0xD7)) {
+				i++
+			}
+		}
+	}
+	return l
+}
+
+// pngLayout walks the PNG's chunks to IEND.
+func pngLayout(b []byte) imageLayout {
+	l := imageLayout{end: -1, text: map[string]string{}}
+	i := 8
+	for i+12 <= len(b) {
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		if i+12+n > len(b) {
+			return l
+		}
+		typ, data := string(b[i+4:i+8]), b[i+8:i+8+n]
+		switch typ {
+		case "IEND":
+			l.end = i + 12 + n
+			return l
+		case "eXIf":
+			l.exif = data
+			l.metadata = append(l.metadata, [2]int{i, i + 12 + n})
+		case "tEXt":
+			if k, v, ok := bytes.Cut(data, []byte{0}); ok {
+				l.text[string(k)] = string(v)
+			}
+			l.metadata = append(l.metadata, [2]int{i, i + 12 + n})
+		case "iTXt":
+			// keyword\0 compression flag, method, language\0 translated keyword\0 text
+			if k, rest, ok := bytes.Cut(data, []byte{0}); ok && len(rest) > 2 && rest[0] == 0 {
+				parts := bytes.SplitN(rest[2:], []byte{0}, 3)
+				if len(parts) == 3 {
+					l.text[string(k)] = string(parts[2])
+				}
+			}
+			l.metadata = append(l.metadata, [2]int{i, i + 12 + n})
+		case "zTXt", "tIME":
+			l.metadata = append(l.metadata, [2]int{i, i + 12 + n})
+		}
+		i += 12 + n
+	}
+	return l
+}
+
+// gifLayout walks the GIF's blocks to the trailer.
+func gifLayout(b []byte) imageLayout {
+	l := imageLayout{end: -1, text: map[string]string{}}
+	if len(b) < 13 {
+		return l
+	}
+	i := 13
+	if b[10]&0x80 != 0 {
+		i += 3 << (b[10]&7 + 1)
+	}
+	// subBlocks skips a chain of data sub-blocks, returning their content.
+	subBlocks := func() ([]byte, bool) {
+		var data []byte
+		for i < len(b) {
+			n := int(b[i])
+			i++
+			if n == 0 {
+				return data, true
+			}
+			if i+n > len(b) {
+				return nil, false
+			}
+			data = append(data, b[i:i+n]...)
+			i += n
+		}
+		return nil, false
+	}
+	for i < len(b) {
+		switch b[i] {
+		case 0x3B:
+			l.end = i + 1
+			return l
+		case 0x21:
+			if i+2 > len(b) {
+				return l
+			}
+			label := b[i+1]
+			i += 2
+			data, ok := subBlocks()
+			if !ok {
+				return l
+			}
+			if label == 0xFE {
+				l.text["Comment"] = string(data)
+			}
+		case 0x2C:
+			if i+10 > len(b) {
+				return l
+			}
+			flags := b[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&7 + 1)
+			}
+			i++ // LZW minimum code size
+			if _, ok := subBlocks(); !ok {
+				return l
+			}
+		default:
+			return l
+		}
+	}
+	return l
+}
+
+func layoutImage(format string, b []byte) imageLayout {
+	switch format {
+	case "jpeg":
+		return jpegLayout(b)
+	case "png":
+		return pngLayout(b)
+	default:
+		return gifLayout(b)
+	}
+}
+
+// exifTags are the IFD0 and Exif IFD tags worth reporting.
+var exifTags = map[uint16]string{
+	0x010E: "ImageDescription", 0x010F: "Make", 0x0110: "Model", 0x0131: "Software",
+	0x0132: "DateTime", 0x013B: "Artist", 0x8298: "Copyright", 0x9003: "DateTimeOriginal",
+	0xA430: "CameraOwnerName", 0xA431: "BodySerialNumber",
+}
+
+type tiffEntry struct {
+	typ, count uint32
+	value      []byte // the value bytes, wherever they are stored
+}
+
+// readIFD returns the entries of the TIFF directory at offset off.
+func readIFD(tiff []byte, order binary.ByteOrder, off uint32) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	if int(off)+2 > len(tiff) {
+		return entries
+	}
+	n := int(order.Uint16(tiff[off:]))
+	sizes := map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	for k := 0; k < n; k++ {
+		e := int(off) + 2 + 12*k
+		if e+12 > len(tiff) {
+			break
+		}
+		tag, typ, count := order.Uint16(tiff[e:]), order.Uint16(tiff[e+2:]), order.Uint32(tiff[e+4:])
+		size := uint64(sizes[typ]) * uint64(count)
+		if size == 0 || size > uint64(len(tiff)) {
+			continue
+		}
+		value := tiff[e+8 : e+12]
+		if size > 4 {
+			at := uint64(order.Uint32(tiff[e+8:]))
+			if at+size > uint64(len(tiff)) {
+				continue
+			}
+			value = tiff[at : at+size]
+		}
+		entries[tag] = tiffEntry{typ: uint32(typ), count: count, value: value[:min(uint64(len(value)), size)]}
+	}
+	return entries
+}
+
+// readExif returns the reported tags and, when present, the GPS position of a TIFF structure.
+func readExif(tiff []byte) (map[string]string, string) {
+	tags := map[string]string{}
+	if len(tiff) < 8 {
+		return tags, ""
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return tags, ""
+	}
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	collect := func(entries map[uint16]tiffEntry) {
+		for tag, e := range entries {
+			if name := exifTags[tag]; name != "" && e.typ == 2 {
+				if v := strings.TrimSpace(strings.TrimRight(string(e.value), "\x00")); v != "" {
+					tags[name] = v
+				}
+			}
+		}
+	}
+	collect(ifd0)
+	if e, ok := ifd0[0x8769]; ok && len(e.value) == 4 {
+		collect(readIFD(tiff, order, order.Uint32(e.value)))
+	}
+	var gps string
+	if e, ok := ifd0[0x8825]; ok && len(e.value) == 4 {
+		g := readIFD(tiff, order, order.Uint32(e.value))
+		degrees := func(e tiffEntry) (float64, bool) {
+			if e.typ != 5 || len(e.value) != 24 {
+				return 0, false
+			}
+			var v float64
+			for k, scale := range []float64{1, 60, 3600} {
+				num, den := order.Uint32(e.value[8*k:]), order.Uint32(e.value[8*k+4:])
+				if den == 0 {
+					return 0, false
+				}
+				v += float64(num) / float64(den) / scale
+			}
+			return v, true
+		}
+		lat, okLat := degrees(g[2])
+		lon, okLon := degrees(g[4])
+		if okLat && okLon {
+			if bytes.HasPrefix(g[1].value, []byte("S")) {
+				lat = -lat
+			}
+			if bytes.HasPrefix(g[3].value, []byte("W")) {
+				lon = -lon
+			}
+			gps = fmt.Sprintf("%.5f, %.5f", lat, lon)
+		} else if len(g) > 0 {
+			gps = "present"
+		}
+	}
+	return tags, gps
+}
+
+// inspectImage reports what an image attachment holds besides its picture, or nil when content
+// isn't a JPEG, PNG or GIF.
+func inspectImage(name string, content []byte) *ImageFileReport {
+	format := sniffFileType(content)
+	if !walkableImageFormats[format] {
+		return nil
+	}
+	r := &ImageFileReport{FileName: name, Format: format, Size: len(content), Metadata: map[string]string{}, URLs: []string{}, Findings: []string{}}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(content)); err == nil {
+		r.Width, r.Height = cfg.Width, cfg.Height
+	}
+	l := layoutImage(format, content)
+	if l.exif != nil {
+		r.Metadata, r.GPS = readExif(l.exif)
+	}
+	for k, v := range l.text {
+		if v = strings.TrimSpace(v); v != "" {
+			r.Metadata[k] = v
+		}
+	}
+	for k, v := range r.Metadata {
+		if len(v) > imageMetadataMaxValue {
+			r.Metadata[k] = v[:imageMetadataMaxValue] + "…"
+		}
+	}
+	r.URLs = append(r.URLs, imageEmbeddedURLs(content)...)
+	if l.end > 0 && l.end < len(content) {
+		appended := content[l.end:]
+		if len(bytes.Trim(appended, "\x00\r\n \t")) > 0 { // padding isn't a payload
+			r.AppendedBytes = len(appended)
+			r.AppendedKind = appendedKind(appended)
+			if r.AppendedKind != "" {
+				r.Findings = append(r.Findings, "appendedPayload")
+			}
+			if len(imageEmbeddedURLs(appended)) > 0 {
+				r.Findings = append(r.Findings, "appendedURLs")
+			}
+		}
+	}
+	if pixels := r.Width * r.Height; pixels > 0 {
+		r.BytesPerPixel = float64(r.Size) / float64(pixels)
+		if r.Size > pixels*imageMaxBytesPerPixel+imageSlackBytes {
+			r.Findings = append(r.Findings, "oversized")
+		}
+	}
+	return r
+}
+
+// appendedKind names what was appended to an image when it is an archive, document or code,
+// wherever in the appended bytes it starts.
+func appendedKind(b []byte) string {
+	if kind := sniffFileType(b); kind != "" {
+		return kind
+	}
+	for _, sig := range fileSignatures {
+		if _, container := containerKinds[sig.kind]; (container || sig.kind == "pdf") && bytes.Contains(b, sig.magic) {
+			return sig.kind
+		}
+	}
+	lower := bytes.ToLower(b)
+	for _, marker := range []string{"<script", "<?php", "<html", "powershell", "wscript."} {
+		if bytes.Contains(lower, []byte(marker)) {
+			return "script"
+		}
+	}
+	return ""
+}
+
+// inspectImageParts reports on each of the email's image parts.
+func inspectImageParts(env *enmime.Envelope) []ImageFileReport {
+	var reports []ImageFileReport
+	for _, p := range append(append(env.Attachments, env.Inlines...), env.OtherParts...) {
+		name := p.FileName
+		if name == "" {
+			name = p.ContentType
+		}
+		if r := inspectImage(name, p.Content); r != nil {
+			reports = append(reports, *r)
+		}
+	}
+	return reports
+}
+
+// stripImageMetadata rewrites a saved JPEG or PNG without its EXIF, XMP, IPTC, comments and text
+// chunks or anything after the image data. Colour profiles (ICC, Adobe APP14) are kept.
+func stripImageMetadata(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	format := sniffFileType(b)
+	if format != "jpeg" && format != "png" {
+		return nil
+	}
+	l := layoutImage(format, b)
+	end := len(b)
+	if l.end > 0 {
+		end = l.end
+	}
+	if len(l.metadata) == 0 && end == len(b) {
+		return nil
+	}
+	var out bytes.Buffer
+	at := 0
+	for _, m := range l.metadata {
+		out.Write(b[at:m[0]])
+		at = m[1]
+	}
+	out.Write(b[at:end])
+	return os.WriteFile(path, out.Bytes(), 0o644)
+}
+
+// ImageFileResult is the imageFileAnalysis event.
+type ImageFileResult struct {
+	Images      []ImageFileReport `json:"images"`
+	Flagged     int               `json:"flagged"`
+	Message     string            `json:"message"`
+	ScoreImpact int               `json:"scoreImpact"`
+}
+
+var imageFindingNames = map[string]string{
+	"appendedPayload": "an archive, document or code appended",
+	"appendedURLs":    "links appended",
+	"oversized":       "far larger than its pixels need",
+}
+
+func performImageFileAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "ImagePolyglot" {
+			check = c
+			break
+		}
+	}
+	result := ImageFileResult{Images: Email.ImageFiles}
+	if result.Images == nil {
+		result.Images = []ImageFileReport{}
+	}
+	var flagged, withMetadata []string
+	for _, r := range result.Images {
+		if len(r.Findings) > 0 {
+			var why []string
+			for _, f := range r.Findings {
+				why = append(why, imageFindingNames[f])
+			}
+			flagged = append(flagged, fmt.Sprintf("%s (%s)", r.FileName, strings.Join(why, ", ")))
+		}
+		if len(r.Metadata) > 0 || r.GPS != "" {
+			withMetadata = append(withMetadata, r.FileName)
+		}
+	}
+	result.Flagged = len(flagged)
+	switch {
+	case len(result.Images) == 0:
+		result.Message = "The email has no image attachments."
+	case len(flagged) > 0:
+		result.Message = "Images hiding more than a picture: " + strings.Join(flagged, "; ") + "."
+	default:
+		result.Message = fmt.Sprintf("%d image(s), none with anything appended or oversized.", len(result.Images))
+	}
+	if len(withMetadata) > 0 {
+		result.Message += fmt.Sprintf(" Metadata found in %s.", strings.Join(withMetadata, ", "))
+	}
+	if len(flagged) == 0 {
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "imageFileAnalysis", Payload: result}
+}
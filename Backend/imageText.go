@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Image-only phishing puts the whole message, the link and the phone number in an attached or
+// inline JPEG/PNG, leaving the body empty so text filters have nothing to read. The email's own
+// images in the attachments sandbox (attached, inline and data: URIs, not remote ones) are run
+// through the OCR engine while the other checks start; the URLs read from them are scanned with the
+// email's links, and their text is searched for phone numbers, wallet addresses, gift card
+// requests and bank detail changes alongside the body. An email whose body says next to nothing
+// while its images carry the text fails ImageOnlyEmail.
+
+const (
+	imageTextMaxImages  = 6   // images OCRed per email
+	imageTextMinWidth   = 150 // smaller images are icons and spacers
+	imageTextMinHeight  = 40
+	imageTextExcerpt    = 300 // characters of each image's text in the event
+	imageOnlyBodyWords  = 15  // at most this many words in the body...
+	imageOnlyImageWords = 20  // ...and at least this many in the images
+)
+
+// ImageText is the text OCR read from one of the email's images.
+type ImageText struct {
+	File       string   `json:"file"`
+	Words      int      `json:"words"`
+	Confidence float64  `json:"confidence"`
+	URLs       []string `json:"urls"`
+	Excerpt    string   `json:"excerpt,omitempty"` // redacted, first imageTextExcerpt characters
+	Error      string   `json:"error,omitempty"`
+
+	text string
+}
+
+// ownImagePaths returns the paths the email's own images ended up at in the attachments sandbox:
+// images the Go decoders couldn't read as saved were converted to a .jpg beside them.
+func ownImagePaths(saved []string) []string {
+	var paths []string
+	seen := map[string]bool{}
+	for _, p := range saved {
+		if _, err := os.Stat(p); err != nil {
+			p = strings.TrimSuffix(p, filepath.Ext(p)) + ".jpg"
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+		}
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// readImageText OCRs the email's own images, skipping duplicates (an inline image referenced by
+// cid: is saved twice) and images too small to hold a sentence.
+func readImageText(ctx context.Context, Email EmailData) []ImageText {
+	var texts []ImageText
+	seen := map[[32]byte]bool{}
+	for _, path := range Email.imageFiles {
+		if len(texts) == imageTextMaxImages {
+			break
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if seen[sum] {
+			continue
+		}
+		seen[sum] = true
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil && (cfg.Width < imageTextMinWidth || cfg.Height < imageTextMinHeight) {
+			continue
+		}
+		ocr := OCRImage(ctx, path, Email.Language.Tesseract)
+		t := ImageText{File: filepath.Base(path), URLs: []string{}, Error: ocr.Error, Confidence: ocr.MeanConfidence, text: ocr.Text}
+		t.Words = len(strings.Fields(ocr.Text))
+		if t.Words > 0 {
+			t.URLs = append(t.URLs, getURL(ocr.Text)...)
+			excerpt := redactPII(strings.Join(strings.Fields(ocr.Text), " "), Email)
+			if utf8.RuneCountInString(excerpt) > imageTextExcerpt {
+				excerpt = string([]rune(excerpt)[:imageTextExcerpt]) + "…"
+			}
+			t.Excerpt = excerpt
+		}
+		texts = append(texts, t)
+	}
+	return texts
+}
+
+// imageURLs returns the URLs read from the email's images.
+func imageURLs(texts []ImageText) []string {
+	var urls []string
+	for _, t := range texts {
+		urls = append(urls, t.URLs...)
+	}
+	return urls
+}
+
+// textWithImages is the body followed by the text read from the email's images, for the checks
+// that search the wording.
+func (e EmailData) textWithImages() string {
+	text := e.Text
+	for _, t := range e.ImageText {
+		if t.text != "" {
+			text += "\n\n" + t.text
+		}
+	}
+	return text
+}
+
+// ImageTextResult is the imageTextAnalysis event.
+type ImageTextResult struct {
+	Images      []ImageText `json:"images"`
+	BodyWords   int         `json:"bodyWords"`
+	ImageWords  int         `json:"imageWords"`
+	ImageOnly   bool        `json:"imageOnly"` // the images carry the message, the body next to nothing
+	Message     string      `json:"message"`
+	ScoreImpact int         `json:"scoreImpact"`
+}
+
+func performImageTextAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "ImageOnlyEmail" {
+			check = c
+			break
+		}
+	}
+	result := ImageTextResult{Images: Email.ImageText, BodyWords: len(strings.Fields(Email.Text))}
+	if result.Images == nil {
+		result.Images = []ImageText{}
+	}
+	failed := 0
+	for _, t := range result.Images {
+		result.ImageWords += t.Words
+		if t.Error != "" {
+			failed++
+		}
+	}
+	result.ImageOnly = result.BodyWords <= imageOnlyBodyWords && result.ImageWords >= imageOnlyImageWords
+	switch {
+	case len(result.Images) == 0:
+		result.Message = "The email has no images of its own large enough to hold text."
+		result.ScoreImpact = check.Impact
+	case failed == len(result.Images):
+		result.Message = "The email's images could not be read."
+		result.ScoreImpact = check.Impact
+	case result.ImageOnly:
+		result.Message = fmt.Sprintf("The body has %d word(s) but the email's images carry %d; the message is in the images.", result.BodyWords, result.ImageWords)
+	default:
+		result.Message = fmt.Sprintf("Read %d word(s) from %d image(s).", result.ImageWords, len(result.Images))
+		if urls := imageURLs(result.Images); len(urls) > 0 {
+			result.Message += fmt.Sprintf(" %d link(s) in the images were scanned with the email's links.", len(urls))
+		}
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "imageTextAnalysis", Payload: result}
+}
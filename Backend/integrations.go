@@ -0,0 +1,36 @@
+package main
+
+import "errors"
+
+// The external integrations can be switched off at runtime (URLSCAN_ENABLED, GEMINI_ENABLED,
+// GOOGLE_SEARCH_ENABLED, REMOTE_IMAGES_ENABLED), e.g. for air-gapped deployments or to stop
+// spending on an API. Checks that depend on a disabled integration are left out of MaxScoreFor
+// and award no points, so the percentage only reflects what was actually checked.
+var (
+	errGeminiDisabled       = errors.New("Gemini analysis is disabled (GEMINI_ENABLED=FALSE)")
+	errGoogleSearchDisabled = errors.New("Google Search is disabled (GOOGLE_SEARCH_ENABLED=FALSE)")
+)
+
+// urlScanningAvailable reports whether links can be judged at all: by the live scanners or, when
+// those are off, by the offline phishing feeds.
+func urlScanningAvailable() bool {
+	return isURLScanEnabled || threatFeedsEnabled
+}
+
+// integrationStatus lists which external integrations are on, for the maxScore event.
+func integrationStatus() map[string]bool {
+	return map[string]bool{
+		"urlScan":      isURLScanEnabled,
+		"threatFeeds":  threatFeedsEnabled,
+		"gemini":       geminiEnabled,
+		"googleSearch": googleSearchEnabled,
+		"remoteImages": remoteImagesEnabled,
+		"yara":         yaraEnabled(),
+		"clamav":       clamdEnabled(),
+		"spamd":        spamdAddress != "",
+		"rspamd":       rspamdURL != "",
+		"geoip":        geoIPEnabled(),
+		"places":       placesEnabled(),
+		"registry":     registryEnabled(),
+	}
+}
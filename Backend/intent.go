@@ -0,0 +1,60 @@
+package main
+
+// Gemini also says what an email is trying to do, as one of intentCategories. The category is
+// kept in the textAnalysis and renderedAnalysis results and streamed on its own as an
+// intentClassification event, with advice for the reader of the email. It doesn't change the
+// score: a marketing email and a phishing email can both come from their real senders.
+
+// intentCategories are the classifications Gemini chooses from, with a label and what the
+// recipient should do.
+var intentCategories = map[string]struct{ label, advice string }{
+	"credentialPhishing": {
+		"Credential phishing",
+		"Don't sign in through links in this email. If you think the account needs attention, open the site yourself from a bookmark or by typing its address, and change your password if you already entered it.",
+	},
+	"invoiceFraud": {
+		"Invoice or payment fraud",
+		"Don't pay or change bank details on the strength of this email. Confirm the request by phone with someone you already know at the company, using a number from your own records, not one in the email.",
+	},
+	"deliveryScam": {
+		"Delivery scam",
+		"Couriers don't ask for fees or card details by email. Track parcels on the courier's own site with the tracking number from the shop you ordered from.",
+	},
+	"sextortion": {
+		"Sextortion",
+		"These emails are sent in bulk and the claims are almost always false, even when they quote an old password. Don't reply or pay; change any password it mentions and report it.",
+	},
+	"marketing": {
+		"Marketing",
+		"This looks like a marketing email. If you didn't sign up, use the unsubscribe link only when the sender checks out, otherwise mark it as spam.",
+	},
+	"personal": {
+		"Personal",
+		"This looks like personal correspondence. Be careful with unexpected requests for money or favours, even from people you know, as accounts do get hijacked.",
+	},
+	"other": {
+		"Other",
+		"No particular scam pattern was recognised. Judge the email by the other checks.",
+	},
+}
+
+// intentCategoryNames lists intentCategories in the order the schema offers them.
+var intentCategoryNames = []string{"credentialPhishing", "invoiceFraud", "deliveryScam", "sextortion", "marketing", "personal", "other"}
+
+// IntentClassification is the intentClassification event.
+type IntentClassification struct {
+	Category string `json:"category"`
+	Label    string `json:"label"`
+	Advice   string `json:"advice"`
+	Source   string `json:"source"` // text or rendered: which analysis classified the email
+}
+
+// classifyIntent turns Gemini's classification into the event, or nil when it gave none or one
+// that isn't a category.
+func classifyIntent(classification, source string) *IntentClassification {
+	c, ok := intentCategories[classification]
+	if !ok {
+		return nil
+	}
+	return &IntentClassification{Category: classification, Label: c.label, Advice: c.advice, Source: source}
+}
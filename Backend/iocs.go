@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// The iocs event sums up an email's indicators of compromise in one machine-readable block, so
+// a SOC can feed them to its SIEM or blocklists without picking them out of the check results.
+
+// AttachmentHash identifies one attachment by its digests.
+type AttachmentHash struct {
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	MD5         string `json:"md5"`
+	SHA1        string `json:"sha1"`
+	SHA256      string `json:"sha256"`
+}
+
+// IOCSummary lists the indicators found in an email. Every list is sorted and never null.
+type IOCSummary struct {
+	Sender       string           `json:"sender"`
+	SenderDomain string           `json:"senderDomain"`
+	Subject      string           `json:"subject"`
+	OriginIP     string           `json:"originIp,omitempty"`
+	OriginGeo    *GeoInfo         `json:"originGeo,omitempty"` // with GEOIP_DB
+	Files        []AttachmentHash `json:"files"`
+	URLs         []string         `json:"urls"`
+	Domains      []string         `json:"domains"` // the sender's and every link's host
+	IPs          []string         `json:"ips"`     // public relay IPs from Received headers and IP-address links
+}
+
+// hashAttachments digests every attached, inline and other non-body part of env.
+func hashAttachments(env *enmime.Envelope) []AttachmentHash {
+	hashes := []AttachmentHash{}
+	for _, p := range append(append(env.Attachments, env.Inlines...), env.OtherParts...) {
+		if len(p.Content) == 0 {
+			continue
+		}
+		m, s1, s256 := md5.Sum(p.Content), sha1.Sum(p.Content), sha256.Sum256(p.Content)
+		hashes = append(hashes, AttachmentHash{
+			FileName:    p.FileName,
+			ContentType: p.ContentType,
+			Size:        len(p.Content),
+			MD5:         hex.EncodeToString(m[:]),
+			SHA1:        hex.EncodeToString(s1[:]),
+			SHA256:      hex.EncodeToString(s256[:]),
+		})
+	}
+	return hashes
+}
+
+// buildIOCs collects the indicators of Email. The URLs are the ones the URL check scans.
+func buildIOCs(env *enmime.Envelope, Email EmailData) IOCSummary {
+	summary := IOCSummary{
+		Sender:       Email.From,
+		SenderDomain: Email.subDomain,
+		Subject:      Email.Subject,
+		OriginIP:     Email.OriginIP,
+		OriginGeo:    lookupGeo(net.ParseIP(Email.OriginIP)),
+		Files:        Email.AttachmentHashes,
+		URLs:         []string{},
+	}
+	if addr, err := mail.ParseAddress(Email.From); err == nil {
+		summary.Sender = addr.Address
+	}
+	if summary.Files == nil {
+		summary.Files = []AttachmentHash{}
+	}
+	domains := map[string]bool{}
+	ips := map[string]bool{}
+	if Email.subDomain != "" {
+		domains[Email.subDomain] = true
+	}
+	if env != nil {
+		for _, ip := range receivedIPs(env.GetHeaderValues("Received")) {
+			ips[ip] = true
+		}
+	}
+	for u := range collectEmailURLs(Email) {
+		summary.URLs = append(summary.URLs, u)
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+		switch {
+		case host == "":
+		case net.ParseIP(host) != nil:
+			ips[host] = true
+		default:
+			domains[host] = true
+		}
+	}
+	sort.Strings(summary.URLs)
+	summary.Domains = sortedKeys(domains)
+	summary.IPs = sortedKeys(ips)
+	return summary
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
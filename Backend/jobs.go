@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every analysis is a job whose events are numbered and kept in memory, so a client whose
+// connection drops can reconnect to GET /jobs/{id}/events with Last-Event-ID and receive what it
+// missed instead of losing the analysis. The analysis keeps running while nobody is connected, for
+// up to ANALYSIS_ABANDON_TIMEOUT, and can be stopped with DELETE /jobs/{id}; a finished job stays
+// available for SSE_RESUME_WINDOW.
+
+// Why a job was cancelled, reported in its "cancelled" event.
+var (
+	errJobCancelled = errors.New("analysis cancelled by the client")
+	errJobAbandoned = errors.New("analysis abandoned: no client was following it")
+)
+
+// sseEvent is one numbered event of a job, already encoded.
+type sseEvent struct {
+	ID   int
+	Name string
+	Data []byte
+}
+
+// analysisJob buffers the events of one analysis for the connections streaming it.
+type analysisJob struct {
+	id     string
+	apiKey string // clientKeyID of the caller that started it
+	cancel context.CancelCauseFunc
+
+	mu      sync.Mutex
+	events  []sseEvent
+	done    bool
+	changed chan struct{} // closed and replaced whenever an event is added or the job finishes
+	clients int           // connections streaming the job
+	abandon *time.Timer   // cancels the job once nobody has streamed it for ANALYSIS_ABANDON_TIMEOUT
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = map[string]*analysisJob{}
+)
+
+// startJob registers a job and returns it with the context its analysis runs under. The context
+// keeps the request's values but not its cancellation: the analysis outlives a dropped connection,
+// and ends when the job is cancelled or abandoned. context.Cause tells which.
+func startJob(parent context.Context, id, apiKey string) (*analysisJob, context.Context) {
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(parent))
+	job := &analysisJob{id: id, apiKey: apiKey, cancel: cancel, changed: make(chan struct{})}
+	jobsMu.Lock()
+	jobs[id] = job
+	jobsMu.Unlock()
+	return job, ctx
+}
+
+func findJob(id string) *analysisJob {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return jobs[id]
+}
+
+// add numbers an event and wakes the connections waiting for it.
+func (j *analysisJob) add(name string, data []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.events = append(j.events, sseEvent{ID: len(j.events) + 1, Name: name, Data: data})
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// finish marks the job complete and forgets it once the resume window has passed.
+func (j *analysisJob) finish() {
+	j.mu.Lock()
+	j.done = true
+	close(j.changed)
+	j.changed = make(chan struct{})
+	if j.abandon != nil {
+		j.abandon.Stop()
+	}
+	j.mu.Unlock()
+	j.cancel(nil)
+	time.AfterFunc(sseResumeWindow, func() {
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+		if jobs[j.id] == j {
+			delete(jobs, j.id)
+		}
+	})
+}
+
+// stop cancels a running job with cause. It reports false if the job had already finished.
+func (j *analysisJob) stop(cause error) bool {
+	j.mu.Lock()
+	done := j.done
+	j.mu.Unlock()
+	if !done {
+		j.cancel(cause)
+	}
+	return !done
+}
+
+// attach counts a connection streaming the job and returns the function to call when it goes.
+// When the last one goes, the job is cancelled unless a client resumes it within
+// ANALYSIS_ABANDON_TIMEOUT, so a closed browser tab doesn't keep Gemini, urlscan and Chrome busy.
+func (j *analysisJob) attach() (detach func()) {
+	j.mu.Lock()
+	j.clients++
+	if j.abandon != nil {
+		j.abandon.Stop()
+		j.abandon = nil
+	}
+	j.mu.Unlock()
+	return func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.clients--
+		if j.clients > 0 || j.done || analysisAbandonTimeout <= 0 {
+			return
+		}
+		j.abandon = time.AfterFunc(analysisAbandonTimeout, func() {
+			j.mu.Lock()
+			abandoned := j.clients == 0 && !j.done
+			j.mu.Unlock()
+			if abandoned {
+				slog.Info("cancelling abandoned analysis", "analysis_id", j.id)
+				j.cancel(errJobAbandoned)
+			}
+		})
+	}
+}
+
+// cancelReason says why a job's context was cancelled, for its "cancelled" event.
+func cancelReason(ctx context.Context) string {
+	return context.Cause(ctx).Error()
+}
+
+// since returns the events after lastID, whether the job is finished, and a channel closed on the
+// next change.
+func (j *analysisJob) since(lastID int) ([]sseEvent, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var events []sseEvent
+	if lastID < len(j.events) {
+		events = j.events[max(lastID, 0):]
+	}
+	return events, j.done, j.changed
+}
+
+// streamJob writes the job's events after lastID to w until the job finishes or the client goes
+// away. It starts with the retry hint and sends a keepalive comment whenever the stream is idle
+// for SSE_KEEPALIVE_INTERVAL, so proxies don't close it during slow checks.
+func streamJob(ctx context.Context, w io.Writer, flusher http.Flusher, job *analysisJob, lastID int) {
+	defer job.attach()()
+	if sseRetry > 0 {
+		if _, err := fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds()); err != nil {
+			slog.WarnContext(ctx, "writing retry hint failed", "err", err)
+		}
+		flusher.Flush()
+	}
+	var keepalive <-chan time.Time
+	var ticker *time.Ticker
+	if sseKeepalive > 0 {
+		ticker = time.NewTicker(sseKeepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	for {
+		events, done, changed := job.since(lastID)
+		for _, e := range events {
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Name, e.Data); err != nil {
+				slog.WarnContext(ctx, "writing event failed", "event", e.Name, "err", err)
+				return
+			}
+			lastID = e.ID
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+			if ticker != nil {
+				ticker.Reset(sseKeepalive) // only idle streams need keepalives
+			}
+		}
+		if done {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "client disconnected from analysis stream", "analysis_id", job.id, "last_event_id", lastID)
+			return
+		case <-changed:
+		case <-keepalive:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				slog.DebugContext(ctx, "writing keepalive failed", "err", err)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// jobEventsHandler resumes an analysis stream: the events after the Last-Event-ID header (or
+// ?lastEventId=), then the rest as they arrive. Only the API key that started the job may
+// follow it; a job started without a key can only be followed with the admin key.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	job := findJob(r.PathValue("id"))
+	if job == nil || (!ownedByCaller(r, job.apiKey) && !isAdminRequest(r)) {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "analysis job not found or expired")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "streaming unsupported")
+		return
+	}
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("lastEventId")
+	}
+	lastID, err := strconv.Atoi(strings.TrimSpace(last))
+	if last != "" && (err != nil || lastID < 0) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "Last-Event-ID must be an event number")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Analysis-ID", job.id)
+	slog.InfoContext(r.Context(), "resuming analysis stream", "analysis_id", job.id, "last_event_id", lastID)
+	streamJob(r.Context(), w, flusher, job, lastID)
+}
+
+// jobCancelHandler stops a running analysis (DELETE /jobs/{id}). Its checks are cancelled, the
+// stream ends with a "cancelled" event, and the analysis is not saved.
+func jobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	job := findJob(r.PathValue("id"))
+	if job == nil || (!ownedByCaller(r, job.apiKey) && !isAdminRequest(r)) {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "analysis job not found or expired")
+		return
+	}
+	if !job.stop(errJobCancelled) {
+		writeJSONError(w, http.StatusConflict, errCodeConflict, "analysis has already finished")
+		return
+	}
+	slog.InfoContext(r.Context(), "analysis cancelled by client", "analysis_id", job.id)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "cancelling", "analysisId": job.id})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+)
+
+// landingPageDir is where landing-page screenshots are kept (SCREENSHOT_DIR/landing). Unlike the
+// per-request sandbox it outlives the analysis, so the paths in a verdict stay valid for the
+// frontend and reports; like email screenshots, they are removed with a cancelled, unsaved or
+// expired analysis.
+var landingPageDir string
+
+// LandingPageReport is what a suspicious link showed when it was opened in the browser.
+type LandingPageReport struct {
+	FinalURL       string       `json:"finalUrl"`
+	Title          string       `json:"title"`
+	Screenshot     string       `json:"screenshot"`
+	Forms          []FormReport `json:"forms"`
+	CredentialForm bool         `json:"credentialForm"` // the page asks for a password
+	Error          string       `json:"error,omitempty"`
+}
+
+// isCleanVerdict reports whether no scanner had anything against the URL.
+func isCleanVerdict(v Verdict) bool {
+	return !v.FinalDecision && v.Score <= 0
+}
+
+// refusePrivateTarget refuses a link whose host resolves to the internal network before a browser
+// is started for it. It only sees the first answer and not the redirects, so the browser itself
+// connects through publicOnlyProxy.
+func refusePrivateTarget(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if !isPublicIP(a.IP) {
+			return fmt.Errorf("%s resolves to non-public address %s", u.Hostname(), a.IP)
+		}
+	}
+	return nil
+}
+
+// publicDialer connects only to public addresses. The check runs on the address actually dialled,
+// after DNS resolution, so neither a redirect nor a DNS answer that changes between lookups can
+// reach the internal network.
+var publicDialer = &net.Dialer{
+	Timeout: 10 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); !isPublicIP(ip) {
+			return fmt.Errorf("refusing to connect to non-public address %s", host)
+		}
+		return nil
+	},
+}
+
+// publicOnlyProxy is the HTTP proxy the landing-page browser goes through, so that every request
+// it makes (the link, each redirect, every image and script) is dialled by publicDialer.
+type publicOnlyProxy struct {
+	transport *http.Transport
+}
+
+func (p publicOnlyProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		upstream, err := publicDialer.DialContext(r.Context(), "tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			upstream.Close()
+			http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+			return
+		}
+		client, buf, err := hj.Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		_, _ = client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(upstream, buf)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(client, upstream)
+		client.Close()
+		return
+	}
+	if r.URL.Scheme != "http" {
+		http.Error(w, "unsupported proxy request", http.StatusBadRequest)
+		return
+	}
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+var landingProxy struct {
+	once sync.Once
+	addr string
+	err  error
+}
+
+// landingProxyAddr starts publicOnlyProxy on a loopback port the first time it is needed.
+func landingProxyAddr() (string, error) {
+	landingProxy.once.Do(func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			landingProxy.err = err
+			return
+		}
+		landingProxy.addr = ln.Addr().String()
+		server := &http.Server{
+			Handler:           publicOnlyProxy{transport: &http.Transport{DialContext: publicDialer.DialContext, Proxy: nil}},
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := server.Serve(ln); err != nil {
+				slog.Error("landing page proxy stopped", "err", err)
+			}
+		}()
+	})
+	return landingProxy.addr, landingProxy.err
+}
+
+// captureLandingPage opens rawURL in a throwaway incognito browser with downloads denied,
+// screenshots the viewport and looks for credential forms in the rendered DOM.
+func captureLandingPage(ctx context.Context, rawURL string) LandingPageReport {
+	report := LandingPageReport{Forms: []FormReport{}}
+	if err := refusePrivateTarget(ctx, rawURL); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	proxy, err := landingProxyAddr()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	opts := append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.ProxyServer("http://"+proxy),
+		chromedp.Flag("proxy-bypass-list", "<-loopback>"), // loopback goes through the proxy too
+		chromedp.Flag("force-webrtc-ip-handling-policy", "disable_non_proxied_udp"),
+		chromedp.NoSandbox,
+		chromedp.Flag("disable-extensions", true),
+		chromedp.Flag("incognito", true),
+		chromedp.Flag("disable-gpu", true),
+		chromedp.Flag("disable-plugins", true),
+		chromedp.Flag("disable-sync", true),
+		chromedp.Flag("no-first-run", true),
+		chromedp.Flag("disable-features", "DownloadBubble,MediaRouter"),
+	)
+	allocCtx, cancel := chromedp.NewExecAllocator(ctx, opts...)
+	defer cancel()
+	bctx, cancel := chromedp.NewContext(allocCtx)
+	defer cancel()
+	bctx, cancel = context.WithTimeout(bctx, 45*time.Second)
+	defer cancel()
+
+	var buf []byte
+	var dom string
+	err = chromedp.Run(bctx,
+		browser.SetDownloadBehavior(browser.SetDownloadBehaviorBehaviorDeny),
+		emulation.SetDeviceMetricsOverride(1280, 1024, 1, false),
+		chromedp.Navigate(rawURL),
+		chromedp.WaitReady("body", chromedp.ByQuery),
+		chromedp.Sleep(2*time.Second), // let script-built login forms appear
+		chromedp.Location(&report.FinalURL),
+		chromedp.Title(&report.Title),
+		chromedp.OuterHTML("html", &dom, chromedp.ByQuery),
+		chromedp.CaptureScreenshot(&buf),
+	)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	report.Forms = findCredentialForms(dom)
+	if report.Forms == nil {
+		report.Forms = []FormReport{}
+	}
+	for _, f := range report.Forms {
+		if f.PasswordFields > 0 {
+			report.CredentialForm = true
+		}
+	}
+
+	if err := os.MkdirAll(landingPageDir, 0755); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	name := fmt.Sprintf("%s-%d.png", hex.EncodeToString(sum[:8]), time.Now().Unix())
+	path := filepath.Join(landingPageDir, name)
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Screenshot = filepath.ToSlash(path)
+	return report
+}
+
+// attachLandingPages captures the landing page of every verdict that isn't clean, up to
+// landingPageMax of them, and attaches the report to the verdict.
+func attachLandingPages(ctx context.Context, verdicts []Verdict) {
+	if landingPageMax <= 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	captured := 0
+	for i := range verdicts {
+		v := &verdicts[i]
+		if isCleanVerdict(*v) || v.Source == "allowlist" || !strings.HasPrefix(strings.ToLower(v.URL), "http") {
+			continue
+		}
+		if captured >= landingPageMax {
+			break
+		}
+		captured++
+		wg.Add(1)
+		go func(v *Verdict) {
+			defer wg.Done()
+			report := captureLandingPage(ctx, v.URL)
+			v.LandingPage = &report
+		}(v)
+	}
+	wg.Wait()
+}
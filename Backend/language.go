@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/abadojack/whatlanggo"
+)
+
+// LanguageInfo is the language an email is written in, as guessed from its text.
+type LanguageInfo struct {
+	Code       string  `json:"code"` // ISO 639-1, e.g. "de"
+	Name       string  `json:"name"`
+	Confidence float64 `json:"confidence"`
+	Reliable   bool    `json:"reliable"`
+	Tesseract  string  `json:"tesseract"` // language packs passed to Tesseract, e.g. "deu+eng"
+}
+
+// minLanguageConfidence is the detector confidence needed before OCR switches language packs.
+// whatlanggo's own "reliable" bar rejects many short but obvious emails.
+const minLanguageConfidence = 0.5
+
+// tesseractCodes covers the languages whose Tesseract pack name isn't their ISO 639-3 code.
+var tesseractCodes = map[string]string{
+	"cmn": "chi_sim",
+	"pes": "fas",
+	"ydd": "yid",
+	"zlm": "msa",
+}
+
+var (
+	tesseractLangsOnce sync.Once
+	tesseractInstalled map[string]bool
+)
+
+// installedTesseractLangs lists the language packs the local Tesseract can load. A nil map
+// means the list couldn't be read, in which case packs are passed through unchecked.
+func installedTesseractLangs() map[string]bool {
+	tesseractLangsOnce.Do(func() {
+		out, err := exec.Command(tesseractPath(), "--list-langs").CombinedOutput()
+		if err != nil {
+			slog.Warn("could not list Tesseract languages, assuming all are installed", "err", err)
+			return
+		}
+		tesseractInstalled = map[string]bool{}
+		for _, line := range strings.Split(string(out), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.Contains(line, " ") {
+				tesseractInstalled[line] = true
+			}
+		}
+	})
+	return tesseractInstalled
+}
+
+// detectLanguage guesses the language of text and picks the Tesseract packs for it. English is
+// always included, since brand names, URLs and footers are usually English whatever the body.
+func detectLanguage(text string) LanguageInfo {
+	info := LanguageInfo{Code: "en", Name: "English", Tesseract: "eng"}
+	if len(strings.Fields(text)) < 5 {
+		return info
+	}
+	d := whatlanggo.Detect(text)
+	info.Confidence = d.Confidence
+	info.Reliable = d.IsReliable()
+	if d.Confidence < minLanguageConfidence || d.Lang == whatlanggo.Eng {
+		return info
+	}
+	info.Code = d.Lang.Iso6391()
+	info.Name = d.Lang.String()
+
+	pack := d.Lang.Iso6393()
+	if mapped, ok := tesseractCodes[pack]; ok {
+		pack = mapped
+	}
+	if installed := installedTesseractLangs(); installed != nil && !installed[pack] {
+		slog.Info("Tesseract language pack not installed, OCR will use English only", "pack", pack)
+		return info
+	}
+	info.Tesseract = pack + "+eng"
+	return info
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type requestIDKey struct{}
+
+// contextHandler adds the request ID carried by the context to every record, so a line logged
+// with slog.InfoContext(ctx, ...) anywhere below a handler can be traced back to its request.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// setupLogging installs the process-wide slog logger. LOG_FORMAT=json switches from text to JSON
+// lines; LOG_LEVEL is debug, info (default), warn or error.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(os.Getenv("LOG_LEVEL")))); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+
+// requestIDFor reuses a caller-supplied X-Request-ID (e.g. from a proxy) when it is sane and
+// otherwise generates one.
+func requestIDFor(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get("X-Request-ID")); validRequestID.MatchString(id) {
+		return id
+	}
+	return newAnalysisID()
+}
+
+// logger returns the logger for work done on behalf of this email's request.
+func (e EmailData) logger() *slog.Logger {
+	if e.RequestID == "" {
+		return slog.Default()
+	}
+	return slog.Default().With("request_id", e.RequestID)
+}
+
+// requestContext returns the context tagged with the email's request ID for work that outlives
+// the HTTP request (rendering, AI calls) but should still log under it: the analysis job's, so
+// the work stops when the job is cancelled, or a background one outside a job.
+func (e EmailData) requestContext() context.Context {
+	ctx := e.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return contextWithRequestID(ctx, e.RequestID)
+}
+
+// tagRequestID adds a "requestId" member to a JSON object payload; anything else is returned as is.
+func tagRequestID(payload []byte, id string) []byte {
+	if id == "" || len(payload) < 2 || payload[0] != '{' {
+		return payload
+	}
+	tagged := []byte(`{"requestId":"` + id + `"`)
+	if rest := bytes.TrimSpace(payload[1:]); len(rest) > 0 && rest[0] != '}' {
+		tagged = append(tagged, ',')
+	}
+	return append(tagged, payload[1:]...)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// Newsletters are bulk mail by design: dozens of tracking pixels, images on the email service's
+// CDN, links through its click tracker. parseEmail reads their List-Id, List-Unsubscribe and
+// Precedence headers and recognises the big email service providers by their Return-Path or
+// sending server. Anyone can write a Return-Path, and the name a server gives itself (HELO), so
+// the provider only counts as verified when the server that handed the message to ours has a
+// reverse DNS name of the provider's, as checked and written in a Received header by one of
+// TRUSTED_MX_HOSTS, or when an Authentication-Results header of one of TRUSTED_AUTHSERV_IDS
+// reports a passing DKIM signature of the provider's domain. A verified newsletter whose unsubscribe link is the
+// sender's or the provider's doesn't lose the tracking-pixel or remote-content points; an
+// unsubscribe link anywhere else fails ListUnsubscribeMatchesSender.
+
+// emailServiceProviders maps the domains of the big email service providers (bounce domains,
+// sending servers, unsubscribe and content hosts) to their names.
+var emailServiceProviders = map[string]string{
+	"sendgrid.net": "SendGrid", "sendgrid.com": "SendGrid",
+	"mcsv.net": "Mailchimp", "mcdlv.net": "Mailchimp", "rsgsv.net": "Mailchimp", "list-manage.com": "Mailchimp", "mcusercontent.com": "Mailchimp",
+	"mandrillapp.com": "Mandrill",
+	"amazonses.com":   "Amazon SES",
+	"mailgun.org":     "Mailgun", "mailgun.net": "Mailgun",
+	"sparkpostmail.com": "SparkPost",
+	"exacttarget.com":   "Salesforce Marketing Cloud",
+	"cmail19.com":       "Campaign Monitor", "cmail20.com": "Campaign Monitor", "createsend.com": "Campaign Monitor",
+	"hubspotemail.net": "HubSpot", "hubspotusercontent-na1.net": "HubSpot",
+	"klaviyomail.com": "Klaviyo", "klaviyo.com": "Klaviyo",
+	"mtasv.net": "Postmark", "postmarkapp.com": "Postmark",
+	"rs6.net": "Constant Contact", "constantcontact.com": "Constant Contact",
+	"mktomail.com": "Marketo",
+}
+
+// MailingList is what the headers say about a message sent to a list.
+type MailingList struct {
+	ListID      string   `json:"listId,omitempty"`
+	Precedence  string   `json:"precedence,omitempty"`
+	Unsubscribe []string `json:"unsubscribe"` // List-Unsubscribe targets
+	OneClick    bool     `json:"oneClick"`    // List-Unsubscribe-Post: List-Unsubscribe=One-Click
+	ReturnPath  string   `json:"returnPath,omitempty"`
+	ESP         string   `json:"esp,omitempty"`
+	ESPVerified bool     `json:"espVerified"` // the server that delivered to ours or a passing DKIM signature belongs to the ESP too
+}
+
+var listUnsubscribeTarget = regexp.MustCompile(`<([^>]+)>`)
+
+// readMailingList reads the list headers of env, or returns nil for a message without any.
+// headers are env's raw headers, in order, for the Received and Authentication-Results headers
+// our own servers wrote.
+func readMailingList(env *enmime.Envelope, headers []headerField) *MailingList {
+	m := &MailingList{
+		ListID:      strings.TrimSpace(env.GetHeader("List-Id")),
+		Precedence:  strings.ToLower(strings.TrimSpace(env.GetHeader("Precedence"))),
+		Unsubscribe: []string{},
+		OneClick:    strings.Contains(strings.ToLower(env.GetHeader("List-Unsubscribe-Post")), "one-click"),
+	}
+	for _, t := range listUnsubscribeTarget.FindAllStringSubmatch(env.GetHeader("List-Unsubscribe"), -1) {
+		m.Unsubscribe = append(m.Unsubscribe, strings.TrimSpace(t[1]))
+	}
+	if rp, err := mail.ParseAddress(env.GetHeader("Return-Path")); err == nil {
+		m.ReturnPath = strings.ToLower(rp.Address)
+	}
+	if _, rpDomain, ok := strings.Cut(m.ReturnPath, "@"); ok {
+		m.ESP = emailServiceProviders[registrableDomain(rpDomain)]
+	}
+	// Senders often bounce to a domain of their own (em.example.com) pointed at the ESP.
+	delivering := deliveringESP(headers)
+	var signing []string
+	for _, d := range trustedDKIMDomains(headers) {
+		if esp := emailServiceProviders[registrableDomain(d)]; esp != "" {
+			signing = append(signing, esp)
+		}
+	}
+	if m.ESP == "" {
+		m.ESP = delivering
+	}
+	if m.ESP == "" && len(signing) > 0 {
+		m.ESP = signing[0]
+	}
+	m.ESPVerified = m.ESP != "" && (delivering == m.ESP || slices.Contains(signing, m.ESP))
+	if m.ListID == "" && len(m.Unsubscribe) == 0 && m.ESP == "" && m.Precedence != "bulk" && m.Precedence != "list" {
+		return nil
+	}
+	return m
+}
+
+var (
+	receivedFrom     = regexp.MustCompile(`^from (\S+) \(([^)]*)\)`)
+	receivedHostname = regexp.MustCompile(`^(?:[a-z0-9-]+\.)+[a-z]{2,63}$`)
+	receivedRDNSName = regexp.MustCompile(`(\S+?)\.? \[[0-9a-f.:]+\]`)
+)
+
+// receivedRDNS returns the reverse DNS name the receiving server looked up for the connecting IP,
+// from the "from" clause of a Received header, or "". The name right after "from" is usually the
+// sender's HELO, which it chooses freely; the looked-up name is in the comment, before the IP
+// ("from helo (rdns [1.2.3.4])" for Postfix, Sendmail and Gmail), except for Exim, which writes
+// the looked-up name first and the HELO in the comment ("from rdns ([1.2.3.4] helo=helo)").
+func receivedRDNS(h string) string {
+	m := receivedFrom.FindStringSubmatch(strings.ToLower(strings.Join(strings.Fields(h), " ")))
+	if m == nil || strings.Contains(m[2], "may be forged") {
+		return ""
+	}
+	name := ""
+	if r := receivedRDNSName.FindStringSubmatch(m[2]); r != nil {
+		name = r[1]
+	} else if strings.Contains(m[2], "helo=") {
+		name = m[1]
+	}
+	if !receivedHostname.MatchString(name) {
+		return "" // "unknown", or an address literal
+	}
+	return name
+}
+
+// deliveringESP returns the ESP whose server, by reverse DNS, handed the message to ours, as
+// written in the Received header of one of TRUSTED_MX_HOSTS, or "". Any other Received header
+// could be the sender's own.
+func deliveringESP(headers []headerField) string {
+	i := ownReceived(headers)
+	if i < 0 {
+		return ""
+	}
+	return emailServiceProviders[registrableDomain(receivedRDNS(headers[i].Value))]
+}
+
+// unsubscribeDomain returns the registrable domain of a List-Unsubscribe target.
+func unsubscribeDomain(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	if strings.EqualFold(u.Scheme, "mailto") {
+		addr, _, _ := strings.Cut(u.Opaque, "?")
+		_, domain, _ := strings.Cut(addr, "@")
+		return registrableDomain(domain)
+	}
+	return registrableDomain(u.Hostname())
+}
+
+// unsubscribeMatches reports whether the List-Unsubscribe targets belong to the sender or its
+// ESP, and returns the ones that don't. A message without targets matches.
+func (m *MailingList) unsubscribeMatches(senderDomain string) (bool, []string) {
+	var others []string
+	for _, t := range m.Unsubscribe {
+		d := unsubscribeDomain(t)
+		if d == "" {
+			continue
+		}
+		if d == senderDomain || (m.ESP != "" && emailServiceProviders[d] == m.ESP) {
+			return true, nil
+		}
+		others = append(others, d)
+	}
+	return len(others) == 0, others
+}
+
+// bulk reports whether the headers mark the message as sent to a list.
+func (m *MailingList) bulk() bool {
+	return m != nil && (m.ListID != "" || len(m.Unsubscribe) > 0 || m.Precedence == "bulk" || m.Precedence == "list")
+}
+
+// newsletter reports whether the message is bulk mail from a verified ESP with an unsubscribe
+// link of the sender's or the ESP's, so bulk-mail traits shouldn't count against it.
+func (m *MailingList) newsletter(senderDomain string) bool {
+	if !m.bulk() || !m.ESPVerified || len(m.Unsubscribe) == 0 {
+		return false
+	}
+	ok, _ := m.unsubscribeMatches(senderDomain)
+	return ok
+}
+
+// MailingListResult is the mailingListAnalysis event.
+type MailingListResult struct {
+	MailingList
+	Bulk               bool     `json:"bulk"`
+	Newsletter         bool     `json:"newsletter"` // verified ESP, matching unsubscribe link
+	UnsubscribeDomains []string `json:"unsubscribeDomains"`
+	UnrelatedDomains   []string `json:"unrelatedDomains"` // unsubscribe domains that are neither the sender's nor the ESP's
+	Message            string   `json:"message"`
+	ScoreImpact        int      `json:"scoreImpact"`
+}
+
+func performMailingListAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "ListUnsubscribeMatchesSender" {
+			check = c
+			break
+		}
+	}
+	result := MailingListResult{UnsubscribeDomains: []string{}, UnrelatedDomains: []string{}}
+	m := Email.MailingList
+	if m == nil {
+		result.Message = "The email wasn't sent to a mailing list."
+		result.ScoreImpact = check.Impact
+		result.Unsubscribe = []string{}
+		ch <- CheckResult{EventName: "mailingListAnalysis", Payload: result}
+		return
+	}
+	result.MailingList = *m
+	result.Bulk = m.bulk()
+	result.Newsletter = m.newsletter(Email.Domain)
+	for _, t := range m.Unsubscribe {
+		if d := unsubscribeDomain(t); d != "" {
+			result.UnsubscribeDomains = append(result.UnsubscribeDomains, d)
+		}
+	}
+	matches, others := m.unsubscribeMatches(Email.Domain)
+	if !matches {
+		result.UnrelatedDomains = others
+	}
+
+	var parts []string
+	switch {
+	case result.Newsletter:
+		parts = append(parts, fmt.Sprintf("A newsletter sent through %s, which delivered it.", m.ESP))
+	case m.ESP != "" && !m.ESPVerified:
+		parts = append(parts, fmt.Sprintf("The Return-Path claims %s, but the server that delivered the email isn't theirs.", m.ESP))
+	case m.ESP != "":
+		parts = append(parts, fmt.Sprintf("Sent through %s.", m.ESP))
+	case result.Bulk:
+		parts = append(parts, "Bulk mail without a recognised email service provider.")
+	}
+	if matches {
+		result.ScoreImpact = check.Impact
+	} else {
+		parts = append(parts, fmt.Sprintf("The unsubscribe link goes to %s, not the sender's domain %s.", strings.Join(others, ", "), Email.Domain))
+	}
+	result.Message = strings.Join(parts, " ")
+	ch <- CheckResult{EventName: "mailingListAnalysis", Payload: result}
+}
@@ -2,17 +2,19 @@ package main
 
 import (
 	"bufio"
-	"database/sql"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -32,76 +34,147 @@ type URLScanUpdate struct {
 	FinalDecision bool   `json:"finalDecision"`
 	Report        string `json:"report"`
 	Error         string `json:"error,omitempty"`
+	Status        string `json:"status,omitempty"`   // queued or notScanned while the scan quota holds the URL back
+	Severity      string `json:"severity,omitempty"` // malicious, suspicious, unknown or clean, with a verdict
 }
 
 type URLScanStartInfo struct {
 	Total int `json:"total"`
 }
 
+// StageProgress is the payload of the progress events a slow check sends while it runs
+// (renderingStarted, ocrCompleted, geminiStarted, ...), so clients can show more than a spinner.
+type StageProgress struct {
+	Check     string `json:"check"`               // the event the check's result will arrive as
+	ElapsedMs int64  `json:"elapsedMs,omitempty"` // on *Completed events, how long the stage took
+}
+
+// sendStage sends a progress event for check; started is the zero time for *Started events.
+func sendStage(eventChan chan<- CheckResult, name, check string, started time.Time) {
+	progress := StageProgress{Check: check}
+	if !started.IsZero() {
+		progress.ElapsedMs = time.Since(started).Milliseconds()
+	}
+	eventChan <- CheckResult{EventName: name, Payload: progress}
+}
+
 type DomainAnalysisResult struct {
 	Status           string `json:"status"`
 	Message          string `json:"message"`
 	MatchedDomain    string `json:"matchedDomain"`
 	ScoreImpact      int    `json:"scoreImpact"`
 	SuspectSubdomain string `json:"suspectSubdomain"` // Added for context
+
+	MailDNS            MailDNSResult `json:"mailDns"`
+	MailDNSScoreImpact int           `json:"mailDnsScoreImpact"`
+
+	TLSCert *TLSCertInfo `json:"tlsCert,omitempty"` // informational: the sender domain's web certificate
+
+	Lookup *DomainLookupStats `json:"lookup,omitempty"` // how the lookalike search ran
+
+	DeceptiveSubdomain *DeceptiveSubdomain `json:"deceptiveSubdomain,omitempty"` // the sender's host shows another domain or brand
+
+	TrancoRank *int `json:"trancoRank,omitempty"` // 0 = not in the top million; absent when the list isn't loaded
 }
 type URLAnalysisResult struct {
-	Status         string    `json:"status"`
-	Message        string    `json:"message"`
-	MaliciousCount int       `json:"maliciousCount"`
-	ScoreImpact    int       `json:"scoreImpact"`
-	UrlVerdicts    []Verdict `json:"urlVerdicts"` // Embed verdicts
+	Status         string         `json:"status"`
+	Message        string         `json:"message"`
+	MaliciousCount int            `json:"maliciousCount"`
+	Severities     map[string]int `json:"severities"` // number of links per severity: malicious, suspicious, unknown, clean
+	ScoreImpact    int            `json:"scoreImpact"`
+	UrlVerdicts    []Verdict      `json:"urlVerdicts"` // Embed verdicts
+
+	RedirectChains     []RedirectChain `json:"redirectChains,omitempty"`
+	LongRedirectChains int             `json:"longRedirectChains"`
+
+	LinkMismatches      []LinkMismatch `json:"linkMismatches"`
+	MismatchScoreImpact int            `json:"mismatchScoreImpact"`
+
+	HeuristicFindings    []URLHeuristicFinding `json:"heuristicFindings"`
+	HeuristicScoreImpact int                   `json:"heuristicScoreImpact"`
+
+	Certificates []TLSCertInfo `json:"certificates,omitempty"` // informational: certs of the final (post-redirect) hosts
+	LinkDomains  []DomainRank  `json:"linkDomains,omitempty"`  // informational: Tranco ranks of the link domains
+	HostingGeo   []HostGeo     `json:"hostingGeo,omitempty"`   // informational: country and ASN of the link hosts
+
+	UnscannedCount int `json:"unscannedCount,omitempty"` // links the URL scan quota didn't allow to be scanned
 }
 type ExecutableAnalysisResult struct {
-	Found       bool   `json:"found"`
-	Message     string `json:"message"`
-	ScoreImpact int    `json:"scoreImpact"`
+	Found       bool               `json:"found"`
+	Message     string             `json:"message"`
+	ScoreImpact int                `json:"scoreImpact"`
+	Files       []AttachmentReport `json:"files"`
+
+	MacrosFound      bool `json:"macrosFound"`
+	MacroScoreImpact int  `json:"macroScoreImpact"`
 }
 type CompanyIdentificationResult struct {
-	Identified  bool   `json:"identified"`
-	Name        string `json:"name,omitempty"`
-	ScoreImpact int    `json:"scoreImpact"`
+	Identified  bool     `json:"identified"`
+	Name        string   `json:"name,omitempty"`
+	Confidence  *float64 `json:"confidence,omitempty"` // Gemini's, from 0 to 1; scales the points awarded
+	ScoreImpact int      `json:"scoreImpact"`
 }
 type CompanyVerificationResult struct {
-	Verified    bool   `json:"verified"`
-	Message     string `json:"message"`
-	ScoreImpact int    `json:"scoreImpact"`
+	Verified    bool            `json:"verified"`
+	Message     string          `json:"message"`
+	ScoreImpact int             `json:"scoreImpact"`
+	Registry    *RegistryRecord `json:"registry,omitempty"` // the company registries' record, when they were asked
 }
 type ActionAnalysisResult struct {
 	ActionRequired bool   `json:"actionRequired"`
 	Action         string `json:"action"`
 }
 type RealismAnalysisResult struct {
-	IsRealistic bool   `json:"isRealistic"`
-	Reason      string `json:"reason"`
-	ScoreImpact int    `json:"scoreImpact"`
+	IsRealistic bool     `json:"isRealistic"`
+	Reason      string   `json:"reason"`
+	Confidence  *float64 `json:"confidence,omitempty"` // Gemini's, from 0 to 1; scales the points awarded
+	ScoreImpact int      `json:"scoreImpact"`
 }
 type PhoneNumbersValidation struct {
 	PhoneNumber string `json:"phoneNumber"`
 	IsValid     bool   `json:"isValid"`
 }
 type ContactMethodResult struct {
-	PhoneNumbers []PhoneNumbersValidation `json:"phoneNumbers"`
-	ScoreImpact  int                      `json:"scoreImpact"`
+	PhoneNumbers       []PhoneNumbersValidation  `json:"phoneNumbers"`
+	ScoreImpact        int                       `json:"scoreImpact"`
+	Emails             []ContactEmailValidation  `json:"emails"`
+	EmailScoreImpact   int                       `json:"emailScoreImpact"`
+	Addresses          []PostalAddressValidation `json:"addresses"`
+	AddressScoreImpact int                       `json:"addressScoreImpact"`
 }
 type ContentAnalysisResult struct {
 	CompanyIdentification CompanyIdentificationResult `json:"companyIdentification"`
 	CompanyVerification   CompanyVerificationResult   `json:"companyVerification"`
 	ActionAnalysis        ActionAnalysisResult        `json:"actionAnalysis"`
 	Summary               string                      `json:"summary"`
+	Intent                *IntentClassification       `json:"intent,omitempty"` // what Gemini says the email is after
 	RealismAnalysis       RealismAnalysisResult       `json:"realismAnalysis"`
 	ContactMethodAnalysis ContactMethodResult         `json:"contactMethodAnalysis"`
+	AIStats               AICallStats                 `json:"aiStats"`
+	Language              LanguageInfo                `json:"language"`
+	PaymentScam           *PaymentScamResult          `json:"paymentScam,omitempty"`         // wallet addresses / gift card requests in the OCR text
+	VisualImpersonation   *VisualImpersonationResult  `json:"visualImpersonation,omitempty"` // rendered analysis only: the brand the screenshot shows
+	OCR                   *OCRResult                  `json:"ocr,omitempty"`                 // rendered analysis only: text blocks and their confidence
+	RenderedText          *RenderedTextResult         `json:"renderedText,omitempty"`        // rendered analysis only: where its text came from
+	RenderVariants        []RenderVariantResult       `json:"renderVariants,omitempty"`      // rendered analysis only: the RENDER_VARIANTS screenshots
+	BlockedRequests       []BlockedRequest            `json:"blockedRequests,omitempty"`     // rendered analysis only: what RENDER_NETWORK_ISOLATED refused
+	Screenshot            string                      `json:"screenshot,omitempty"`          // rendered analysis only: kept for the HTML report
+	QuotedChars           int                         `json:"quotedChars,omitempty"`         // length of the quoted reply thread left out of the AI analysis
 	Error                 string                      `json:"error,omitempty"`
 }
 
 type ScoreResult struct {
-	BaseScore          int             `json:"baseScore"`
-	FinalScoreNormal   int             `json:"finalScoreNormal"`
-	FinalScoreRendered int             `json:"finalScoreRendered"`
-	MaxPossibleScore   float64         `json:"maxPossibleScore"`
-	NormalPercentage   float64         `json:"normalPercentage"`
-	RenderedPercentage float64         `json:"renderedPercentage"`
-	EnabledChecks      map[string]bool `json:"enabledChecks,omitempty"`
+	BaseScore          int                  `json:"baseScore"`
+	FinalScoreNormal   int                  `json:"finalScoreNormal"`
+	FinalScoreRendered int                  `json:"finalScoreRendered"`
+	MaxPossibleScore   float64              `json:"maxPossibleScore"`
+	NormalPercentage   float64              `json:"normalPercentage"`
+	RenderedPercentage float64              `json:"renderedPercentage"`
+	EnabledChecks      map[string]bool      `json:"enabledChecks,omitempty"`
+	AnalysisID         string               `json:"analysisId,omitempty"`
+	Profile            string               `json:"profile,omitempty"`
+	Timings            *AnalysisTimings     `json:"timings,omitempty"`    // where the analysis spent its time
+	Suppressed         *FeedbackSuppression `json:"suppressed,omitempty"` // the sender's been reported as a false positive too often to flag
 }
 
 // Struct for streaming individual check results
@@ -128,29 +201,241 @@ func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 
 func init() {
 	setupDependencies()
-	if err := godotenv.Load(); err != nil {
-		log.Printf(".env file not found: %v\n", err)
+	envErr := godotenv.Load()
+	cfgErr := loadConfigFile()
+	setupLogging()
+	if envErr != nil {
+		slog.Warn(".env file not found", "err", envErr)
+	}
+	if cfgErr != nil {
+		configProblem("%v", cfgErr)
 	}
 	geminiKey = os.Getenv("GEMINI_API_KEY")
 	aiModel = os.Getenv("AI_MODEL")
+	aiFallbackModel = os.Getenv("AI_FALLBACK_MODEL")
+	if aiFallbackModel == "" {
+		aiFallbackModel = "gemini-1.5-flash"
+	}
+	aiMaxRetries = getEnvInt("AI_MAX_RETRIES", 3)
+	aiInitialBackoff = getEnvDuration("AI_INITIAL_BACKOFF", time.Second)
+	aiTimeout = getEnvDuration("AI_TIMEOUT", 90*time.Second)
+	aiCacheTTL = getEnvDuration("AI_CACHE_TTL", 24*time.Hour)
+	aiCacheMaxEntries = getEnvInt("AI_CACHE_MAX_ENTRIES", 500)
+	aiPriceInputPerMTok = getEnvFloat("AI_PRICE_INPUT_PER_MTOK", 0)
+	aiPriceOutputPerMTok = getEnvFloat("AI_PRICE_OUTPUT_PER_MTOK", 0)
+	companyDBDriver = strings.ToLower(strings.TrimSpace(envOr("COMPANY_DB_DRIVER", "sqlite")))
+	companyDBDSN = os.Getenv("COMPANY_DB_DSN")
+	if companyDBDriver == "sqlite" && companyDBDSN != "" {
+		companyDBPath = companyDBDSN
+	}
+	resultsDBPath = os.Getenv("RESULTS_DB")
+	if resultsDBPath == "" {
+		resultsDBPath = "results.db"
+	}
 	googleSearchAPIKey = os.Getenv("GOOGLE_SEARCH_API_KEY")
 	googleSearchCX = os.Getenv("GOOGLE_SEARCH_CX")
 	mainPrompt = os.Getenv("MAIN_PROMPT")
+	promptDir = os.Getenv("PROMPT_DIR")
+	if promptDir == "" {
+		promptDir = "prompts"
+	}
+	promptTemplate = os.Getenv("PROMPT_TEMPLATE")
+	if promptTemplate == "" {
+		promptTemplate = "main"
+	}
+	promptReloadInterval = getEnvDuration("PROMPT_RELOAD_INTERVAL", 10*time.Second)
+	adminAPIKey = os.Getenv("ADMIN_API_KEY")
 	URLScanAPIKey = os.Getenv("URLSCAN_API_KEY")
 	VTotalAPIKey = os.Getenv("VTotal_API_KEY")
+	safeBrowsingAPIKey = os.Getenv("SAFE_BROWSING_API_KEY")
+	placesAPIKey = os.Getenv("PLACES_API_KEY")
+	companiesHouseAPIKey = os.Getenv("COMPANIES_HOUSE_API_KEY")
+	openCorporatesAPIToken = os.Getenv("OPENCORPORATES_API_TOKEN")
+	cloudflareAccountID = os.Getenv("CLOUDFLARE_ACCOUNT_ID")
+	cloudflareAPIToken = os.Getenv("CLOUDFLARE_API_TOKEN")
+	safeBrowsingTrustClean = os.Getenv("SAFE_BROWSING_TRUST_CLEAN") == "TRUE"
+	defangOutput = os.Getenv("DEFANG_OUTPUT") == "TRUE"
+	threatFeedsEnabled = os.Getenv("THREAT_FEEDS_ENABLED") == "TRUE"
+	threatFeedDBPath = os.Getenv("THREAT_FEED_DB")
+	if threatFeedDBPath == "" {
+		threatFeedDBPath = "threat_feeds.db"
+	}
+	threatFeedInterval = getEnvDuration("THREAT_FEED_INTERVAL", 6*time.Hour)
+	trancoEnabled = os.Getenv("TRANCO_ENABLED") == "TRUE"
+	trancoPath = envOr("TRANCO_FILE", "tranco.csv")
+	geoIPDBPath = strings.TrimSpace(os.Getenv("GEOIP_DB"))
+	geoIPASNDBPath = strings.TrimSpace(os.Getenv("GEOIP_ASN_DB"))
+	trancoRefresh = getEnvDuration("TRANCO_REFRESH", 24*time.Hour)
+	brandIndexRefresh = getEnvDuration("BRAND_INDEX_REFRESH", time.Hour)
+	dbRefreshMaxAge = getEnvDuration("DB_REFRESH_INTERVAL", 0)
+	dbRefreshMaxPerType = getEnvInt("DB_REFRESH_MAX_PER_TYPE", 400000)
+	phishTankAppKey = os.Getenv("PHISHTANK_APP_KEY")
+	redirectHopThreshold = getEnvInt("REDIRECT_HOP_THRESHOLD", 3)
+	trackingPixelThreshold = getEnvInt("TRACKING_PIXEL_THRESHOLD", 3)
+	trustedForwarders = splitList(os.Getenv("TRUSTED_FORWARDERS"))
+	trustedAuthservIDs = splitList(os.Getenv("TRUSTED_AUTHSERV_IDS"))
+	trustedMXHosts = splitList(os.Getenv("TRUSTED_MX_HOSTS"))
+	dnsblZones = splitList(os.Getenv("DNSBL_ZONES"))
+	if _, set := os.LookupEnv("DNSBL_ZONES"); !set {
+		dnsblZones = []string{"zen.spamhaus.org", "bl.spamcop.net", "b.barracudacentral.org"}
+	}
+	regions, err := parsePhoneRegions(os.Getenv("PHONE_REGIONS"))
+	if err != nil {
+		configProblem("PHONE_REGIONS: %v", err)
+	}
+	phoneRegions = regions
+	archiveMaxDepth = getEnvInt("ARCHIVE_MAX_DEPTH", 3)
+	archiveMaxBytes = int64(getEnvInt("ARCHIVE_MAX_MB", 100)) << 20
+	attachedEmailMaxDepth = getEnvInt("ATTACHED_EMAIL_MAX_DEPTH", 2)
+	attachedEmailMax = getEnvInt("ATTACHED_EMAIL_MAX", 5)
+	landingPageMax = getEnvInt("LANDING_PAGE_MAX", 5)
+	maxEMLBytes = int64(getEnvInt("MAX_EML_MB", 25)) << 20
+	switch piiRedactionMode = strings.ToLower(strings.TrimSpace(os.Getenv("PII_REDACTION"))); piiRedactionMode {
+	case piiRedactionOff, piiRedactionStrict:
+	default:
+		piiRedactionMode = piiRedactionStandard
+	}
+	piiRedactionImages = os.Getenv("PII_REDACTION_IMAGES") == "TRUE"
 	isURLScanEnabled = os.Getenv("URLSCAN_ENABLED") == "TRUE"
+	geminiEnabled = os.Getenv("GEMINI_ENABLED") != "FALSE"
+	googleSearchEnabled = os.Getenv("GOOGLE_SEARCH_ENABLED") != "FALSE"
+	remoteImagesEnabled = os.Getenv("REMOTE_IMAGES_ENABLED") != "FALSE"
+	renderIsolated = os.Getenv("RENDER_NETWORK_ISOLATED") == "TRUE"
+	if renderIsolated {
+		// Isolation promises the sender learns nothing, which downloading the images would break.
+		remoteImagesEnabled = false
+	}
+	stripQuotedReplies = os.Getenv("STRIP_QUOTED_REPLIES") != "FALSE"
+	yaraRulesDir = strings.TrimSpace(os.Getenv("YARA_RULES_DIR"))
+	yaraCommand = envOr("YARA_COMMAND", "yara")
+	scriptRulesDir = strings.TrimSpace(os.Getenv("SCRIPT_RULES_DIR"))
+	feedbackSuppressAfter = getEnvInt("FEEDBACK_SUPPRESS_AFTER", 3)
+	campaignSimilarity = getEnvInt("CAMPAIGN_SIMILARITY", 70)
+	campaignWindow = getEnvDuration("CAMPAIGN_WINDOW", 7*24*time.Hour)
+	campaignWebhookURL = strings.TrimSpace(os.Getenv("CAMPAIGN_WEBHOOK_URL"))
+	campaignWebhookAfter = getEnvInt("CAMPAIGN_WEBHOOK_AFTER", 2)
+	clamdAddress = strings.TrimSpace(os.Getenv("CLAMD_ADDRESS"))
+	clamdTimeout = getEnvDuration("CLAMD_TIMEOUT", 30*time.Second)
+	spamdAddress = strings.TrimSpace(os.Getenv("SPAMD_ADDRESS"))
+	rspamdURL = strings.TrimSpace(os.Getenv("RSPAMD_URL"))
+	rspamdPassword = os.Getenv("RSPAMD_PASSWORD")
+	spamEngineTimeout = getEnvDuration("SPAM_ENGINE_TIMEOUT", 30*time.Second)
+	uiEnabled = os.Getenv("UI_ENABLED") != "FALSE"
+	sseKeepalive = getEnvDuration("SSE_KEEPALIVE_INTERVAL", 15*time.Second)
+	sseRetry = getEnvDuration("SSE_RETRY", 3*time.Second)
+	sseResumeWindow = getEnvDuration("SSE_RESUME_WINDOW", 5*time.Minute)
+	resultsRetention = getEnvDuration("RESULTS_RETENTION", 0)
+	analysisAbandonTimeout = getEnvDuration("ANALYSIS_ABANDON_TIMEOUT", 30*time.Second)
+	siemSyslogAddress = strings.TrimSpace(os.Getenv("SIEM_SYSLOG_ADDRESS"))
+	siemFormat = strings.ToLower(strings.TrimSpace(envOr("SIEM_FORMAT", "json")))
+	splunkHECURL = strings.TrimSpace(os.Getenv("SPLUNK_HEC_URL"))
+	splunkHECToken = os.Getenv("SPLUNK_HEC_TOKEN")
+	splunkHECSourcetype = envOr("SPLUNK_HEC_SOURCETYPE", "email_checker")
+	siemTimeout = getEnvDuration("SIEM_TIMEOUT", 10*time.Second)
+	ocrEngineName = strings.ToLower(strings.TrimSpace(envOr("OCR_ENGINE", "tesseract")))
+	googleVisionAPIKey = os.Getenv("GOOGLE_VISION_API_KEY")
+	emailPath = envOr("EMAIL_DIR", "TestEmails")
+	screenshotDir = envOr("SCREENSHOT_DIR", "screenshots")
+	landingPageDir = filepath.Join(screenshotDir, "landing")
+	emailScreenshotDir = filepath.Join(screenshotDir, "emails")
+	defaultCountry = strings.ToLower(strings.TrimSpace(envOr("DEFAULT_COUNTRY", "gb")))
+	urlscanDefaults.Visibility = envOr("URLSCAN_VISIBILITY", urlscanDefaults.Visibility)
+	urlscanDefaults.Country = os.Getenv("URLSCAN_COUNTRY")
+	urlScanQuotas = map[string]*scanQuota{
+		"urlscan":    newScanQuota(getEnvInt("URLSCAN_QUOTA_PER_MINUTE", 0), getEnvInt("URLSCAN_QUOTA_PER_DAY", 0)),
+		"virustotal": newScanQuota(getEnvInt("VTOTAL_QUOTA_PER_MINUTE", 0), getEnvInt("VTOTAL_QUOTA_PER_DAY", 0)),
+	}
+	if source, err := checkRenderedTextSource(envOr("RENDERED_TEXT_SOURCE", renderedTextAuto)); err != nil {
+		configProblem("RENDERED_TEXT_SOURCE %v", err)
+	} else {
+		renderedTextSource = source
+	}
+	if views, err := parseRenderVariants(os.Getenv("RENDER_VARIANTS")); err != nil {
+		configProblem("RENDER_VARIANTS: %v", err)
+	} else {
+		renderVariants = views
+	}
+	if scanners, err := parseURLScanners(envOr("URL_SCANNERS", "virustotal")); err != nil {
+		configProblem("URL_SCANNERS: %v", err)
+	} else {
+		urlScanners = scanners
+	}
+	limiter = newRateLimiter(
+		getEnvInt("RATE_LIMIT_PER_MINUTE", 10),
+		getEnvInt("RATE_LIMIT_GLOBAL_PER_MINUTE", 60),
+		getEnvInt("MAX_CONCURRENT_PER_KEY", 2),
+		getEnvInt("MAX_CONCURRENT_ANALYSES", 8),
+	)
+	applyScoring()
+	validateConfig()
+}
+
+// getEnvInt reads an integer environment variable, falling back to def when unset. Invalid values
+// are recorded in configProblems.
+func getEnvInt(name string, def int) int {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		configProblem("%s: invalid value %q", name, raw)
+		return def
+	}
+	return v
+}
+
+// splitList splits a comma-separated setting into its trimmed, non-empty items.
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvFloat reads a floating-point environment variable, falling back to def when unset. Invalid
+// values are recorded in configProblems.
+func getEnvFloat(name string, def float64) float64 {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		configProblem("%s: invalid value %q", name, raw)
+		return def
+	}
+	return v
+}
+
+// getEnvDuration reads a duration environment variable (e.g. "30s"), falling back to def when unset.
+// Invalid values are recorded in configProblems.
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		configProblem("%s: invalid value %q", name, raw)
+		return def
+	}
+	return v
 }
 
 func askForConfirmation(question string) bool {
 	// If an environment variable explicitly requests automatic installs, honor it.
 	if strings.ToLower(strings.TrimSpace(os.Getenv("AUTO_INSTALL_DEPS"))) == "true" {
-		log.Printf("AUTO_INSTALL_DEPS=true - auto-confirming: %s", question)
+		slog.Info("AUTO_INSTALL_DEPS=true - auto-confirming", "question", question)
 		return true
 	}
 
 	// If not running interactively, do not block; default to not installing.
 	if !isInteractive() {
-		log.Printf("Non-interactive environment - skipping prompt for: %s", question)
+		slog.Info("non-interactive environment - skipping prompt", "question", question)
 		return false
 	}
 
@@ -175,18 +460,101 @@ func isInteractive() bool {
 }
 
 var (
-	geminiKey          string
-	aiModel            string
-	googleSearchAPIKey string
-	googleSearchCX     string
-	mainPrompt         string
-	URLScanAPIKey      string
-	VTotalAPIKey       string
-	isURLScanEnabled   bool
+	geminiKey              string
+	aiModel                string
+	aiFallbackModel        string
+	aiMaxRetries           int
+	aiInitialBackoff       time.Duration
+	aiTimeout              time.Duration
+	aiCacheTTL             time.Duration
+	aiCacheMaxEntries      int
+	aiPriceInputPerMTok    float64
+	aiPriceOutputPerMTok   float64
+	companyDBDriver        string
+	companyDBDSN           string
+	resultsDBPath          string
+	googleSearchAPIKey     string
+	googleSearchCX         string
+	mainPrompt             string
+	promptDir              string
+	promptTemplate         string
+	promptReloadInterval   time.Duration
+	adminAPIKey            string
+	URLScanAPIKey          string
+	VTotalAPIKey           string
+	safeBrowsingAPIKey     string
+	placesAPIKey           string
+	companiesHouseAPIKey   string
+	openCorporatesAPIToken string
+	cloudflareAccountID    string
+	cloudflareAPIToken     string
+	safeBrowsingTrustClean bool
+	defangOutput           bool
+	threatFeedsEnabled     bool
+	threatFeedDBPath       string
+	threatFeedInterval     time.Duration
+	trancoEnabled          bool
+	geoIPDBPath            string
+	geoIPASNDBPath         string
+	stripQuotedReplies     bool
+	yaraRulesDir           string
+	yaraCommand            string
+	scriptRulesDir         string
+	feedbackSuppressAfter  int
+	campaignSimilarity     int
+	campaignWindow         time.Duration
+	campaignWebhookURL     string
+	campaignWebhookAfter   int
+	clamdAddress           string
+	clamdTimeout           time.Duration
+	spamdAddress           string
+	rspamdURL              string
+	rspamdPassword         string
+	spamEngineTimeout      time.Duration
+	uiEnabled              bool
+	sseKeepalive           time.Duration
+	sseRetry               time.Duration
+	sseResumeWindow        time.Duration
+	resultsRetention       time.Duration // saved analyses older than this are deleted; 0 keeps them
+	analysisAbandonTimeout time.Duration
+	siemSyslogAddress      string
+	siemFormat             string
+	splunkHECURL           string
+	splunkHECToken         string
+	splunkHECSourcetype    string
+	siemTimeout            time.Duration
+	trancoPath             string
+	trancoRefresh          time.Duration
+	brandIndexRefresh      time.Duration
+	dbRefreshMaxAge        time.Duration
+	dbRefreshMaxPerType    int
+	phishTankAppKey        string
+	redirectHopThreshold   int
+	trackingPixelThreshold int
+	dnsblZones             []string
+	trustedForwarders      []string
+	trustedAuthservIDs     []string // Authentication-Results written by our servers carry one of these
+	trustedMXHosts         []string // our servers, as they name themselves in Received headers
+	phoneRegions           []string // tried after the analysis country for numbers without a prefix
+	archiveMaxDepth        int
+	archiveMaxBytes        int64
+	attachedEmailMaxDepth  int
+	attachedEmailMax       int
+	landingPageMax         int
+	maxEMLBytes            int64
+	piiRedactionMode       string
+	piiRedactionImages     bool
+	isURLScanEnabled       bool
+	geminiEnabled          bool
+	googleSearchEnabled    bool
+	remoteImagesEnabled    bool
+	ocrEngineName          string
+	googleVisionAPIKey     string
+	emailPath              string
+	screenshotDir          string
+	defaultCountry         string
 )
 
-var emailPath = "TestEmails"
-
 // appointmentDomains is a slice of sender domains that are known to send
 // appointment/booking notifications. Add domains here to update behavior.
 var appointmentDomains = []string{
@@ -207,60 +575,15 @@ func domainInList(domain string, list []string) bool {
 	return false
 }
 
+// verifyStartupRequirements refuses to start without the critical dependencies; /readyz
+// reports the same checks while the server runs.
 func verifyStartupRequirements() error {
 	var issues []string
-
-	requiredFiles := []struct {
-		path string
-		desc string
-	}{
-		{"wikidata_websites4.db", "primary company/domain database"},
-	}
-	for _, file := range requiredFiles {
-		if _, err := os.Stat(file.path); err != nil {
-			if os.IsNotExist(err) {
-				issues = append(issues, fmt.Sprintf("missing %s (%s)", file.path, file.desc))
-			} else {
-				issues = append(issues, fmt.Sprintf("cannot access %s: %v", file.path, err))
-			}
-		}
-	}
-
-	requiredEnv := []struct {
-		value  string
-		name   string
-		reason string
-	}{
-		{geminiKey, "GEMINI_API_KEY", "Gemini content analysis"},
-		{googleSearchAPIKey, "GOOGLE_SEARCH_API_KEY", "Google Custom Search"},
-		{googleSearchCX, "GOOGLE_SEARCH_CX", "Google Custom Search CX"},
-		{mainPrompt, "MAIN_PROMPT", "AI prompt instructions"},
-		{VTotalAPIKey, "VTotal_API_KEY", "VirusTotal URL scanning"},
-	}
-	for _, envVar := range requiredEnv {
-		if strings.TrimSpace(envVar.value) == "" {
-			issues = append(issues, fmt.Sprintf("environment variable %s is not set (%s)", envVar.name, envVar.reason))
+	for _, c := range dependencyChecks(context.Background()) {
+		if c.Critical && !c.OK {
+			issues = append(issues, fmt.Sprintf("%s: %s", c.Name, c.Detail))
 		}
 	}
-	if isURLScanEnabled && strings.TrimSpace(URLScanAPIKey) == "" {
-		issues = append(issues, "environment variable URLSCAN_API_KEY is not set but URLSCAN_ENABLED is TRUE")
-	}
-
-	requiredBinaries := []struct {
-		name   string
-		alias  []string
-		reason string
-	}{
-		{"tesseract", []string{"tesseract.exe"}, "Tesseract OCR"},
-		{"magick", []string{"magick.exe"}, "ImageMagick"},
-		//{"chrome", []string{"google-chrome", "chromium", "msedge", "chrome.exe", "msedge.exe"}, "Chromium-based browser for chromedp"},
-	}
-	for _, bin := range requiredBinaries {
-		if !commandExists(append([]string{bin.name}, bin.alias...)...) {
-			issues = append(issues, fmt.Sprintf("missing executable for %s (tried %v)", bin.reason, append([]string{bin.name}, bin.alias...)))
-		}
-	}
-
 	if len(issues) > 0 {
 		return fmt.Errorf("startup requirements check failed:\n - %s", strings.Join(issues, "\n - "))
 	}
@@ -284,29 +607,106 @@ func commandExists(names ...string) bool {
 
 // --- Main Application Logic ---
 func main() {
+	serverOpts := parseServerFlags()
+	if len(configProblems) > 0 {
+		slog.Error("invalid configuration", "problems", configProblems)
+		os.Exit(1)
+	}
+	if serverOpts.mock || serverOpts.mockRecord {
+		if err := enableMocks(serverOpts.mockDir, serverOpts.mockRecord); err != nil {
+			slog.Error("loading mock fixtures failed", "dir", serverOpts.mockDir, "err", err)
+			os.Exit(1)
+		}
+	}
+	if err := reopenCompanyStore(); err != nil {
+		slog.Warn("company database unavailable", "driver", companyDBDriver, "err", err)
+	} else if err := companyStore().EnsureSchema(context.Background()); err != nil {
+		slog.Warn("updating the company database schema failed", "err", err)
+	}
+	if serverOpts.importCompanyDB != "" {
+		if err := importCompanyDB(context.Background(), serverOpts.importCompanyDB); err != nil {
+			slog.Error("company database import failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if err := verifyStartupRequirements(); err != nil {
-		log.Fatalf("%v", err)
+		slog.Error("startup checks failed", "err", err)
+		os.Exit(1)
 	}
-	requiredDirs := []string{emailPath, "attachments", "screenshots"}
+	requiredDirs := []string{emailPath, "attachments", screenshotDir}
 	for _, dir := range requiredDirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatalf("Failed to create essential directory %s: %v", dir, err)
+			slog.Error("failed to create essential directory", "dir", dir, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	prompts.watch(promptDir, promptReloadInterval)
+	go runBrandIndex(brandIndexRefresh)
+	go runDBRefresh(dbRefreshMaxAge)
+	if trancoEnabled {
+		go runTranco(trancoPath, trancoRefresh)
+	}
+	openGeoIP()
+
+	if threatFeedsEnabled {
+		if store, err := openThreatFeedStore(threatFeedDBPath); err != nil {
+			slog.Warn("threat feeds unavailable", "err", err)
+		} else {
+			threatFeeds = store
+			go threatFeeds.run(threatFeedInterval)
 		}
 	}
 
-	http.Handle("/process-eml-stream", enableCORS(http.HandlerFunc(streamEmailHandler)))
-	port := "8080"
-	log.Printf("Starting server on port %s...\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Printf("Error starting server: %s\n", err)
+	if store, err := openResultsStore(resultsDBPath); err != nil {
+		slog.Warn("results store unavailable, analyses will not be persisted", "err", err)
+	} else {
+		results = store
+		if err := reloadChecks(); err != nil {
+			slog.Error("loading check settings failed", "err", err)
+		}
+		if err := reloadExecutiveDirectories(); err != nil {
+			slog.Error("loading executive directories failed", "err", err)
+		}
+		go runResultsRetention(resultsRetention)
+	}
+
+	if serverOpts.corpus.dir != "" {
+		os.Exit(runCorpus(serverOpts.corpus, os.Stdout))
+	}
+
+	http.Handle("/process-eml-stream", enableCORS(rateLimit(http.HandlerFunc(streamEmailHandler))))
+	http.Handle("/process-eml", enableCORS(rateLimit(http.HandlerFunc(processEMLHandler))))
+	http.Handle("/sanitize-eml", enableCORS(rateLimit(http.HandlerFunc(sanitizeHandler))))
+	http.Handle("/jobs/{id}", enableCORS(http.HandlerFunc(jobCancelHandler)))
+	http.Handle("/jobs/{id}/events", enableCORS(http.HandlerFunc(jobEventsHandler)))
+	http.Handle("/results", enableCORS(http.HandlerFunc(resultsListHandler)))
+	http.Handle("/results/{id}", enableCORS(http.HandlerFunc(resultHandler)))
+	http.Handle("/results/{id}/report", enableCORS(http.HandlerFunc(reportHandler)))
+	http.Handle("/results/{id}/stix", enableCORS(http.HandlerFunc(stixHandler)))
+	http.Handle("/results/{id}/feedback", enableCORS(http.HandlerFunc(feedbackHandler)))
+	http.Handle("/campaigns", requireAdmin(http.HandlerFunc(campaignsHandler)))
+	http.Handle("/executives", enableCORS(http.HandlerFunc(executivesHandler)))
+	if uiEnabled {
+		http.Handle("/ui/", uiHandler())
+		http.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	}
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	registerAdminRoutes()
+	if err := serve(serverOpts); err != nil {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
 	}
 }
 
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Request-ID, Last-Event-ID, X-Target-Country")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Analysis-ID, Retry-After")
 		if r.Method == "OPTIONS" {
 			return
 		}
@@ -315,194 +715,328 @@ func enableCORS(next http.Handler) http.Handler {
 }
 
 func streamEmailHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. Set headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	// Every log line and SSE payload of this request carries its ID.
+	requestID := requestIDFor(r)
+	r = r.WithContext(contextWithRequestID(r.Context(), requestID))
+	ctx := r.Context()
+	w.Header().Set("X-Request-ID", requestID)
+
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "streaming unsupported")
 		return
 	}
+	profile, status, err := resolveProfile(r)
+	if err != nil {
+		writeJSONError(w, status, errCodeInvalidProfile, err.Error())
+		return
+	}
+
+	targetCountry, err := requestedCountry(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	requestedRegions, err := parsePhoneRegions(r.URL.Query().Get("phoneRegions"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	urlscanOptions, err := requestedURLScanOptions(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	analysisID := newAnalysisID()
+	apiKey := clientKeyID(r)
 
-	// 2. Initial file processing
+	// 1. Validate the upload before any work is started. Until the SSE headers go out, failures
+	// are answered with a JSON error body.
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
-			log.Printf("Error closing request body: %v", err)
+			slog.WarnContext(ctx, "closing request body failed", "err", err)
 		}
 	}(r.Body)
 
-	base64Data, err := io.ReadAll(r.Body)
+	emlData, status, code, err := readEMLBody(w, r)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
+		slog.WarnContext(ctx, "rejecting upload", "status", status, "err", err)
+		writeJSONError(w, status, code, err.Error())
 		return
 	}
 	// Create a unique sandbox directory for this entire request.
 	sandboxDir, err := os.MkdirTemp("", "email-checker-*")
 	if err != nil {
-		http.Error(w, "Failed to create sandbox directory", http.StatusInternalServerError)
-		log.Printf("Error creating sandbox dir: %v", err)
+		slog.ErrorContext(ctx, "creating sandbox dir failed", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "failed to create sandbox directory")
 		return
 	}
 	// defer to GUARANTEE the entire sandbox is deleted when the handler finishes.
 	defer func(path string) {
 		err := os.RemoveAll(path)
 		if err != nil {
-			log.Printf("Error removing sandbox dir: %v", err)
+			slog.WarnContext(ctx, "removing sandbox dir failed", "dir", path, "err", err)
 		}
 	}(sandboxDir)
 
-	emlData, err := base64.StdEncoding.DecodeString(string(base64Data))
-	if err != nil {
-		log.Printf("Error decoding base64 data: %v", err)
-		return
+	// A forwarded email is analysed as the message it forwards, unless the client asks otherwise.
+	var forwarded *ForwardInfo
+	if r.URL.Query().Get("unwrapForwarded") != "false" {
+		if inner, info := unwrapForwarded(emlData); info != nil {
+			emlData, forwarded = inner, info
+			slog.InfoContext(ctx, "analysing forwarded email", "method", info.Method, "forwarded_by", info.ForwardedBy)
+		}
 	}
+
 	fileName := filepath.Join(sandboxDir, "original.eml")
 	if err := os.WriteFile(fileName, emlData, 0644); err != nil {
-		log.Printf("Error writing temp eml file: %v", err)
+		slog.ErrorContext(ctx, "writing temp eml file failed", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "failed to store email")
 		return
 	}
 
-	env, fileName, Email, err := parseEmail(fileName, sandboxDir)
+	env, fileName, Email, err := parseEmail(ctx, fileName, sandboxDir)
 	if err != nil {
-		log.Printf("Error parsing email: %v", err)
-		http.Error(w, "failed to parse email", http.StatusBadRequest)
+		slog.WarnContext(ctx, "parsing email failed", "err", err)
+		writeJSONError(w, http.StatusUnprocessableEntity, errCodeInvalidEmail, "failed to parse email")
 		return
 	}
 
-	// Channel for final results from each main analysis function
-	resultsChan := make(chan CheckResult)
+	// 2. Set headers for SSE
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	Email.RequestID = requestID
+	Email.Profile = profile
+	slog.InfoContext(ctx, "analysing email", "analysis_id", analysisID, "from", Email.From, "domain", Email.Domain, "profile", profile.name())
+
+	// The analysis runs as a job: events are numbered and buffered so a dropped client can resume
+	// with Last-Event-ID, and the analysis carries on without it until it is cancelled or abandoned.
+	job, ctx := startJob(ctx, analysisID, apiKey)
+	timings := newTimingRecorder()
+	ctx = withTimings(ctx, timings)
+	Email.ctx = ctx
+	w.Header().Set("X-Analysis-ID", analysisID)
+
 	// This channel will safely handle all messages sent to the client.
 	eventChan := make(chan CheckResult)
+	defang := defangRequested(r)
 
-	// Start a single "writer" goroutine. It safely listens on eventChan and writes to the client.
-	// 1. Create a WaitGroup specifically for the writer goroutine.
+	// A single "recorder" goroutine encodes every event into the job; a second one streams the job
+	// to this connection.
 	var writerWg sync.WaitGroup
-	writerWg.Add(1) // We have one writer goroutine to wait for.
+	writerWg.Add(2)
 
 	go func() {
-		// 2. Ensure Done is called when this goroutine exits.
 		defer writerWg.Done()
-
+		defer job.finish()
 		for event := range eventChan {
-			jsonData, err := json.Marshal(event.Payload)
-			if err != nil {
-				log.Printf("Error marshalling event data for %s: %v", event.EventName, err)
-				continue
+			payload := event.Payload
+			if defang {
+				payload = defangPayload(payload)
 			}
-			_, err = fmt.Fprintf(w, "event: %s\n", event.EventName)
+			jsonData, err := json.Marshal(payload)
 			if err != nil {
-				log.Printf("Error writing event name for %s: %v", event.EventName, err)
-			}
-			_, err = fmt.Fprintf(w, "data: %s\n\n", jsonData)
-			if err != nil {
-				log.Printf("Error writing event data for %s: %v", event.EventName, err)
+				slog.ErrorContext(ctx, "marshalling event failed", "event", event.EventName, "err", err)
+				continue
 			}
-			flusher.Flush()
+			job.add(event.EventName, tagRequestID(jsonData, requestID))
 		}
 	}()
+	go func() {
+		defer writerWg.Done()
+		streamJob(r.Context(), w, flusher, job, 0)
+	}()
 
-	enabledChecks := map[string]bool{
-		"checkDomain":           r.URL.Query().Get("checkDomain") != "false",
-		"checkUrls":             r.URL.Query().Get("checkUrls") != "false",
-		"checkAttachments":      r.URL.Query().Get("checkAttachments") != "false",
-		"checkTextAnalysis":     r.URL.Query().Get("checkTextAnalysis") != "false",
-		"checkRenderedAnalysis": r.URL.Query().Get("checkRenderedAnalysis") != "false",
+	// A profile can switch checks off by default; the query can still switch them off per request.
+	enabledChecks := make(map[string]bool, len(checkToggles))
+	for _, toggle := range checkToggles {
+		enabledChecks[toggle] = profile.checkEnabled(toggle) && r.URL.Query().Get(toggle) != "false"
 	}
 
-	maxScore := MaxScoreFor(enabledChecks)
+	maxScore := MaxScoreFor(enabledChecks, profile)
 	eventChan <- CheckResult{
 		EventName: "maxScore",
-		Payload:   map[string]interface{}{"maxScore": maxScore, "enabledChecks": enabledChecks},
-	}
-
-	db, err := sql.Open("sqlite", "wikidata_websites4.db")
-	if err != nil {
-		log.Printf("Database connection failed: %v", err)
-		close(resultsChan)
-		close(eventChan)
-		return
-	}
-	defer func(db *sql.DB) {
-		err := db.Close()
-		if err != nil {
-			log.Printf("Error closing database connection: %v", err)
+		Payload: map[string]interface{}{
+			"maxScore": maxScore, "enabledChecks": enabledChecks, "integrations": integrationStatus(), "profile": profile.name(),
+			"analysisId": analysisID,
+		},
+	}
+	if forwarded != nil {
+		eventChan <- CheckResult{EventName: "forwarded", Payload: forwarded}
+	}
+	if Email.Automated != nil {
+		eventChan <- CheckResult{EventName: "automatedMessage", Payload: Email.Automated}
+	}
+	iocs := buildIOCs(env, Email)
+	eventChan <- CheckResult{EventName: "iocs", Payload: iocs}
+
+	// The store is shared by all requests; if it couldn't be opened at startup, try again.
+	db := companyStore()
+	if db == nil {
+		if err := reopenCompanyStore(); err != nil {
+			slog.ErrorContext(ctx, "database connection failed", "err", err)
+			eventChan <- CheckResult{EventName: "error", Payload: map[string]string{"error": "company database unavailable", "code": errCodeInternal}}
+			close(eventChan)
+			writerWg.Wait()
+			return
 		}
-	}(db)
+		db = companyStore()
+	}
 
 	var totalDatabaseReadTimeNanos int64
 	// Legacy fields kept for backward compatibility
 	userIP := getIPAddress(r)
-	countryCode, err := getCountryCodeFromIP(userIP)
-	if err != nil {
-		log.Printf("Could not determine country for IP %s: %v. Proceeding without localization.", userIP, err)
-		countryCode = "gb"
+	// A country the caller names wins over the profile's, which wins over where the caller is.
+	countryCode := targetCountry
+	if countryCode == "" {
+		countryCode = profile.country()
 	}
-
-	var analysisWg sync.WaitGroup
-	activeChecks := 0
-	if enabledChecks["checkDomain"] {
-		analysisWg.Add(1)
-		activeChecks++
-		go performDomainAnalysis(&analysisWg, resultsChan, db, Email.Domain, Email.subDomain, &totalDatabaseReadTimeNanos)
-	}
-	if enabledChecks["checkUrls"] {
-		analysisWg.Add(1)
-		activeChecks++
-		go performURLAnalysis(&analysisWg, resultsChan, eventChan, r.Context(), Email)
-	}
-	if enabledChecks["checkAttachments"] {
-		analysisWg.Add(1)
-		activeChecks++
-		go performExecutableAnalysis(&analysisWg, resultsChan, env)
-	}
-	if enabledChecks["checkTextAnalysis"] {
-		analysisWg.Add(1)
-		activeChecks++
-		go func() {
-			err := performTextAnalysis(&analysisWg, resultsChan, fileName, db, &totalDatabaseReadTimeNanos, sandboxDir, countryCode, Email)
-			if err != nil {
-				log.Printf("Text analysis failed: %v", err)
-			}
-		}()
-	}
-	if enabledChecks["checkRenderedAnalysis"] {
-		analysisWg.Add(1)
-		activeChecks++
-		go performRenderedAnalysis(&analysisWg, resultsChan, fileName, env, db, &totalDatabaseReadTimeNanos, sandboxDir, countryCode, Email)
+	if countryCode == "" {
+		countryCode, err = getCountryCodeFromIP(userIP)
+		if err != nil {
+			slog.WarnContext(ctx, "could not determine country, proceeding without localization", "ip", userIP, "err", err)
+			countryCode = defaultCountry
+		}
 	}
-	if activeChecks == 0 {
-		close(resultsChan)
-	} else {
-		go func() {
-			analysisWg.Wait()
-			close(resultsChan)
-		}()
+
+	Email.PhoneRegions = phoneRegionsFor(requestedRegions, countryCode)
+	Email.URLScan = urlscanOptions
+
+	allCheckData := runChecks(ctx, emailAnalysis{
+		env: env, email: Email, fileName: fileName, sandboxDir: sandboxDir, countryCode: countryCode,
+		db: db, enabledChecks: enabledChecks, dbReadNanos: &totalDatabaseReadTimeNanos, timings: timings,
+	}, eventChan)
+
+	attached := analyseAttachedEmails(ctx, emailAnalysis{
+		env: env, email: Email, sandboxDir: sandboxDir, countryCode: countryCode,
+		db: db, enabledChecks: enabledChecks, dbReadNanos: &totalDatabaseReadTimeNanos,
+	}, maxScore, profile, nil)
+	for _, report := range attached {
+		eventChan <- CheckResult{EventName: "attachedEmail", Payload: report}
+	}
+	// The forwarding email may carry links or attachments of its own, so it is checked too.
+	if forwarded != nil && ctx.Err() == nil {
+		wrapper, _ := analyseAttachedEmail(ctx, emailAnalysis{
+			email: Email, sandboxDir: sandboxDir, countryCode: countryCode,
+			db: db, enabledChecks: enabledChecks, dbReadNanos: &totalDatabaseReadTimeNanos,
+		}, "", forwarded.wrapper, maxScore, profile, nil)
+		wrapper.Path = "wrapper"
+		attached = append(attached, wrapper)
+		eventChan <- CheckResult{EventName: "forwardWrapper", Payload: wrapper}
+	}
+	// A cancelled analysis has half-finished checks: its score would mean nothing, so it is
+	// neither scored nor saved.
+	if ctx.Err() != nil {
+		removeAnalysisScreenshots(ctx, []interface{}{allCheckData, attached})
+		eventChan <- CheckResult{EventName: "cancelled", Payload: map[string]string{"reason": cancelReason(ctx)}}
+		close(eventChan)
+		writerWg.Wait()
+		return
 	}
 
-	allCheckData := make(map[string]interface{})
-	for result := range resultsChan {
-		allCheckData[result.EventName] = result.Payload
-		eventChan <- result
+	usage := summariseUsage(analysisID, allCheckData)
+	for _, report := range attached {
+		usage.addAttached(report)
+	}
+	if len(usage.Calls) > 0 {
+		eventChan <- CheckResult{EventName: "usage", Payload: usage}
 	}
 
-	scores := calculateFinalScores(allCheckData, maxScore)
+	scores := calculateFinalScores(allCheckData, maxScore, profile)
 	scores.EnabledChecks = enabledChecks
+	scores.AnalysisID = analysisID
+	scores.Profile = profile.name()
+	scores.Timings = timings.report(atomic.LoadInt64(&totalDatabaseReadTimeNanos))
+	scores.Suppressed = feedbackSuppression(Email.From, apiKey, Email.DMARCPass, scores)
 	eventChan <- CheckResult{EventName: "finalScores", Payload: scores}
+	if len(attached) > 0 {
+		allCheckData["attachedEmails"] = attached // stored with the analysis; not scored
+	}
+	allCheckData["iocs"] = iocs
+	if Email.Automated != nil {
+		allCheckData["automatedMessage"] = Email.Automated
+	}
+
+	record := AnalysisRecord{
+		ID:        analysisID,
+		CreatedAt: time.Now(),
+		APIKey:    apiKey,
+		Subject:   Email.Subject,
+		From:      Email.From,
+		Domain:    Email.Domain,
+		Scores:    scores,
+		Checks:    allCheckData,
+	}
+	if results != nil {
+		for mode, stats := range usage.Calls {
+			if err := results.recordUsage(analysisID, apiKey, mode, stats); err != nil {
+				slog.ErrorContext(ctx, "recording AI usage failed", "err", err)
+			}
+		}
+		if err := results.saveAnalysis(record); err != nil {
+			slog.ErrorContext(ctx, "saving analysis failed", "analysis_id", analysisID, "err", err)
+			removeAnalysisScreenshots(ctx, allCheckData)
+		} else if match := fileUnderCampaign(ctx, record, Email.Text); match != nil {
+			eventChan <- CheckResult{EventName: "campaignMatch", Payload: results.forReporter(*match, apiKey)}
+		}
+	}
+	go forwardToSIEM(record)
 
 	close(eventChan)
 
-	// 3. Wait for the writer goroutine to finish before the handler returns.
+	// 3. Wait for the writer goroutines to finish before the handler returns.
 	writerWg.Wait()
 
-	log.Println("Streaming complete for request.")
+	slog.InfoContext(ctx, "streaming complete", "analysis_id", analysisID)
 }
 
 // --- Analysis Functions (Refactored to send results to a channel) ---
 
-func performDomainAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, db *sql.DB, domain, subdomain string, dbTime *int64) {
+func performDomainAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, eventChan chan<- CheckResult, ctx context.Context, db CompanyStore, domain, subdomain string, dbTime *int64) {
 	defer wg.Done()
+	var mailCheck Check
+	for _, c := range activeChecks() {
+		if c.Name == "SenderDomainReceivesMail" {
+			mailCheck = c
+			break
+		}
+	}
+	// A domain that can't receive mail can't receive replies either: fine for a no-reply
+	// subdomain of a real company, but typical of throwaway and parked phishing domains.
+	certCh := make(chan TLSCertInfo, 1)
+	go func() { certCh <- fetchTLSCert(ctx, domain) }()
+	mailDNS := checkMailDNS(ctx, subdomain)
+	send := func(result DomainAnalysisResult) {
+		result.MailDNS = mailDNS
+		if cert := <-certCh; domain != "" {
+			cert.markLookalike(result.Status == "DomainImpersonation" || result.Status == "DeceptiveSubdomain")
+			if cert.FreshLookalike {
+				result.Message += fmt.Sprintf(" Its website uses a Let's Encrypt certificate issued %d day(s) ago.", cert.AgeDays)
+			}
+			result.TLSCert = &cert
+		}
+		switch {
+		case mailDNS.Status == "Error":
+			// A failed lookup proves nothing either way, so like any other failed check it scores nothing.
+			if mailDNS.Error != "no sender domain" {
+				result.Message += " The sender domain's mail records could not be looked up."
+			}
+		case mailDNS.CanMail:
+			result.MailDNSScoreImpact = mailCheck.Impact
+		case !mailDNS.Exists:
+			result.Message += " The sender domain does not exist in DNS."
+		case mailDNS.Parked:
+			result.Message += " The sender domain is parked."
+		default:
+			result.Message += " The sender domain has no MX or A records, so it cannot receive mail."
+		}
+		ch <- CheckResult{EventName: "domainAnalysis", Payload: result}
+	}
+
 	trustedProviders := map[string]struct{}{
 		"gmail.com":      {},
 		"googlemail.com": {},
@@ -526,14 +1060,14 @@ func performDomainAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, db *sql.DB
 			ScoreImpact:      0,
 			SuspectSubdomain: subdomain,
 		}
-		ch <- CheckResult{EventName: "domainAnalysis", Payload: result}
+		send(result)
 		return // Exit early, skipping the database check
 	}
 
 	if _, isTrusted := trustedProviders[domain]; isTrusted {
 		// Find the freemail check to get its impact
 		var freeMailCheck Check
-		for _, c := range AllChecks {
+		for _, c := range activeChecks() {
 			if c.Name == "freeMailMatch" {
 				freeMailCheck = c
 				break
@@ -547,31 +1081,37 @@ func performDomainAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, db *sql.DB
 			MatchedDomain:    domain,
 			SuspectSubdomain: subdomain,
 		}
-		ch <- CheckResult{EventName: "domainAnalysis", Payload: result}
+		send(result)
 		return // Exit early, skipping the database check
 	}
 
+	sendStage(eventChan, "domainQueryStarted", "domainAnalysis", time.Time{})
 	startDbRead := time.Now()
-	domainReal, matchedDomain, err := checkDomainReal(db, domain)
+	domainReal, matchedDomain, lookup, err := checkDomainRealStats(ctx, db, domain)
 	atomic.AddInt64(dbTime, time.Since(startDbRead).Nanoseconds())
+	sendStage(eventChan, "domainQueryCompleted", "domainAnalysis", startDbRead)
 	if err != nil {
-		log.Printf("Domain analysis failed: %v", err)
-		ch <- CheckResult{EventName: "domainAnalysis", Payload: DomainAnalysisResult{
+		slog.ErrorContext(ctx, "domain analysis failed", "err", err)
+		send(DomainAnalysisResult{
 			Status:           "Error",
 			Message:          fmt.Sprintf("Domain analysis failed: %v", err),
 			MatchedDomain:    "",
 			ScoreImpact:      0,
 			SuspectSubdomain: subdomain,
-		}}
+		})
 		return
 	}
 
-	result := DomainAnalysisResult{MatchedDomain: matchedDomain, SuspectSubdomain: subdomain}
+	result := DomainAnalysisResult{MatchedDomain: matchedDomain, SuspectSubdomain: subdomain, Lookup: &lookup}
+	rank, ranked := trancoRank(domain)
+	if ranked {
+		result.TrancoRank = &rank
+	}
 	switch domainReal {
 	case 0:
 		result.Status = "DomainImpersonation"
 		result.Message = fmt.Sprintf("A similar domain '%s' is in the known database.", matchedDomain)
-		for _, c := range AllChecks {
+		for _, c := range activeChecks() {
 			if c.Name == "DomainImpersonation" {
 				result.ScoreImpact = c.Impact
 				break
@@ -580,7 +1120,7 @@ func performDomainAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, db *sql.DB
 	case 1:
 		result.Status = "DomainExactMatch"
 		result.Message = "Domain is in the known database."
-		for _, c := range AllChecks {
+		for _, c := range activeChecks() {
 			if c.Name == "DomainExactMatch" {
 				result.ScoreImpact = c.Impact
 				break
@@ -589,104 +1129,470 @@ func performDomainAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, db *sql.DB
 	case 2:
 		result.Status = "DomainNoSimilarity"
 		result.Message = "Domain not in database, and no similarities found."
-		for _, c := range AllChecks {
-			if c.Name == "DomainNoSimilarity" {
+		if ranked && rank == 0 {
+			// Neither a known company nor a popular site: more likely a throwaway domain.
+			result.Status = "DomainUnranked"
+			result.Message = "Domain not in database, no similarities found, and not among the top million sites."
+		}
+		if deceptive := findDeceptiveSubdomain(ctx, db, subdomain); deceptive != nil {
+			result.Status = "DeceptiveSubdomain"
+			result.Message = fmt.Sprintf("The sender's address shows '%s' but belongs to the unrelated domain '%s'.", deceptive.Shown, deceptive.Domain)
+			result.DeceptiveSubdomain = deceptive
+		}
+		for _, c := range activeChecks() {
+			if c.Name == result.Status {
 				result.ScoreImpact = c.Impact
 				break
 			}
 		}
 	}
-	ch <- CheckResult{EventName: "domainAnalysis", Payload: result}
+	send(result)
 }
 
-func performURLAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, eventChan chan<- CheckResult, rCtx context.Context, Email EmailData) {
+// emailAnalysis is one email and what its checks run with.
+type emailAnalysis struct {
+	env           *enmime.Envelope
+	email         EmailData
+	fileName      string
+	sandboxDir    string
+	countryCode   string
+	db            CompanyStore
+	enabledChecks map[string]bool
+	dbReadNanos   *int64
+	timings       *timingRecorder // the uploaded email's; nil for attached emails
+}
+
+// runChecks runs every enabled check on a, passing each result on to eventChan as it
+// arrives, and returns the results by event name.
+func runChecks(ctx context.Context, a emailAnalysis, eventChan chan<- CheckResult) map[string]interface{} {
+	resultsChan := make(chan CheckResult)
+	started := time.Now()
+	enabledChecks, db, Email, env := a.enabledChecks, a.db, a.email, a.env
+	fileName, sandboxDir, countryCode := a.fileName, a.sandboxDir, a.countryCode
+	// The text in the email's images is read alongside the other checks. The ones that scan its
+	// links or search its wording (URLs, text analysis, payment scams, bank details, scripts and
+	// plugins) get the email from withImageText, which waits for the OCR.
+	withImageText := func() EmailData { return Email }
+	if enabledChecks["checkImageText"] {
+		imageTextDone := make(chan struct{})
+		withImages := Email
+		go func() {
+			defer close(imageTextDone)
+			withImages.ImageText = readImageText(ctx, Email)
+			withImages.AttachmentURLs = append(slices.Clone(Email.AttachmentURLs), imageURLs(withImages.ImageText)...)
+		}()
+		withImageText = func() EmailData {
+			<-imageTextDone
+			return withImages
+		}
+	}
+	var analysisWg sync.WaitGroup
+	activeChecks := 0
+	if enabledChecks["checkDomain"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performDomainAnalysis(&analysisWg, resultsChan, eventChan, ctx, db, Email.Domain, Email.subDomain, a.dbReadNanos)
+	}
+	if enabledChecks["checkUrls"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go func() { performURLAnalysis(&analysisWg, resultsChan, eventChan, ctx, db, withImageText()) }()
+	}
+	if enabledChecks["checkAttachments"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performExecutableAnalysis(&analysisWg, resultsChan, ctx, env)
+		analysisWg.Add(1)
+		activeChecks++
+		go performImageFileAnalysis(&analysisWg, resultsChan, Email)
+	}
+	if enabledChecks["checkTextAnalysis"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go func() {
+			err := performTextAnalysis(&analysisWg, resultsChan, eventChan, fileName, db, a.dbReadNanos, sandboxDir, countryCode, withImageText())
+			if err != nil {
+				slog.ErrorContext(ctx, "text analysis failed", "err", err)
+			}
+		}()
+	}
+	if enabledChecks["checkRenderedAnalysis"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performRenderedAnalysis(&analysisWg, resultsChan, eventChan, fileName, env, db, a.dbReadNanos, sandboxDir, countryCode, Email)
+	}
+	if enabledChecks["checkTracking"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performTrackingAnalysis(&analysisWg, resultsChan, Email)
+		analysisWg.Add(1)
+		activeChecks++
+		go performRemoteContentAnalysis(&analysisWg, resultsChan, Email)
+	}
+	if enabledChecks["checkHiddenContent"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performHiddenContentAnalysis(&analysisWg, resultsChan, Email)
+		analysisWg.Add(1)
+		activeChecks++
+		go performObfuscationPaddingAnalysis(&analysisWg, resultsChan, Email)
+	}
+	if enabledChecks["checkHtmlAttachments"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performHTMLAttachmentAnalysis(&analysisWg, resultsChan, fileName, env, sandboxDir, countryCode, Email)
+	}
+	if enabledChecks["checkForms"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performEmbeddedFormAnalysis(&analysisWg, resultsChan, env)
+	}
+	if enabledChecks["checkSpamHeaders"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performSpamHeaderAnalysis(&analysisWg, resultsChan, Email)
+	}
+	if enabledChecks["checkMailingList"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performMailingListAnalysis(&analysisWg, resultsChan, Email)
+	}
+	if enabledChecks["checkImageText"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go func() { performImageTextAnalysis(&analysisWg, resultsChan, withImageText()) }()
+	}
+	if enabledChecks["checkSendTime"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performSendTimeAnalysis(&analysisWg, resultsChan, Email)
+	}
+	if enabledChecks["checkUnicode"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performUnicodeAnalysis(&analysisWg, resultsChan, Email)
+	}
+	if enabledChecks["checkActiveContent"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performActiveContentAnalysis(&analysisWg, resultsChan, env)
+	}
+	if enabledChecks["checkCalendar"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performCalendarAnalysis(&analysisWg, resultsChan, Email)
+	}
+	if enabledChecks["checkSenderIP"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go performSenderIPAnalysis(&analysisWg, resultsChan, ctx, Email)
+	}
+	if enabledChecks["checkExecutives"] && executiveDirectoryFor(Email.Profile) != nil {
+		analysisWg.Add(1)
+		activeChecks++
+		go performExecutiveAnalysis(&analysisWg, resultsChan, Email)
+	}
+	if enabledChecks["checkPaymentScam"] {
+		analysisWg.Add(1)
+		activeChecks++
+		go func() { performPaymentScamAnalysis(&analysisWg, resultsChan, withImageText()) }()
+		analysisWg.Add(1)
+		activeChecks++
+		go func() { performBankDetailAnalysis(&analysisWg, resultsChan, withImageText()) }()
+	}
+	if enabledChecks["checkYara"] && yaraEnabled() {
+		analysisWg.Add(1)
+		activeChecks++
+		go performYARAAnalysis(&analysisWg, resultsChan, ctx, env, sandboxDir)
+	}
+	if enabledChecks["checkSpamEngine"] && spamEngineEnabled() {
+		analysisWg.Add(1)
+		activeChecks++
+		go performSpamEngineAnalysis(&analysisWg, resultsChan, ctx, Email)
+	}
+	if enabledChecks["checkScripts"] && scriptRulesEnabled() {
+		analysisWg.Add(1)
+		activeChecks++
+		go func() { performScriptAnalysis(&analysisWg, resultsChan, ctx, withImageText(), env, countryCode) }()
+	}
+	for _, plugin := range checkPlugins {
+		if enabledChecks[pluginToggle(plugin.Name())] {
+			analysisWg.Add(1)
+			activeChecks++
+			go func() {
+				performPluginAnalysis(&analysisWg, resultsChan, ctx, plugin, &AnalysisContext{
+					Email: withImageText(), Envelope: env, FileName: fileName, SandboxDir: sandboxDir, CountryCode: countryCode, DB: db,
+				})
+			}()
+		}
+	}
+	if activeChecks == 0 {
+		close(resultsChan)
+	} else {
+		go func() {
+			analysisWg.Wait()
+			close(resultsChan)
+		}()
+	}
+
+	allCheckData := make(map[string]interface{})
+	for result := range resultsChan {
+		a.timings.checkDone(result.EventName, started)
+		allCheckData[result.EventName] = result.Payload
+		eventChan <- result
+	}
+
+	return allCheckData
+}
+
+func performURLAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, eventChan chan<- CheckResult, rCtx context.Context, db CompanyStore, Email EmailData) {
 	defer wg.Done()
 	var check Check
-	for _, c := range AllChecks {
+	for _, c := range activeChecks() {
 		if c.Name == "MaliciousURLFound" {
 			check = c
 			break
 		}
 	}
-	if !isURLScanEnabled {
-		result := URLAnalysisResult{
-			Status:      "Disabled",
-			Message:     "Url analysis has been turned of by developer temporarily.",
-			ScoreImpact: check.Impact, // No score impact when disabled
+	var mismatchCheck Check
+	for _, c := range activeChecks() {
+		if c.Name == "LinkTextMismatch" {
+			mismatchCheck = c
+			break
+		}
+	}
+	var heuristicCheck Check
+	for _, c := range activeChecks() {
+		if c.Name == "URLHeuristics" {
+			heuristicCheck = c
+			break
+		}
+	}
+	// Anchor text vs. href and the structural heuristics are judged from the email alone,
+	// so they are reported even when scanning is off.
+	mismatches := findLinkMismatches(Email.HTML)
+	findings := findSuspiciousURLs(rCtx, db, Email)
+	send := func(result URLAnalysisResult) {
+		result.LinkMismatches = mismatches
+		if len(mismatches) == 0 {
+			result.MismatchScoreImpact = mismatchCheck.Impact
+		} else {
+			result.Message += fmt.Sprintf(" %d link(s) display one domain but lead to another.", len(mismatches))
+		}
+		result.HeuristicFindings = findings
+		penalty := 0
+		for _, f := range findings {
+			penalty += f.Penalty
+		}
+		result.HeuristicScoreImpact = max(heuristicCheck.Impact-penalty, 0)
+		if len(findings) > 0 {
+			result.Message += fmt.Sprintf(" %d link(s) use suspicious URL tricks (IP hosts, embedded credentials, script/data schemes, deep or deceptive subdomains).", len(findings))
 		}
 		ch <- CheckResult{EventName: "urlAnalysis", Payload: result}
-		return // Exit the function early
 	}
+	uniqueURLs := collectEmailURLs(Email)
 
-	ctx, cancel := context.WithTimeout(rCtx, 3*time.Minute)
-	defer cancel()
-	// (URL extraction logic)
-	uniqueURLs := make(map[string]struct{})
-	ignoredExtensions := map[string]struct{}{
-		".png": {}, ".jpg": {}, ".jpeg": {}, ".gif": {}, ".webp": {},
-		".css": {}, ".svg": {}, ".woff": {}, ".woff2": {}, ".ttf": {}, ".js": {},
+	// Operator allow/block lists are consulted before any redirect-following or external lookup.
+	rawURLs := make([]string, 0, len(uniqueURLs))
+	for u := range uniqueURLs {
+		rawURLs = append(rawURLs, u)
+	}
+	listVerdicts, unlisted := applyURLLists(rawURLs, Email.Profile)
+	uniqueURLs = make(map[string]struct{}, len(unlisted))
+	for _, u := range unlisted {
+		uniqueURLs[u] = struct{}{}
 	}
 
-	// 1. Process HTML Links (with anchor text)
-	htmlLinks := extractLinksFromHTML(Email.HTML)
-	for _, l := range htmlLinks {
-		decodedURL := html.UnescapeString(strings.TrimSpace(l.URL))
-		if isSensitiveURL(decodedURL, l.Text) {
-			continue // Skip sensitive links
-		}
-		if parsedURL, err := url.Parse(decodedURL); err == nil {
-			if _, ignore := ignoredExtensions[strings.ToLower(filepath.Ext(parsedURL.Path))]; !ignore {
-				uniqueURLs[decodedURL] = struct{}{}
+	if !isURLScanEnabled {
+		// Without live scanning we don't visit the links at all, not even their landing pages, but
+		// the offline phishing feeds can still be consulted for the URLs exactly as they appear in
+		// the email.
+		verdicts := listVerdicts
+		if threatFeeds != nil && len(unlisted) > 0 {
+			hits, err := threatFeeds.lookup(unlisted)
+			if err != nil {
+				slog.WarnContext(rCtx, "threat feed lookup failed", "err", err)
+			}
+			for u, sources := range hits {
+				verdicts = append(verdicts, feedVerdict(u, sources))
 			}
 		}
-	}
-
-	// 2. Process Plain Text Links (no anchor text)
-	textLinks := getURL(Email.Text)
-	for _, u := range textLinks {
-		decodedURL := html.UnescapeString(strings.TrimSpace(u))
-		// Pass empty string for text, checking URL only
-		if isSensitiveURL(decodedURL, "") {
-			continue
+		maliciousCount := 0
+		for _, v := range verdicts {
+			if v.FinalDecision {
+				maliciousCount++
+			}
 		}
-		if parsedURL, err := url.Parse(decodedURL); err == nil {
-			if _, ignore := ignoredExtensions[strings.ToLower(filepath.Ext(parsedURL.Path))]; !ignore {
-				uniqueURLs[decodedURL] = struct{}{}
+		if maliciousCount > 0 {
+			result := URLAnalysisResult{
+				Status:         "MaliciousURLsDetected",
+				Message:        fmt.Sprintf("%d URL(s) are blocklisted or listed in phishing feeds.", maliciousCount),
+				MaliciousCount: maliciousCount,
+				Severities:     gradeVerdicts(verdicts, 0),
+				ScoreImpact:    0,
+				UrlVerdicts:    verdicts,
 			}
+			send(result)
+			return
 		}
+		result := URLAnalysisResult{
+			Status:  "Disabled",
+			Message: "Live URL scanning is disabled (URLSCAN_ENABLED=FALSE).",
+		}
+		if urlScanningAvailable() {
+			// The offline feeds had nothing on any link.
+			result.Message += " No link is listed in the offline phishing feeds."
+			result.ScoreImpact = check.Impact
+		}
+		send(result)
+		return // Exit the function early
 	}
 
-	var finalURLsEmail []string
-	finalUniqueURLs := make(map[string]struct{})
+	ctx, cancel := context.WithTimeout(rCtx, 3*time.Minute)
+	defer cancel()
+
+	// finalUniqueURLs maps each final (post-redirect) URL to the links that led to it.
+	finalUniqueURLs := make(map[string][]string)
+	var chains []RedirectChain
+	longChains := 0
 	for u := range uniqueURLs {
-		if final, err := getFinalURL(ctx, u); err == nil && final != "" {
-			finalUniqueURLs[final] = struct{}{}
+		if chain, err := getRedirectChain(ctx, u); err == nil && chain.Final != "" {
+			finalUniqueURLs[chain.Final] = append(finalUniqueURLs[chain.Final], u)
+			if len(chain.Hops) > 1 {
+				chains = append(chains, chain)
+			}
+			if chain.TooLong {
+				longChains++
+			}
 		}
 	}
+	var resolvedURLs []string
 	for u := range finalUniqueURLs {
-		finalURLsEmail = append(finalURLsEmail, u)
+		resolvedURLs = append(resolvedURLs, u)
 	}
+	// Redirect destinations get the same list treatment as the links themselves.
+	finalListVerdicts, finalURLsEmail := applyURLLists(resolvedURLs, Email.Profile)
+	listVerdicts = append(listVerdicts, finalListVerdicts...)
 
 	// Send urlScanStarted event to the central channel
 	eventChan <- CheckResult{
 		EventName: "urlScanStarted",
-		Payload:   URLScanStartInfo{Total: len(finalURLsEmail)},
+		Payload:   URLScanStartInfo{Total: len(finalURLsEmail) + len(listVerdicts)},
+	}
+	for _, v := range listVerdicts {
+		eventChan <- CheckResult{
+			EventName: "urlScanResult",
+			Payload:   scanUpdate(v),
+		}
+	}
+
+	lookup := make([]string, 0, len(uniqueURLs)+len(finalURLsEmail))
+	lookup = append(lookup, finalURLsEmail...)
+	for u := range uniqueURLs {
+		if _, isFinal := finalUniqueURLs[u]; !isFinal {
+			lookup = append(lookup, u)
+		}
+	}
+
+	// Offline phishing feeds are checked first: a hit there needs no further scanning.
+	preVerdicts := listVerdicts
+	candidates := finalURLsEmail
+	if threatFeeds != nil {
+		hits, err := threatFeeds.lookup(lookup)
+		if err != nil {
+			slog.WarnContext(rCtx, "threat feed lookup failed", "err", err)
+		} else if len(hits) > 0 {
+			candidates = nil
+			for _, final := range finalURLsEmail {
+				sources := hits[final]
+				for _, orig := range finalUniqueURLs[final] {
+					sources = append(sources, hits[orig]...)
+				}
+				if len(sources) == 0 {
+					candidates = append(candidates, final)
+					continue
+				}
+				v := feedVerdict(final, sources)
+				preVerdicts = append(preVerdicts, v)
+				eventChan <- CheckResult{
+					EventName: "urlScanResult",
+					Payload:   scanUpdate(v),
+				}
+			}
+		}
+	}
+
+	// Fast pre-filter: Safe Browsing answers in milliseconds, so anything it already knows
+	// about is decided here without touching the slow scanners.
+	var toScan []string
+	if safeBrowsingAPIKey != "" && len(candidates) > 0 {
+		matches, err := checkSafeBrowsing(ctx, lookup)
+		if err != nil {
+			slog.WarnContext(ctx, "Safe Browsing lookup failed, falling back to full scans", "err", err)
+			toScan = candidates
+		} else {
+			for _, final := range candidates {
+				threats := matches[final]
+				for _, orig := range finalUniqueURLs[final] {
+					threats = append(threats, matches[orig]...)
+				}
+				switch {
+				case len(threats) > 0:
+					v := safeBrowsingVerdict(final, threats)
+					preVerdicts = append(preVerdicts, v)
+					eventChan <- CheckResult{
+						EventName: "urlScanResult",
+						Payload:   scanUpdate(v),
+					}
+				case safeBrowsingTrustClean:
+					v := Verdict{URL: final, Source: "safebrowsing", Cats: []string{}}
+					preVerdicts = append(preVerdicts, v)
+					eventChan <- CheckResult{
+						EventName: "urlScanResult",
+						Payload:   scanUpdate(v),
+					}
+				default:
+					toScan = append(toScan, final)
+				}
+			}
+		}
+	} else {
+		toScan = candidates
 	}
+
 	var urlWg sync.WaitGroup
-	verdictsChan := make(chan Verdict, len(finalURLsEmail))
-	for _, u := range finalURLsEmail {
+	var unscanned, failed atomic.Int32
+	verdictsChan := make(chan Verdict, len(finalURLsEmail)+len(listVerdicts))
+	for _, v := range preVerdicts {
+		verdictsChan <- v
+	}
+	for _, u := range toScan {
 		urlWg.Add(1)
 		go func(url string) {
 			defer urlWg.Done()
-			if v, err := checkURLsVTotal(ctx, url); err == nil && v != nil {
+			queued := func(wait time.Duration) {
+				eventChan <- CheckResult{
+					EventName: "urlScanResult",
+					Payload:   URLScanUpdate{URL: url, Status: "queued"},
+				}
+			}
+			if v, err := scanURL(ctx, url, URLScanRequest{Options: Email.URLScan, Store: db}, queued); err == nil && v != nil {
 				verdictsChan <- *v
 				// Stream individual result back to the central event channel
 				eventChan <- CheckResult{
 					EventName: "urlScanResult",
-					Payload:   URLScanUpdate{URL: url, FinalDecision: v.FinalDecision, Report: v.Report},
+					Payload:   scanUpdate(*v),
+				}
+			} else if errors.Is(err, errScanQuota) {
+				unscanned.Add(1)
+				slog.InfoContext(ctx, "URL not scanned, quota exhausted", "url", url, "err", err)
+				eventChan <- CheckResult{
+					EventName: "urlScanResult",
+					Payload:   URLScanUpdate{URL: url, Status: "notScanned", Error: err.Error()},
 				}
 			} else if err != nil {
-				log.Printf("Error scanning URL %s: %v", url, err)
+				failed.Add(1)
+				slog.WarnContext(ctx, "scanning URL failed", "url", url, "err", err)
 				// Stream error back to the central event channel
 				eventChan <- CheckResult{
 					EventName: "urlScanResult",
@@ -702,64 +1608,190 @@ func performURLAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, eventChan cha
 	for v := range verdictsChan {
 		verdicts = append(verdicts, v)
 	}
+	// Links that any source had doubts about are opened in an isolated browser to see whether
+	// they lead to a login page.
+	attachLandingPages(ctx, verdicts)
 
-	maliciousURLCount := 0
-	for _, v := range verdicts {
-		if v.FinalDecision {
-			maliciousURLCount++
-		}
-	}
+	severities := gradeVerdicts(verdicts, int(unscanned.Load()+failed.Load()))
+	maliciousURLCount := severities[severityMalicious]
 
-	result := URLAnalysisResult{UrlVerdicts: verdicts, MaliciousCount: maliciousURLCount}
-	if maliciousURLCount > 0 {
+	result := URLAnalysisResult{UrlVerdicts: verdicts, MaliciousCount: maliciousURLCount, Severities: severities, RedirectChains: chains, LongRedirectChains: longChains}
+	result.Certificates = inspectURLCerts(ctx, db, resolvedURLs)
+	result.LinkDomains = trancoRanks(resolvedURLs)
+	result.HostingGeo = locateLinkHosts(ctx, resolvedURLs, claimedCountry(Email.Domain))
+	result.ScoreImpact = severityImpact(check.Impact, severities)
+	switch suspicious := severities[severitySuspicious]; {
+	case maliciousURLCount > 0:
 		result.Status = "MaliciousURLsDetected"
 		result.Message = fmt.Sprintf("%d malicious URL(s) were detected.", maliciousURLCount)
-		result.ScoreImpact = 0 // No points if malicious URLs are found
-	} else {
+		if suspicious > 0 {
+			result.Message += fmt.Sprintf(" %d more look suspicious.", suspicious)
+		}
+	case suspicious > 0:
+		result.Status = "SuspiciousURLsDetected"
+		result.Message = fmt.Sprintf("%d suspicious URL(s) were found: a minority of scanners flagged them or they look deceptive.", suspicious)
+	default:
 		result.Status = "Clean"
 		result.Message = "No malicious URLs were found."
-		result.ScoreImpact = check.Impact
 	}
-	ch <- CheckResult{EventName: "urlAnalysis", Payload: result}
+	if n := int(unscanned.Load()); n > 0 {
+		result.UnscannedCount = n
+		result.Message += fmt.Sprintf(" %d link(s) weren't scanned because the URL scanner's quota is used up.", n)
+	}
+	if longChains > 0 {
+		result.Message += fmt.Sprintf(" %d link(s) pass through more than %d redirects.", longChains, redirectHopThreshold)
+	}
+	freshLookalikes := 0
+	for _, c := range result.Certificates {
+		if c.FreshLookalike {
+			freshLookalikes++
+		}
+	}
+	if freshLookalikes > 0 {
+		result.Message += fmt.Sprintf(" %d link(s) lead to a lookalike domain with a freshly issued Let's Encrypt certificate.", freshLookalikes)
+	}
+	var abroad []string
+	for _, h := range result.HostingGeo {
+		if h.Mismatch {
+			abroad = append(abroad, fmt.Sprintf("%s (%s)", h.Host, h.GeoInfo))
+		}
+	}
+	if len(abroad) > 0 {
+		result.Message += fmt.Sprintf(" Link(s) hosted outside %s, where the sender's domain is: %s.", claimedCountry(Email.Domain), strings.Join(abroad, "; "))
+	}
+	send(result)
 }
 
-func performExecutableAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, env *enmime.Envelope) {
+// collectEmailURLs gathers the unique, decoded links from the HTML anchors and plain text,
+// skipping sensitive one-click links (unsubscribe, verify, ...) and static assets.
+func collectEmailURLs(Email EmailData) map[string]struct{} {
+	uniqueURLs := make(map[string]struct{})
+	ignoredExtensions := map[string]struct{}{
+		".png": {}, ".jpg": {}, ".jpeg": {}, ".gif": {}, ".webp": {},
+		".css": {}, ".svg": {}, ".woff": {}, ".woff2": {}, ".ttf": {}, ".js": {},
+	}
+
+	// 1. Process HTML Links (with anchor text)
+	htmlLinks := extractLinksFromHTML(Email.HTML)
+	for _, l := range htmlLinks {
+		decodedURL := html.UnescapeString(strings.TrimSpace(l.URL))
+		if isSensitiveURL(decodedURL, l.Text) {
+			continue // Skip sensitive links
+		}
+		if parsedURL, err := url.Parse(decodedURL); err == nil {
+			if _, ignore := ignoredExtensions[strings.ToLower(filepath.Ext(parsedURL.Path))]; !ignore {
+				uniqueURLs[decodedURL] = struct{}{}
+			}
+		}
+	}
+
+	// 2. Process Plain Text Links (no anchor text), plus links pulled out of attachments
+	textLinks := append(getURL(Email.Text), Email.AttachmentURLs...)
+	textLinks = append(append(textLinks, formActionURLs(Email.HTML)...), activeContentURLs(Email.HTML)...)
+	if Email.Padding != nil {
+		textLinks = append(textLinks, Email.Padding.URLs...)
+	}
+	for _, u := range textLinks {
+		decodedURL := html.UnescapeString(strings.TrimSpace(u))
+		// Pass empty string for text, checking URL only
+		if isSensitiveURL(decodedURL, "") {
+			continue
+		}
+		if parsedURL, err := url.Parse(decodedURL); err == nil {
+			if _, ignore := ignoredExtensions[strings.ToLower(filepath.Ext(parsedURL.Path))]; !ignore {
+				uniqueURLs[decodedURL] = struct{}{}
+			}
+		}
+	}
+	return uniqueURLs
+}
+
+func performExecutableAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, rCtx context.Context, env *enmime.Envelope) {
 	defer wg.Done() // This line is new!
 	var check Check
-	for _, c := range AllChecks {
+	for _, c := range activeChecks() {
 		if c.Name == "ExecutableFileFound" {
 			check = c
 			break
 		}
 	}
-	found, message := analyseForExecutables(env)
-	result := ExecutableAnalysisResult{Found: found, Message: message}
+	var macroCheck Check
+	for _, c := range activeChecks() {
+		if c.Name == "OfficeMacroFound" {
+			macroCheck = c
+			break
+		}
+	}
+	ctx, cancel := context.WithTimeout(rCtx, time.Minute)
+	defer cancel()
+	found, message, files := analyseForExecutables(ctx, env)
+	result := ExecutableAnalysisResult{Found: found, Message: message, Files: files}
 	if !found {
 		result.ScoreImpact = check.Impact
 	}
+	var macroFindings []string
+	for _, f := range files {
+		if f.Macros == nil {
+			continue
+		}
+		result.MacrosFound = true
+		finding := f.FileName + " contains VBA macros"
+		if len(f.Macros.AutoExec) > 0 {
+			finding += " that run automatically (" + strings.Join(f.Macros.AutoExec, ", ") + ")"
+		}
+		macroFindings = append(macroFindings, finding)
+	}
+	if result.MacrosFound {
+		result.Message += " " + strings.Join(macroFindings, "; ") + "."
+	} else {
+		result.MacroScoreImpact = macroCheck.Impact
+	}
 	ch <- CheckResult{EventName: "executableAnalysis", Payload: result}
 }
 
-func performTextAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, fileName string, db *sql.DB, dbTime *int64, sandboxDir string, countryCode string, Email EmailData) (err error) {
+func performTextAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, eventChan chan<- CheckResult, fileName string, db CompanyStore, dbTime *int64, sandboxDir string, countryCode string, Email EmailData) (err error) {
 	defer wg.Done()
-	whoResult, err := whoTheyAre(true, fileName, sandboxDir, Email, "")
+	if geminiEnabled {
+		sendStage(eventChan, "geminiStarted", "textAnalysis", time.Time{})
+	}
+	startAI := time.Now()
+	whoResult, aiStats, err := whoTheyAre(true, fileName, sandboxDir, Email, nil, "", countryCode)
+	if geminiEnabled {
+		sendStage(eventChan, "geminiCompleted", "textAnalysis", startAI)
+	}
+	if errors.Is(err, errGeminiDisabled) {
+		ch <- CheckResult{
+			EventName: "textAnalysis",
+			Payload:   ContentAnalysisResult{Language: Email.Language, Error: "Content analysis is disabled."},
+		}
+		return nil
+	}
 	if err != nil {
-		log.Printf("Normal text analysis failed: %v", err)
+		Email.logger().Error("text analysis failed", "err", err)
 		// Send an error payload instead of just returning
 		ch <- CheckResult{
 			EventName: "textAnalysis",
-			Payload:   ContentAnalysisResult{Error: "Failed to analyse email content."},
+			Payload:   ContentAnalysisResult{AIStats: aiStats, Language: Email.Language, Error: "Failed to analyse email content."},
 		}
 		return
 	}
-	var result ContentAnalysisResult
+	result := ContentAnalysisResult{AIStats: aiStats, Language: Email.Language, QuotedChars: Email.QuotedChars}
 	populateContentAnalysis(&result, whoResult, db, dbTime, countryCode, Email)
+	if result.Intent = classifyIntent(whoResult.Classification, "text"); result.Intent != nil {
+		eventChan <- CheckResult{EventName: "intentClassification", Payload: *result.Intent}
+	}
 
 	// Phone Number Validation (logic is the same as before)
-	phoneNumbers := extractPhoneNumbersFromEmail(Email.Text + "\n" + Email.HTML)
+	phoneNumbers := extractPhoneNumbersFromEmail(Email.textWithImages()+"\n"+Email.HTML, Email.PhoneRegions)
 	result.ContactMethodAnalysis.PhoneNumbers = []PhoneNumbersValidation{}
-	if len(phoneNumbers) == 0 {
-		for _, c := range AllChecks {
+	// Strict PII redaction forbids looking numbers up, so they count as if there were none.
+	// Without Google Search the check is out of the maximum score and awards nothing.
+	if !googleSearchEnabled {
+		for _, number := range phoneNumbers {
+			result.ContactMethodAnalysis.PhoneNumbers = append(result.ContactMethodAnalysis.PhoneNumbers, PhoneNumbersValidation{PhoneNumber: number})
+		}
+	} else if len(phoneNumbers) == 0 || piiRedactionMode == piiRedactionStrict {
+		for _, c := range activeChecks() {
 			if c.Name == "CorrectPhoneNumber" {
 				result.ContactMethodAnalysis.ScoreImpact = c.Impact
 				break
@@ -771,16 +1803,16 @@ func performTextAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, fileName str
 		for _, number := range phoneNumbers {
 			isValid := false
 			searchQuery := fmt.Sprintf("\"%s\"", number)
-			if body, err := searchGoogle(searchQuery, countryCode); err == nil && string(body) != "" {
+			if body, err := searchGoogle(Email.requestContext(), searchQuery, countryCode); err == nil && string(body) != "" {
 				var sr, sr2 GoogleSearchResult
 				if json.Unmarshal(body, &sr) == nil && len(sr.Items) > 0 {
-					if body2, err2 := searchGoogle(sr.Items[0].DisplayLink, countryCode); err2 == nil && string(body2) != "" {
+					if body2, err2 := searchGoogle(Email.requestContext(), sr.Items[0].DisplayLink, countryCode); err2 == nil && string(body2) != "" {
 						if json.Unmarshal(body2, &sr2) == nil && len(sr2.Items) > 0 {
 							companyTitle := strings.ToLower(sr2.Items[0].Title)
 							if whoResult.OrganizationName != "" && strings.Contains(companyTitle, strings.ToLower(whoResult.OrganizationName)) && !containsAny(companyTitle, bannedWords) {
 								isValid = true
 								if !scoreImpactApplied {
-									for _, c := range AllChecks {
+									for _, c := range activeChecks() {
 										if c.Name == "CorrectPhoneNumber" {
 											result.ContactMethodAnalysis.ScoreImpact = c.Impact
 											break
@@ -796,37 +1828,124 @@ func performTextAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, fileName str
 			result.ContactMethodAnalysis.PhoneNumbers = append(result.ContactMethodAnalysis.PhoneNumbers, PhoneNumbersValidation{PhoneNumber: number, IsValid: isValid})
 		}
 	}
+	validateContactDetails(&result, Email.Text+"\n"+strings.Join(mailtoAddresses(Email.HTML), "\n"), whoResult, db, countryCode, Email)
 
 	ch <- CheckResult{EventName: "textAnalysis", Payload: result}
 	return
 }
 
-func performRenderedAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, fileName string, env *enmime.Envelope, db *sql.DB, dbTime *int64, sandboxDir string, countryCode string, Email EmailData) {
+func performRenderedAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, eventChan chan<- CheckResult, fileName string, env *enmime.Envelope, db CompanyStore, dbTime *int64, sandboxDir string, countryCode string, Email EmailData) {
 	defer wg.Done()
 
 	// Rendering logic
-	fileNameImage, screenshotFileName := RenderEmailHTML(env, fileName, sandboxDir)
-	renderEmailText := OCRImage(fileNameImage)
+	ctx := Email.requestContext()
+	sendStage(eventChan, "renderingStarted", "renderedAnalysis", time.Time{})
+	started := time.Now()
+	rendered := RenderEmailHTML(ctx, env, fileName, sandboxDir, renderVariants)
+	fileNameImage := rendered.Path
+	sendStage(eventChan, "renderingCompleted", "renderedAnalysis", started)
+	result := ContentAnalysisResult{Language: Email.Language, BlockedRequests: rendered.Blocked}
+
+	// The page's own text is read unless the email is mostly images; then the screenshots are OCRed.
+	useOCR := fileNameImage != "" && needsOCR(rendered.Page)
+	started = time.Now()
+	var ocr OCRResult
+	renderEmailText := rendered.Page.Text
+	if useOCR {
+		ocr = OCRImage(ctx, fileNameImage, Email.Language.Tesseract)
+		renderEmailText = ocr.Text
+		result.RenderedText = compareRenderedText(renderedTextOCR, rendered.Page, Email.Text, Email)
+	} else if fileNameImage != "" {
+		result.RenderedText = compareRenderedText(renderedTextDOM, rendered.Page, Email.Text, Email)
+	}
+	baseText := renderEmailText
+	screenshotPaths, screenshotFileNames := []string{fileNameImage}, []string{rendered.FileName}
+	for _, v := range rendered.Variants {
+		variantText, variantErr := v.Page.Text, ""
+		if useOCR {
+			variantOCR := OCRImage(ctx, v.Path, Email.Language.Tesseract)
+			variantText, variantErr = variantOCR.Text, variantOCR.Error
+		}
+		shown := RenderVariantResult{Name: v.Name, Screenshot: keepEmailScreenshot(ctx, v.Path), Error: variantErr}
+		// Only what the normal screenshot doesn't show is added to the text the checks read.
+		for _, line := range linesOnlyIn(variantText, baseText) {
+			renderEmailText += "\n" + line
+			shown.OnlyHere = append(shown.OnlyHere, redactPII(line, Email))
+		}
+		result.RenderVariants = append(result.RenderVariants, shown)
+		screenshotPaths = append(screenshotPaths, v.Path)
+		screenshotFileNames = append(screenshotFileNames, v.FileName)
+	}
+	if useOCR {
+		sendStage(eventChan, "ocrCompleted", "renderedAnalysis", started)
+	}
 
-	var result ContentAnalysisResult
+	if fileNameImage != "" {
+		if useOCR {
+			// The blocks go out with the result, so mask the recipient's details as for Gemini.
+			blocks := make([]OCRBlock, len(ocr.Blocks))
+			for i, b := range ocr.Blocks {
+				blocks[i] = OCRBlock{Text: redactPII(b.Text, Email), Confidence: b.Confidence}
+			}
+			reported := ocr
+			reported.Blocks = blocks
+			result.OCR = &reported
+		}
+		result.Screenshot = keepEmailScreenshot(ctx, fileNameImage)
+	}
+	if scan := scanPaymentScam(renderEmailText); scan.Found() {
+		result.PaymentScam = &scan
+	}
+	// The brand the screenshot shows is asked separately, alongside the main analysis. It needs the
+	// screenshot itself, so it is skipped while images are kept from Gemini.
+	visualDone := make(chan *VisualImpersonationResult, 1)
+	if fileNameImage != "" && geminiEnabled && imagesToGemini() {
+		go func() {
+			visual := checkVisualImpersonation(screenshotPaths, db, Email)
+			eventChan <- CheckResult{EventName: "visualImpersonation", Payload: visual}
+			visualDone <- &visual
+		}()
+	} else {
+		visualDone <- nil
+	}
 	if renderEmailText == "" {
-		log.Println("No text extracted from rendered email.")
+		Email.logger().Warn("no text extracted from rendered email")
 	} else {
-		whoResult, err := whoTheyAre(false, fileName, sandboxDir, Email, screenshotFileName)
-		if err != nil {
-			log.Printf("Rendered text analysis failed: %v", err)
+		if geminiEnabled {
+			sendStage(eventChan, "geminiStarted", "renderedAnalysis", time.Time{})
+		}
+		started = time.Now()
+		whoResult, aiStats, err := whoTheyAre(false, fileName, sandboxDir, Email, screenshotFileNames, renderEmailText, countryCode)
+		if geminiEnabled {
+			sendStage(eventChan, "geminiCompleted", "renderedAnalysis", started)
+		}
+		result.AIStats = aiStats
+		if errors.Is(err, errGeminiDisabled) {
+			result.Error = "Content analysis is disabled."
+		} else if err != nil {
+			Email.logger().Error("rendered analysis failed", "err", err)
 			ch <- CheckResult{
 				EventName: "renderedAnalysis",
-				Payload:   ContentAnalysisResult{Error: "Failed to analyse rendered email screenshot."},
+				Payload: ContentAnalysisResult{
+					AIStats: aiStats, Language: Email.Language, VisualImpersonation: <-visualDone,
+					Error: "Failed to analyse rendered email screenshot.",
+				},
 			}
 			return
 		} else {
 			populateContentAnalysis(&result, whoResult, db, dbTime, countryCode, Email)
+			if result.Intent = classifyIntent(whoResult.Classification, "rendered"); result.Intent != nil {
+				eventChan <- CheckResult{EventName: "intentClassification", Payload: *result.Intent}
+			}
 			// Phone Number Validation (Rendered)
-			phoneNumbers := extractPhoneNumbersFromEmail(renderEmailText)
+			phoneNumbers := extractPhoneNumbersFromEmail(renderEmailText, Email.PhoneRegions)
 			result.ContactMethodAnalysis.PhoneNumbers = []PhoneNumbersValidation{}
-			if len(phoneNumbers) == 0 {
-				for _, c := range AllChecks {
+			if !googleSearchEnabled {
+				for _, number := range phoneNumbers {
+					result.ContactMethodAnalysis.PhoneNumbers = append(result.ContactMethodAnalysis.PhoneNumbers, PhoneNumbersValidation{PhoneNumber: number})
+				}
+			} else if len(phoneNumbers) == 0 || piiRedactionMode == piiRedactionStrict {
+				for _, c := range activeChecks() {
 					if c.Name == "CorrectPhoneNumber" {
 						result.ContactMethodAnalysis.ScoreImpact = c.Impact
 						break
@@ -839,16 +1958,16 @@ func performRenderedAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, fileName
 				for _, number := range phoneNumbers {
 					isValid := false
 					searchQuery := fmt.Sprintf("\"%s\"", number)
-					if body, err := searchGoogle(searchQuery, countryCode); err == nil && string(body) != "" {
+					if body, err := searchGoogle(Email.requestContext(), searchQuery, countryCode); err == nil && string(body) != "" {
 						var sr, sr2 GoogleSearchResult
 						if json.Unmarshal(body, &sr) == nil && len(sr.Items) > 0 {
-							if body2, err2 := searchGoogle(sr.Items[0].DisplayLink, countryCode); err2 == nil && string(body2) != "" {
+							if body2, err2 := searchGoogle(Email.requestContext(), sr.Items[0].DisplayLink, countryCode); err2 == nil && string(body2) != "" {
 								if json.Unmarshal(body2, &sr2) == nil && len(sr2.Items) > 0 {
 									companyTitle := strings.ToLower(sr2.Items[0].Title)
 									if whoResult.OrganizationName != "" && strings.Contains(companyTitle, strings.ToLower(whoResult.OrganizationName)) && !containsAny(companyTitle, bannedWords) {
 										isValid = true
 										if !scoreImpactApplied {
-											for _, c := range AllChecks {
+											for _, c := range activeChecks() {
 												if c.Name == "CorrectPhoneNumber" {
 													result.ContactMethodAnalysis.ScoreImpact = c.Impact
 													break
@@ -864,31 +1983,35 @@ func performRenderedAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, fileName
 					result.ContactMethodAnalysis.PhoneNumbers = append(result.ContactMethodAnalysis.PhoneNumbers, PhoneNumbersValidation{PhoneNumber: number, IsValid: isValid})
 				}
 			}
+			validateContactDetails(&result, renderEmailText, whoResult, db, countryCode, Email)
 		}
 	}
+	result.VisualImpersonation = <-visualDone
 	ch <- CheckResult{EventName: "renderedAnalysis", Payload: result}
 }
 
 // Helper function remains the same
-func populateContentAnalysis(result *ContentAnalysisResult, whoResult EmailAnalysis, db *sql.DB, dbTimeNanos *int64, countryCode string, Email EmailData) {
+func populateContentAnalysis(result *ContentAnalysisResult, whoResult EmailAnalysis, db CompanyStore, dbTimeNanos *int64, countryCode string, Email EmailData) {
 	result.CompanyIdentification.Identified = whoResult.OrganizationFound
 	result.CompanyIdentification.Name = whoResult.OrganizationName
+	result.CompanyIdentification.Confidence = whoResult.OrganizationConfidence
 	if whoResult.OrganizationFound {
-		for _, c := range AllChecks {
+		for _, c := range activeChecks() {
 			if c.Name == "CompanyIdentified" {
-				result.CompanyIdentification.ScoreImpact = c.Impact
+				result.CompanyIdentification.ScoreImpact = scaleByConfidence(c.Impact, whoResult.OrganizationConfidence)
 				break
 			}
 		}
 		dbReadStart := time.Now()
-		verified, err := verifyCompany(db, whoResult, countryCode, Email)
+		verified, registered, err := verifyCompany(db, whoResult, countryCode, Email)
 		atomic.AddInt64(dbTimeNanos, time.Since(dbReadStart).Nanoseconds())
 		if err != nil {
-			log.Printf("Error verifying company: %v", err)
+			Email.logger().Warn("verifying company failed", "err", err)
 		}
 		result.CompanyVerification.Verified = verified
+		result.CompanyVerification.Registry = registered
 		if verified {
-			for _, c := range AllChecks {
+			for _, c := range activeChecks() {
 				if c.Name == "CompanyVerified" {
 					result.CompanyVerification.ScoreImpact = c.Impact
 					break
@@ -898,6 +2021,9 @@ func populateContentAnalysis(result *ContentAnalysisResult, whoResult EmailAnaly
 		} else {
 			result.CompanyVerification.Message = "Could not verify the sender's domain against the identified company."
 		}
+		if registered != nil && !registered.Active {
+			result.CompanyVerification.Message += fmt.Sprintf(" %s is registered as %s (%s).", registered.Name, registered.Status, registered.Number)
+		}
 	}
 
 	result.ActionAnalysis.ActionRequired = whoResult.ActionRequired
@@ -906,20 +2032,32 @@ func populateContentAnalysis(result *ContentAnalysisResult, whoResult EmailAnaly
 
 	result.RealismAnalysis.IsRealistic = whoResult.Realistic
 	result.RealismAnalysis.Reason = whoResult.RealisticReason
+	result.RealismAnalysis.Confidence = whoResult.RealisticConfidence
 	if whoResult.Realistic {
-		for _, c := range AllChecks {
+		for _, c := range activeChecks() {
 			if c.Name == "RealismCheck" {
-				result.RealismAnalysis.ScoreImpact = c.Impact
+				result.RealismAnalysis.ScoreImpact = scaleByConfidence(c.Impact, whoResult.RealisticConfidence)
 				break
 			}
 		}
 	}
 }
 
+// scaleByConfidence scales the points of an AI verdict by how sure Gemini was of it, so a guess
+// earns less than a certain answer. Without a confidence the verdict counts in full.
+func scaleByConfidence(impact int, confidence *float64) int {
+	if confidence == nil {
+		return impact
+	}
+	return int(math.Round(float64(impact) * min(max(*confidence, 0), 1)))
+}
+
 // New function to calculate scores at the end
 // main.go
 
-func calculateFinalScores(data map[string]interface{}, maxScore float64) ScoreResult {
+// calculateFinalScores sums the points awarded by each check. The checks score with the
+// server-wide weights; a profile's own weights are applied here.
+func calculateFinalScores(data map[string]interface{}, maxScore float64, p *Profile) ScoreResult {
 	var scores ScoreResult
 	var baseScore int
 
@@ -955,11 +2093,90 @@ func calculateFinalScores(data map[string]interface{}, maxScore float64) ScoreRe
 
 	// Calculate the base score using the other checks and the (potentially modified) domain score
 	if execData, ok := data["executableAnalysis"].(ExecutableAnalysisResult); ok {
-		baseScore += execData.ScoreImpact
+		baseScore += p.weigh("ExecutableFileFound", execData.ScoreImpact)
+		baseScore += p.weigh("OfficeMacroFound", execData.MacroScoreImpact)
 	}
-	baseScore += domainData.ScoreImpact // This now uses the context-aware score
+	baseScore += p.weigh(domainData.Status, domainData.ScoreImpact) // statuses are named after their check
+	baseScore += p.weigh("SenderDomainReceivesMail", domainData.MailDNSScoreImpact)
 	if urlData, ok := data["urlAnalysis"].(URLAnalysisResult); ok {
-		baseScore += urlData.ScoreImpact
+		baseScore += p.weigh("MaliciousURLFound", urlData.ScoreImpact)
+		baseScore += p.weigh("LinkTextMismatch", urlData.MismatchScoreImpact)
+		baseScore += p.weigh("URLHeuristics", urlData.HeuristicScoreImpact)
+	}
+	if trackingData, ok := data["trackingAnalysis"].(TrackingAnalysisResult); ok {
+		baseScore += p.weigh("TrackingPixelsFound", trackingData.ScoreImpact)
+	}
+	if remoteData, ok := data["remoteContentAnalysis"].(RemoteContentResult); ok {
+		baseScore += p.weigh("RemoteContentUnrelated", remoteData.ScoreImpact)
+	}
+	if hiddenData, ok := data["hiddenContentAnalysis"].(HiddenContentResult); ok {
+		baseScore += p.weigh("HiddenContent", hiddenData.ScoreImpact)
+	}
+	if paddingData, ok := data["obfuscationPadding"].(ObfuscationPaddingResult); ok {
+		baseScore += p.weigh("ObfuscationPadding", paddingData.ScoreImpact)
+	}
+	if htmlAttachmentData, ok := data["htmlAttachmentAnalysis"].(HTMLAttachmentAnalysisResult); ok {
+		baseScore += p.weigh("HTMLAttachmentPhishing", htmlAttachmentData.ScoreImpact)
+	}
+	if formData, ok := data["embeddedFormAnalysis"].(EmbeddedFormResult); ok {
+		baseScore += p.weigh("EmbeddedCredentialForm", formData.ScoreImpact)
+	}
+	if engineData, ok := data["spamEngineAnalysis"].(SpamEngineResult); ok {
+		baseScore += p.weigh("SpamEngineVerdict", engineData.ScoreImpact)
+		if engineData.Skipped {
+			// An outage says nothing about the email.
+			maxScore -= float64(positiveImpact(p, "SpamEngineVerdict"))
+		}
+	}
+	if spamData, ok := data["spamHeaderAnalysis"].(SpamHeaderResult); ok {
+		baseScore += p.weigh("UpstreamSpamVerdict", spamData.ScoreImpact)
+	}
+	if listData, ok := data["mailingListAnalysis"].(MailingListResult); ok {
+		baseScore += p.weigh("ListUnsubscribeMatchesSender", listData.ScoreImpact)
+	}
+	if imageFileData, ok := data["imageFileAnalysis"].(ImageFileResult); ok {
+		baseScore += p.weigh("ImagePolyglot", imageFileData.ScoreImpact)
+	}
+	if imageData, ok := data["imageTextAnalysis"].(ImageTextResult); ok {
+		baseScore += p.weigh("ImageOnlyEmail", imageData.ScoreImpact)
+	}
+	if timeData, ok := data["sendTimeAnalysis"].(SendTimeResult); ok {
+		baseScore += p.weigh("SendingTimeAnomaly", timeData.ScoreImpact)
+	}
+	if unicodeData, ok := data["unicodeAnalysis"].(UnicodeAnomalyResult); ok {
+		baseScore += p.weigh("UnicodeObfuscation", unicodeData.ScoreImpact)
+	}
+	if activeData, ok := data["activeContentAnalysis"].(ActiveContentResult); ok {
+		baseScore += p.weigh("EmailScript", activeData.ScriptScoreImpact)
+		baseScore += p.weigh("MetaRefreshRedirect", activeData.RefreshScoreImpact)
+		baseScore += p.weigh("BaseTagRewrite", activeData.BaseScoreImpact)
+	}
+	if calendarData, ok := data["calendarAnalysis"].(CalendarAnalysisResult); ok {
+		baseScore += p.weigh("CalendarInvitePhishing", calendarData.ScoreImpact)
+	}
+	if senderIPData, ok := data["senderIPAnalysis"].(SenderIPAnalysisResult); ok {
+		baseScore += p.weigh("SenderIPListed", senderIPData.ScoreImpact)
+	}
+	if executiveData, ok := data["executiveImpersonation"].(ExecutiveImpersonationResult); ok {
+		baseScore += p.weigh("ExecutiveImpersonation", executiveData.ScoreImpact)
+	}
+	if yaraData, ok := data["yaraAnalysis"].(YARAAnalysisResult); ok {
+		baseScore += p.weigh("YARARuleMatch", yaraData.ScoreImpact)
+	}
+	if scriptData, ok := data["scriptAnalysis"].(ScriptAnalysisResult); ok {
+		baseScore += p.weigh("ScriptedRuleFinding", scriptData.ScoreImpact)
+	}
+	paymentData, hasPaymentData := data["paymentScamAnalysis"].(PaymentScamResult)
+	if hasPaymentData {
+		baseScore += p.weigh("CryptoOrGiftCardRequest", paymentData.ScoreImpact)
+	}
+	if bankData, ok := data["bankDetailAnalysis"].(BankDetailChangeResult); ok {
+		baseScore += p.weigh("BankDetailChange", bankData.ScoreImpact)
+	}
+	for _, plugin := range checkPlugins {
+		if pluginData, ok := data[plugin.Name()].(PluginResult); ok {
+			baseScore += p.weigh(plugin.Name(), pluginData.ScoreImpact)
+		}
 	}
 
 	scores.BaseScore = baseScore
@@ -968,18 +2185,30 @@ func calculateFinalScores(data map[string]interface{}, maxScore float64) ScoreRe
 
 	// Add scores from the text analysis only if we actually have results
 	if hasTextData {
-		finalScoreNormal += textData.CompanyIdentification.ScoreImpact
-		finalScoreNormal += textData.CompanyVerification.ScoreImpact
-		finalScoreNormal += textData.RealismAnalysis.ScoreImpact
-		finalScoreNormal += textData.ContactMethodAnalysis.ScoreImpact
+		finalScoreNormal += p.weigh("CompanyIdentified", textData.CompanyIdentification.ScoreImpact)
+		finalScoreNormal += p.weigh("CompanyVerified", textData.CompanyVerification.ScoreImpact)
+		finalScoreNormal += p.weigh("RealismCheck", textData.RealismAnalysis.ScoreImpact)
+		finalScoreNormal += p.weigh("CorrectPhoneNumber", textData.ContactMethodAnalysis.ScoreImpact)
+		finalScoreNormal += p.weigh("CorrectContactEmail", textData.ContactMethodAnalysis.EmailScoreImpact)
+		finalScoreNormal += p.weigh("CorrectPostalAddress", textData.ContactMethodAnalysis.AddressScoreImpact)
 	}
 
 	// Add scores from the rendered analysis only if we actually have results
 	if hasRenderedData {
-		finalScoreRendered += renderedData.CompanyIdentification.ScoreImpact
-		finalScoreRendered += renderedData.CompanyVerification.ScoreImpact
-		finalScoreRendered += renderedData.RealismAnalysis.ScoreImpact
-		finalScoreRendered += renderedData.ContactMethodAnalysis.ScoreImpact
+		finalScoreRendered += p.weigh("CompanyIdentified", renderedData.CompanyIdentification.ScoreImpact)
+		finalScoreRendered += p.weigh("CompanyVerified", renderedData.CompanyVerification.ScoreImpact)
+		finalScoreRendered += p.weigh("RealismCheck", renderedData.RealismAnalysis.ScoreImpact)
+		finalScoreRendered += p.weigh("CorrectPhoneNumber", renderedData.ContactMethodAnalysis.ScoreImpact)
+		finalScoreRendered += p.weigh("CorrectContactEmail", renderedData.ContactMethodAnalysis.EmailScoreImpact)
+		finalScoreRendered += p.weigh("CorrectPostalAddress", renderedData.ContactMethodAnalysis.AddressScoreImpact)
+		if renderedData.VisualImpersonation != nil {
+			finalScoreRendered += p.weigh("VisualImpersonation", renderedData.VisualImpersonation.ScoreImpact)
+		}
+		// A wallet address or gift card request that only shows up in the screenshot (e.g. an
+		// image-only scam) costs the rendered score what the body scan would have.
+		if hasPaymentData && paymentData.ScoreImpact > 0 && renderedData.PaymentScam != nil && renderedData.PaymentScam.Found() {
+			finalScoreRendered -= p.weigh("CryptoOrGiftCardRequest", paymentData.ScoreImpact)
+		}
 	}
 
 	// Finalize and calculate percentages
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// With -mock, every outgoing HTTP request (Gemini, Google Search, VirusTotal, urlscan, Cloudflare,
+// Safe Browsing, Google Places, company registries, GeoIP, remote images) is answered from the
+// fixtures in MOCK_DIR instead of the network, so the whole pipeline runs reproducibly and
+// without API keys. With -mock-record the requests go out as usual and each response is saved
+// there as a fixture for later runs.
+//
+// A fixture is a JSON file:
+//
+//	{"method": "GET", "host": "www.virustotal.com", "path": "/api/v3/urls/*",
+//	 "status": 200, "headers": {"Content-Type": "application/json"}, "body": {...}}
+//
+// host and path are path.Match patterns and match anything when empty; query and bodySha256,
+// when set, must match exactly (the "key" parameter is ignored). The most specific matching
+// fixture wins. body is sent as is, or as text when it is a JSON string; bodyFile names a file
+// next to the fixture instead. A request no fixture matches fails.
+
+// mockFixture is one recorded response.
+type mockFixture struct {
+	Method     string            `json:"method,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Query      string            `json:"query,omitempty"`
+	BodySHA256 string            `json:"bodySha256,omitempty"`
+	Status     int               `json:"status"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       json.RawMessage   `json:"body,omitempty"`
+	BodyFile   string            `json:"bodyFile,omitempty"`
+
+	file string // where it was loaded from
+}
+
+// specificity ranks fixtures so an exact recording beats a catch-all pattern.
+func (f mockFixture) specificity() int {
+	n := 0
+	if f.BodySHA256 != "" {
+		n += 8
+	}
+	if f.Query != "" {
+		n += 4
+	}
+	if f.Path != "" && !strings.ContainsAny(f.Path, "*?[") {
+		n += 2
+	}
+	if f.Host != "" && !strings.ContainsAny(f.Host, "*?[") {
+		n++
+	}
+	return n
+}
+
+func (f mockFixture) matches(r *http.Request, bodySum string) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, r.Method) {
+		return false
+	}
+	if f.Host != "" {
+		if ok, _ := path.Match(f.Host, r.URL.Hostname()); !ok {
+			return false
+		}
+	}
+	if f.Path != "" {
+		if ok, _ := path.Match(f.Path, mockPath(r.URL)); !ok {
+			return false
+		}
+	}
+	if f.Query != "" && f.Query != mockQuery(r.URL) {
+		return false
+	}
+	return f.BodySHA256 == "" || f.BodySHA256 == bodySum
+}
+
+// mockPath is the request's path without doubled slashes, which some SDKs send.
+func mockPath(u *url.URL) string {
+	return path.Clean("/" + u.Path)
+}
+
+// mockQuery is the request's query without API keys, in a stable order.
+func mockQuery(u *url.URL) string {
+	q := u.Query()
+	q.Del("key")
+	return q.Encode()
+}
+
+// loadMockFixtures reads every *.json fixture in dir, most specific first.
+func loadMockFixtures(dir string) ([]mockFixture, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []mockFixture
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var f mockFixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if f.Status == 0 {
+			f.Status = http.StatusOK
+		}
+		f.file = file
+		fixtures = append(fixtures, f)
+	}
+	sort.SliceStable(fixtures, func(i, j int) bool { return fixtures[i].specificity() > fixtures[j].specificity() })
+	return fixtures, nil
+}
+
+// mockTransport answers requests from fixtures.
+type mockTransport struct {
+	dir      string
+	fixtures []mockFixture
+}
+
+func (m *mockTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256Hex(body)
+	for _, f := range m.fixtures {
+		if !f.matches(r, sum) {
+			continue
+		}
+		content := []byte(f.Body)
+		var text string
+		if f.BodyFile != "" {
+			if content, err = os.ReadFile(filepath.Join(m.dir, f.BodyFile)); err != nil {
+				return nil, fmt.Errorf("mock fixture %s: %w", f.file, err)
+			}
+		} else if json.Unmarshal(content, &text) == nil {
+			content = []byte(text)
+		}
+		header := make(http.Header, len(f.Headers))
+		for k, v := range f.Headers {
+			header.Set(k, v)
+		}
+		slog.Debug("serving mock response", "method", r.Method, "url", r.URL.Redacted(), "fixture", filepath.Base(f.file))
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+			StatusCode:    f.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(content)),
+			ContentLength: int64(len(content)),
+			Request:       r,
+		}, nil
+	}
+	slog.Warn("no mock fixture for request", "method", r.Method, "host", r.URL.Hostname(), "path", mockPath(r.URL))
+	return nil, fmt.Errorf("mock: no fixture for %s %s%s", r.Method, r.URL.Hostname(), mockPath(r.URL))
+}
+
+// recordingTransport passes requests on and saves each response as a fixture in dir.
+type recordingTransport struct {
+	dir      string
+	delegate http.RoundTripper
+
+	mu sync.Mutex
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.delegate.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(content))
+
+	f := mockFixture{
+		Method: r.Method, Host: r.URL.Hostname(), Path: mockPath(r.URL), Query: mockQuery(r.URL),
+		Status: resp.StatusCode, Headers: map[string]string{},
+	}
+	if len(body) > 0 {
+		f.BodySHA256 = sha256Hex(body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		f.Headers["Content-Type"] = ct
+	}
+	name := "rec-" + strings.ReplaceAll(f.Host, ".", "_") + "-" + sha256Hex([]byte(f.Method + " " + r.URL.Host + f.Path + "?" + f.Query + "#" + f.BodySHA256))[:12]
+	if json.Valid(content) {
+		f.Body = content
+	} else {
+		f.BodyFile = name + ".body"
+	}
+	if err := t.save(name, f, content); err != nil {
+		slog.Warn("recording mock fixture failed", "url", r.URL.Redacted(), "err", err)
+	}
+	return resp, nil
+}
+
+func (t *recordingTransport) save(name string, f mockFixture, content []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return err
+	}
+	if f.BodyFile != "" {
+		if err := os.WriteFile(filepath.Join(t.dir, f.BodyFile), content, 0o644); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(t.dir, name+".json"), append(data, '\n'), 0o644)
+}
+
+// readRequestBody reads r's body and puts it back for the next reader.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// mockKey stands in for the API keys in mock mode, so the integrations run against the fixtures.
+const mockKey = "mock"
+
+// enableMocks routes all outgoing HTTP through the fixtures in dir, or records into dir. Every
+// client in the server uses http.DefaultTransport, so replacing it is enough.
+func enableMocks(dir string, record bool) error {
+	if record {
+		http.DefaultTransport = &recordingTransport{dir: dir, delegate: http.DefaultTransport}
+		slog.Info("recording outgoing HTTP responses as mock fixtures", "dir", dir)
+		return nil
+	}
+	fixtures, err := loadMockFixtures(dir)
+	if err != nil {
+		return err
+	}
+	if len(fixtures) == 0 {
+		return errors.New("no fixtures in " + dir)
+	}
+	http.DefaultTransport = &mockTransport{dir: dir, fixtures: fixtures}
+	for _, key := range []*string{&geminiKey, &googleSearchAPIKey, &googleSearchCX, &VTotalAPIKey, &URLScanAPIKey, &safeBrowsingAPIKey, &placesAPIKey, &companiesHouseAPIKey, &openCorporatesAPIToken, &cloudflareAccountID, &cloudflareAPIToken, &googleVisionAPIKey} {
+		if *key == "" {
+			*key = mockKey
+		}
+	}
+	slog.Info("serving outgoing HTTP requests from mock fixtures", "dir", dir, "fixtures", len(fixtures))
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jaytaylor/html2text"
+)
+
+// Some emails are padded with dozens of empty paragraphs or a block thousands of pixels tall, so
+// that whatever follows (filler text for spam filters, or the real payload of a reply chain) is
+// out of the reader's sight. cutHTML drops everything from the padding on before the email is
+// analysed; what it dropped is kept in EmailData.Padding, its links are still scanned, and
+// padding fails the ObfuscationPadding check whatever follows it: a tail without text or links
+// can still carry scripts, forms or tracking markup.
+
+// PaddingCut is what cutHTML cut off an email's HTML.
+type PaddingCut struct {
+	Reason       string   `json:"reason"`       // tallBlock, emptyDivs or emptyParagraphs
+	RemovedChars int      `json:"removedChars"` // HTML cut off, padding included
+	TextChars    int      `json:"textChars"`    // text in it
+	URLs         []string `json:"urls"`         // links in it
+	text         string
+}
+
+// describePadding measures the HTML cut off at the padding.
+func describePadding(removed, reason string) *PaddingCut {
+	p := &PaddingCut{Reason: reason, RemovedChars: len(removed), URLs: []string{}}
+	text, err := html2text.FromString(removed, html2text.Options{PrettyTables: false})
+	if err != nil {
+		return p
+	}
+	p.text = strings.TrimSpace(text)
+	p.TextChars = len([]rune(p.text))
+	if urls := getURL(p.text); urls != nil {
+		p.URLs = urls
+	}
+	return p
+}
+
+// ObfuscationPaddingResult is the obfuscationPadding event.
+type ObfuscationPaddingResult struct {
+	Padded      bool        `json:"padded"`
+	Padding     *PaddingCut `json:"padding,omitempty"`
+	Sample      string      `json:"sample,omitempty"` // the start of the text after the padding
+	Message     string      `json:"message"`
+	ScoreImpact int         `json:"scoreImpact"`
+}
+
+var paddingReasonNames = map[string]string{
+	paddingTallBlock:       "a block thousands of pixels tall",
+	paddingEmptyDivs:       "40 or more empty blocks",
+	paddingEmptyParagraphs: "40 or more empty paragraphs",
+}
+
+func performObfuscationPaddingAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "ObfuscationPadding" {
+			check = c
+			break
+		}
+	}
+	result := ObfuscationPaddingResult{Padding: Email.Padding}
+	switch p := Email.Padding; {
+	case p == nil:
+		result.Message = "The email isn't padded with blank space."
+		result.ScoreImpact = check.Impact
+	case p.TextChars == 0 && len(p.URLs) == 0:
+		result.Padded = true
+		result.Message = fmt.Sprintf("The email pushes %d characters of markup with no readable text or links out of view behind %s.",
+			p.RemovedChars, paddingReasonNames[p.Reason])
+	default:
+		result.Padded = true
+		sample := []rune(p.text)
+		if len(sample) > 200 {
+			sample = append(sample[:200], '…')
+		}
+		result.Sample = redactPII(string(sample), Email)
+		result.Message = fmt.Sprintf("The email pushes %d characters of text and %d link(s) out of view behind %s.",
+			p.TextChars, len(p.URLs), paddingReasonNames[p.Reason])
+	}
+	ch <- CheckResult{EventName: "obfuscationPadding", Payload: result}
+}
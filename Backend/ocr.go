@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OCRBlock is one block of text (a paragraph or column) found in an image, with the engine's
+// confidence in it from 0 to 100.
+type OCRBlock struct {
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+}
+
+// OCRResult is the text an OCR engine read from an image.
+type OCRResult struct {
+	Engine         string     `json:"engine"`
+	Text           string     `json:"-"`
+	Blocks         []OCRBlock `json:"blocks"`
+	MeanConfidence float64    `json:"meanConfidence"` // over blocks, weighted by their length
+	Error          string     `json:"error,omitempty"`
+}
+
+// OCREngine reads the text in an image file. lang is a Tesseract language list such as
+// "deu+eng"; engines that don't use Tesseract packs treat it as a hint.
+type OCREngine interface {
+	Name() string
+	Recognize(ctx context.Context, imagePath, lang string) (OCRResult, error)
+}
+
+// ocrEngines are the available OCR_ENGINE values. The libtesseract engine registers itself
+// when built with -tags gosseract.
+var ocrEngines = map[string]func() (OCREngine, error){
+	"tesseract-cli": func() (OCREngine, error) { return tesseractCLI{}, nil },
+	"vision":        newVisionOCR,
+}
+
+// registerOCREngine adds an engine that is only compiled in with a build tag.
+func registerOCREngine(name string, newEngine func() (OCREngine, error)) bool {
+	ocrEngines[name] = newEngine
+	return true
+}
+
+var (
+	ocrEngineOnce sync.Once
+	ocrEngine     OCREngine
+	ocrEngineErr  error
+)
+
+// currentOCREngine returns the engine chosen by OCR_ENGINE. "tesseract" (the default) uses the
+// linked libtesseract when the binary was built with it and the command-line tool otherwise.
+func currentOCREngine() (OCREngine, error) {
+	ocrEngineOnce.Do(func() {
+		name := ocrEngineName
+		if name == "tesseract" {
+			name = "tesseract-cli"
+			if _, ok := ocrEngines["libtesseract"]; ok {
+				name = "libtesseract"
+			}
+		}
+		newEngine, ok := ocrEngines[name]
+		if !ok {
+			ocrEngineErr = fmt.Errorf("unknown OCR_ENGINE %q", ocrEngineName)
+			return
+		}
+		ocrEngine, ocrEngineErr = newEngine()
+		if ocrEngineErr == nil {
+			slog.Info("OCR engine ready", "engine", ocrEngine.Name())
+		}
+	})
+	return ocrEngine, ocrEngineErr
+}
+
+// usesTesseractCLI reports whether OCR depends on the tesseract executable.
+func usesTesseractCLI() bool {
+	e, err := currentOCREngine()
+	return err == nil && e.Name() == "tesseract-cli"
+}
+
+// finishOCR fills in the full text and the mean confidence from the blocks.
+func finishOCR(result *OCRResult) {
+	texts := make([]string, 0, len(result.Blocks))
+	var weighted, total float64
+	for _, b := range result.Blocks {
+		texts = append(texts, b.Text)
+		n := float64(len(b.Text))
+		weighted += b.Confidence * n
+		total += n
+	}
+	result.Text = strings.Join(texts, "\n\n")
+	if total > 0 {
+		result.MeanConfidence = weighted / total
+	}
+}
+
+// tesseractCLI runs the tesseract executable with TSV output, which carries word confidences.
+type tesseractCLI struct{}
+
+func (tesseractCLI) Name() string { return "tesseract-cli" }
+
+func (tesseractCLI) Recognize(ctx context.Context, imagePath, lang string) (OCRResult, error) {
+	args := []string{imagePath, "stdout"}
+	if lang != "" {
+		args = append(args, "-l", lang)
+	}
+	args = append(args, "tsv")
+	cmd := exec.CommandContext(ctx, tesseractPath(), args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return OCRResult{}, fmt.Errorf("tesseract: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	result := OCRResult{Engine: "tesseract-cli", Blocks: parseTesseractTSV(string(out))}
+	finishOCR(&result)
+	return result, nil
+}
+
+// parseTesseractTSV groups the word rows of Tesseract's TSV output into blocks, keeping line
+// breaks, and averages the word confidences of each block.
+func parseTesseractTSV(tsv string) []OCRBlock {
+	type word struct {
+		par, line, num int
+		text           string
+		conf           float64
+	}
+	words := map[int][]word{}
+	for i, row := range strings.Split(tsv, "\n") {
+		cols := strings.Split(strings.TrimRight(row, "\r"), "\t")
+		if i == 0 || len(cols) < 12 || cols[0] != "5" {
+			continue // header, or not a word row
+		}
+		text := strings.TrimSpace(cols[11])
+		conf, err := strconv.ParseFloat(cols[10], 64)
+		if text == "" || err != nil || conf < 0 {
+			continue
+		}
+		block, _ := strconv.Atoi(cols[2])
+		par, _ := strconv.Atoi(cols[3])
+		line, _ := strconv.Atoi(cols[4])
+		num, _ := strconv.Atoi(cols[5])
+		words[block] = append(words[block], word{par, line, num, text, conf})
+	}
+
+	blockNums := make([]int, 0, len(words))
+	for n := range words {
+		blockNums = append(blockNums, n)
+	}
+	sort.Ints(blockNums)
+	blocks := make([]OCRBlock, 0, len(blockNums))
+	for _, n := range blockNums {
+		ws := words[n]
+		sort.SliceStable(ws, func(i, j int) bool {
+			if ws[i].par != ws[j].par {
+				return ws[i].par < ws[j].par
+			}
+			if ws[i].line != ws[j].line {
+				return ws[i].line < ws[j].line
+			}
+			return ws[i].num < ws[j].num
+		})
+		var sb strings.Builder
+		var sum float64
+		for i, w := range ws {
+			if i > 0 {
+				if w.par != ws[i-1].par || w.line != ws[i-1].line {
+					sb.WriteByte('\n')
+				} else {
+					sb.WriteByte(' ')
+				}
+			}
+			sb.WriteString(w.text)
+			sum += w.conf
+		}
+		blocks = append(blocks, OCRBlock{Text: sb.String(), Confidence: sum / float64(len(ws))})
+	}
+	return blocks
+}
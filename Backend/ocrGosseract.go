@@ -0,0 +1,50 @@
+//go:build gosseract
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/otiai10/gosseract/v2"
+)
+
+// libtesseract calls Tesseract in-process through gosseract instead of starting the tesseract
+// command for every image. It needs the libtesseract and leptonica development headers, so it
+// is only compiled with -tags gosseract.
+type libtesseract struct{}
+
+// Registered during package variable initialisation, which runs before the init that validates
+// OCR_ENGINE.
+var _ = registerOCREngine("libtesseract", func() (OCREngine, error) { return libtesseract{}, nil })
+
+func (libtesseract) Name() string { return "libtesseract" }
+
+func (libtesseract) Recognize(ctx context.Context, imagePath, lang string) (OCRResult, error) {
+	// A client isn't safe for concurrent use and is cheap next to the recognition itself.
+	client := gosseract.NewClient()
+	defer func() { _ = client.Close() }()
+	if lang != "" {
+		if err := client.SetLanguage(strings.Split(lang, "+")...); err != nil {
+			return OCRResult{}, err
+		}
+	}
+	if err := client.SetImage(imagePath); err != nil {
+		return OCRResult{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return OCRResult{}, err
+	}
+	boxes, err := client.GetBoundingBoxes(gosseract.RIL_BLOCK)
+	if err != nil {
+		return OCRResult{}, err
+	}
+	result := OCRResult{Engine: "libtesseract", Blocks: make([]OCRBlock, 0, len(boxes))}
+	for _, b := range boxes {
+		if text := strings.TrimSpace(b.Word); text != "" {
+			result.Blocks = append(result.Blocks, OCRBlock{Text: text, Confidence: b.Confidence})
+		}
+	}
+	finishOCR(&result)
+	return result, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"regexp"
+	"strings"
+
+	"github.com/richardlehane/mscfb"
+)
+
+// MacroReport describes the VBA project found in an Office document.
+type MacroReport struct {
+	Modules    []string `json:"modules"`
+	AutoExec   []string `json:"autoExec"`   // entry points Office runs without user interaction
+	Suspicious []string `json:"suspicious"` // keywords typical of droppers (Shell, URLDownloadToFile, ...)
+}
+
+var (
+	// autoExecMacro matches the macro names Word/Excel run automatically on open or close.
+	autoExecMacro = regexp.MustCompile(`(?i)\b(AutoExec|AutoOpen|Auto_Open|AutoClose|Auto_Close|AutoExit|AutoNew|DocumentOpen|Document_Open|Document_Close|Document_New|DocumentBeforeClose|Document_BeforeClose|NewDocument|Workbook_Open|Workbook_Activate|Workbook_Close|Workbook_BeforeClose)\b`)
+	// suspiciousMacro matches calls commonly used to download or launch a payload.
+	suspiciousMacro = regexp.MustCompile(`(?i)\b(Shell|WScript\.Shell|CreateObject|GetObject|URLDownloadToFile|PowerShell|cmd\.exe|MSXML2\.XMLHTTP|WinHttp\.WinHttpRequest|ADODB\.Stream|CallByName|ExecuteExcel4Macro|Environ|StrReverse|Kill)\b`)
+)
+
+// errVBAFormat is returned for VBA streams that aren't valid MS-OVBA compressed containers.
+var errVBAFormat = errors.New("invalid VBA compressed container")
+
+// isOOXML reports whether a zip is an Office Open XML document (.docx, .xlsm, ...) rather than
+// a plain archive.
+func isOOXML(content []byte) bool {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return false
+	}
+	for _, f := range zr.File {
+		if f.Name == "[Content_Types].xml" {
+			return true
+		}
+	}
+	return false
+}
+
+// findOfficeMacros returns the VBA macros in an OLE (.doc, .xls) or OOXML (.docm, .xlsm)
+// document, or nil when the file is neither or carries no VBA project.
+func findOfficeMacros(content []byte) *MacroReport {
+	switch {
+	case bytes.HasPrefix(content, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}):
+		return findOLEMacros(content)
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return nil
+		}
+		for _, f := range zr.File {
+			if !strings.HasSuffix(strings.ToLower(f.Name), "vbaproject.bin") {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return &MacroReport{Modules: []string{}, AutoExec: []string{}, Suspicious: []string{}}
+			}
+			bin, err := io.ReadAll(io.LimitReader(rc, 50<<20))
+			_ = rc.Close()
+			if err != nil {
+				return &MacroReport{Modules: []string{}, AutoExec: []string{}, Suspicious: []string{}}
+			}
+			if rep := findOLEMacros(bin); rep != nil {
+				return rep
+			}
+			// A vbaProject.bin we can't parse is still a macro-enabled document.
+			return &MacroReport{Modules: []string{}, AutoExec: []string{}, Suspicious: []string{}}
+		}
+	}
+	return nil
+}
+
+// findOLEMacros reads the VBA storage of a compound file, decompresses each module's source
+// and scans it for auto-exec entry points and suspicious calls.
+func findOLEMacros(content []byte) *MacroReport {
+	doc, err := mscfb.New(bytes.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	streams := make(map[string][]byte)
+	hasVBA := false
+	for entry, err := doc.Next(); err == nil; entry, err = doc.Next() {
+		inVBA := false
+		for _, p := range entry.Path {
+			if strings.EqualFold(p, "VBA") || strings.EqualFold(p, "_VBA_PROJECT_CUR") || strings.EqualFold(p, "Macros") {
+				inVBA = true
+			}
+		}
+		if !inVBA || entry.Size == 0 || entry.Size > 20<<20 {
+			continue
+		}
+		hasVBA = true
+		data := make([]byte, entry.Size)
+		if _, err := io.ReadFull(entry, data); err != nil {
+			continue
+		}
+		streams[strings.Join(append(append([]string{}, entry.Path...), entry.Name), "/")] = data
+	}
+	if !hasVBA {
+		return nil
+	}
+
+	rep := &MacroReport{Modules: []string{}, AutoExec: []string{}, Suspicious: []string{}}
+	seenAuto := make(map[string]struct{})
+	seenSusp := make(map[string]struct{})
+	for key, data := range streams {
+		if !strings.HasSuffix(key, "VBA/dir") {
+			continue
+		}
+		base := strings.TrimSuffix(key, "dir")
+		dir, err := decompressVBA(data)
+		if err != nil {
+			continue
+		}
+		for _, m := range vbaModules(dir) {
+			rep.Modules = append(rep.Modules, m.name)
+			stream, ok := streams[base+m.stream]
+			if !ok || int(m.offset) >= len(stream) {
+				continue
+			}
+			source, err := decompressVBA(stream[m.offset:])
+			if err != nil {
+				continue
+			}
+			for _, name := range autoExecMacro.FindAllString(string(source), -1) {
+				if _, dup := seenAuto[strings.ToLower(name)]; !dup {
+					seenAuto[strings.ToLower(name)] = struct{}{}
+					rep.AutoExec = append(rep.AutoExec, name)
+				}
+			}
+			for _, kw := range suspiciousMacro.FindAllString(string(source), -1) {
+				if _, dup := seenSusp[strings.ToLower(kw)]; !dup {
+					seenSusp[strings.ToLower(kw)] = struct{}{}
+					rep.Suspicious = append(rep.Suspicious, kw)
+				}
+			}
+		}
+	}
+	return rep
+}
+
+type vbaModule struct {
+	name   string
+	stream string
+	offset uint32
+}
+
+// vbaModules walks the records of a decompressed "dir" stream (MS-OVBA 2.3.4.2) and returns
+// each module's name, stream name and source offset.
+func vbaModules(dir []byte) []vbaModule {
+	var modules []vbaModule
+	var cur vbaModule
+	for pos := 0; pos+6 <= len(dir); {
+		id := binary.LittleEndian.Uint16(dir[pos:])
+		size := int(binary.LittleEndian.Uint32(dir[pos+2:]))
+		if id == 0x0009 {
+			size = 6 // PROJECTVERSION's size field is reserved; the record is always 6 bytes
+		}
+		start := pos + 6
+		if size < 0 || start+size > len(dir) {
+			break
+		}
+		data := dir[start : start+size]
+		switch id {
+		case 0x0019: // MODULENAME
+			cur = vbaModule{name: string(data)}
+		case 0x001A: // MODULESTREAMNAME
+			cur.stream = string(data)
+		case 0x0031: // MODULEOFFSET
+			if len(data) >= 4 {
+				cur.offset = binary.LittleEndian.Uint32(data)
+			}
+		case 0x002B: // module terminator
+			if cur.stream == "" {
+				cur.stream = cur.name
+			}
+			modules = append(modules, cur)
+			cur = vbaModule{}
+		}
+		pos = start + size
+	}
+	return modules
+}
+
+// decompressVBA decodes an MS-OVBA compressed container (2.4.1).
+func decompressVBA(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 0x01 {
+		return nil, errVBAFormat
+	}
+	var out []byte
+	for pos := 1; pos+2 <= len(data); {
+		header := binary.LittleEndian.Uint16(data[pos:])
+		chunkEnd := min(pos+int(header&0x0FFF)+3, len(data))
+		i := pos + 2
+		chunkStart := len(out)
+		if header&0x8000 == 0 {
+			// Raw chunk: always 4096 literal bytes.
+			end := min(i+4096, len(data))
+			out = append(out, data[i:end]...)
+			pos = end
+			continue
+		}
+		for i < chunkEnd {
+			flags := data[i]
+			i++
+			for bit := 0; bit < 8 && i < chunkEnd; bit++ {
+				if flags&(1<<bit) == 0 {
+					out = append(out, data[i])
+					i++
+					continue
+				}
+				if i+2 > chunkEnd {
+					return out, errVBAFormat
+				}
+				token := binary.LittleEndian.Uint16(data[i:])
+				i += 2
+				bitCount := min(max(bits.Len(uint(len(out)-chunkStart-1)), 4), 12)
+				lengthMask := uint16(0xFFFF) >> bitCount
+				offset := int(token>>(16-bitCount)) + 1
+				length := int(token&lengthMask) + 3
+				src := len(out) - offset
+				if src < chunkStart {
+					return out, errVBAFormat
+				}
+				for n := 0; n < length; n++ {
+					out = append(out, out[src+n])
+				}
+			}
+		}
+		pos = chunkEnd
+	}
+	return out, nil
+}
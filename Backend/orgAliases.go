@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/agnivade/levenshtein"
+)
+
+// Gemini names the organisation an email claims to come from as it appears in the email
+// ("Google", "HMRC", "Amazon.co.uk"), which rarely equals the Wikidata label ("Google LLC",
+// "HM Revenue and Customs"). Aliases map such names to the domains the organisation sends
+// from; an alias domain also covers its subdomains, so gov.uk covers hmrc.gov.uk.
+
+// builtinOrgAliases are aliases of frequently impersonated organisations. Free-mail domains
+// such as gmail.com aren't listed: anyone can send from them.
+var builtinOrgAliases = map[string][]string{
+	"google":                   {"google.com", "google.co.uk", "googlemail.com", "youtube.com"},
+	"alphabet":                 {"abc.xyz", "google.com"},
+	"youtube":                  {"youtube.com", "google.com"},
+	"microsoft":                {"microsoft.com", "microsoftonline.com", "office.com", "office365.com", "live.com"},
+	"office 365":               {"microsoft.com", "microsoftonline.com", "office.com", "office365.com"},
+	"outlook":                  {"microsoft.com", "outlook.com", "office.com"},
+	"apple":                    {"apple.com", "icloud.com"},
+	"icloud":                   {"apple.com", "icloud.com"},
+	"amazon":                   {"amazon.com", "amazon.co.uk", "amazon.de", "amazonses.com"},
+	"amazon web services":      {"amazon.com", "amazonaws.com", "aws.com"},
+	"aws":                      {"amazon.com", "amazonaws.com", "aws.com"},
+	"meta":                     {"meta.com", "facebook.com", "facebookmail.com"},
+	"facebook":                 {"facebook.com", "facebookmail.com", "meta.com"},
+	"instagram":                {"instagram.com", "facebookmail.com", "mail.instagram.com"},
+	"whatsapp":                 {"whatsapp.com", "facebookmail.com"},
+	"paypal":                   {"paypal.com", "paypal.co.uk"},
+	"netflix":                  {"netflix.com"},
+	"dhl":                      {"dhl.com", "dhl.co.uk", "dhl.de"},
+	"royal mail":               {"royalmail.com", "royalmail.co.uk"},
+	"hmrc":                     {"gov.uk"},
+	"hm revenue and customs":   {"gov.uk"},
+	"dvla":                     {"gov.uk"},
+	"nhs":                      {"nhs.uk", "nhs.net"},
+	"irs":                      {"irs.gov"},
+	"internal revenue service": {"irs.gov"},
+}
+
+// orgNameNoise are words dropped when comparing organisation names.
+var orgNameNoise = map[string]bool{
+	"the": true, "inc": true, "incorporated": true, "ltd": true, "limited": true, "llc": true, "llp": true,
+	"plc": true, "corp": true, "corporation": true, "co": true, "company": true, "group": true,
+	"holdings": true, "gmbh": true, "ag": true, "sa": true, "nv": true, "bv": true, "pty": true, "uk": true,
+}
+
+// normaliseOrgName lower-cases name, spells out "&", drops punctuation, a trailing web suffix
+// (".com", ".co.uk") and the words in orgNameNoise.
+func normaliseOrgName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.ReplaceAll(name, "&", " and ")
+	if i := strings.IndexByte(name, '.'); i > 0 && !strings.Contains(name, " ") {
+		name = name[:i] // amazon.co.uk
+	}
+	words := strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	kept := words[:0]
+	for _, w := range words {
+		if !orgNameNoise[w] {
+			kept = append(kept, w)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// orgNamesMatch reports whether two normalised names are the same, allowing one typo in names
+// of at least six characters and two in names of at least twelve.
+func orgNamesMatch(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if a == b {
+		return true
+	}
+	n := min(len([]rune(a)), len([]rune(b)))
+	allowed := 0
+	switch {
+	case n >= 12:
+		allowed = 2
+	case n >= 6:
+		allowed = 1
+	}
+	return allowed > 0 && levenshtein.ComputeDistance(a, b) <= allowed
+}
+
+// aliasDomains returns the domains of every built-in or imported alias matching name.
+func aliasDomains(ctx context.Context, store CompanyStore, name string) ([]string, error) {
+	want := normaliseOrgName(name)
+	seen := map[string]bool{}
+	var domains []string
+	add := func(aliases map[string][]string) {
+		for alias, ds := range aliases {
+			if !orgNamesMatch(want, normaliseOrgName(alias)) {
+				continue
+			}
+			for _, d := range ds {
+				if !seen[d] {
+					seen[d] = true
+					domains = append(domains, d)
+				}
+			}
+		}
+	}
+	add(builtinOrgAliases)
+	imported, err := store.OrgAliases(ctx)
+	add(imported)
+	return domains, err
+}
+
+// domainCovers reports whether sender is domain or one of its subdomains.
+func domainCovers(domain, sender string) bool {
+	domain, sender = strings.ToLower(domain), strings.ToLower(sender)
+	return sender == domain || strings.HasSuffix(sender, "."+domain)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Organisations can add their own domains, brands and aliases to the company database, so mail
+// from in-house domains is recognised instead of landing in DomainNoSimilarity. Imported rows
+// carry the import's source name in the source column (Wikidata rows have "wikidata") and
+// survive database refreshes.
+
+const wikidataSource = "wikidata"
+
+// ImportedOrg is one organisation in an import.
+type ImportedOrg struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"` // trusted sender domains, e.g. acme.com
+	Brands  []string `json:"brands"`  // names to protect from lookalikes, e.g. acme
+	Aliases []string `json:"aliases"` // other names the organisation is known by
+}
+
+type orgImport struct {
+	Source        string        `json:"source"`
+	Organisations []ImportedOrg `json:"organisations"`
+}
+
+// parseOrgImport reads an import body: JSON as orgImport, or CSV with a header row naming the
+// columns name, domain, brand and alias, several values in one cell separated by ";". Rows
+// with the same name are merged.
+func parseOrgImport(r *http.Request, body io.Reader) (orgImport, error) {
+	var imp orgImport
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		cr := csv.NewReader(body)
+		cr.FieldsPerRecord = -1
+		cr.TrimLeadingSpace = true
+		records, err := cr.ReadAll()
+		if err != nil {
+			return imp, fmt.Errorf("invalid CSV: %w", err)
+		}
+		if len(records) == 0 {
+			return imp, errors.New("empty CSV")
+		}
+		cols := map[string]int{}
+		for i, h := range records[0] {
+			cols[strings.ToLower(strings.TrimSpace(h))] = i
+		}
+		if _, ok := cols["name"]; !ok {
+			return imp, errors.New(`CSV needs a "name" column`)
+		}
+		cell := func(rec []string, col string) []string {
+			i, ok := cols[col]
+			if !ok || i >= len(rec) {
+				return nil
+			}
+			return splitCell(rec[i])
+		}
+		byName := map[string]int{}
+		for _, rec := range records[1:] {
+			if cols["name"] >= len(rec) {
+				continue // a short row without the name column
+			}
+			name := strings.TrimSpace(rec[cols["name"]])
+			if name == "" {
+				continue
+			}
+			i, seen := byName[name]
+			if !seen {
+				i = len(imp.Organisations)
+				byName[name] = i
+				imp.Organisations = append(imp.Organisations, ImportedOrg{Name: name})
+			}
+			o := &imp.Organisations[i]
+			o.Domains = append(o.Domains, cell(rec, "domain")...)
+			o.Brands = append(o.Brands, cell(rec, "brand")...)
+			o.Aliases = append(o.Aliases, cell(rec, "alias")...)
+		}
+	} else if err := json.NewDecoder(body).Decode(&imp); err != nil {
+		return imp, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if s := strings.TrimSpace(r.URL.Query().Get("source")); s != "" {
+		imp.Source = s
+	}
+	imp.Source = strings.ToLower(strings.TrimSpace(imp.Source))
+	if imp.Source == "" {
+		imp.Source = "import"
+	}
+	if imp.Source == wikidataSource {
+		return imp, fmt.Errorf("source %q is reserved", wikidataSource)
+	}
+	return imp, nil
+}
+
+func splitCell(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// ImportOrgs replaces the rows of imp.Source with the organisations in imp, in one
+// transaction. Each name and alias gets a websites row per domain, so company verification
+// finds the domains under any of the names.
+func (s *sqlCompanyStore) ImportOrgs(ctx context.Context, imp orgImport) (websites, brands int, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if _, err = tx.ExecContext(ctx, s.q(`DELETE FROM websites WHERE source = ?`), imp.Source); err != nil {
+		return 0, 0, err
+	}
+	for _, table := range []string{"protected_brands", "org_aliases"} {
+		if _, err = tx.ExecContext(ctx, s.q(`DELETE FROM `+table+` WHERE source = ?`), imp.Source); err != nil {
+			return 0, 0, err
+		}
+	}
+	for _, o := range imp.Organisations {
+		if strings.TrimSpace(o.Name) == "" {
+			return 0, 0, errors.New("every organisation needs a name")
+		}
+		item := "import:" + imp.Source + ":" + o.Name
+		names := append([]string{o.Name}, o.Aliases...)
+		slds := map[string]bool{}
+		for _, raw := range o.Domains {
+			website := strings.TrimSpace(raw)
+			if !strings.Contains(website, "://") {
+				website = "https://" + website
+			}
+			domain, subdomain, err := normaliseImportDomain(website)
+			if err != nil {
+				return 0, 0, fmt.Errorf("%s: %w", o.Name, err)
+			}
+			if sld := strings.Split(domain, ".")[0]; len(sld) > 3 {
+				slds[sld] = true
+			}
+			for _, name := range names {
+				if _, err := tx.ExecContext(ctx, s.upsertWebsite(),
+					item+":"+name, name, website, "Imported", domain, subdomain, imp.Source); err != nil {
+					return 0, 0, err
+				}
+				// The alias table lets verifyCompany match the names loosely.
+				if _, err := tx.ExecContext(ctx, s.insertIgnore("org_aliases", "alias, domain, source"), name, domain, imp.Source); err != nil {
+					return 0, 0, err
+				}
+				websites++
+			}
+		}
+		for _, b := range o.Brands {
+			if sld, err := idna.ToASCII(strings.ToLower(strings.TrimSpace(b))); err == nil && sld != "" {
+				slds[sld] = true
+			}
+		}
+		for sld := range slds {
+			// Wikidata may protect the same SLD already; the imported row then isn't needed.
+			res, err := tx.ExecContext(ctx, s.insertIgnore("protected_brands", "sld, source"), sld, imp.Source)
+			if err != nil {
+				return 0, 0, err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				brands++
+			}
+		}
+	}
+	return websites, brands, tx.Commit()
+}
+
+// normaliseImportDomain turns a website URL into the registrable domain and, for a deeper
+// host, the host itself, as the Wikidata rows store them.
+func normaliseImportDomain(raw string) (string, sql.NullString, error) {
+	domain, subdomain := splitWebsiteDomain(raw)
+	if domain == "" {
+		return "", subdomain, fmt.Errorf("invalid domain %q", raw)
+	}
+	ascii, err := idna.ToASCII(domain)
+	if err != nil {
+		return "", subdomain, fmt.Errorf("invalid domain %q: %w", raw, err)
+	}
+	return ascii, subdomain, nil
+}
+
+// ImportedSources summarises the imports in the company database.
+func (s *sqlCompanyStore) ImportedSources(ctx context.Context) ([]map[string]interface{}, error) {
+	rows, err := s.db.QueryContext(ctx, s.q(`SELECT source, COUNT(DISTINCT item), COUNT(DISTINCT domain)
+		FROM websites WHERE source <> ? GROUP BY source ORDER BY source`), wikidataSource)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	list := []map[string]interface{}{}
+	for rows.Next() {
+		var source string
+		var names, domains int
+		if err := rows.Scan(&source, &names, &domains); err != nil {
+			return nil, err
+		}
+		list = append(list, map[string]interface{}{"source": source, "names": names, "domains": domains})
+	}
+	return list, rows.Err()
+}
+
+// orgImportHandler manages imported organisations: GET lists the sources, POST imports (and
+// replaces) one source, DELETE ?source= removes it.
+func orgImportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet && currentDBRefreshStatus().Running {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "the company database is being refreshed; try again when it finishes"})
+		return
+	}
+	store := companyStore()
+	if store == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "company database unavailable"})
+		return
+	}
+	// The schema is brought up to date at startup; only a change makes sure of it again, as the
+	// database may have been replaced since. A GET never alters the database.
+	if r.Method != http.MethodGet {
+		if err := store.EnsureSchema(ctx); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := store.ImportedSources(ctx)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"imports": list})
+	case http.MethodPost:
+		imp, err := parseOrgImport(r, http.MaxBytesReader(w, r.Body, 20<<20))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		websites, brands, err := store.ImportOrgs(ctx, imp)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		refreshBrandIndex(ctx)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"source": imp.Source, "organisations": len(imp.Organisations), "websites": websites, "brands": brands,
+		})
+	case http.MethodDelete:
+		source := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("source")))
+		if source == "" || source == wikidataSource {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "source must name an import"})
+			return
+		}
+		if _, _, err := store.ImportOrgs(ctx, orgImport{Source: source}); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		refreshBrandIndex(ctx)
+		writeJSON(w, http.StatusOK, map[string]string{"deleted": source})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
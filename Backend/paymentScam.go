@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// CryptoAddress is a cryptocurrency wallet address found in the email.
+type CryptoAddress struct {
+	Kind    string `json:"kind"` // "bitcoin" or "ethereum"
+	Address string `json:"address"`
+	Valid   bool   `json:"valid"` // the checksum verifies, so it's a real address and not a lookalike string
+}
+
+// PaymentScamResult reports requests for payment by cryptocurrency or gift card, which almost
+// never appear in legitimate corporate mail.
+type PaymentScamResult struct {
+	Addresses       []CryptoAddress `json:"addresses"`
+	GiftCardPhrases []string        `json:"giftCardPhrases"`
+	GiftCardRequest bool            `json:"giftCardRequest"`
+	Message         string          `json:"message"`
+	ScoreImpact     int             `json:"scoreImpact"`
+}
+
+// Found reports whether the result holds a checksum-valid address or a gift-card request.
+func (r PaymentScamResult) Found() bool {
+	if r.GiftCardRequest {
+		return true
+	}
+	for _, a := range r.Addresses {
+		if a.Valid {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	btcLegacyAddress = regexp.MustCompile(`\b[13][1-9A-HJ-NP-Za-km-z]{25,34}\b`)
+	btcBech32Address = regexp.MustCompile(`(?i)\bbc1[ac-hj-np-z02-9]{8,87}\b`)
+	ethAddress       = regexp.MustCompile(`\b0x[0-9a-fA-F]{40}\b`)
+
+	// Strong phrases only appear when someone wants gift card codes handed over; weak ones
+	// (brands, "buy gift cards") also turn up in retail promotions, so two different ones are
+	// needed, in separate parts of the text.
+	giftCardStrong = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)scratch(ed)?\s+(off\s+)?the\s+(back|card|silver|strip)`),
+		regexp.MustCompile(`(?i)(send|email|text|forward)\s+(me\s+|us\s+)?(the\s+)?(card\s+)?(codes?|pins?|pictures?|photos?|images?|numbers?)\b[^.\n]{0,40}\b(cards?|gift)`),
+		regexp.MustCompile(`(?i)gift\s*cards?\s+(codes?|pins?|numbers?|claim codes?)`),
+		regexp.MustCompile(`(?i)(pay|payment)\s+(it\s+)?(with|in|by|using)\s+(\w+\s+){0,2}gift\s*cards?`),
+	}
+	giftCardWeak = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)(buy|purchase|get|pick\s+up)\s+(some\s+|a\s+few\s+|\d+\s+)?(\w+\s+){0,3}gift\s*cards?`),
+		regexp.MustCompile(`(?i)(itunes|apple|google\s+play|steam|amazon|ebay|vanilla|visa|razer\s+gold)\s+(gift\s+)?cards?`),
+		regexp.MustCompile(`(?i)\$\s?\d{2,4}\s+(each|per\s+card|in\s+gift\s*cards?)`),
+	}
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// validBase58Check verifies a legacy (P2PKH/P2SH) Bitcoin address's double-SHA256 checksum.
+func validBase58Check(addr string) bool {
+	n := new(big.Int)
+	for _, r := range addr {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return false
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	decoded := n.Bytes()
+	for _, r := range addr {
+		if r != '1' {
+			break
+		}
+		decoded = append([]byte{0}, decoded...)
+	}
+	if len(decoded) != 25 || (decoded[0] != 0x00 && decoded[0] != 0x05) {
+		return false
+	}
+	first := sha256.Sum256(decoded[:21])
+	second := sha256.Sum256(first[:])
+	return bytes.Equal(second[:4], decoded[21:])
+}
+
+// validBech32 verifies a segwit address's bech32 (v0) or bech32m (v1+) checksum (BIP 173/350).
+func validBech32(addr string) bool {
+	if strings.ToLower(addr) != addr && strings.ToUpper(addr) != addr {
+		return false // mixed case is invalid
+	}
+	addr = strings.ToLower(addr)
+	sep := strings.LastIndexByte(addr, '1')
+	if sep < 1 || sep+7 > len(addr) {
+		return false
+	}
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	hrp, data := addr[:sep], addr[sep+1:]
+	values := make([]int, 0, len(hrp)*2+1+len(data))
+	for _, c := range hrp {
+		values = append(values, int(c)>>5)
+	}
+	values = append(values, 0)
+	for _, c := range hrp {
+		values = append(values, int(c)&31)
+	}
+	for _, c := range data {
+		i := strings.IndexRune(charset, c)
+		if i < 0 {
+			return false
+		}
+		values = append(values, i)
+	}
+	gen := []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := 1
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ v
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	witnessVersion := strings.IndexRune(charset, rune(data[0]))
+	if witnessVersion == 0 {
+		return chk == 1
+	}
+	return chk == 0x2bc830a3
+}
+
+// validEthereum accepts all-lower/all-upper addresses (no checksum) and verifies the EIP-55
+// mixed-case checksum otherwise.
+func validEthereum(addr string) bool {
+	hexPart := addr[2:]
+	if strings.ToLower(hexPart) == hexPart || strings.ToUpper(hexPart) == hexPart {
+		return true
+	}
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte(strings.ToLower(hexPart)))
+	hash := hex.EncodeToString(h.Sum(nil))
+	for i, c := range hexPart {
+		if c >= '0' && c <= '9' {
+			continue
+		}
+		upper := hash[i] >= '8'
+		if upper != (c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// findCryptoAddresses returns the Bitcoin and Ethereum addresses in text with their checksums checked.
+func findCryptoAddresses(text string) []CryptoAddress {
+	seen := map[string]bool{}
+	addrs := []CryptoAddress{}
+	add := func(kind, a string, valid bool) {
+		if !seen[a] {
+			seen[a] = true
+			addrs = append(addrs, CryptoAddress{Kind: kind, Address: a, Valid: valid})
+		}
+	}
+	for _, a := range btcLegacyAddress.FindAllString(text, -1) {
+		add("bitcoin", a, validBase58Check(a))
+	}
+	for _, a := range btcBech32Address.FindAllString(text, -1) {
+		add("bitcoin", a, validBech32(a))
+	}
+	for _, a := range ethAddress.FindAllString(text, -1) {
+		add("ethereum", a, validEthereum(a))
+	}
+	return addrs
+}
+
+// findGiftCardRequest returns the gift card purchase phrases in text and whether together they
+// amount to a request for gift cards. The weak patterns overlap ("buy Amazon gift cards" is both a
+// purchase and a brand), so a weak phrase only counts when it doesn't overlap one counted before,
+// and only the first phrase of each pattern counts.
+func findGiftCardRequest(text string) ([]string, bool) {
+	phrases := []string{}
+	strong := 0
+	for _, re := range giftCardStrong {
+		if m := re.FindString(text); m != "" {
+			phrases = append(phrases, m)
+			strong++
+		}
+	}
+	type span struct{ pattern, start, end int }
+	var spans []span
+	for i, re := range giftCardWeak {
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			spans = append(spans, span{i, loc[0], loc[1]})
+		}
+	}
+	sort.Slice(spans, func(a, b int) bool {
+		if spans[a].start != spans[b].start {
+			return spans[a].start < spans[b].start
+		}
+		return spans[a].end > spans[b].end
+	})
+	counted := map[int]bool{}
+	end := 0
+	for _, s := range spans {
+		if s.start < end || counted[s.pattern] {
+			continue
+		}
+		counted[s.pattern] = true
+		end = s.end
+		phrases = append(phrases, text[s.start:s.end])
+	}
+	return phrases, strong > 0 || len(counted) >= 2
+}
+
+// scanPaymentScam looks for wallet addresses and gift card requests in text.
+func scanPaymentScam(text string) PaymentScamResult {
+	result := PaymentScamResult{Addresses: findCryptoAddresses(text)}
+	result.GiftCardPhrases, result.GiftCardRequest = findGiftCardRequest(text)
+	return result
+}
+
+func performPaymentScamAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "CryptoOrGiftCardRequest" {
+			check = c
+			break
+		}
+	}
+
+	result := scanPaymentScam(Email.Subject + "\n" + Email.textWithImages())
+	valid := 0
+	for _, a := range result.Addresses {
+		if a.Valid {
+			valid++
+		}
+	}
+	switch {
+	case valid > 0 && result.GiftCardRequest:
+		result.Message = fmt.Sprintf("The email contains %d cryptocurrency wallet address(es) and asks for gift cards.", valid)
+	case valid > 0:
+		result.Message = fmt.Sprintf("The email contains %d cryptocurrency wallet address(es).", valid)
+	case result.GiftCardRequest:
+		result.Message = "The email asks for gift cards to be bought or their codes sent."
+	default:
+		result.Message = "No cryptocurrency addresses or gift card requests found."
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "paymentScamAnalysis", Payload: result}
+}
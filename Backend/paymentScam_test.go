@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestFindGiftCardRequest(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"Buy Amazon gift cards for the holidays!", false},
+		{"Amazon gift cards, Steam gift cards and Apple gift cards, all in one place.", false},
+		{"I need you to buy 5 gift cards for a client today. Get Apple cards, $100 each.", true},
+		{"Scratch off the back and send me the codes of the cards.", true},
+	}
+	for _, tt := range tests {
+		if _, got := findGiftCardRequest(tt.text); got != tt.want {
+			t.Errorf("findGiftCardRequest(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// PDFReport lists the active content and links found in a PDF attachment.
+type PDFReport struct {
+	ActiveContent []string `json:"activeContent"` // e.g. JavaScript, Launch, EmbeddedFile
+	OpenAction    bool     `json:"openAction"`    // something runs when the document is opened
+	URLs          []string `json:"urls"`
+}
+
+// Suspicious reports whether the PDF carries content that can execute or drop files.
+func (p *PDFReport) Suspicious() bool {
+	return len(p.ActiveContent) > 0
+}
+
+const (
+	maxPDFStreamBytes = 5 << 20
+	maxPDFTotalBytes  = 20 << 20
+)
+
+var (
+	pdfName        = regexp.MustCompile(`/(?:[^\s/\[\]<>(){}%#]|#[0-9A-Fa-f]{2})+`)
+	pdfNameEscape  = regexp.MustCompile(`#[0-9A-Fa-f]{2}`)
+	pdfActiveKey   = regexp.MustCompile(`/(JS|JavaScript|Launch|EmbeddedFile|RichMedia|XFA)(?:[\s/<>\[\]()]|$)`)
+	pdfOpenKey     = regexp.MustCompile(`/(OpenAction|AA)(?:[\s/<>\[\]()]|$)`)
+	pdfURIString   = regexp.MustCompile(`/URI\s*\(((?:\\.|[^\\)])*)\)`)
+	pdfURIHex      = regexp.MustCompile(`/URI\s*<([0-9A-Fa-f\s]+)>`)
+	pdfStreamStart = regexp.MustCompile(`stream\r?\n`)
+)
+
+// normalisePDFNames decodes #xx escapes in PDF names, so /J#61vaScript reads as /JavaScript.
+func normalisePDFNames(data []byte) []byte {
+	return pdfName.ReplaceAllFunc(data, func(name []byte) []byte {
+		if !bytes.Contains(name, []byte("#")) {
+			return name
+		}
+		return pdfNameEscape.ReplaceAllFunc(name, func(esc []byte) []byte {
+			b, err := hex.DecodeString(string(esc[1:]))
+			if err != nil {
+				return esc
+			}
+			return b
+		})
+	})
+}
+
+// unescapePDFString resolves the backslash escapes of a PDF literal string.
+func unescapePDFString(s string) string {
+	r := strings.NewReplacer(`\(`, "(", `\)`, ")", `\\`, `\`, `\n`, "", `\r`, "", "\\\n", "")
+	return r.Replace(s)
+}
+
+// inflatePDFStreams returns the Flate-decoded contents of the document's streams, which is where
+// object streams hide dictionaries (and any /JS keys) from a plain byte search.
+func inflatePDFStreams(content []byte) [][]byte {
+	var out [][]byte
+	total := 0
+	for _, loc := range pdfStreamStart.FindAllIndex(content, -1) {
+		start := loc[1]
+		end := bytes.Index(content[start:], []byte("endstream"))
+		if end < 0 {
+			continue
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(content[start : start+end]))
+		if err != nil {
+			continue
+		}
+		data, _ := io.ReadAll(io.LimitReader(zr, maxPDFStreamBytes))
+		_ = zr.Close()
+		if len(data) == 0 {
+			continue
+		}
+		total += len(data)
+		if total > maxPDFTotalBytes {
+			break
+		}
+		out = append(out, data)
+	}
+	return out
+}
+
+// analysePDF scans a PDF for JavaScript, launch actions, embedded files and link annotations.
+// It returns nil when content isn't a PDF.
+func analysePDF(content []byte) *PDFReport {
+	head := content
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if !bytes.Contains(head, []byte("%PDF-")) {
+		return nil
+	}
+
+	rep := &PDFReport{ActiveContent: []string{}, URLs: []string{}}
+	seenActive := make(map[string]struct{})
+	seenURL := make(map[string]struct{})
+	addURL := func(u string) {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			return
+		}
+		if _, dup := seenURL[u]; !dup {
+			seenURL[u] = struct{}{}
+			rep.URLs = append(rep.URLs, u)
+		}
+	}
+
+	for _, chunk := range append([][]byte{content}, inflatePDFStreams(content)...) {
+		chunk = normalisePDFNames(chunk)
+		for _, m := range pdfActiveKey.FindAllSubmatch(chunk, -1) {
+			name := string(m[1])
+			if name == "JS" {
+				name = "JavaScript"
+			}
+			if _, dup := seenActive[name]; !dup {
+				seenActive[name] = struct{}{}
+				rep.ActiveContent = append(rep.ActiveContent, name)
+			}
+		}
+		if pdfOpenKey.Match(chunk) {
+			rep.OpenAction = true
+		}
+		for _, m := range pdfURIString.FindAllSubmatch(chunk, -1) {
+			addURL(unescapePDFString(string(m[1])))
+		}
+		for _, m := range pdfURIHex.FindAllSubmatch(chunk, -1) {
+			if b, err := hex.DecodeString(strings.Join(strings.Fields(string(m[1])), "")); err == nil {
+				addURL(string(b))
+			}
+		}
+	}
+	return rep
+}
+
+// pdfAttachmentURLs collects the link targets of every PDF attached to the email so they can be
+// scanned alongside the links in the body.
+func pdfAttachmentURLs(parts [][]byte) []string {
+	var urls []string
+	for _, content := range parts {
+		if rep := analysePDF(content); rep != nil {
+			urls = append(urls, rep.URLs...)
+		}
+	}
+	return urls
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// Organisation-specific checks (e.g. "is this internal sender really internal?") can be added in a
+// file of their own without touching the pipeline. A check implements CheckPlugin and registers
+// itself at package initialisation:
+//
+//	var _ = RegisterCheck(internalSenderCheck{})
+//
+// It then runs alongside the built-in checks, streams its result as an event named after it, can
+// be switched off per request with ?check<Name>=false or per profile, is listed and reweighted by
+// /admin/checks and the scoring section, and counts towards the score and the maximum score.
+
+// CheckPlugin is a custom check. (The built-in weight table already uses the name Check.)
+type CheckPlugin interface {
+	// Name is the event the result is streamed as and the check's name in the weight table,
+	// e.g. "internalSender".
+	Name() string
+	// Run inspects the email. Its ScoreImpact is out of MaxImpact; the pipeline rescales it when
+	// an operator changes the check's weight.
+	Run(ctx context.Context, a *AnalysisContext) PluginResult
+	// MaxImpact is the check's default weight: the points it awards an email that passes.
+	MaxImpact() int
+}
+
+// A CheckPlugin may also describe itself for /admin/checks and the report.
+type checkDescriber interface {
+	Description() string
+}
+
+// AnalysisContext is what a custom check gets to look at.
+type AnalysisContext struct {
+	Email       EmailData        // parsed headers, text, HTML, links and attachment hashes; Profile is the tenant's
+	Envelope    *enmime.Envelope // the full MIME tree
+	FileName    string           // the .eml in the sandbox
+	SandboxDir  string           // scratch space, removed after the analysis
+	CountryCode string
+	DB          CompanyStore // the company database; may be nil
+}
+
+// PluginResult is the payload of a custom check's event.
+type PluginResult struct {
+	Message     string      `json:"message"`
+	ScoreImpact int         `json:"scoreImpact"`
+	Details     interface{} `json:"details,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+var (
+	checkPlugins      []CheckPlugin
+	validPluginName   = regexp.MustCompile(`^[a-z][A-Za-z0-9]{0,39}$`)
+	reservedEventName = map[string]bool{
+		"maxScore": true, "forwarded": true, "automatedMessage": true, "iocs": true, "domainAnalysis": true, "urlScanStarted": true,
+		"urlScanResult": true, "urlAnalysis": true, "executableAnalysis": true, "trackingAnalysis": true, "remoteContentAnalysis": true, "hiddenContentAnalysis": true, "obfuscationPadding": true,
+		"htmlAttachmentAnalysis": true, "embeddedFormAnalysis": true, "activeContentAnalysis": true, "unicodeAnalysis": true, "mailingListAnalysis": true, "sendTimeAnalysis": true, "imageTextAnalysis": true, "imageFileAnalysis": true, "spamHeaderAnalysis": true, "spamEngineAnalysis": true, "calendarAnalysis": true, "senderIPAnalysis": true, "executiveImpersonation": true,
+		"paymentScamAnalysis": true, "bankDetailAnalysis": true, "yaraAnalysis": true, "scriptAnalysis": true, "textAnalysis": true, "renderedAnalysis": true,
+		"attachedEmail": true, "forwardWrapper": true, "usage": true, "finalScores": true, "campaignMatch": true, "intentClassification": true, "visualImpersonation": true,
+		"error": true, "cancelled": true,
+	}
+)
+
+// RegisterCheck adds a custom check. It is meant to be called while the package initialises, and
+// panics on an invalid or duplicate name as that is a programming error.
+func RegisterCheck(c CheckPlugin) bool {
+	name := c.Name()
+	if !validPluginName.MatchString(name) || reservedEventName[name] || strings.HasSuffix(name, "Started") || strings.HasSuffix(name, "Completed") {
+		panic(fmt.Sprintf("RegisterCheck: invalid check name %q", name))
+	}
+	for _, existing := range AllChecks {
+		if strings.EqualFold(existing.Name, name) {
+			panic(fmt.Sprintf("RegisterCheck: a check named %q already exists", name))
+		}
+	}
+	description := "Custom check " + name
+	if d, ok := c.(checkDescriber); ok && d.Description() != "" {
+		description = d.Description()
+	}
+	checkPlugins = append(checkPlugins, c)
+	AllChecks = append(AllChecks, Check{Name: name, Description: description, Impact: c.MaxImpact()})
+	checkToggles = append(checkToggles, pluginToggle(name))
+	return true
+}
+
+// pluginToggle is the request switch of a custom check: "internalSender" -> "checkInternalSender".
+func pluginToggle(name string) string {
+	return "check" + strings.ToUpper(name[:1]) + name[1:]
+}
+
+// runPlugin runs one custom check and rescales its award to the check's configured weight. A
+// panic in the check is reported as its error rather than taking the server down.
+func runPlugin(ctx context.Context, c CheckPlugin, a *AnalysisContext) (result PluginResult) {
+	name := c.Name()
+	defer func() {
+		if r := recover(); r != nil {
+			slog.ErrorContext(ctx, "custom check panicked", "check", name, "panic", r)
+			result = PluginResult{Message: "The check failed.", Error: fmt.Sprint(r)}
+		}
+	}()
+	result = c.Run(ctx, a)
+	if maxImpact := c.MaxImpact(); maxImpact != 0 {
+		result.ScoreImpact = int(math.Round(float64(result.ScoreImpact) * float64(defaultImpact(name)) / float64(maxImpact)))
+	}
+	return result
+}
+
+// performPluginAnalysis runs a custom check for runChecks.
+func performPluginAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, ctx context.Context, c CheckPlugin, a *AnalysisContext) {
+	defer wg.Done()
+	ch <- CheckResult{EventName: c.Name(), Payload: runPlugin(ctx, c, a)}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile is one tenant's configuration, from the "profiles" section of the config file. A
+// request uses the profile its X-API-Key is bound to, or the one it names in the X-Profile
+// header or ?profile= parameter; without either it gets the profile called "default", if any,
+// and otherwise the server-wide settings.
+type Profile struct {
+	Name           string          `yaml:"-" json:"name"`
+	APIKeys        []string        `yaml:"api_keys" json:"-"`                // X-API-Key values bound to this profile
+	Country        string          `yaml:"country" json:"country,omitempty"` // replaces the GeoIP lookup
+	Scoring        map[string]int  `yaml:"scoring" json:"scoring,omitempty"` // check name to impact
+	Checks         map[string]bool `yaml:"checks" json:"checks,omitempty"`   // default check toggles, e.g. checkUrls: false
+	URLAllow       []string        `yaml:"url_allow" json:"urlAllow,omitempty"`
+	URLBlock       []string        `yaml:"url_block" json:"urlBlock,omitempty"`
+	AIModel        string          `yaml:"ai_model" json:"aiModel,omitempty"`
+	AIFallback     string          `yaml:"ai_fallback_model" json:"aiFallbackModel,omitempty"`
+	PromptTemplate string          `yaml:"prompt_template" json:"promptTemplate,omitempty"`
+}
+
+var profiles = map[string]*Profile{}
+
+// loadProfiles parses the "profiles" section of the config file and checks each profile.
+func loadProfiles(node interface{}, path string) {
+	if node == nil {
+		return
+	}
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		configProblem("%s: profiles: %v", path, err)
+		return
+	}
+	parsed := map[string]*Profile{}
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&parsed); err != nil {
+		configProblem("%s: profiles: %v", path, err)
+		return
+	}
+	keyOwner := map[string]string{}
+	for name, p := range parsed {
+		if p == nil {
+			p = &Profile{}
+			parsed[name] = p
+		}
+		p.Name = name
+		p.Country = strings.ToLower(strings.TrimSpace(p.Country))
+		if p.Country != "" && len(p.Country) != 2 {
+			configProblem("profile %s: country must be a two-letter country code", name)
+		}
+		for _, key := range p.APIKeys {
+			if other, dup := keyOwner[key]; dup {
+				configProblem("profiles %s and %s share an API key", other, name)
+			}
+			keyOwner[key] = name
+		}
+		for check := range p.Scoring {
+			if !checkExists(check) {
+				configProblem("profile %s: scoring: unknown check %q", name, check)
+			}
+		}
+		for toggle := range p.Checks {
+			if !isCheckToggle(toggle) {
+				configProblem("profile %s: checks: unknown toggle %q", name, toggle)
+			}
+		}
+		for i, pattern := range p.URLAllow {
+			p.URLAllow[i] = normaliseListPattern(pattern)
+		}
+		for i, pattern := range p.URLBlock {
+			p.URLBlock[i] = normaliseListPattern(pattern)
+		}
+	}
+	profiles = parsed
+}
+
+func checkExists(name string) bool {
+	for _, c := range activeChecks() {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultImpact is the server-wide impact of a check.
+func defaultImpact(name string) int {
+	for _, c := range activeChecks() {
+		if c.Name == name {
+			return c.Impact
+		}
+	}
+	return 0
+}
+
+// impact is the check's impact under this profile. A nil profile uses the server-wide weights.
+// A check weighted 0 server-wide stays at 0: it awards nothing whether it passes or fails, so
+// weigh has nothing to rescale, and counting the profile's weight in the maximum score would only
+// lower every email's percentage.
+func (p *Profile) impact(name string) int {
+	def := defaultImpact(name)
+	if p != nil && def != 0 {
+		if v, ok := p.Scoring[name]; ok {
+			return v
+		}
+	}
+	return def
+}
+
+// weigh rescales a score a check awarded under the server-wide weights to the profile's weight
+// for it, keeping partial awards (e.g. URL heuristics reduced per finding) proportional.
+func (p *Profile) weigh(name string, awarded int) int {
+	def, v := defaultImpact(name), p.impact(name)
+	if def == 0 || v == def {
+		return awarded
+	}
+	return int(math.Round(float64(awarded) * float64(v) / float64(def)))
+}
+
+// checkEnabled is the profile's default for a request toggle such as "checkUrls".
+func (p *Profile) checkEnabled(toggle string) bool {
+	if p == nil {
+		return true
+	}
+	on, set := p.Checks[toggle]
+	return !set || on
+}
+
+// aiModels returns the primary and fallback Gemini models to use.
+func (p *Profile) aiModels() (string, string) {
+	model, fallback := aiModel, aiFallbackModel
+	if p != nil && p.AIModel != "" {
+		model = p.AIModel
+	}
+	if p != nil && p.AIFallback != "" {
+		fallback = p.AIFallback
+	}
+	return model, fallback
+}
+
+// promptTemplate returns the prompt template the profile uses.
+func (p *Profile) promptTemplate() string {
+	if p != nil && p.PromptTemplate != "" {
+		return p.PromptTemplate
+	}
+	return promptTemplate
+}
+
+// country returns the profile's fixed country code, or "" to locate the client by IP.
+func (p *Profile) country() string {
+	if p == nil {
+		return ""
+	}
+	return p.Country
+}
+
+// name returns the profile name for results and logs ("" for the server-wide settings).
+func (p *Profile) name() string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+// applyProfileURLLists decides the URLs on the profile's own allow/block lists, with the same
+// rules as applyURLLists: the blocklist wins and allowlisted URLs are not scanned.
+func (p *Profile) applyProfileURLLists(urls []string) (verdicts []Verdict, remaining []string) {
+	if p == nil || (len(p.URLAllow) == 0 && len(p.URLBlock) == 0) {
+		return nil, urls
+	}
+urls:
+	for _, u := range urls {
+		for _, pattern := range p.URLBlock {
+			if urlListMatches(pattern, u) {
+				verdicts = append(verdicts, Verdict{
+					URL: u, Source: "blocklist", Score: 100, Cats: []string{"blocklisted"},
+					PlatformVerdict: true, FinalDecision: true,
+				})
+				continue urls
+			}
+		}
+		for _, pattern := range p.URLAllow {
+			if urlListMatches(pattern, u) {
+				verdicts = append(verdicts, Verdict{URL: u, Source: "allowlist", Cats: []string{}})
+				continue urls
+			}
+		}
+		remaining = append(remaining, u)
+	}
+	return verdicts, remaining
+}
+
+// resolveProfile picks the profile for a request. A key bound to a profile can't select another
+// one, and a profile with bound keys can't be selected without one of them.
+func resolveProfile(r *http.Request) (*Profile, int, error) {
+	if len(profiles) == 0 {
+		return nil, 0, nil
+	}
+	bound := boundProfile(r)
+
+	requested := strings.TrimSpace(r.Header.Get("X-Profile"))
+	if requested == "" {
+		requested = strings.TrimSpace(r.URL.Query().Get("profile"))
+	}
+	if requested == "" {
+		if bound != nil {
+			return bound, 0, nil
+		}
+		if p, ok := profiles["default"]; ok && len(p.APIKeys) == 0 {
+			return p, 0, nil
+		}
+		return nil, 0, nil
+	}
+
+	p, ok := profiles[requested]
+	if !ok {
+		return nil, http.StatusBadRequest, fmt.Errorf("unknown profile %q", requested)
+	}
+	if bound != nil && bound != p {
+		return nil, http.StatusForbidden, fmt.Errorf("API key is not allowed to use profile %q", requested)
+	}
+	if len(p.APIKeys) > 0 && bound != p {
+		return nil, http.StatusForbidden, fmt.Errorf("profile %q requires one of its API keys", requested)
+	}
+	return p, 0, nil
+}
+
+// boundProfile is the profile the request's X-API-Key is bound to, or nil.
+func boundProfile(r *http.Request) *Profile {
+	key := strings.TrimSpace(r.Header.Get("X-API-Key"))
+	var bound *Profile
+	if key != "" {
+		for _, p := range profiles {
+			for _, k := range p.APIKeys {
+				if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+					bound = p
+				}
+			}
+		}
+	}
+	return bound
+}
+
+// profileNames lists the configured profiles, sorted.
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
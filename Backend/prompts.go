@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// PromptVars are the values a prompt template can interpolate.
+type PromptVars struct {
+	Subject    string
+	From       string
+	Domain     string
+	Country    string
+	Language   string // detected language of the email body, e.g. "German"
+	Mode       string // "text" or "rendered"
+	MainPrompt string // the legacy MAIN_PROMPT value, so templates can extend it
+}
+
+// promptStore holds the parsed templates from promptDir, reloaded when files change on disk.
+type promptStore struct {
+	mu        sync.RWMutex
+	dir       string
+	templates map[string]*template.Template
+	modTimes  map[string]time.Time
+}
+
+var prompts = &promptStore{templates: map[string]*template.Template{}, modTimes: map[string]time.Time{}}
+
+// load (re)parses every *.tmpl file in the directory if anything was added, removed or modified.
+func (p *promptStore) load(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	modTimes := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		modTimes[strings.TrimSuffix(filepath.Base(f), ".tmpl")] = info.ModTime()
+	}
+
+	p.mu.RLock()
+	unchanged := p.dir == dir && len(modTimes) == len(p.modTimes)
+	if unchanged {
+		for name, t := range modTimes {
+			if !p.modTimes[name].Equal(t) {
+				unchanged = false
+				break
+			}
+		}
+	}
+	p.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	templates := make(map[string]*template.Template, len(modTimes))
+	for name := range modTimes {
+		path := filepath.Join(dir, name+".tmpl")
+		t, err := template.New(name).Option("missingkey=error").ParseFiles(path)
+		if err != nil {
+			slog.Warn("skipping prompt template", "path", path, "err", err)
+			continue
+		}
+		templates[name] = t.Lookup(filepath.Base(path))
+	}
+
+	p.mu.Lock()
+	p.dir = dir
+	p.templates = templates
+	p.modTimes = modTimes
+	p.mu.Unlock()
+	slog.Info("loaded prompt templates", "count", len(templates), "dir", dir)
+	return nil
+}
+
+// watch polls the template directory so edits are picked up without a restart.
+func (p *promptStore) watch(dir string, interval time.Duration) {
+	if err := p.load(dir); err != nil {
+		slog.Error("loading prompt templates failed", "err", err)
+	}
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := p.load(dir); err != nil {
+				slog.Error("reloading prompt templates failed", "err", err)
+			}
+		}
+	}()
+}
+
+// names lists the loaded template names in sorted order.
+func (p *promptStore) names() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := make([]string, 0, len(p.templates))
+	for name := range p.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// render executes the named template. ok is false when no such template is loaded.
+func (p *promptStore) render(name string, vars PromptVars) (string, bool, error) {
+	p.mu.RLock()
+	t, ok := p.templates[name]
+	p.mu.RUnlock()
+	if !ok {
+		return "", false, nil
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return "", true, fmt.Errorf("render prompt template %s: %w", name, err)
+	}
+	return strings.TrimSpace(buf.String()), true, nil
+}
+
+// instructionPrompt returns the analysis instructions from the named template, falling back to MAIN_PROMPT.
+func instructionPrompt(name string, vars PromptVars) (string, error) {
+	vars.MainPrompt = mainPrompt
+	text, ok, err := prompts.render(name, vars)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return mainPrompt, nil
+	}
+	return text, nil
+}
+
+// buildPrompt assembles the full text prompt sent to Gemini for either the raw EML or the rendered
+// screenshot. When the screenshot may not be sent (see imagesToGemini), the rendered prompt carries
+// renderedText, the email's rendered text, redacted, instead.
+func buildPrompt(initial bool, templateName string, raw []byte, renderedText string, Email EmailData, countryCode string) (string, error) {
+	Email.Subject = redactPII(Email.Subject, Email)
+	vars := PromptVars{
+		Subject:  Email.Subject,
+		From:     Email.From,
+		Domain:   Email.Domain,
+		Country:  countryCode,
+		Language: Email.Language.Name,
+		Mode:     "rendered",
+	}
+	if initial {
+		vars.Mode = "text"
+	}
+	instructions, err := instructionPrompt(templateName, vars)
+	if err != nil {
+		return "", err
+	}
+	if Email.Language.Code != "" && Email.Language.Code != "en" {
+		instructions = "The email is written in " + Email.Language.Name +
+			"; judge it by the norms of that language and answer in English. " + instructions
+	}
+	if initial {
+		return "This is the full EML file:\n" + redactEML(raw, Email) +
+			"\n" + instructions, nil
+	}
+	if !imagesToGemini() {
+		return "This is the email subject: " + Email.Subject + "\n The from email address: " + Email.From +
+			" \n This is the text of the email as rendered:\n" + redactPII(renderedText, Email) +
+			"\n" + instructions, nil
+	}
+	return "This is the email subject: " + Email.Subject + "\n The from email address: " + Email.From +
+		" \n There is a full screenshot of the email attached. " + instructions, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter caps how many analyses run at once and how many are started per minute, both per
+// API key (clientKeyID) and across the server. Every analysis can hold a browser and several
+// Gemini calls, so excess requests are turned away with 429 rather than queued. A limit of 0
+// disables that limit.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	perKeyPerMinute   int
+	globalPerMinute   int
+	maxPerKey         int
+	maxGlobal         int
+	buckets           map[string]*tokenBucket
+	global            tokenBucket
+	active            map[string]int
+	activeTotal       int
+	lastPrune         time.Time
+	bucketIdleTimeout time.Duration
+}
+
+// tokenBucket refills continuously at rate/minute up to rate tokens.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket and takes one token. When it is empty it returns how long until the
+// next token is available.
+func (b *tokenBucket) take(rate int, now time.Time) (bool, time.Duration) {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = math.Min(float64(rate), b.tokens+now.Sub(b.last).Minutes()*float64(rate))
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / float64(rate) * float64(time.Minute))
+}
+
+// refund gives back a token taken by a request that was refused by another limit after all.
+func (b *tokenBucket) refund() {
+	b.tokens++
+}
+
+var limiter *rateLimiter
+
+func newRateLimiter(perKeyPerMinute, globalPerMinute, maxPerKey, maxGlobal int) *rateLimiter {
+	return &rateLimiter{
+		perKeyPerMinute:   perKeyPerMinute,
+		globalPerMinute:   globalPerMinute,
+		maxPerKey:         maxPerKey,
+		maxGlobal:         maxGlobal,
+		buckets:           map[string]*tokenBucket{},
+		active:            map[string]int{},
+		bucketIdleTimeout: 10 * time.Minute,
+	}
+}
+
+// acquire admits one analysis for key. On success the caller must call release(key) when the
+// analysis ends; otherwise it gets the reason and how long the client should wait.
+func (l *rateLimiter) acquire(key string) (ok bool, reason string, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+
+	// Concurrency is checked first so a refused request doesn't use up a token.
+	if l.maxGlobal > 0 && l.activeTotal >= l.maxGlobal {
+		return false, "too many analyses in progress on the server", 5 * time.Second
+	}
+	if l.maxPerKey > 0 && l.active[key] >= l.maxPerKey {
+		return false, fmt.Sprintf("at most %d concurrent analyses per client", l.maxPerKey), 5 * time.Second
+	}
+	// The per-key bucket goes first so a client over its own limit doesn't drain the server's;
+	// if the server's limit then refuses the request, the client gets its token back.
+	var b *tokenBucket
+	if l.perKeyPerMinute > 0 {
+		if b = l.buckets[key]; b == nil {
+			b = &tokenBucket{}
+			l.buckets[key] = b
+		}
+		if ok, wait := b.take(l.perKeyPerMinute, now); !ok {
+			return false, fmt.Sprintf("at most %d analyses per minute per client", l.perKeyPerMinute), wait
+		}
+	}
+	if l.globalPerMinute > 0 {
+		if ok, wait := l.global.take(l.globalPerMinute, now); !ok {
+			if b != nil {
+				b.refund()
+			}
+			return false, fmt.Sprintf("at most %d analyses per minute on the server", l.globalPerMinute), wait
+		}
+	}
+	l.active[key]++
+	l.activeTotal++
+	return true, "", 0
+}
+
+func (l *rateLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[key] <= 1 {
+		delete(l.active, key)
+	} else {
+		l.active[key]--
+	}
+	if l.activeTotal > 0 {
+		l.activeTotal--
+	}
+}
+
+// prune drops buckets that have been idle long enough to be full again. Called with mu held.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > l.bucketIdleTimeout && l.active[key] == 0 {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit wraps an analysis endpoint with the limiter, answering 429 with Retry-After when the
+// caller or the server is over its limits.
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := clientKeyID(r)
+		ok, reason, retryAfter := limiter.acquire(key)
+		if !ok {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			slog.WarnContext(r.Context(), "analysis rate limited", "client", shortKeyID(key), "reason", reason, "retry_after", seconds)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{"error": "rate limit exceeded: " + reason, "retryAfter": seconds})
+			return
+		}
+		defer limiter.release(key)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// PII redaction modes (PII_REDACTION). Standard masks the recipient's identity, payment card
+// numbers and phone numbers (the checks read those from the email itself, so Gemini doesn't need
+// them); strict additionally masks every other email address and IBANs, and stops searches that
+// would send a phone number to Google.
+const (
+	piiRedactionOff      = "off"
+	piiRedactionStandard = "standard"
+	piiRedactionStrict   = "strict"
+)
+
+// imagesToGemini reports whether the email's screenshots and images may be sent to Gemini. They
+// can't be redacted, so while redaction is on they are only sent with PII_REDACTION_IMAGES=TRUE.
+func imagesToGemini() bool {
+	return piiRedactionMode == piiRedactionOff || piiRedactionImages
+}
+
+// errPIISearchSkipped is returned by searchGoogle when strict redaction forbids the query.
+var errPIISearchSkipped = errors.New("search skipped: query contains personal data")
+
+var (
+	piiEmailAddress = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	piiCardNumber   = regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`)
+	piiPhoneNumber  = regexp.MustCompile(`(?:\+|\b)\d[\d \-().]{7,}\d\b`)
+	piiIBAN         = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,4})?\b`)
+)
+
+// recipientHeaders are the headers that name the mailbox the email was delivered to.
+var recipientHeaders = []string{"To", "Cc", "Bcc", "Delivered-To", "X-Original-To", "Envelope-To"}
+
+// emailRecipients returns the recipient addresses and display names from the envelope headers.
+func emailRecipients(env *enmime.Envelope) (addresses, names []string) {
+	seen := map[string]bool{}
+	for _, h := range recipientHeaders {
+		for _, v := range env.GetHeaderValues(h) {
+			list, err := mail.ParseAddressList(v)
+			if err != nil {
+				if a, err := mail.ParseAddress(strings.Trim(v, " <>")); err == nil {
+					list = []*mail.Address{a}
+				} else {
+					continue
+				}
+			}
+			for _, a := range list {
+				addr := strings.ToLower(a.Address)
+				if addr != "" && !seen[addr] {
+					seen[addr] = true
+					addresses = append(addresses, addr)
+				}
+				if name := strings.TrimSpace(a.Name); name != "" && !seen["name:"+name] {
+					seen["name:"+name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	return addresses, names
+}
+
+// luhnValid reports whether the digits in s pass the Luhn check used by payment cards.
+func luhnValid(s string) bool {
+	sum, double, n := 0, false, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// replaceFold replaces every case-insensitive occurrence of old in s.
+func replaceFold(s, old, repl string) string {
+	if old == "" {
+		return s
+	}
+	re := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(old))
+	return re.ReplaceAllLiteralString(s, repl)
+}
+
+// redactPII masks personal data in text before it leaves for Gemini or Google. Recipients are
+// those of Email; the sender's own address is left alone since the analysis is about it.
+func redactPII(text string, Email EmailData) string {
+	if piiRedactionMode == piiRedactionOff || text == "" {
+		return text
+	}
+
+	// Longest first, so "Jane Doe" goes before "Jane".
+	names := append([]string(nil), Email.RecipientNames...)
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	for _, addr := range Email.Recipients {
+		text = replaceFold(text, addr, "[REDACTED_EMAIL]")
+	}
+	for _, name := range names {
+		if len(name) >= 3 {
+			text = replaceFold(text, name, "[REDACTED_NAME]")
+		}
+	}
+	text = piiCardNumber.ReplaceAllStringFunc(text, func(m string) string {
+		if luhnValid(m) {
+			return "[REDACTED_CARD]"
+		}
+		return m
+	})
+	// IBANs before phone numbers, whose pattern would take their digit groups.
+	if piiRedactionMode == piiRedactionStrict {
+		text = piiIBAN.ReplaceAllString(text, "[REDACTED_IBAN]")
+	}
+	text = piiPhoneNumber.ReplaceAllStringFunc(text, func(m string) string {
+		digits := 0
+		for _, c := range m {
+			if c >= '0' && c <= '9' {
+				digits++
+			}
+		}
+		if digits < 9 || digits > 15 {
+			return m
+		}
+		return "[REDACTED_PHONE]"
+	})
+
+	if piiRedactionMode != piiRedactionStrict {
+		return text
+	}
+	sender := ""
+	if a, err := mail.ParseAddress(Email.From); err == nil {
+		sender = strings.ToLower(a.Address)
+	}
+	return piiEmailAddress.ReplaceAllStringFunc(text, func(m string) string {
+		if strings.ToLower(m) == sender {
+			return m
+		}
+		return "[REDACTED_EMAIL]"
+	})
+}
+
+// redactEML masks personal data in a whole EML file. The patterns can't see through base64 or
+// quoted-printable (whose soft line breaks split a number or name anywhere), so the message is
+// decoded and rebuilt around its redacted text and HTML, and the headers are redacted as written.
+func redactEML(raw []byte, Email EmailData) string {
+	if piiRedactionMode == piiRedactionOff {
+		return string(raw)
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return redactPII(string(raw), Email)
+	}
+	rebuilt, err := buildEMLUniversal(env, redactPII(env.Text, Email), redactPII(env.HTML, Email))
+	if err != nil {
+		return redactPII(string(raw), Email)
+	}
+	header, body, _ := bytes.Cut(rebuilt, []byte("\r\n\r\n"))
+	return redactPII(string(header), Email) + "\r\n\r\n" + string(body)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// With COMPANIES_HOUSE_API_KEY and/or OPENCORPORATES_API_TOKEN, verifyCompany also asks the
+// official company registries about the organisation Gemini named, after the database and the
+// aliases and before the Google fallback. Companies House is asked when the email is analysed
+// for the UK or the sender's domain is under .uk; OpenCorporates covers every jurisdiction.
+// Registries don't record web domains, so the sender's domain counts as the company's when its
+// name (acme-widgets for acme-widgets.co.uk) is the registered name without the legal suffix.
+// A company that is registered but dissolved never verifies a sender.
+
+// RegistryRecord is the company a registry returned for the claimed organisation.
+type RegistryRecord struct {
+	Registry      string `json:"registry"` // companiesHouse or openCorporates
+	Name          string `json:"name"`
+	Number        string `json:"number"`
+	Jurisdiction  string `json:"jurisdiction,omitempty"`
+	Status        string `json:"status,omitempty"`
+	Active        bool   `json:"active"`
+	URL           string `json:"url,omitempty"`
+	DomainMatches bool   `json:"domainMatches"` // the sender's domain is named after the company
+}
+
+// registryEnabled reports whether any company registry is configured.
+func registryEnabled() bool {
+	return companiesHouseAPIKey != "" || openCorporatesAPIToken != ""
+}
+
+// lookupRegistries asks the configured registries about org and returns the best record: an
+// active company whose name matches the sender's domain, otherwise any active company, otherwise
+// a dissolved one. It returns nil when no registry knows the organisation.
+func lookupRegistries(ctx context.Context, org, countryCode string, Email EmailData) *RegistryRecord {
+	var records []RegistryRecord
+	if companiesHouseAPIKey != "" && (strings.EqualFold(countryCode, "gb") || claimedCountry(Email.Domain) == "GB") {
+		found, err := searchCompaniesHouse(ctx, org)
+		if err != nil {
+			Email.logger().Warn("Companies House search failed", "err", err)
+		}
+		records = append(records, found...)
+	}
+	if openCorporatesAPIToken != "" {
+		found, err := searchOpenCorporates(ctx, org, countryCode)
+		if err != nil {
+			Email.logger().Warn("OpenCorporates search failed", "err", err)
+		}
+		records = append(records, found...)
+	}
+
+	want := normaliseOrgName(org)
+	var best *RegistryRecord
+	rank := func(r RegistryRecord) int {
+		switch {
+		case r.Active && r.DomainMatches:
+			return 3
+		case r.Active:
+			return 2
+		}
+		return 1
+	}
+	for _, r := range records {
+		if !orgNamesMatch(want, normaliseOrgName(r.Name)) {
+			continue
+		}
+		r.DomainMatches = domainNamedAfter(Email.Domain, r.Name)
+		if best == nil || rank(r) > rank(*best) {
+			rec := r
+			best = &rec
+		}
+	}
+	return best
+}
+
+// domainNamedAfter reports whether the name part of domain (its registrable domain without the
+// public suffix, e.g. acme-widgets for mail.acme-widgets.co.uk) spells the registered name, or
+// its first word. Lookalikes are what this check is for, so the match must be exact: amaz.co.uk
+// isn't named after AMAZON UK SERVICES LTD.
+func domainNamedAfter(domain, registeredName string) bool {
+	site, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(strings.TrimSuffix(domain, ".")))
+	if err != nil {
+		return false
+	}
+	label := strings.ReplaceAll(site[:strings.IndexByte(site, '.')], "-", "")
+	words := strings.Fields(normaliseOrgName(registeredName))
+	if label == "" || len(words) == 0 {
+		return false
+	}
+	// "hsbc" for HSBC UK BANK PLC, "tesco" for TESCO STORES LIMITED
+	return label == strings.Join(words, "") || label == words[0]
+}
+
+// registryGet fetches a registry search and decodes the JSON answer into v.
+func registryGet(ctx context.Context, dependency string, req *http.Request, v interface{}) error {
+	defer trackDependency(ctx, dependency, time.Now())
+	client := newClientWithDefaultHeaders()
+	client.Timeout = 10 * time.Second
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if cerr := resp.Body.Close(); cerr != nil {
+		slog.WarnContext(ctx, "closing response body failed", "err", cerr)
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, string(body))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// searchCompaniesHouse searches the UK register by name.
+func searchCompaniesHouse(ctx context.Context, org string) ([]RegistryRecord, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		"https://api.company-information.service.gov.uk/search/companies?items_per_page=5&q="+url.QueryEscape(org), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The API key is the user name of HTTP basic auth, with an empty password.
+	req.SetBasicAuth(companiesHouseAPIKey, "")
+	var result struct {
+		Items []struct {
+			Title         string `json:"title"`
+			CompanyNumber string `json:"company_number"`
+			CompanyStatus string `json:"company_status"`
+		} `json:"items"`
+	}
+	if err := registryGet(ctx, "companiesHouse", req, &result); err != nil {
+		return nil, err
+	}
+	records := make([]RegistryRecord, 0, len(result.Items))
+	for _, it := range result.Items {
+		records = append(records, RegistryRecord{
+			Registry:     "companiesHouse",
+			Name:         it.Title,
+			Number:       it.CompanyNumber,
+			Jurisdiction: "gb",
+			Status:       it.CompanyStatus,
+			Active:       it.CompanyStatus == "active",
+			URL:          "https://find-and-update.company-information.service.gov.uk/company/" + url.PathEscape(it.CompanyNumber),
+		})
+	}
+	return records, nil
+}
+
+// searchOpenCorporates searches every jurisdiction OpenCorporates covers, preferring the
+// analysis country's.
+func searchOpenCorporates(ctx context.Context, org, countryCode string) ([]RegistryRecord, error) {
+	q := url.Values{"q": {org}, "per_page": {"5"}, "api_token": {openCorporatesAPIToken}}
+	if countryCode != "" {
+		q.Set("country_code", strings.ToLower(countryCode))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://api.opencorporates.com/v0.4/companies/search?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Results struct {
+			Companies []struct {
+				Company struct {
+					Name              string `json:"name"`
+					CompanyNumber     string `json:"company_number"`
+					JurisdictionCode  string `json:"jurisdiction_code"`
+					CurrentStatus     string `json:"current_status"`
+					Inactive          bool   `json:"inactive"`
+					OpenCorporatesURL string `json:"opencorporates_url"`
+				} `json:"company"`
+			} `json:"companies"`
+		} `json:"results"`
+	}
+	if err := registryGet(ctx, "openCorporates", req, &result); err != nil {
+		return nil, err
+	}
+	records := make([]RegistryRecord, 0, len(result.Results.Companies))
+	for _, c := range result.Results.Companies {
+		records = append(records, RegistryRecord{
+			Registry:     "openCorporates",
+			Name:         c.Company.Name,
+			Number:       c.Company.CompanyNumber,
+			Jurisdiction: c.Company.JurisdictionCode,
+			Status:       c.Company.CurrentStatus,
+			Active:       !c.Company.Inactive,
+			URL:          c.Company.OpenCorporatesURL,
+		})
+	}
+	return records, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+)
+
+// Every remote image, stylesheet and font an email loads is fetched from somebody's server when
+// it is opened. parseEmail lists them (Email.RemoteContent) and remoteContentAnalysis groups them
+// by registrable domain. A brand's real mail loads its logos from its own domain or an email
+// service's CDN; a phish sent from elsewhere hotlinks them from the brand's site. Content served
+// only from domains unrelated to the sender fails the RemoteContentUnrelated check.
+
+// RemoteResource is one external resource the email's HTML references.
+type RemoteResource struct {
+	URL  string `json:"url"`
+	Kind string `json:"kind"` // image, stylesheet or font
+}
+
+// contentHosts are email service and CDN domains that serve content for many senders, so they
+// say nothing about whether the content belongs to the sender.
+var contentHosts = map[string]bool{
+	"mcusercontent.com": true, "list-manage.com": true, "sendgrid.net": true, "sendgrid.com": true,
+	"mailgun.org": true, "sparkpostmail.com": true, "hubspotusercontent-na1.net": true,
+	"hubspotemail.net": true, "exacttarget.com": true, "cmail19.com": true, "cmail20.com": true,
+	"rs6.net": true, "klaviyo.com": true, "cloudfront.net": true, "amazonaws.com": true,
+	"akamaihd.net": true, "googleusercontent.com": true, "gstatic.com": true, "googleapis.com": true,
+	"ctfassets.net": true, "cloudinary.com": true, "imgix.net": true,
+}
+
+var (
+	cssImportURL = regexp.MustCompile(`(?i)@import\s+(?:url\(\s*)?['"]?([^'")\s;]+)`)
+	fontFileExt  = map[string]bool{".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true}
+)
+
+// isContentHost reports whether host is or is under one of contentHosts. Several of them
+// (cloudfront.net, googleapis.com...) are public suffixes, so their customers' hosts are
+// registrable domains of their own.
+func isContentHost(host string) bool {
+	for h := range contentHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// findRemoteContent lists the remote images (<img>, background attributes and CSS url()),
+// stylesheets (<link rel="stylesheet"> and @import) and fonts referenced by htmlStr.
+func findRemoteContent(htmlStr string) []RemoteResource {
+	var found []RemoteResource
+	seen := map[string]bool{}
+	add := func(raw, kind string) {
+		u := html.UnescapeString(strings.TrimSpace(raw))
+		if strings.HasPrefix(u, "//") {
+			u = "https:" + u
+		}
+		if !strings.HasPrefix(strings.ToLower(u), "http") || linkHost(u) == "" || seen[u] {
+			return
+		}
+		seen[u] = true
+		if kind == "image" {
+			p := strings.ToLower(u)
+			if i := strings.IndexAny(p, "?#"); i >= 0 {
+				p = p[:i]
+			}
+			if fontFileExt[path.Ext(p)] {
+				kind = "font"
+			}
+		}
+		found = append(found, RemoteResource{URL: u, Kind: kind})
+	}
+
+	z := html.NewTokenizer(strings.NewReader(htmlStr))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		name, hasAttr := z.TagName()
+		if !hasAttr {
+			continue
+		}
+		attrs := map[string]string{}
+		for more := true; more; {
+			var key, val []byte
+			key, val, more = z.TagAttr()
+			attrs[string(key)] = string(val)
+		}
+		switch tag := string(name); {
+		case tag == "img":
+			add(attrs["src"], "image")
+		case tag == "link":
+			rel := strings.ToLower(attrs["rel"])
+			switch {
+			case strings.Contains(rel, "stylesheet"):
+				add(attrs["href"], "stylesheet")
+			case strings.EqualFold(attrs["as"], "font"):
+				add(attrs["href"], "font")
+			case strings.Contains(rel, "icon"):
+				add(attrs["href"], "image")
+			}
+		}
+		if bg, ok := attrs["background"]; ok {
+			add(bg, "image")
+		}
+	}
+	for _, m := range cssImportURL.FindAllStringSubmatch(htmlStr, -1) {
+		add(m[1], "stylesheet")
+	}
+	for _, u := range extractCSSBackgrounds(htmlStr) {
+		add(u, "image")
+	}
+	return found
+}
+
+// RemoteDomain is the content served from one registrable domain.
+type RemoteDomain struct {
+	Domain      string   `json:"domain"`
+	Relation    string   `json:"relation"` // sender, contentHost or unrelated
+	Images      int      `json:"images"`
+	Stylesheets int      `json:"stylesheets"`
+	Fonts       int      `json:"fonts"`
+	URLs        []string `json:"urls"` // the first remoteContentMaxURLs
+}
+
+const remoteContentMaxURLs = 10
+
+// RemoteContentResult is the remoteContentAnalysis event.
+type RemoteContentResult struct {
+	Total            int            `json:"total"`
+	Domains          []RemoteDomain `json:"domains"` // most resources first
+	UnrelatedDomains []string       `json:"unrelatedDomains"`
+	Unrelated        bool           `json:"unrelated"` // content from unrelated domains and none from the sender's
+	Message          string         `json:"message"`
+	ScoreImpact      int            `json:"scoreImpact"`
+}
+
+// remoteContentCensus groups resources by registrable domain and relates each to the sender.
+func remoteContentCensus(resources []RemoteResource, senderDomain string) RemoteContentResult {
+	result := RemoteContentResult{Total: len(resources), Domains: []RemoteDomain{}, UnrelatedDomains: []string{}}
+	byDomain := map[string]*RemoteDomain{}
+	var order []string
+	for _, r := range resources {
+		d := registrableDomain(linkHost(r.URL))
+		if d == "" {
+			d = linkHost(r.URL) // IP literal or bare host
+		}
+		rd, ok := byDomain[d]
+		if !ok {
+			rd = &RemoteDomain{Domain: d, Relation: "unrelated", URLs: []string{}}
+			switch {
+			case senderDomain != "" && d == senderDomain:
+				rd.Relation = "sender"
+			case isContentHost(d):
+				rd.Relation = "contentHost"
+			}
+			byDomain[d] = rd
+			order = append(order, d)
+		}
+		switch r.Kind {
+		case "stylesheet":
+			rd.Stylesheets++
+		case "font":
+			rd.Fonts++
+		default:
+			rd.Images++
+		}
+		if len(rd.URLs) < remoteContentMaxURLs {
+			rd.URLs = append(rd.URLs, r.URL)
+		}
+	}
+	fromSender := false
+	for _, d := range order {
+		rd := byDomain[d]
+		result.Domains = append(result.Domains, *rd)
+		switch rd.Relation {
+		case "unrelated":
+			result.UnrelatedDomains = append(result.UnrelatedDomains, d)
+		case "sender":
+			fromSender = true
+		}
+	}
+	sort.SliceStable(result.Domains, func(i, j int) bool {
+		a, b := result.Domains[i], result.Domains[j]
+		return a.Images+a.Stylesheets+a.Fonts > b.Images+b.Stylesheets+b.Fonts
+	})
+	result.Unrelated = len(result.UnrelatedDomains) > 0 && !fromSender
+	return result
+}
+
+func performRemoteContentAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "RemoteContentUnrelated" {
+			check = c
+			break
+		}
+	}
+	result := remoteContentCensus(Email.RemoteContent, Email.Domain)
+	switch {
+	case result.Total == 0:
+		result.Message = "The email loads no remote content."
+		result.ScoreImpact = check.Impact
+	case result.Unrelated && Email.MailingList.newsletter(Email.Domain):
+		result.Message = fmt.Sprintf("The email loads %d remote resource(s) from %s; it is a newsletter from %s.",
+			result.Total, strings.Join(result.UnrelatedDomains, ", "), Email.MailingList.ESP)
+		result.ScoreImpact = check.Impact
+	case result.Unrelated:
+		result.Message = fmt.Sprintf("The email loads %d remote resource(s), none from the sender's domain %s but some from unrelated domains: %s.",
+			result.Total, Email.Domain, strings.Join(result.UnrelatedDomains, ", "))
+	default:
+		result.Message = fmt.Sprintf("The email loads %d remote resource(s) from %d domain(s).", result.Total, len(result.Domains))
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "remoteContentAnalysis", Payload: result}
+}
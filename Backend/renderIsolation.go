@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// Rendering an email in Chrome loads its remote images, stylesheets and fonts, so the sender's
+// tracking pixels learn that the email was opened, and from where. With RENDER_NETWORK_ISOLATED
+// every request the page makes is intercepted and refused, as for HTML attachments, and the
+// screenshot shows what the email looks like with remote content blocked. The requests refused
+// are reported as renderedAnalysis.blockedRequests.
+
+var renderIsolated bool
+
+// BlockedRequest is a request the isolated renderer refused.
+type BlockedRequest struct {
+	URL  string `json:"url"`
+	Type string `json:"type"` // what the page wanted it for: Image, Stylesheet, Font, Script, …
+}
+
+// requestBlocker refuses a page's network requests and records them, once per URL.
+type requestBlocker struct {
+	mu      sync.Mutex
+	seen    map[string]bool
+	blocked []BlockedRequest
+}
+
+// localRequest reports whether u is loaded without the network: the page itself, the cid:
+// images saved next to it, and inline data.
+func localRequest(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "file", "data", "blob", "about":
+		return true
+	}
+	return false
+}
+
+// intercept starts refusing the requests of the page in ctx, which must be a chromedp context
+// that hasn't run yet. The returned action turns interception on; run it before navigating.
+func (b *requestBlocker) intercept(ctx context.Context) chromedp.Action {
+	chromedp.ListenTarget(ctx, func(ev any) {
+		e, ok := ev.(*fetch.EventRequestPaused)
+		if !ok {
+			return
+		}
+		// Answering from the listener itself would block the event loop.
+		go func() {
+			c := chromedp.FromContext(ctx)
+			if c == nil || c.Target == nil {
+				return
+			}
+			execCtx := cdp.WithExecutor(ctx, c.Target)
+			if localRequest(e.Request.URL) {
+				_ = fetch.ContinueRequest(e.RequestID).Do(execCtx)
+				return
+			}
+			b.record(e.Request.URL, string(e.ResourceType))
+			_ = fetch.FailRequest(e.RequestID, network.ErrorReasonBlockedByClient).Do(execCtx)
+		}()
+	})
+	return fetch.Enable()
+}
+
+func (b *requestBlocker) record(u, resourceType string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.seen == nil {
+		b.seen = map[string]bool{}
+	}
+	if b.seen[u] {
+		return
+	}
+	b.seen[u] = true
+	b.blocked = append(b.blocked, BlockedRequest{URL: u, Type: resourceType})
+}
+
+// list returns the requests refused so far.
+func (b *requestBlocker) list() []BlockedRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]BlockedRequest(nil), b.blocked...)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+)
+
+// Some phishing only shows itself in one rendering mode: text coloured to vanish on a white
+// background but not on a dark one, or blocks that a prefers-color-scheme or max-width media
+// query only displays in dark mode or on a phone. RENDER_VARIANTS (e.g. "dark,mobile") has the
+// email rendered again in those modes, in the same browser as the normal screenshot. Every
+// variant's text is read like the normal rendering's (from the page, or by OCR for image-heavy
+// emails) and its screenshot sent to Gemini with the normal one; lines that only a variant
+// shows are listed under renderedAnalysis.renderVariants and join the text the rendered
+// checks read.
+
+// renderView is one way of rendering a page.
+type renderView struct {
+	Name   string
+	Width  int
+	Height int
+	Mobile bool
+	Dark   bool // prefers-color-scheme: dark
+}
+
+var desktopView = renderView{Name: "desktop", Width: 1280, Height: 1024}
+
+// knownRenderVariants are the extra views RENDER_VARIANTS can name.
+var knownRenderVariants = map[string]renderView{
+	"dark":   {Name: "dark", Width: 1280, Height: 1024, Dark: true},
+	"mobile": {Name: "mobile", Width: 390, Height: 844, Mobile: true},
+}
+
+var renderVariants []renderView
+
+// parseRenderVariants turns RENDER_VARIANTS into the extra views to render, in order.
+func parseRenderVariants(raw string) ([]renderView, error) {
+	var views []renderView
+	seen := map[string]bool{}
+	for _, name := range splitList(raw) {
+		name = strings.ToLower(name)
+		v, ok := knownRenderVariants[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown render variant %q (dark or mobile)", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			views = append(views, v)
+		}
+	}
+	return views, nil
+}
+
+// actions renders the page at fileURL in the view, takes a full-page screenshot and reads the
+// page's text.
+func (v renderView) actions(fileURL string, shot *renderedView) chromedp.Tasks {
+	scheme := "light"
+	if v.Dark {
+		scheme = "dark"
+	}
+	return chromedp.Tasks{
+		emulation.SetDeviceMetricsOverride(int64(v.Width), int64(v.Height), 3, v.Mobile).
+			WithScreenOrientation(&emulation.ScreenOrientation{
+				Type:  emulation.OrientationTypePortraitPrimary,
+				Angle: 0,
+			}),
+		emulation.SetEmulatedMedia().WithFeatures([]*emulation.MediaFeature{
+			{Name: "prefers-color-scheme", Value: scheme},
+		}),
+		chromedp.Navigate(fileURL),
+		chromedp.WaitReady("body", chromedp.ByQuery),
+		chromedp.Sleep(1 * time.Second),
+		chromedp.FullScreenshot(&shot.Screenshot, 100),
+		chromedp.Evaluate(domTextScript, &shot.Page),
+	}
+}
+
+// RenderedVariant is a variant screenshot saved next to the normal one, and the page's text in it.
+type RenderedVariant struct {
+	Name     string
+	Path     string
+	FileName string
+	Page     domText
+}
+
+// variantFileName is the screenshot name of a variant of the screenshot called base.
+func variantFileName(base, variant string) string {
+	return strings.TrimSuffix(base, filepath.Ext(base)) + "-" + variant + ".png"
+}
+
+// RenderVariantResult is what a variant showed, in renderedAnalysis.renderVariants.
+type RenderVariantResult struct {
+	Name       string   `json:"name"`
+	Screenshot string   `json:"screenshot,omitempty"` // kept for the HTML report
+	OnlyHere   []string `json:"onlyHere,omitempty"`   // OCR lines the normal screenshot doesn't show
+	Error      string   `json:"error,omitempty"`
+}
+
+// normaliseOCRWords lower-cases s and keeps only its words, one space apart.
+func normaliseOCRWords(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r > 127)
+	}), " ")
+}
+
+// linesOnlyIn returns the lines of variant, with at least two words, whose words don't appear
+// in that order in base. Lines are compared against the whole of base because a narrower
+// view wraps the same text differently.
+func linesOnlyIn(variant, base string) []string {
+	all := " " + normaliseOCRWords(base) + " "
+	var only []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(variant, "\n") {
+		words := normaliseOCRWords(line)
+		if strings.Count(words, " ") < 1 || seen[words] || strings.Contains(all, " "+words+" ") {
+			continue
+		}
+		seen[words] = true
+		only = append(only, strings.TrimSpace(line))
+	}
+	return only
+}
+
+// renderTimeout is how long rendering views may take: 90s, and 30s more for each variant.
+func renderTimeout(views int) time.Duration {
+	return 90*time.Second + time.Duration(max(views-1, 0))*30*time.Second
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The rendered analysis used to OCR every screenshot, although Chrome already knows the text it
+// laid out. Now the page's document.body.innerText is read after rendering (innerText leaves out
+// what CSS hides, so it is the text a reader sees) and OCR only runs for image-heavy emails:
+// fewer than renderedTextMinWords words, or images covering at least imageHeavyShare of the
+// page. RENDERED_TEXT_SOURCE=ocr restores OCR for every email and =dom never uses it.
+// renderedAnalysis.renderedText says which source was used and compares the rendered text with
+// the email's raw text.
+
+const (
+	renderedTextAuto = "auto"
+	renderedTextDOM  = "dom"
+	renderedTextOCR  = "ocr"
+)
+
+var renderedTextSource = renderedTextAuto
+
+const (
+	renderedTextMinWords = 20
+	imageHeavyShare      = 0.5
+	// renderedTextMaxLines caps the lines listed by the comparison.
+	renderedTextMaxLines = 20
+)
+
+// domTextScript returns the page's visible text and the share of the page covered by images
+// (img, svg, canvas and CSS background images).
+const domTextScript = `(() => {
+	const doc = document.documentElement;
+	const area = Math.max(doc.scrollWidth * doc.scrollHeight, 1);
+	let images = 0;
+	for (const el of document.querySelectorAll('*')) {
+		const tag = el.tagName.toLowerCase();
+		if (tag === 'img' || tag === 'svg' || tag === 'canvas' || getComputedStyle(el).backgroundImage !== 'none') {
+			const r = el.getBoundingClientRect();
+			images += r.width * r.height;
+		}
+	}
+	return {text: document.body ? document.body.innerText : '', imageShare: Math.min(images / area, 1)};
+})()`
+
+// domText is what domTextScript returns.
+type domText struct {
+	Text       string  `json:"text"`
+	ImageShare float64 `json:"imageShare"`
+}
+
+// RenderedTextResult is renderedAnalysis.renderedText.
+type RenderedTextResult struct {
+	Source     string  `json:"source"` // dom or ocr
+	Words      int     `json:"words"`  // in the DOM text
+	ImageShare float64 `json:"imageShare"`
+	// The lines the rendering shows that the email's raw text (its HTML converted to text, or
+	// its plain-text body) doesn't have, and the other way round.
+	OnlyRendered []string `json:"onlyRendered,omitempty"`
+	OnlyRaw      []string `json:"onlyRaw,omitempty"`
+}
+
+// checkRenderedTextSource normalises RENDERED_TEXT_SOURCE.
+func checkRenderedTextSource(raw string) (string, error) {
+	switch s := strings.ToLower(strings.TrimSpace(raw)); s {
+	case renderedTextAuto, renderedTextDOM, renderedTextOCR:
+		return s, nil
+	default:
+		return "", fmt.Errorf("must be auto, dom or ocr, got %q", raw)
+	}
+}
+
+// needsOCR reports whether the rendered text has to come from OCR of the screenshot.
+func needsOCR(d domText) bool {
+	switch renderedTextSource {
+	case renderedTextOCR:
+		return true
+	case renderedTextDOM:
+		return false
+	}
+	return len(strings.Fields(d.Text)) < renderedTextMinWords || d.ImageShare >= imageHeavyShare
+}
+
+// compareRenderedText compares the page's text with the email's raw text.
+func compareRenderedText(source string, d domText, raw string, Email EmailData) *RenderedTextResult {
+	result := &RenderedTextResult{Source: source, Words: len(strings.Fields(d.Text)), ImageShare: d.ImageShare}
+	if strings.TrimSpace(raw) == "" || strings.TrimSpace(d.Text) == "" {
+		return result
+	}
+	for _, line := range firstN(linesOnlyIn(d.Text, raw), renderedTextMaxLines) {
+		result.OnlyRendered = append(result.OnlyRendered, redactPII(line, Email))
+	}
+	for _, line := range firstN(linesOnlyIn(raw, d.Text), renderedTextMaxLines) {
+		result.OnlyRaw = append(result.OnlyRaw, redactPII(line, Email))
+	}
+	return result
+}
+
+func firstN(lines []string, n int) []string {
+	if len(lines) > n {
+		return lines[:n]
+	}
+	return lines
+}
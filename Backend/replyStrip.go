@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/jaytaylor/html2text"
+	"golang.org/x/net/html"
+)
+
+// A reply usually carries the whole thread below it. The quoted messages are earlier mail the
+// recipient has already seen; left in, they drown the new content the AI and the text
+// heuristics should judge and cost tokens on every analysis. Only the newest message is kept,
+// but the links in the quoted part are still scanned.
+
+// replyAttribution matches the line a mail client writes above a quoted reply, e.g.
+// "On Mon, 1 Jan 2024 at 10:00, Alice <alice@example.com> wrote:", which Gmail may wrap before
+// "wrote:".
+var replyAttribution = regexp.MustCompile(`(?im)^[ \t]*(?:on [^\n]{1,200}(?:\n[^\n]{0,100})?wrote|am [^\n]{1,200}(?:\n[^\n]{0,100})?schrieb[^\n:]{0,100}|le [^\n]{1,200}(?:\n[^\n]{0,100})?a écrit|el [^\n]{1,200}(?:\n[^\n]{0,100})?escribió|il [^\n]{1,200}(?:\n[^\n]{0,100})?ha scritto)[ \t]*:[ \t]*$`)
+
+// replySeparator matches Outlook's separators above a quoted reply: "-----Original Message-----"
+// (and translations), or a rule followed by the original's From line.
+var replySeparator = regexp.MustCompile(`(?im)^[ \t]*(?:-{3,}\s*(?:original message|ursprüngliche nachricht|message d'origine|mensaje original)\s*-{3,}|_{20,}\s*\n\s*\**(?:from|von|de|da)\**\s*:)`)
+
+// outlookHeaderBlock matches the "From: … Sent: …" block Outlook puts above a reply without a
+// separator line.
+var outlookHeaderBlock = regexp.MustCompile(`(?im)^[ \t]*\**(?:from|von|de)\**\s*:[^\n]*\n[ \t]*\**(?:sent|gesendet|envoyé|enviado)\**\s*:`)
+
+// forwardedNotice matches the notices of forwarded content, which is the email being reported
+// rather than an old reply, so it is never cut.
+var forwardedNotice = regexp.MustCompile(`(?i)forwarded message|begin forwarded message|weitergeleitete nachricht|message transf[ée]r[ée]|mensaje reenviado|messaggio inoltrato`)
+
+// stripQuotedText splits text into the newest message and the quoted thread below it. The
+// thread starts at the first attribution or separator line, or where every remaining non-blank
+// line is quoted with ">"; when nothing is left above it, text is returned whole.
+func stripQuotedText(text string) (newest, quoted string) {
+	cut := len(text)
+	for _, re := range []*regexp.Regexp{replyAttribution, replySeparator, outlookHeaderBlock} {
+		if loc := re.FindStringIndex(text); loc != nil && loc[0] < cut {
+			cut = loc[0]
+		}
+	}
+	if start := trailingQuoteStart(text); start < cut {
+		cut = start
+	}
+	if cut == len(text) || strings.TrimSpace(text[:cut]) == "" || forwardedNotice.MatchString(text[cut:]) {
+		return text, ""
+	}
+	return strings.TrimSpace(text[:cut]), text[cut:]
+}
+
+// trailingQuoteStart returns the offset of the run of ">" lines that ends text, or len(text).
+// Quotes with replies written between them are left alone.
+func trailingQuoteStart(text string) int {
+	start, end := len(text), len(text)
+	for end > 0 {
+		lineStart := strings.LastIndexByte(text[:end-1], '\n') + 1
+		line := strings.TrimSpace(text[lineStart:end])
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, ">"):
+			start = lineStart
+		default:
+			return start
+		}
+		end = lineStart
+	}
+	return start
+}
+
+// isQuoteContainer reports whether n is the element a mail client wraps the quoted thread in:
+// Gmail's gmail_quote, Apple Mail's and Thunderbird's <blockquote type="cite">, Outlook's
+// divRplyFwdMsg / appendonsend and its bordered header, Yahoo's yahoo_quoted.
+func isQuoteContainer(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	var id, class, style, typ string
+	for _, a := range n.Attr {
+		switch strings.ToLower(a.Key) {
+		case "id":
+			id = a.Val
+		case "class":
+			class = a.Val
+		case "style":
+			style = strings.ToLower(strings.ReplaceAll(a.Val, " ", ""))
+		case "type":
+			typ = a.Val
+		}
+	}
+	classes := strings.Fields(class)
+	hasClass := func(c string) bool {
+		for _, cl := range classes {
+			if cl == c {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case hasClass("gmail_quote"), hasClass("yahoo_quoted"), hasClass("moz-cite-prefix"):
+		return true
+	case id == "divRplyFwdMsg", id == "appendonsend", strings.HasPrefix(id, "yahoo_quoted"):
+		return true
+	case n.Data == "blockquote" && strings.EqualFold(typ, "cite"):
+		return true
+	case n.Data == "div" && (strings.Contains(style, "border-top:solid#e1e1e1") || strings.Contains(style, "border-top:solid#b5c4df")):
+		return true
+	}
+	return false
+}
+
+// stripQuotedHTML splits an HTML body at the first quote container: everything from it to the
+// end of the document is the quoted thread. The body is returned whole when nothing is left
+// before the container, or the container holds forwarded content.
+func stripQuotedHTML(body string) (newest, quoted string) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return body, ""
+	}
+	var container *html.Node
+	var find func(*html.Node)
+	find = func(n *html.Node) {
+		for c := n.FirstChild; c != nil && container == nil; c = c.NextSibling {
+			if isQuoteContainer(c) {
+				container = c
+				return
+			}
+			find(c)
+		}
+	}
+	find(doc)
+	if container == nil {
+		return body, ""
+	}
+
+	// Detach the container and everything after it, at every level up to the root.
+	var removed []*html.Node
+	for n := container; n.Parent != nil; {
+		parent, from := n.Parent, n.NextSibling
+		if n == container {
+			from = n
+		}
+		for s := from; s != nil; {
+			next := s.NextSibling
+			parent.RemoveChild(s)
+			removed = append(removed, s)
+			s = next
+		}
+		n = parent
+	}
+	var kept, cut bytes.Buffer
+	if err := html.Render(&kept, doc); err != nil {
+		return body, ""
+	}
+	for _, n := range removed {
+		_ = html.Render(&cut, n)
+	}
+	keptText, _ := html2text.FromString(kept.String(), html2text.Options{OmitLinks: true})
+	if strings.TrimSpace(keptText) == "" || forwardedNotice.MatchString(cut.String()) {
+		return body, ""
+	}
+	return kept.String(), cut.String()
+}
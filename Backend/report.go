@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The HTML report is one self-contained file per analysis: the screenshot is inlined, nothing is
+// loaded from anywhere, links aren't clickable and indicators are defanged, so it can be archived
+// or mailed around without anyone landing on the phishing site by accident.
+
+// emailScreenshotDir keeps the rendered screenshot of each email (SCREENSHOT_DIR/emails) for the
+// report, since the sandbox it is taken in is deleted with the request. A screenshot lives as
+// long as the saved analysis that refers to it: it is removed when the analysis isn't saved
+// (no results store, a cancelled analysis or a failed write) and when RESULTS_RETENTION expires it.
+var emailScreenshotDir string
+
+// keepEmailScreenshot copies a screenshot out of the sandbox and returns its new path, or "".
+// Without a results store there is no report to keep it for.
+func keepEmailScreenshot(ctx context.Context, path string) string {
+	if results == nil {
+		return ""
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	if err := os.MkdirAll(emailScreenshotDir, 0755); err != nil {
+		slog.WarnContext(ctx, "creating email screenshot directory failed", "err", err)
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	kept := filepath.Join(emailScreenshotDir, fmt.Sprintf("%s-%d.png", hex.EncodeToString(sum[:8]), time.Now().Unix()))
+	if err := os.WriteFile(kept, b, 0644); err != nil {
+		slog.WarnContext(ctx, "keeping email screenshot failed", "err", err)
+		return ""
+	}
+	return filepath.ToSlash(kept)
+}
+
+// keptScreenshots lists the email and landing-page screenshots that an analysis's check results
+// refer to, at any depth (attached emails and render variants have their own).
+func keptScreenshots(checks interface{}) []string {
+	b, err := json.Marshal(checks)
+	if err != nil {
+		return nil
+	}
+	var tree interface{}
+	if err := json.Unmarshal(b, &tree); err != nil {
+		return nil
+	}
+	dirs := []string{filepath.ToSlash(emailScreenshotDir) + "/", filepath.ToSlash(landingPageDir) + "/"}
+	kept := func(s string) bool {
+		for _, dir := range dirs {
+			if strings.HasPrefix(s, dir) {
+				return true
+			}
+		}
+		return false
+	}
+	var paths []string
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			for key, child := range n {
+				if s, ok := child.(string); ok && key == "screenshot" && kept(s) {
+					paths = append(paths, s)
+					continue
+				}
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range n {
+				walk(child)
+			}
+		}
+	}
+	walk(tree)
+	return paths
+}
+
+// removeAnalysisScreenshots deletes the screenshots kept for an analysis that isn't, or is no
+// longer, saved.
+func removeAnalysisScreenshots(ctx context.Context, checks interface{}) {
+	for _, path := range keptScreenshots(checks) {
+		if err := os.Remove(filepath.FromSlash(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.WarnContext(ctx, "removing screenshot failed", "path", path, "err", err)
+		}
+	}
+}
+
+// defangURL makes a URL unclickable the way threat reports do: hxxp:// and [.] in the host.
+func defangURL(raw string) string {
+	lower := strings.ToLower(raw)
+	for _, scheme := range []string{"https://", "http://"} {
+		if strings.HasPrefix(lower, scheme) {
+			rest := raw[len(scheme):]
+			end := strings.IndexAny(rest, "/?#")
+			if end < 0 {
+				end = len(rest)
+			}
+			return strings.Replace(scheme, "tt", "xx", 1) + defangHost(rest[:end]) + rest[end:]
+		}
+	}
+	return defangHost(raw)
+}
+
+// defangHost brackets the dots of a domain or IP and the @ of an address.
+func defangHost(host string) string {
+	return strings.NewReplacer(".", "[.]", "@", "[@]").Replace(host)
+}
+
+// reportRow is one check in the report's table.
+type reportRow struct {
+	Check   string
+	Message string
+	Points  string
+}
+
+// reportData is what the report template is filled with.
+type reportData struct {
+	Record     AnalysisRecord
+	From       string
+	Generated  string
+	Screenshot template.URL // data: URL, or empty
+	Rows       []reportRow
+	IOCs       *reportIOCs
+}
+
+// reportIOCs are the indicators of the iocs event, defanged.
+type reportIOCs struct {
+	Sender  string
+	Origin  string
+	URLs    []string
+	Domains []string
+	IPs     []string
+	Files   []map[string]interface{}
+}
+
+// reportChecks turns the stored check results into table rows, sorted by event name. The IOC
+// block and attached-email reports have sections of their own.
+func reportChecks(checks map[string]interface{}) []reportRow {
+	var rows []reportRow
+	for name, v := range checks {
+		if name == "iocs" || name == "attachedEmails" {
+			continue
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		row := reportRow{Check: name, Points: "–"}
+		for _, key := range []string{"message", "summary", "error"} {
+			if s, ok := m[key].(string); ok && s != "" {
+				row.Message = s
+				break
+			}
+		}
+		if n, ok := m["scoreImpact"].(float64); ok {
+			row.Points = fmt.Sprintf("%+d", int(n))
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Check < rows[j].Check })
+	return rows
+}
+
+// reportIndicators defangs the stored iocs block, or returns nil when there is none.
+func reportIndicators(checks map[string]interface{}) *reportIOCs {
+	m, ok := checks["iocs"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	list := func(key string, defang func(string) string) []string {
+		var out []string
+		items, _ := m[key].([]interface{})
+		for _, it := range items {
+			if s, ok := it.(string); ok {
+				out = append(out, defang(s))
+			}
+		}
+		return out
+	}
+	iocs := &reportIOCs{
+		URLs:    list("urls", defangURL),
+		Domains: list("domains", defangHost),
+		IPs:     list("ips", defangHost),
+	}
+	if s, ok := m["sender"].(string); ok {
+		iocs.Sender = defangHost(s)
+	}
+	if s, ok := m["originIp"].(string); ok {
+		iocs.Origin = defangHost(s)
+	}
+	if g, ok := m["originGeo"].(map[string]interface{}); ok && iocs.Origin != "" {
+		var geo GeoInfo
+		geo.Country, _ = g["country"].(string)
+		geo.ASOrg, _ = g["asOrg"].(string)
+		if n, ok := g["asn"].(float64); ok {
+			geo.ASN = uint(n)
+		}
+		if where := geo.String(); where != "" {
+			iocs.Origin += " (" + where + ")"
+		}
+	}
+	files, _ := m["files"].([]interface{})
+	for _, f := range files {
+		if fm, ok := f.(map[string]interface{}); ok {
+			iocs.Files = append(iocs.Files, fm)
+		}
+	}
+	return iocs
+}
+
+// reportScreenshot inlines the kept screenshot of the rendered analysis as a data: URL.
+func reportScreenshot(checks map[string]interface{}) template.URL {
+	rendered, ok := checks["renderedAnalysis"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	path, _ := rendered["screenshot"].(string)
+	if path == "" {
+		return ""
+	}
+	b, err := os.ReadFile(filepath.FromSlash(path))
+	if err != nil {
+		return ""
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(b))
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="Content-Security-Policy" content="default-src 'none'; img-src data:; style-src 'unsafe-inline'">
+<title>Email analysis {{.Record.ID}}</title>
+<style>
+body { font-family: Verdana, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f2f2f2; }
+code { font-size: 0.9em; word-break: break-all; }
+img { max-width: 100%; border: 1px solid #ccc; }
+</style>
+</head>
+<body>
+<h1>Email analysis report</h1>
+<table>
+<tr><th>Analysis</th><td><code>{{.Record.ID}}</code></td></tr>
+<tr><th>Analysed</th><td>{{.Record.CreatedAt.UTC.Format "2006-01-02 15:04:05 UTC"}}</td></tr>
+<tr><th>From</th><td><code>{{.From}}</code></td></tr>
+<tr><th>Subject</th><td>{{.Record.Subject}}</td></tr>
+<tr><th>Score</th><td>{{printf "%.0f" .Record.Scores.NormalPercentage}}% (text), {{printf "%.0f" .Record.Scores.RenderedPercentage}}% (rendered); {{.Record.Scores.FinalScoreNormal}} / {{printf "%.0f" .Record.Scores.MaxPossibleScore}} points</td></tr>
+</table>
+
+<h2>Checks</h2>
+<table>
+<tr><th>Check</th><th>Result</th><th>Points</th></tr>
+{{range .Rows}}<tr><td>{{.Check}}</td><td>{{.Message}}</td><td>{{.Points}}</td></tr>
+{{end}}</table>
+
+{{with .IOCs}}<h2>Indicators (defanged)</h2>
+<table>
+{{if .Sender}}<tr><th>Sender</th><td><code>{{.Sender}}</code></td></tr>{{end}}
+{{if .Origin}}<tr><th>Origin IP</th><td><code>{{.Origin}}</code></td></tr>{{end}}
+{{range .URLs}}<tr><th>URL</th><td><code>{{.}}</code></td></tr>
+{{end}}{{range .Domains}}<tr><th>Domain</th><td><code>{{.}}</code></td></tr>
+{{end}}{{range .IPs}}<tr><th>IP</th><td><code>{{.}}</code></td></tr>
+{{end}}</table>
+{{if .Files}}<table>
+<tr><th>File</th><th>Size</th><th>SHA256</th><th>SHA1</th><th>MD5</th></tr>
+{{range .Files}}<tr><td>{{index . "fileName"}}</td><td>{{index . "size"}}</td><td><code>{{index . "sha256"}}</code></td><td><code>{{index . "sha1"}}</code></td><td><code>{{index . "md5"}}</code></td></tr>
+{{end}}</table>{{end}}
+{{end}}
+{{if .Screenshot}}<h2>Rendered email</h2>
+<img src="{{.Screenshot}}" alt="Screenshot of the rendered email">
+{{end}}
+<p><small>Generated {{.Generated}}. Links in this report are defanged and not clickable.</small></p>
+</body>
+</html>
+`))
+
+// renderReport writes the HTML report of rec.
+func renderReport(rec AnalysisRecord) ([]byte, error) {
+	data := reportData{
+		Record:     rec,
+		From:       defangHost(rec.From),
+		Generated:  time.Now().UTC().Format("2006-01-02 15:04:05 UTC"),
+		Screenshot: reportScreenshot(rec.Checks),
+		Rows:       reportChecks(rec.Checks),
+		IOCs:       reportIndicators(rec.Checks),
+	}
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadResult returns the saved analysis named in the path, after checking the caller may see it:
+// the API key that ran it, or the admin key. On failure the error response has been written.
+func loadResult(w http.ResponseWriter, r *http.Request) (AnalysisRecord, bool) {
+	if results == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "results store unavailable"})
+		return AnalysisRecord{}, false
+	}
+	if !canReadResults(w, r) {
+		return AnalysisRecord{}, false
+	}
+	rec, err := results.analysis(r.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "analysis not found"})
+		return AnalysisRecord{}, false
+	}
+	if err != nil {
+		slog.Error("loading analysis failed", "id", r.PathValue("id"), "err", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to load analysis"})
+		return AnalysisRecord{}, false
+	}
+	if !isAdminRequest(r) && !ownedByCaller(r, rec.APIKey) {
+		// Not 403: whether an ID exists is none of the caller's business.
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "analysis not found"})
+		return AnalysisRecord{}, false
+	}
+	return rec, true
+}
+
+// isAdminRequest reports whether the request carries the admin key.
+func isAdminRequest(r *http.Request) bool {
+	return adminAPIKey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Key")), []byte(adminAPIKey)) == 1
+}
+
+// canReadResults reports whether the request carries an API key or the admin key. Callers
+// without a key all share the "anonymous" identity, so their analyses are readable only with the
+// admin key. On failure the error response has been written.
+func canReadResults(w http.ResponseWriter, r *http.Request) bool {
+	if isAdminRequest(r) || clientKeyID(r) != "anonymous" {
+		return true
+	}
+	writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "needs an X-API-Key or the admin key"})
+	return false
+}
+
+// resultsListHandler lists the caller's saved analyses, newest first (?limit=, default 50, at most
+// 500; ?offset=). With the admin key every caller's are listed.
+func resultsListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if results == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "results store unavailable"})
+		return
+	}
+	if !canReadResults(w, r) {
+		return
+	}
+	limit, offset := 50, 0
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, 500)
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && v > 0 {
+		offset = v
+	}
+	apiKey := clientKeyID(r)
+	if isAdminRequest(r) {
+		apiKey = ""
+	}
+	list, err := results.listAnalyses(apiKey, limit, offset)
+	if err != nil {
+		slog.Error("listing analyses failed", "err", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list analyses"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"analyses": list, "limit": limit, "offset": offset})
+}
+
+// resultHandler returns one saved analysis as JSON: its scores and every check result.
+func resultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	rec, ok := loadResult(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	rec, ok := loadResult(w, r)
+	if !ok {
+		return
+	}
+	body, err := renderReport(rec)
+	if err != nil {
+		slog.Error("rendering report failed", "id", rec.ID, "err", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to render report"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="analysis-%s.html"`, rec.ID))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src data:; style-src 'unsafe-inline'")
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AnalysisRecord is one completed analysis as persisted in the results store.
+type AnalysisRecord struct {
+	ID        string                 `json:"id"`
+	CreatedAt time.Time              `json:"createdAt"`
+	APIKey    string                 `json:"apiKey"`
+	Subject   string                 `json:"subject"`
+	From      string                 `json:"from"`
+	Domain    string                 `json:"domain"`
+	Scores    ScoreResult            `json:"scores"`
+	Checks    map[string]interface{} `json:"checks"`
+}
+
+// UsageSummary aggregates Gemini token usage and estimated cost for one day and API key.
+type UsageSummary struct {
+	Day              string  `json:"day"`
+	APIKey           string  `json:"apiKey"`
+	Calls            int     `json:"calls"`
+	CacheHits        int     `json:"cacheHits"`
+	PromptTokens     int64   `json:"promptTokens"`
+	OutputTokens     int64   `json:"outputTokens"`
+	TotalTokens      int64   `json:"totalTokens"`
+	EstimatedCostUSD float64 `json:"estimatedCostUsd"`
+}
+
+// resultsStore persists analysis outcomes and AI usage in a small SQLite database,
+// separate from the read-mostly company/domain database.
+type resultsStore struct {
+	db *sql.DB
+}
+
+// results is the process-wide results store. It is nil when the store could not be opened,
+// in which case analyses still run but nothing is persisted.
+var results *resultsStore
+
+func openResultsStore(path string) (*resultsStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("open results db: %w", err)
+	}
+	// SQLite handles one writer at a time; serialise through a single connection.
+	db.SetMaxOpenConns(1)
+	schema := []string{
+		`CREATE TABLE IF NOT EXISTS analyses (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMP NOT NULL,
+			api_key TEXT NOT NULL,
+			subject TEXT,
+			from_header TEXT,
+			domain TEXT,
+			scores_json TEXT,
+			checks_json TEXT
+		)`,
+		`CREATE TABLE IF NOT EXISTS ai_usage (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			analysis_id TEXT NOT NULL,
+			api_key TEXT NOT NULL,
+			day TEXT NOT NULL,
+			mode TEXT NOT NULL,
+			model TEXT,
+			cache_hit INTEGER NOT NULL DEFAULT 0,
+			prompt_tokens INTEGER NOT NULL DEFAULT 0,
+			output_tokens INTEGER NOT NULL DEFAULT 0,
+			total_tokens INTEGER NOT NULL DEFAULT 0,
+			cost_usd REAL NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_ai_usage_day_key ON ai_usage(day, api_key)`,
+		`CREATE TABLE IF NOT EXISTS url_lists (
+			list TEXT NOT NULL,
+			pattern TEXT NOT NULL,
+			note TEXT,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (list, pattern)
+		)`,
+		`CREATE TABLE IF NOT EXISTS attachment_policy (
+			kind TEXT NOT NULL,
+			value TEXT NOT NULL,
+			action TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			note TEXT,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (kind, value)
+		)`,
+		`CREATE TABLE IF NOT EXISTS feedback (
+			analysis_id TEXT NOT NULL,
+			api_key TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			reason TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			verdict TEXT NOT NULL,
+			normal_percentage REAL,
+			rendered_percentage REAL,
+			features_json TEXT,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (analysis_id, api_key)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_feedback_sender ON feedback(sender, kind)`,
+		`CREATE INDEX IF NOT EXISTS idx_feedback_sender_key ON feedback(sender, api_key, kind)`,
+		`CREATE TABLE IF NOT EXISTS body_hashes (
+			analysis_id TEXT PRIMARY KEY,
+			api_key TEXT NOT NULL,
+			ssdeep TEXT NOT NULL,
+			block_size INTEGER NOT NULL,
+			campaign_id TEXT NOT NULL,
+			similarity INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_body_hashes_block ON body_hashes(block_size, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_body_hashes_campaign ON body_hashes(campaign_id)`,
+		`CREATE TABLE IF NOT EXISTS campaign_alerts (
+			campaign_id TEXT PRIMARY KEY,
+			notified_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS executive_directories (
+			profile TEXT PRIMARY KEY,
+			directory_json TEXT NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS check_settings (
+			name TEXT PRIMARY KEY,
+			impact INTEGER,
+			description TEXT,
+			updated_at TIMESTAMP NOT NULL
+		)`,
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("init results db: %w", err)
+		}
+	}
+	return &resultsStore{db: db}, nil
+}
+
+// newAnalysisID returns a random identifier for one analysis run.
+func newAnalysisID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// clientKeyID identifies the caller for usage accounting and as the owner of its analyses and
+// jobs, without storing the raw API key: "key-" and the whole SHA-256 of the key, since a shorter
+// hash would let one key be found that reads another's results. Callers without a key (or with a
+// blank one) are "anonymous".
+func clientKeyID(r *http.Request) string {
+	key := strings.TrimSpace(r.Header.Get("X-API-Key"))
+	if key == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:])
+}
+
+// shortKeyID shortens a clientKeyID for logs. It must never be compared.
+func shortKeyID(id string) string {
+	if len(id) > len("key-")+8 {
+		return id[:len("key-")+8]
+	}
+	return id
+}
+
+// ownedByCaller reports whether the request carries the API key that owner (a clientKeyID)
+// identifies. Anonymous callers don't share an identity, so they own nothing.
+func ownedByCaller(r *http.Request, owner string) bool {
+	id := clientKeyID(r)
+	return id != "anonymous" && subtle.ConstantTimeCompare([]byte(id), []byte(owner)) == 1
+}
+
+func (s *resultsStore) saveAnalysis(rec AnalysisRecord) error {
+	scoresJSON, err := json.Marshal(rec.Scores)
+	if err != nil {
+		return err
+	}
+	checksJSON, err := json.Marshal(rec.Checks)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO analyses (id, created_at, api_key, subject, from_header, domain, scores_json, checks_json)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.ID, rec.CreatedAt.UTC(), rec.APIKey, rec.Subject, rec.From, rec.Domain, string(scoresJSON), string(checksJSON))
+	return err
+}
+
+// analysis loads one saved analysis; sql.ErrNoRows means there is none with that ID.
+func (s *resultsStore) analysis(id string) (AnalysisRecord, error) {
+	var rec AnalysisRecord
+	var subject, from, domain, scoresJSON, checksJSON sql.NullString
+	err := s.db.QueryRow(`SELECT id, created_at, api_key, subject, from_header, domain, scores_json, checks_json
+		FROM analyses WHERE id = ?`, id).Scan(&rec.ID, &rec.CreatedAt, &rec.APIKey, &subject, &from, &domain, &scoresJSON, &checksJSON)
+	if err != nil {
+		return AnalysisRecord{}, err
+	}
+	rec.Subject, rec.From, rec.Domain = subject.String, from.String, domain.String
+	if scoresJSON.Valid {
+		if err := json.Unmarshal([]byte(scoresJSON.String), &rec.Scores); err != nil {
+			return AnalysisRecord{}, fmt.Errorf("decode scores: %w", err)
+		}
+	}
+	if checksJSON.Valid {
+		if err := json.Unmarshal([]byte(checksJSON.String), &rec.Checks); err != nil {
+			return AnalysisRecord{}, fmt.Errorf("decode checks: %w", err)
+		}
+	}
+	return rec, nil
+}
+
+// expireAnalyses deletes the analyses saved before cutoff, together with the email screenshots
+// kept for them, and returns how many there were.
+func (s *resultsStore) expireAnalyses(ctx context.Context, cutoff time.Time) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, checks_json FROM analyses WHERE created_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	expired := map[string]string{}
+	for rows.Next() {
+		var id string
+		var checksJSON sql.NullString
+		if err := rows.Scan(&id, &checksJSON); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		expired[id] = checksJSON.String
+	}
+	// The store has a single connection, which the deletes below need.
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for id, checksJSON := range expired {
+		var checks interface{}
+		if json.Unmarshal([]byte(checksJSON), &checks) == nil {
+			removeAnalysisScreenshots(ctx, checks)
+		}
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM analyses WHERE id = ?`, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// runResultsRetention deletes saved analyses once they are older than maxAge, checking hourly.
+func runResultsRetention(maxAge time.Duration) {
+	if maxAge <= 0 || results == nil {
+		return
+	}
+	for {
+		n, err := results.expireAnalyses(context.Background(), time.Now().Add(-maxAge))
+		if err != nil {
+			slog.Error("deleting expired analyses failed", "err", err)
+		} else if n > 0 {
+			slog.Info("deleted expired analyses", "count", n)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// AnalysisSummary is one saved analysis in a listing, without its check results.
+type AnalysisSummary struct {
+	ID                 string    `json:"id"`
+	CreatedAt          time.Time `json:"createdAt"`
+	APIKey             string    `json:"apiKey"`
+	Subject            string    `json:"subject"`
+	From               string    `json:"from"`
+	Domain             string    `json:"domain"`
+	NormalPercentage   float64   `json:"normalPercentage"`
+	RenderedPercentage float64   `json:"renderedPercentage"`
+}
+
+// listAnalyses returns saved analyses, newest first; an empty apiKey lists every key's.
+func (s *resultsStore) listAnalyses(apiKey string, limit, offset int) ([]AnalysisSummary, error) {
+	query := `SELECT id, created_at, api_key, subject, from_header, domain, scores_json FROM analyses`
+	args := []interface{}{}
+	if apiKey != "" {
+		query += ` WHERE api_key = ?`
+		args = append(args, apiKey)
+	}
+	query += ` ORDER BY created_at DESC LIMIT ? OFFSET ?`
+	rows, err := s.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	list := []AnalysisSummary{}
+	for rows.Next() {
+		var a AnalysisSummary
+		var subject, from, domain, scoresJSON sql.NullString
+		if err := rows.Scan(&a.ID, &a.CreatedAt, &a.APIKey, &subject, &from, &domain, &scoresJSON); err != nil {
+			return nil, err
+		}
+		a.Subject, a.From, a.Domain = subject.String, from.String, domain.String
+		var scores ScoreResult
+		if scoresJSON.Valid && json.Unmarshal([]byte(scoresJSON.String), &scores) == nil {
+			a.NormalPercentage, a.RenderedPercentage = scores.NormalPercentage, scores.RenderedPercentage
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+func (s *resultsStore) recordUsage(analysisID, apiKey, mode string, stats AICallStats) error {
+	now := time.Now().UTC()
+	_, err := s.db.Exec(`INSERT INTO ai_usage (analysis_id, api_key, day, mode, model, cache_hit, prompt_tokens, output_tokens, total_tokens, cost_usd, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		analysisID, apiKey, now.Format("2006-01-02"), mode, stats.Model, stats.CacheHit,
+		stats.PromptTokens, stats.OutputTokens, stats.TotalTokens, stats.EstimatedCostUSD, now)
+	return err
+}
+
+// usageSummary returns per-day, per-key totals for usage recorded on or after since.
+func (s *resultsStore) usageSummary(since time.Time) ([]UsageSummary, error) {
+	rows, err := s.db.Query(`SELECT day, api_key, COUNT(*), SUM(cache_hit), SUM(prompt_tokens), SUM(output_tokens), SUM(total_tokens), SUM(cost_usd)
+		FROM ai_usage WHERE day >= ? GROUP BY day, api_key ORDER BY day DESC, api_key`, since.UTC().Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			slog.Warn("closing usage rows failed", "err", err)
+		}
+	}(rows)
+
+	summaries := []UsageSummary{}
+	for rows.Next() {
+		var u UsageSummary
+		if err := rows.Scan(&u.Day, &u.APIKey, &u.Calls, &u.CacheHits, &u.PromptTokens, &u.OutputTokens, &u.TotalTokens, &u.EstimatedCostUSD); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, u)
+	}
+	return summaries, rows.Err()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// safeBrowsingBatchSize is the maximum number of threat entries the Lookup API accepts per request.
+const safeBrowsingBatchSize = 500
+
+// checkSafeBrowsing looks the given URLs up in the Google Safe Browsing v4 Lookup API and returns
+// the threat types matched for each listed URL. URLs absent from the map had no match.
+func checkSafeBrowsing(ctx context.Context, urls []string) (map[string][]string, error) {
+	matches := make(map[string][]string)
+	if safeBrowsingAPIKey == "" || len(urls) == 0 {
+		return matches, nil
+	}
+	defer trackDependency(ctx, "safeBrowsing", time.Now())
+
+	client := newClientWithDefaultHeaders()
+	client.Timeout = 10 * time.Second
+
+	for start := 0; start < len(urls); start += safeBrowsingBatchSize {
+		end := start + safeBrowsingBatchSize
+		if end > len(urls) {
+			end = len(urls)
+		}
+
+		type threatEntry struct {
+			URL string `json:"url"`
+		}
+		entries := make([]threatEntry, 0, end-start)
+		for _, u := range urls[start:end] {
+			entries = append(entries, threatEntry{URL: u})
+		}
+		reqBody := map[string]interface{}{
+			"client": map[string]string{"clientId": "email-checker", "clientVersion": "1.0"},
+			"threatInfo": map[string]interface{}{
+				"threatTypes":      []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"},
+				"platformTypes":    []string{"ANY_PLATFORM"},
+				"threatEntryTypes": []string{"URL"},
+				"threatEntries":    entries,
+			},
+		}
+		body, err := json.Marshal(reqBody)
+		if err != nil {
+			return nil, err
+		}
+
+		endpoint := "https://safebrowsing.googleapis.com/v4/threatMatches:find?key=" + url.QueryEscape(safeBrowsingAPIKey)
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("safe browsing lookup: %w", err)
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		if cerr := resp.Body.Close(); cerr != nil {
+			slog.WarnContext(ctx, "closing response body failed", "err", cerr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read safe browsing response: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("safe browsing error: %s: %s", resp.Status, string(respBody))
+		}
+
+		var result struct {
+			Matches []struct {
+				ThreatType string `json:"threatType"`
+				Threat     struct {
+					URL string `json:"url"`
+				} `json:"threat"`
+			} `json:"matches"`
+		}
+		if err := json.Unmarshal(respBody, &result); err != nil {
+			return nil, fmt.Errorf("decode safe browsing response: %w", err)
+		}
+		for _, m := range result.Matches {
+			matches[m.Threat.URL] = append(matches[m.Threat.URL], m.ThreatType)
+		}
+	}
+	return matches, nil
+}
+
+// safeBrowsingVerdict builds the verdict reported for a URL listed by Safe Browsing.
+func safeBrowsingVerdict(u string, threats []string) Verdict {
+	return Verdict{
+		URL:             u,
+		Source:          "safebrowsing",
+		Score:           100,
+		Cats:            threats,
+		Report:          "https://transparencyreport.google.com/safe-browsing/search?url=" + url.QueryEscape(u),
+		PlatformVerdict: true,
+		FinalDecision:   true,
+	}
+}
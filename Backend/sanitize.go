@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/net/html"
+)
+
+// POST /sanitize-eml takes the same base64 .eml as /process-eml-stream and returns a neutralised
+// copy that a help desk can forward or open safely: scripts, frames, forms and other active HTML
+// removed, links defanged (hxxps://example[.]com) in both bodies, remote images and stylesheets
+// blocked, and attachments the executable check finds dangerous dropped. The copy is rebuilt with
+// updateEMLUniversal, so only From, To, Subject and Date survive of the headers, and a note at the
+// top of each body says what was removed.
+
+// sanitizeTimeout bounds the attachment inspection (VirusTotal, ClamAV) of one email.
+const sanitizeTimeout = time.Minute
+
+var (
+	// sanitizeDropElements are removed together with their content.
+	sanitizeDropElements = map[string]bool{
+		"script": true, "iframe": true, "frame": true, "frameset": true, "object": true, "embed": true,
+		"applet": true, "noscript": true, "template": true, "svg": true, "math": true,
+	}
+	// sanitizeDropTags are removed, but their content kept.
+	sanitizeDropTags = map[string]bool{"form": true, "link": true, "meta": true, "base": true}
+	// sanitizeDropAttrs are removed from every element, as are on* handlers.
+	sanitizeDropAttrs = map[string]bool{
+		"srcset": true, "action": true, "formaction": true, "background": true, "ping": true,
+		"poster": true, "lowsrc": true, "dynsrc": true, "xlink:href": true,
+	}
+	cssURL    = regexp.MustCompile(`(?i)url\s*\([^)]*\)`)
+	cssImport = regexp.MustCompile(`(?i)@import[^;]*;?`)
+)
+
+// remoteURL reports whether a src or href makes the client fetch something.
+func remoteURL(u string) bool {
+	u = strings.ToLower(strings.TrimSpace(u))
+	return strings.HasPrefix(u, "http:") || strings.HasPrefix(u, "https:") || strings.HasPrefix(u, "//") || strings.HasPrefix(u, "ftp:")
+}
+
+// sanitizeHTML neutralises an HTML body. It returns the new HTML and the number of remote images
+// blocked.
+func sanitizeHTML(src string) (string, int) {
+	var out strings.Builder
+	blocked := 0
+	skip := 0              // depth inside a dropped element
+	inStyle := false       // inside <style>, whose text is CSS
+	var openLinks []string // defanged targets of the open <a> elements, "" for those without one
+	z := html.NewTokenizer(strings.NewReader(src))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return out.String(), blocked
+		}
+		tok := z.Token()
+		name := tok.Data
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if sanitizeDropElements[name] {
+				if tt == html.StartTagToken {
+					skip++
+				}
+				continue
+			}
+			if skip > 0 || sanitizeDropTags[name] {
+				continue
+			}
+			var attrs []html.Attribute
+			link := ""
+			for _, a := range tok.Attr {
+				key := strings.ToLower(a.Key)
+				val := a.Val
+				switch {
+				case strings.HasPrefix(key, "on"), sanitizeDropAttrs[key]:
+					continue
+				case key == "style":
+					if cssURL.MatchString(val) || strings.Contains(strings.ToLower(val), "expression(") {
+						continue
+					}
+				case key == "href":
+					// Links keep their text; the target follows it, defanged.
+					if strings.TrimSpace(val) != "" && !strings.HasPrefix(strings.TrimSpace(val), "#") {
+						link = defangURL(strings.TrimSpace(val))
+					}
+					continue
+				case key == "src":
+					if remoteURL(val) {
+						blocked++
+						attrs = append(attrs, html.Attribute{Key: "alt", Val: "[remote image blocked: " + defangURL(strings.TrimSpace(val)) + "]"})
+						continue
+					}
+					if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(val)), "data:image/") && !strings.HasPrefix(strings.ToLower(val), "cid:") {
+						continue
+					}
+				}
+				attrs = append(attrs, html.Attribute{Key: key, Val: val})
+			}
+			tok.Attr = attrs
+			out.WriteString(tok.String())
+			if tt == html.StartTagToken {
+				switch name {
+				case "a":
+					openLinks = append(openLinks, link)
+				case "style":
+					inStyle = true
+				}
+			}
+		case html.EndTagToken:
+			if sanitizeDropElements[name] {
+				if skip > 0 {
+					skip--
+				}
+				continue
+			}
+			if skip > 0 || sanitizeDropTags[name] {
+				continue
+			}
+			if name == "style" {
+				inStyle = false
+			}
+			if name == "a" && len(openLinks) > 0 {
+				if link := openLinks[len(openLinks)-1]; link != "" {
+					out.WriteString(" [" + html.EscapeString(link) + "]")
+				}
+				openLinks = openLinks[:len(openLinks)-1]
+			}
+			out.WriteString(tok.String())
+		case html.TextToken:
+			switch {
+			case skip > 0:
+			case inStyle:
+				out.WriteString(cssImport.ReplaceAllString(cssURL.ReplaceAllString(tok.Data, "none"), ""))
+			default:
+				out.WriteString(html.EscapeString(tok.Data))
+			}
+		case html.DoctypeToken:
+			out.WriteString(tok.String())
+		case html.CommentToken:
+			// Conditional comments can carry markup for Outlook; drop them all.
+		}
+	}
+}
+
+// sanitizeText defangs the links in a plain-text body.
+func sanitizeText(text string) string {
+	links := getURL(text)
+	// Longest first, so a link isn't half-replaced through a shorter one it starts with.
+	sort.Slice(links, func(i, j int) bool { return len(links[i]) > len(links[j]) })
+	pairs := make([]string, 0, 2*len(links))
+	seen := map[string]bool{}
+	for _, l := range links {
+		if !seen[l] {
+			seen[l] = true
+			pairs = append(pairs, l, defangURL(l))
+		}
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// attachmentDanger is why an attachment report makes the file unsafe to pass on, or "".
+func attachmentDanger(r AttachmentReport) string {
+	_, executable := executableKinds[r.DetectedType]
+	_, container := containerKinds[r.DetectedType]
+	switch {
+	case r.DangerousExt && r.PolicySeverity != "low":
+		return "dangerous file type"
+	case r.TypeMismatch && (executable || container):
+		return "disguised as another file type"
+	case r.VTMalicious > 0:
+		return "flagged by VirusTotal"
+	case r.ClamAV != "":
+		return "detected by ClamAV as " + r.ClamAV
+	case r.Macros != nil:
+		return "contains macros"
+	case r.PDF != nil && r.PDF.Suspicious():
+		return "contains active PDF content"
+	case r.Encrypted:
+		return "password-protected"
+	}
+	return ""
+}
+
+// removedAttachment is an attachment left out of the sanitised copy.
+type removedAttachment struct {
+	Name   string
+	Reason string
+}
+
+// sanitizeAttachments splits parts into those that are kept and those removed, using the reports
+// of analyseForExecutables: a part goes if it, or anything in it, is dangerous.
+func sanitizeAttachments(parts []*enmime.Part, reports []AttachmentReport) (kept []*enmime.Part, removed []removedAttachment) {
+	for _, p := range parts {
+		reason := ""
+		if isHTMLAttachment(p) {
+			reason = "HTML attachment"
+		}
+		sum := sha256.Sum256(p.Content)
+		hash := hex.EncodeToString(sum[:])
+		for _, r := range reports {
+			if reason != "" {
+				break
+			}
+			// Unnamed parts (most inline images) all share the name "", so the content decides.
+			own := r.ContainedIn == "" && r.FileName == p.FileName && r.SHA256 == hash
+			inside := p.FileName != "" && (r.ContainedIn == p.FileName || strings.HasPrefix(r.ContainedIn, p.FileName+"/"))
+			if why := attachmentDanger(r); why != "" && inside {
+				reason = r.FileName + " inside: " + why
+			} else if own {
+				reason = why
+			}
+		}
+		if reason == "" {
+			kept = append(kept, p)
+			continue
+		}
+		name := p.FileName
+		if name == "" {
+			name = "unnamed " + p.ContentType + " part"
+		}
+		removed = append(removed, removedAttachment{Name: name, Reason: reason})
+	}
+	return kept, removed
+}
+
+// sanitizeNote is the notice put at the top of both bodies.
+func sanitizeNote(removed []removedAttachment, blockedImages int) string {
+	note := "[Sanitised copy: links are defanged and active content removed."
+	if blockedImages > 0 {
+		note += " " + strconv.Itoa(blockedImages) + " remote image(s) blocked."
+	}
+	for _, r := range removed {
+		note += fmt.Sprintf(" Removed attachment %s (%s).", r.Name, r.Reason)
+	}
+	return note + "]"
+}
+
+// sanitizeEmail builds the neutralised copy of env in dir and returns it.
+func sanitizeEmail(ctx context.Context, env *enmime.Envelope, dir string) ([]byte, []removedAttachment, error) {
+	ctx, cancel := context.WithTimeout(ctx, sanitizeTimeout)
+	defer cancel()
+	_, _, reports := analyseForExecutables(ctx, env)
+
+	clean := *env
+	var removed, removedOther []removedAttachment
+	clean.Attachments, removed = sanitizeAttachments(env.Attachments, reports)
+	clean.OtherParts, removedOther = sanitizeAttachments(env.OtherParts, reports)
+	removed = append(removed, removedOther...)
+	clean.Inlines, removedOther = sanitizeAttachments(env.Inlines, reports)
+	removed = append(removed, removedOther...)
+
+	newHTML, blocked := "", 0
+	if strings.TrimSpace(env.HTML) != "" {
+		newHTML, blocked = sanitizeHTML(env.HTML)
+	}
+	note := sanitizeNote(removed, blocked)
+	newPlain := note + "\n\n" + sanitizeText(env.Text)
+	if newHTML != "" {
+		newHTML = "<p>" + html.EscapeString(note) + "</p>\n" + newHTML
+	}
+
+	outPath := filepath.Join(dir, "sanitized.eml")
+	if err := updateEMLUniversal(outPath, &clean, newPlain, newHTML); err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(outPath)
+	return data, removed, err
+}
+
+// sanitizeHandler answers POST /sanitize-eml with the neutralised .eml as a download.
+func sanitizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	ctx := r.Context()
+	emlData, status, code, err := readEMLBody(w, r)
+	if err != nil {
+		writeJSONError(w, status, code, err.Error())
+		return
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(emlData))
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, errCodeInvalidEmail, "failed to parse email")
+		return
+	}
+	dir, err := os.MkdirTemp("", "email-checker-sanitize-*")
+	if err != nil {
+		slog.ErrorContext(ctx, "creating sandbox dir failed", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "failed to create sandbox directory")
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	data, removed, err := sanitizeEmail(ctx, env, dir)
+	if err != nil {
+		slog.ErrorContext(ctx, "sanitising email failed", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "failed to sanitise email")
+		return
+	}
+	slog.InfoContext(ctx, "sanitised email", "removed_attachments", len(removed))
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", `attachment; filename="sanitized.eml"`)
+	w.Header().Set("X-Removed-Attachments", strconv.Itoa(len(removed)))
+	_, _ = w.Write(data)
+}
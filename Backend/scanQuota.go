@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The live URL scanners have per-minute and per-day quotas (urlscan.io's free plan allows 60
+// scans a minute and 5,000 a day, VirusTotal's public API 4 lookups a minute and 500 a day).
+// An email with dozens of links used to start every scan at once, so most came back as 429
+// errors. With URLSCAN_QUOTA_PER_MINUTE/PER_DAY and VTOTAL_QUOTA_PER_MINUTE/PER_DAY the scans are
+// admitted in order within each scanner's quota: the rest wait their turn, streamed as
+// urlScanResult events with status "queued", and a link that can't be scanned before the
+// analysis times out, or once the day's quota is used up, is reported as "notScanned" rather
+// than as an error. A 429 from a scanner holds back its scans until its Retry-After has passed,
+// then the link is tried once more.
+
+// errScanQuota is returned for links the quota doesn't allow to be scanned in this analysis.
+var errScanQuota = errors.New("URL scan quota exhausted")
+
+// scanQuota admits scans within a per-minute and a per-day allowance; 0 disables either.
+type scanQuota struct {
+	mu          sync.Mutex
+	perMinute   int
+	perDay      int
+	slots       []time.Time // start times of the scans admitted in the last minute, in order
+	day         time.Time   // the UTC day dayCount counts
+	dayCount    int
+	pausedUntil time.Time
+}
+
+func newScanQuota(perMinute, perDay int) *scanQuota {
+	return &scanQuota{perMinute: perMinute, perDay: perDay}
+}
+
+// reserve books the earliest start the quota allows for a scan asked for at now.
+func (q *scanQuota) reserve(now time.Time) (time.Time, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	start := now
+	if q.pausedUntil.After(start) {
+		start = q.pausedUntil
+	}
+	if q.perMinute > 0 {
+		i := sort.Search(len(q.slots), func(i int) bool { return q.slots[i].After(now.Add(-time.Minute)) })
+		q.slots = q.slots[i:]
+		if len(q.slots) >= q.perMinute {
+			// The scan perMinute places back has to be a minute old before this one starts.
+			if t := q.slots[len(q.slots)-q.perMinute].Add(time.Minute); t.After(start) {
+				start = t
+			}
+		}
+	}
+	if q.perDay > 0 {
+		if day := start.UTC().Truncate(24 * time.Hour); !day.Equal(q.day) {
+			q.day, q.dayCount = day, 0
+		}
+		if q.dayCount >= q.perDay {
+			return time.Time{}, fmt.Errorf("%w: all %d scans for today are used", errScanQuota, q.perDay)
+		}
+		q.dayCount++
+	}
+	if q.perMinute > 0 {
+		i := sort.Search(len(q.slots), func(i int) bool { return q.slots[i].After(start) })
+		q.slots = append(q.slots, time.Time{})
+		copy(q.slots[i+1:], q.slots[i:])
+		q.slots[i] = start
+	}
+	return start, nil
+}
+
+// release gives back a reservation that wasn't used.
+func (q *scanQuota) release(start time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, s := range q.slots {
+		if s.Equal(start) {
+			q.slots = append(q.slots[:i], q.slots[i+1:]...)
+			break
+		}
+	}
+	if q.perDay > 0 && q.dayCount > 0 && start.UTC().Truncate(24*time.Hour).Equal(q.day) {
+		q.dayCount--
+	}
+}
+
+// pause holds back every scan until until, after the scanner answered 429.
+func (q *scanQuota) pause(until time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if until.After(q.pausedUntil) {
+		q.pausedUntil = until
+	}
+}
+
+// admit waits until the quota lets a scan start, calling queued first when it has to wait. It
+// returns errScanQuota when the scan can't start before ctx's deadline or today.
+func (q *scanQuota) admit(ctx context.Context, queued func(wait time.Duration)) error {
+	if q == nil {
+		return nil
+	}
+	start, err := q.reserve(time.Now())
+	if err != nil {
+		return err
+	}
+	wait := time.Until(start)
+	if wait <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && start.After(deadline) {
+		q.release(start)
+		return fmt.Errorf("%w: the next free slot is in %s, after the scan timeout", errScanQuota, wait.Round(time.Second))
+	}
+	if queued != nil {
+		queued(wait)
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		q.release(start)
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// scanLimitError is a scanner's 429 answer.
+type scanLimitError struct {
+	scanner    string
+	retryAfter time.Duration
+}
+
+func (e *scanLimitError) Error() string {
+	return fmt.Sprintf("%s rate limit reached, retry in %s", e.scanner, e.retryAfter)
+}
+
+// scanLimited turns a 429 response into a scanLimitError, reading how long to wait from
+// Retry-After or urlscan.io's X-Rate-Limit-Reset-After (seconds), defaulting to a minute.
+func scanLimited(scanner string, resp *http.Response) error {
+	retry := time.Minute
+	for _, h := range []string{"Retry-After", "X-Rate-Limit-Reset-After"} {
+		if s, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get(h))); err == nil && s > 0 {
+			retry = time.Duration(s) * time.Second
+			break
+		}
+	}
+	return &scanLimitError{scanner: scanner, retryAfter: retry}
+}
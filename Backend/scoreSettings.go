@@ -19,6 +19,16 @@ var AllChecks = []Check{
 		Description: "Sender domain not in database and no close matches",
 		Impact:      +17,
 	},
+	{
+		Name:        "DomainUnranked",
+		Description: "Sender domain not in database, no close matches, and not in the Tranco top million",
+		Impact:      +8,
+	},
+	{
+		Name:        "DeceptiveSubdomain",
+		Description: "Sender's subdomain shows a known domain or brand in front of an unrelated domain (e.g. paypal.com.security-update.net)",
+		Impact:      0,
+	},
 	{
 		Name:        "DomainImpersonation",
 		Description: "Sender domain similar to a known domain (likely impersonation)",
@@ -29,6 +39,21 @@ var AllChecks = []Check{
 		Description: "Sender is from a freeMail (e.g., Gmail, Outlook) which is not professional for business",
 		Impact:      +12,
 	},
+	{
+		Name:        "SenderDomainReceivesMail",
+		Description: "Sender domain exists, isn't parked and has MX (or A) records able to receive mail",
+		Impact:      3,
+	},
+	{
+		Name:        "SenderIPListed",
+		Description: "The IP that delivered the email is listed on a DNS blocklist (e.g. Spamhaus)",
+		Impact:      5,
+	},
+	{
+		Name:        "ExecutiveImpersonation",
+		Description: "Sender's display name isn't one of the tenant's executives while the address is outside its domains",
+		Impact:      15,
+	},
 	{
 		Name:        "CompanyIdentified",
 		Description: "NLP (Gemini) successfully identifies claimed company",
@@ -49,36 +74,255 @@ var AllChecks = []Check{
 		Description: "Phone number is valid and matches the company",
 		Impact:      4,
 	},
+	{
+		Name:        "CorrectContactEmail",
+		Description: "Every email address given in the body is on one of the claimed company's domains",
+		Impact:      4,
+	},
+	{
+		Name:        "CorrectPostalAddress",
+		Description: "A postal address given in the body is the claimed company's, according to Google Places",
+		Impact:      3,
+	},
 	{
 		Name:        "MaliciousURLFound",
 		Description: "A URL in the email was identified as malicious or suspicious",
 		Impact:      10,
 	},
+	{
+		Name:        "LinkTextMismatch",
+		Description: "A link's visible text shows a different domain than the one it actually points to",
+		Impact:      4,
+	},
+	{
+		Name:        "URLHeuristics",
+		Description: "No links use IP-address hosts, embedded credentials, javascript:/data: schemes or excessive subdomains",
+		Impact:      5,
+	},
 	{
 		Name:        "ExecutableFileFound",
 		Description: "A file in the email was identified as an executable",
 		Impact:      3,
 	},
+	{
+		Name:        "OfficeMacroFound",
+		Description: "An attached Office document contains VBA macros",
+		Impact:      8,
+	},
+	{
+		Name:        "HTMLAttachmentPhishing",
+		Description: "An attached HTML page contains a login form, obfuscated JavaScript or unrealistic content",
+		Impact:      6,
+	},
+	{
+		Name:        "UnicodeObfuscation",
+		Description: "The subject, sender and body have no bidi overrides, lookalike-script words, styled letters or hidden characters",
+		Impact:      5,
+	},
+	{
+		Name:        "EmbeddedCredentialForm",
+		Description: "The email's HTML contains no form asking for a password or card details",
+		Impact:      6,
+	},
+	{
+		Name:        "EmailScript",
+		Description: "The email's HTML contains no <script> elements",
+		Impact:      4,
+	},
+	{
+		Name:        "MetaRefreshRedirect",
+		Description: "The email's HTML doesn't redirect with a meta refresh",
+		Impact:      4,
+	},
+	{
+		Name:        "BaseTagRewrite",
+		Description: "The email's HTML has no <base href> rewriting its relative links",
+		Impact:      3,
+	},
+	{
+		Name:        "CalendarInvitePhishing",
+		Description: "A calendar invite carries links but its organizer isn't from the sending domain",
+		Impact:      3,
+	},
+	{
+		Name:        "CryptoOrGiftCardRequest",
+		Description: "The email contains no cryptocurrency wallet addresses or requests to buy gift cards",
+		Impact:      10,
+	},
+	{
+		Name:        "VisualImpersonation",
+		Description: "The rendered email looks like a known brand whose domains don't include the sender's; a penalty on the rendered score, scaled by the AI's confidence",
+		Impact:      -15,
+	},
+	{
+		Name:        "BankDetailChange",
+		Description: "The email gives bank details and says payment details have changed (invoice fraud); a penalty, not part of the maximum score",
+		Impact:      -25,
+	},
+	{
+		Name:        "YARARuleMatch",
+		Description: "No operator-supplied YARA rule matches an attachment or the HTML body",
+		Impact:      8,
+	},
+	{
+		Name:        "ScriptedRuleFinding",
+		Description: "No operator-supplied scripted rule reports a finding",
+		Impact:      5,
+	},
+	{
+		Name:        "HiddenContent",
+		Description: "The email hides no text from its reader (white-on-white or zero-size text, hidden blocks, extreme letter-spacing, zero-width characters inside words)",
+		Impact:      5,
+	},
+	{
+		Name:        "ObfuscationPadding",
+		Description: "The HTML doesn't hide text or links behind dozens of empty blocks or a giant fixed-height block",
+		Impact:      4,
+	},
+	{
+		Name:        "TrackingPixelsFound",
+		Description: "The email contains many invisible remote tracking images (typical of bulk/spam campaigns)",
+		Impact:      2,
+	},
+	{
+		Name:        "SpamEngineVerdict",
+		Description: "The local SpamAssassin or Rspamd doesn't class the email as spam",
+		Impact:      5,
+	},
+	{
+		Name:        "UpstreamSpamVerdict",
+		Description: "No spam filter the email passed through before arriving marked it as spam",
+		Impact:      4,
+	},
+	{
+		Name:        "ListUnsubscribeMatchesSender",
+		Description: "The List-Unsubscribe link belongs to the sender or its email service provider",
+		Impact:      2,
+	},
+	{
+		Name:        "RemoteContentUnrelated",
+		Description: "The email's remote images, stylesheets and fonts don't come only from domains unrelated to the sender",
+		Impact:      3,
+	},
+	{
+		Name:        "ImagePolyglot",
+		Description: "No image attachment has an archive, code or links appended or is far larger than its pixels need",
+		Impact:      5,
+	},
+	{
+		Name:        "ImageOnlyEmail",
+		Description: "The email's message isn't carried only by images while the body says next to nothing",
+		Impact:      4,
+	},
+	{
+		Name:        "SendingTimeAnomaly",
+		Description: "The Date header agrees with the Received timestamps and the email wasn't sent in the small hours of the sender's timezone",
+		Impact:      2,
+	},
+}
+
+// checkToggles are the per-request switches (query parameters) for each group of checks.
+var checkToggles = []string{
+	"checkDomain", "checkUrls", "checkAttachments", "checkTextAnalysis", "checkRenderedAnalysis",
+	"checkTracking", "checkHtmlAttachments", "checkCalendar", "checkSenderIP", "checkPaymentScam",
+	"checkYara", "checkScripts", "checkExecutives", "checkHiddenContent", "checkForms",
+	"checkActiveContent", "checkUnicode", "checkMailingList",
+	"checkSpamHeaders", "checkSpamEngine", "checkSendTime", "checkImageText",
+}
+
+func isCheckToggle(name string) bool {
+	for _, t := range checkToggles {
+		if t == name {
+			return true
+		}
+	}
+	return false
 }
 
-// MaxScoreFor calculates the maximum attainable score for the enabled checks map.
-func MaxScoreFor(enabled map[string]bool) float64 {
+// MaxScoreFor calculates the maximum attainable score for the enabled checks map, using the
+// profile's weights (nil for the server-wide ones).
+func MaxScoreFor(enabled map[string]bool, p *Profile) float64 {
 	if enabled == nil {
 		enabled = map[string]bool{}
 	}
 
 	total := 0
 	if isEnabled(enabled, "checkDomain") {
-		total += maxDomainImpact()
+		total += maxDomainImpact(p)
+		total += positiveImpact(p, "SenderDomainReceivesMail")
 	}
 	if isEnabled(enabled, "checkUrls") {
-		total += positiveImpact("MaliciousURLFound")
+		if urlScanningAvailable() {
+			total += positiveImpact(p, "MaliciousURLFound")
+		}
+		total += positiveImpact(p, "LinkTextMismatch")
+		total += positiveImpact(p, "URLHeuristics")
 	}
 	if isEnabled(enabled, "checkAttachments") {
-		total += positiveImpact("ExecutableFileFound")
+		total += positiveImpact(p, "ExecutableFileFound")
+		total += positiveImpact(p, "OfficeMacroFound")
+		total += positiveImpact(p, "ImagePolyglot")
+	}
+	if isEnabled(enabled, "checkTracking") {
+		total += positiveImpact(p, "TrackingPixelsFound")
+		total += positiveImpact(p, "RemoteContentUnrelated")
+	}
+	if isEnabled(enabled, "checkHiddenContent") {
+		total += positiveImpact(p, "HiddenContent")
+		total += positiveImpact(p, "ObfuscationPadding")
+	}
+	if isEnabled(enabled, "checkHtmlAttachments") {
+		total += positiveImpact(p, "HTMLAttachmentPhishing")
+	}
+	if isEnabled(enabled, "checkForms") {
+		total += positiveImpact(p, "EmbeddedCredentialForm")
+	}
+	if isEnabled(enabled, "checkSpamEngine") && spamEngineEnabled() {
+		total += positiveImpact(p, "SpamEngineVerdict")
+	}
+	if isEnabled(enabled, "checkSpamHeaders") {
+		total += positiveImpact(p, "UpstreamSpamVerdict")
+	}
+	if isEnabled(enabled, "checkMailingList") {
+		total += positiveImpact(p, "ListUnsubscribeMatchesSender")
+	}
+	if isEnabled(enabled, "checkImageText") {
+		total += positiveImpact(p, "ImageOnlyEmail")
+	}
+	if isEnabled(enabled, "checkSendTime") {
+		total += positiveImpact(p, "SendingTimeAnomaly")
+	}
+	if isEnabled(enabled, "checkUnicode") {
+		total += positiveImpact(p, "UnicodeObfuscation")
+	}
+	if isEnabled(enabled, "checkActiveContent") {
+		total += positiveImpact(p, "EmailScript") + positiveImpact(p, "MetaRefreshRedirect") + positiveImpact(p, "BaseTagRewrite")
+	}
+	if isEnabled(enabled, "checkCalendar") {
+		total += positiveImpact(p, "CalendarInvitePhishing")
+	}
+	if isEnabled(enabled, "checkSenderIP") {
+		total += positiveImpact(p, "SenderIPListed")
+	}
+	if isEnabled(enabled, "checkExecutives") && executiveDirectoryFor(p) != nil {
+		total += positiveImpact(p, "ExecutiveImpersonation")
+	}
+	if isEnabled(enabled, "checkPaymentScam") {
+		total += positiveImpact(p, "CryptoOrGiftCardRequest")
+	}
+	if isEnabled(enabled, "checkYara") && yaraEnabled() {
+		total += positiveImpact(p, "YARARuleMatch")
+	}
+	if isEnabled(enabled, "checkScripts") && scriptRulesEnabled() {
+		total += positiveImpact(p, "ScriptedRuleFinding")
 	}
 	if isEnabled(enabled, "checkTextAnalysis") || isEnabled(enabled, "checkRenderedAnalysis") {
-		total += textAnalysisImpact()
+		total += textAnalysisImpact(p)
+	}
+	for _, plugin := range checkPlugins {
+		if isEnabled(enabled, pluginToggle(plugin.Name())) {
+			total += positiveImpact(p, plugin.Name())
+		}
 	}
 	return float64(total)
 }
@@ -91,29 +335,37 @@ func isEnabled(enabled map[string]bool, key string) bool {
 	return val
 }
 
-func maxDomainImpact() int {
+func maxDomainImpact(p *Profile) int {
 	maxScore := 0
 	for _, name := range []string{"DomainExactMatch", "DomainNoSimilarity", "freeMailMatch"} {
-		if impact := positiveImpact(name); impact > maxScore {
+		if impact := positiveImpact(p, name); impact > maxScore {
 			maxScore = impact
 		}
 	}
 	return maxScore
 }
 
-func textAnalysisImpact() int {
+// textAnalysisImpact is the most the Gemini content checks can award. Without Gemini there are
+// none; without Google Search phone numbers can't be validated, and without a Places key postal
+// addresses can't.
+func textAnalysisImpact(p *Profile) int {
+	if !geminiEnabled {
+		return 0
+	}
 	sum := 0
-	for _, name := range []string{"CompanyIdentified", "CompanyVerified", "RealismCheck", "CorrectPhoneNumber"} {
-		sum += positiveImpact(name)
+	for _, name := range []string{"CompanyIdentified", "CompanyVerified", "RealismCheck"} {
+		sum += positiveImpact(p, name)
+	}
+	if googleSearchEnabled {
+		sum += positiveImpact(p, "CorrectPhoneNumber")
+	}
+	sum += positiveImpact(p, "CorrectContactEmail")
+	if placesEnabled() {
+		sum += positiveImpact(p, "CorrectPostalAddress")
 	}
 	return sum
 }
 
-func positiveImpact(name string) int {
-	for _, c := range AllChecks {
-		if c.Name == name && c.Impact > 0 {
-			return c.Impact
-		}
-	}
-	return 0
+func positiveImpact(p *Profile, name string) int {
+	return max(p.impact(name), 0)
 }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Operators can add their own detections without rebuilding the server: every .star file in
+// SCRIPT_RULES_DIR is a Starlark script defining check(email), which is called for each email and
+// returns None, a finding, or a list of findings. A finding is a dict:
+//
+//	{"message": "Invoice from a new supplier", "scoreImpact": -3, "rule": "new-supplier"}
+//
+// scoreImpact is the (negative) number of ScriptedRuleFinding points the finding costs, the whole
+// check by default; rule defaults to the script's name. The scripts are read again for every
+// email, so a new or changed file takes effect on the next analysis.
+
+// ScriptFinding is one finding reported by a script.
+type ScriptFinding struct {
+	Rule        string `json:"rule"`
+	Script      string `json:"script"`
+	Message     string `json:"message"`
+	ScoreImpact int    `json:"scoreImpact"`
+}
+
+type ScriptAnalysisResult struct {
+	Findings    []ScriptFinding `json:"findings"`
+	Scripts     int             `json:"scripts"` // scripts run
+	Message     string          `json:"message"`
+	ScoreImpact int             `json:"scoreImpact"`
+	Errors      []string        `json:"errors,omitempty"` // scripts that failed, with the reason
+	Error       string          `json:"error,omitempty"`
+}
+
+const (
+	// scriptTimeout and scriptMaxSteps bound one script's run over one email.
+	scriptTimeout  = 2 * time.Second
+	scriptMaxSteps = 10_000_000
+)
+
+// scriptRulesEnabled reports whether a scripts directory is configured.
+func scriptRulesEnabled() bool {
+	return scriptRulesDir != ""
+}
+
+// scriptRuleFiles lists the .star files in dir, sorted.
+func scriptRuleFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.EqualFold(filepath.Ext(e.Name()), ".star") {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// scriptName is how findings and errors refer to a script: its file name without .star.
+func scriptName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+}
+
+// scriptBuiltins are the functions scripts get besides Starlark's own.
+var scriptBuiltins = starlark.StringDict{
+	"re_search": starlark.NewBuiltin("re_search", scriptRESearch),
+}
+
+// scriptRESearch is re_search(pattern, s): whether the Go regular expression matches s.
+func scriptRESearch(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, s string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &pattern, &s); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.Bool(re.MatchString(s)), nil
+}
+
+// loadScript runs a script's top level and returns its check function.
+func loadScript(thread *starlark.Thread, file string) (starlark.Callable, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	globals, err := starlark.ExecFile(thread, filepath.Base(file), src, scriptBuiltins)
+	if err != nil {
+		return nil, err
+	}
+	check, ok := globals["check"].(starlark.Callable)
+	if !ok {
+		return nil, errors.New("it doesn't define check(email)")
+	}
+	return check, nil
+}
+
+// validateScriptRules loads every script in dir, for the config check at startup.
+func validateScriptRules(dir string) error {
+	files, err := scriptRuleFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%s has no .star files", dir)
+	}
+	for _, file := range files {
+		thread := &starlark.Thread{Name: file}
+		thread.SetMaxExecutionSteps(scriptMaxSteps)
+		if _, err := loadScript(thread, file); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(file), err)
+		}
+	}
+	return nil
+}
+
+// scriptEmail is the email argument scripts get.
+func scriptEmail(Email EmailData, env *enmime.Envelope, countryCode string) starlark.Value {
+	strs := func(values []string) *starlark.List {
+		list := make([]starlark.Value, len(values))
+		for i, v := range values {
+			list[i] = starlark.String(v)
+		}
+		return starlark.NewList(list)
+	}
+
+	headers := starlark.NewDict(len(env.Root.Header))
+	for name, values := range env.Root.Header {
+		_ = headers.SetKey(starlark.String(strings.ToLower(name)), strs(values))
+	}
+	links := make([]string, 0)
+	for link := range collectEmailURLs(Email) {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+	attachments := make([]starlark.Value, len(Email.AttachmentHashes))
+	for i, a := range Email.AttachmentHashes {
+		attachments[i] = starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"name":        starlark.String(a.FileName),
+			"contentType": starlark.String(a.ContentType),
+			"size":        starlark.MakeInt(a.Size),
+			"sha256":      starlark.String(a.SHA256),
+		})
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"subject":     starlark.String(Email.Subject),
+		"sender":      starlark.String(Email.From),
+		"domain":      starlark.String(Email.Domain),
+		"text":        starlark.String(Email.Text),
+		"html":        starlark.String(Email.HTML),
+		"links":       strs(links),
+		"recipients":  strs(Email.Recipients),
+		"originIP":    starlark.String(Email.OriginIP),
+		"language":    starlark.String(Email.Language.Code),
+		"countryCode": starlark.String(countryCode),
+		"headers":     headers,
+		"attachments": starlark.NewList(attachments),
+	})
+}
+
+// scriptFindings reads what check(email) returned.
+func scriptFindings(v starlark.Value, script string, checkImpact int) ([]ScriptFinding, error) {
+	var items []starlark.Value
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *starlark.Dict:
+		items = []starlark.Value{v}
+	case *starlark.List:
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, v.Index(i))
+		}
+	default:
+		return nil, fmt.Errorf("check returned %s, want None, a dict or a list of dicts", v.Type())
+	}
+
+	findings := make([]ScriptFinding, 0, len(items))
+	for _, item := range items {
+		d, ok := item.(*starlark.Dict)
+		if !ok {
+			return nil, fmt.Errorf("finding is a %s, want a dict", item.Type())
+		}
+		f := ScriptFinding{Rule: script, Script: script, ScoreImpact: -checkImpact}
+		message, _, _ := d.Get(starlark.String("message"))
+		text, ok := starlark.AsString(message)
+		if !ok || strings.TrimSpace(text) == "" {
+			return nil, errors.New(`finding has no "message"`)
+		}
+		f.Message = text
+		if rule, found, _ := d.Get(starlark.String("rule")); found {
+			if s, ok := starlark.AsString(rule); ok && s != "" {
+				f.Rule = s
+			}
+		}
+		if impact, found, _ := d.Get(starlark.String("scoreImpact")); found {
+			var n int
+			if err := starlark.AsInt(impact, &n); err != nil {
+				return nil, fmt.Errorf("scoreImpact: %w", err)
+			}
+			f.ScoreImpact = min(n, 0) // findings can only cost points
+		}
+		findings = append(findings, f)
+	}
+	return findings, nil
+}
+
+// runScript runs one script's check over email.
+func runScript(ctx context.Context, file string, email starlark.Value, checkImpact int) ([]ScriptFinding, error) {
+	ctx, cancel := context.WithTimeout(ctx, scriptTimeout)
+	defer cancel()
+	thread := &starlark.Thread{
+		Name: file,
+		Print: func(_ *starlark.Thread, msg string) {
+			slog.DebugContext(ctx, "script rule output", "script", file, "msg", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	stop := context.AfterFunc(ctx, func() { thread.Cancel(context.Cause(ctx).Error()) })
+	defer stop()
+
+	check, err := loadScript(thread, file)
+	if err != nil {
+		return nil, err
+	}
+	v, err := starlark.Call(thread, check, starlark.Tuple{email}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return scriptFindings(v, scriptName(file), checkImpact)
+}
+
+func performScriptAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, ctx context.Context, Email EmailData, env *enmime.Envelope, countryCode string) {
+	defer wg.Done()
+	defer trackDependency(ctx, "scripts", time.Now())
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "ScriptedRuleFinding" {
+			check = c
+			break
+		}
+	}
+	result := ScriptAnalysisResult{Findings: []ScriptFinding{}}
+	files, err := scriptRuleFiles(scriptRulesDir)
+	if err != nil || len(files) == 0 {
+		slog.ErrorContext(ctx, "reading script rules failed", "dir", scriptRulesDir, "err", err)
+		result.Error = "Script rules could not be read."
+		result.Message = "The scripted rules could not be run."
+		ch <- CheckResult{EventName: "scriptAnalysis", Payload: result}
+		return
+	}
+
+	email := scriptEmail(Email, env, countryCode)
+	email.Freeze() // scripts share it
+	penalty := 0
+	for _, file := range files {
+		findings, err := runScript(ctx, file, email, check.Impact)
+		if err != nil {
+			slog.WarnContext(ctx, "script rule failed", "script", filepath.Base(file), "err", err)
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", scriptName(file), err))
+			continue
+		}
+		result.Scripts++
+		for _, f := range findings {
+			penalty -= f.ScoreImpact
+		}
+		result.Findings = append(result.Findings, findings...)
+	}
+
+	if len(result.Findings) > 0 {
+		rules := make([]string, len(result.Findings))
+		for i, f := range result.Findings {
+			rules[i] = f.Rule
+		}
+		result.Message = fmt.Sprintf("%d scripted rule finding(s): %s.", len(result.Findings), strings.Join(rules, ", "))
+	} else {
+		result.Message = "No scripted rule reported a finding."
+	}
+	if len(result.Errors) > 0 {
+		// As with YARA, a broken rule set doesn't vouch for the email.
+		result.Error = fmt.Sprintf("%d of %d script(s) failed.", len(result.Errors), len(files))
+	} else {
+		result.ScoreImpact = max(check.Impact-penalty, 0)
+	}
+	ch <- CheckResult{EventName: "scriptAnalysis", Payload: result}
+}
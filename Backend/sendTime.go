@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // countryTimezones must load on hosts (and Windows) without a zoneinfo database
+
+	"github.com/jhillyerd/enmime"
+)
+
+// Three clocks say when an email was sent: the Date header the sender's client wrote, the
+// timestamp of the oldest Received header (the sender's first server) and that of the newest
+// (the recipient's own server, which the sender can't forge). Phishing kits often reuse a Date
+// from a template or stamp one days out, and campaigns run from other continents land in the
+// small hours of the organisation they pretend to be. A Date well ahead of delivery or days
+// before the message left, or a send between midnight and 5am in the claimed organisation's
+// timezone (from the sender domain's country, else the Date header's own offset), fails
+// SendingTimeAnomaly. Newsletters and automated messages are scheduled, so their hour isn't held
+// against them.
+
+const (
+	sendTimeFutureSkew = 2 * time.Hour  // Date after delivery, allowing for clock drift
+	sendTimePastSkew   = 72 * time.Hour // Date before the message left its first server
+	sendTimeOddHours   = 5              // sends before 05:00 local time are odd
+)
+
+// countryTimezones is a representative timezone per country code of claimedCountry; countries
+// spanning several (US, CA, AU, BR, RU) get their most populous business one.
+var countryTimezones = map[string]string{
+	"GB": "Europe/London", "IE": "Europe/Dublin", "FR": "Europe/Paris", "DE": "Europe/Berlin",
+	"NL": "Europe/Amsterdam", "BE": "Europe/Brussels", "LU": "Europe/Luxembourg", "CH": "Europe/Zurich",
+	"AT": "Europe/Vienna", "IT": "Europe/Rome", "ES": "Europe/Madrid", "PT": "Europe/Lisbon",
+	"DK": "Europe/Copenhagen", "SE": "Europe/Stockholm", "NO": "Europe/Oslo", "FI": "Europe/Helsinki",
+	"PL": "Europe/Warsaw", "CZ": "Europe/Prague", "HU": "Europe/Budapest", "RO": "Europe/Bucharest",
+	"GR": "Europe/Athens", "TR": "Europe/Istanbul", "UA": "Europe/Kyiv", "RU": "Europe/Moscow",
+	"IL": "Asia/Jerusalem", "AE": "Asia/Dubai", "SA": "Asia/Riyadh", "IN": "Asia/Kolkata",
+	"PK": "Asia/Karachi", "SG": "Asia/Singapore", "MY": "Asia/Kuala_Lumpur", "HK": "Asia/Hong_Kong",
+	"CN": "Asia/Shanghai", "TW": "Asia/Taipei", "JP": "Asia/Tokyo", "KR": "Asia/Seoul",
+	"PH": "Asia/Manila", "ID": "Asia/Jakarta", "TH": "Asia/Bangkok", "VN": "Asia/Ho_Chi_Minh",
+	"AU": "Australia/Sydney", "NZ": "Pacific/Auckland", "ZA": "Africa/Johannesburg", "NG": "Africa/Lagos",
+	"KE": "Africa/Nairobi", "EG": "Africa/Cairo", "US": "America/New_York", "CA": "America/Toronto",
+	"MX": "America/Mexico_City", "BR": "America/Sao_Paulo", "AR": "America/Argentina/Buenos_Aires",
+	"CL": "America/Santiago", "CO": "America/Bogota",
+}
+
+// SendTimes are the timestamps of the Date header and the oldest and newest Received headers;
+// zero when missing or unparsable.
+type SendTimes struct {
+	Date          time.Time
+	FirstReceived time.Time
+	Delivered     time.Time
+}
+
+// readSendTimes reads the Date header and the Received timestamps of env.
+func readSendTimes(env *enmime.Envelope) SendTimes {
+	var t SendTimes
+	if d, err := mail.ParseDate(strings.TrimSpace(env.GetHeader("Date"))); err == nil {
+		t.Date = d
+	}
+	received := env.GetHeaderValues("Received") // newest first
+	for _, h := range received {
+		if ts := receivedTime(h); !ts.IsZero() {
+			if t.Delivered.IsZero() {
+				t.Delivered = ts
+			}
+			t.FirstReceived = ts
+		}
+	}
+	return t
+}
+
+// receivedTime parses the timestamp after the last ";" of a Received header.
+func receivedTime(h string) time.Time {
+	i := strings.LastIndex(h, ";")
+	if i < 0 {
+		return time.Time{}
+	}
+	d, err := mail.ParseDate(strings.Join(strings.Fields(h[i+1:]), " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return d
+}
+
+// senderTimezone returns the timezone of the organisation the sender domain claims, or the Date
+// header's own offset, with a label for the report. It returns nil when there is neither.
+func senderTimezone(domain string, date time.Time) (*time.Location, string) {
+	if name := countryTimezones[claimedCountry(domain)]; name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc, name
+		}
+	}
+	if date.IsZero() {
+		return nil, ""
+	}
+	return date.Location(), "the Date header's offset (" + date.Format("-0700") + ")"
+}
+
+// SendTimeResult is the sendTimeAnalysis event.
+type SendTimeResult struct {
+	Date          string   `json:"date,omitempty"` // RFC 3339, as written
+	FirstReceived string   `json:"firstReceived,omitempty"`
+	Delivered     string   `json:"delivered,omitempty"`
+	DateSkew      string   `json:"dateSkew,omitempty"` // Date minus the first Received timestamp
+	Timezone      string   `json:"timezone,omitempty"`
+	LocalTime     string   `json:"localTime,omitempty"` // when it was sent, in Timezone
+	Anomalies     []string `json:"anomalies"`           // dateInFuture, dateInPast or oddHour
+	Message       string   `json:"message"`
+	ScoreImpact   int      `json:"scoreImpact"`
+}
+
+func performSendTimeAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "SendingTimeAnomaly" {
+			check = c
+			break
+		}
+	}
+	t := Email.SendTime
+	result := SendTimeResult{Anomalies: []string{}}
+	for _, f := range []struct {
+		to *string
+		at time.Time
+	}{{&result.Date, t.Date}, {&result.FirstReceived, t.FirstReceived}, {&result.Delivered, t.Delivered}} {
+		if !f.at.IsZero() {
+			*f.to = f.at.Format(time.RFC3339)
+		}
+	}
+
+	var parts []string
+	if t.Date.IsZero() {
+		parts = append(parts, "The email has no valid Date header.")
+	}
+	left := t.FirstReceived
+	if left.IsZero() {
+		left = t.Delivered
+	}
+	if !t.Date.IsZero() && !left.IsZero() {
+		skew := t.Date.Sub(left)
+		result.DateSkew = skew.Round(time.Minute).String()
+		switch {
+		case !t.Delivered.IsZero() && t.Date.Sub(t.Delivered) > sendTimeFutureSkew:
+			result.Anomalies = append(result.Anomalies, "dateInFuture")
+			parts = append(parts, fmt.Sprintf("The Date header is %s after the email was delivered.", humanDuration(t.Date.Sub(t.Delivered))))
+		case -skew > sendTimePastSkew:
+			result.Anomalies = append(result.Anomalies, "dateInPast")
+			parts = append(parts, fmt.Sprintf("The Date header is %s before the email left its first server.", humanDuration(-skew)))
+		}
+	}
+
+	sent := t.FirstReceived
+	if sent.IsZero() {
+		sent = t.Date
+	}
+	if loc, label := senderTimezone(Email.Domain, t.Date); loc != nil && !sent.IsZero() {
+		local := sent.In(loc)
+		result.Timezone = label
+		result.LocalTime = local.Format("Mon 2 Jan 15:04 MST")
+		scheduled := Email.MailingList.bulk() || Email.Automated != nil
+		if h := local.Hour(); h < sendTimeOddHours {
+			if scheduled {
+				parts = append(parts, fmt.Sprintf("Sent at %s in %s, which is usual for bulk or automated mail.", local.Format("15:04"), label))
+			} else {
+				result.Anomalies = append(result.Anomalies, "oddHour")
+				parts = append(parts, fmt.Sprintf("Sent at %s in %s, outside business hours for the claimed sender.", local.Format("15:04"), label))
+			}
+		}
+	}
+
+	if len(result.Anomalies) == 0 {
+		result.ScoreImpact = check.Impact
+		if len(parts) == 0 {
+			parts = append(parts, "The Date header agrees with the Received timestamps and the email was sent at a normal hour.")
+		}
+	}
+	result.Message = strings.Join(parts, " ")
+	ch <- CheckResult{EventName: "sendTimeAnalysis", Payload: result}
+}
+
+// humanDuration writes d in days or hours, e.g. "3 days" or "5h".
+func humanDuration(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	}
+	return d.Round(time.Minute).String()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverOptions are the listener settings given on the command line. Each flag falls back to an
+// environment variable so containers can be configured without changing the entrypoint.
+type serverOptions struct {
+	addr            string
+	tlsCert         string
+	tlsKey          string
+	autocertDomains []string
+	autocertEmail   string
+	autocertCache   string
+	httpAddr        string
+	importCompanyDB string // load this SQLite company database into COMPANY_DB_DSN and exit
+	mock            bool   // answer outgoing HTTP requests from the fixtures in mockDir
+	mockRecord      bool   // save real responses into mockDir
+	mockDir         string
+	corpus          corpusOptions // with corpus.dir set, run the golden corpus instead of serving
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func parseServerFlags() serverOptions {
+	var opts serverOptions
+	var domains string
+	flag.StringVar(&opts.addr, "addr", envOr("LISTEN_ADDR", ":8080"), "address to serve the API on")
+	flag.StringVar(&opts.tlsCert, "tls-cert", os.Getenv("TLS_CERT_FILE"), "PEM certificate file; serves HTTPS when set with -tls-key")
+	flag.StringVar(&opts.tlsKey, "tls-key", os.Getenv("TLS_KEY_FILE"), "PEM private key file for -tls-cert")
+	flag.StringVar(&domains, "autocert", os.Getenv("AUTOCERT_DOMAINS"), "comma-separated domains to get Let's Encrypt certificates for")
+	flag.StringVar(&opts.autocertEmail, "autocert-email", os.Getenv("AUTOCERT_EMAIL"), "contact email for the Let's Encrypt account")
+	flag.StringVar(&opts.autocertCache, "autocert-cache", envOr("AUTOCERT_CACHE", "autocert-cache"), "directory where issued certificates are kept")
+	flag.StringVar(&opts.httpAddr, "http-addr", envOr("AUTOCERT_HTTP_ADDR", ":80"), "with -autocert, plain HTTP address for ACME challenges and redirects (empty disables)")
+	flag.StringVar(&opts.importCompanyDB, "import-company-db", "", "load a SQLite company database (e.g. wikidata_websites4.db) into the Postgres or MySQL database of COMPANY_DB_DSN, then exit")
+	flag.BoolVar(&opts.mock, "mock", os.Getenv("MOCK_MODE") == "TRUE", "serve Gemini, Google Search, URL scanners and remote images from the fixtures in -mock-dir instead of the network")
+	flag.BoolVar(&opts.mockRecord, "mock-record", false, "make real requests and save their responses as fixtures in -mock-dir")
+	flag.StringVar(&opts.mockDir, "mock-dir", envOr("MOCK_DIR", "mocks"), "directory of mock fixtures")
+	flag.StringVar(&opts.corpus.dir, "corpus", "", "analyse every .eml in this directory, compare the results with -golden-dir, report drift and exit")
+	flag.StringVar(&opts.corpus.goldenDir, "golden-dir", envOr("GOLDEN_DIR", "golden"), "directory of golden results for -corpus")
+	flag.BoolVar(&opts.corpus.update, "update-golden", false, "with -corpus, save the current results as the golden files")
+	flag.Float64Var(&opts.corpus.tolerance, "golden-tolerance", 0.5, "with -corpus, how many percentage points a score may move before it counts as drift")
+	flag.Parse()
+	opts.autocertDomains = splitList(domains)
+	return opts
+}
+
+// serve runs the API on the default mux: over HTTPS with the given certificate, over HTTPS with
+// certificates from Let's Encrypt, or over plain HTTP for use behind a TLS-terminating proxy.
+func serve(opts serverOptions) error {
+	server := &http.Server{
+		Addr:              opts.addr,
+		ReadHeaderTimeout: 10 * time.Second,
+		// No write timeout: analyses stream over SSE for as long as the scanners take.
+	}
+
+	switch {
+	case len(opts.autocertDomains) > 0:
+		if opts.tlsCert != "" || opts.tlsKey != "" {
+			return errors.New("-autocert cannot be combined with -tls-cert/-tls-key")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(opts.autocertDomains...),
+			Cache:      autocert.DirCache(opts.autocertCache),
+			Email:      opts.autocertEmail,
+		}
+		server.TLSConfig = m.TLSConfig()
+		if opts.httpAddr != "" {
+			// HTTP-01 challenges; everything else is redirected to HTTPS.
+			go func() {
+				challenge := &http.Server{Addr: opts.httpAddr, Handler: m.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+				if err := challenge.ListenAndServe(); err != nil {
+					slog.Error("ACME challenge listener stopped", "addr", opts.httpAddr, "err", err)
+				}
+			}()
+		}
+		slog.Info("starting server", "addr", opts.addr, "tls", "autocert", "domains", opts.autocertDomains)
+		return server.ListenAndServeTLS("", "")
+
+	case opts.tlsCert != "" || opts.tlsKey != "":
+		if opts.tlsCert == "" || opts.tlsKey == "" {
+			return errors.New("-tls-cert and -tls-key must be given together")
+		}
+		// Fail at startup rather than on the first handshake.
+		if _, err := tls.LoadX509KeyPair(opts.tlsCert, opts.tlsKey); err != nil {
+			return err
+		}
+		slog.Info("starting server", "addr", opts.addr, "tls", "file", "cert", opts.tlsCert)
+		return server.ListenAndServeTLS(opts.tlsCert, opts.tlsKey)
+
+	default:
+		slog.Info("starting server", "addr", opts.addr)
+		return server.ListenAndServe()
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every completed analysis can be forwarded as a one-line summary to the organisation's SIEM: as
+// RFC 5424 syslog carrying JSON or CEF (SIEM_SYSLOG_ADDRESS, SIEM_FORMAT), and/or as an event to a
+// Splunk HTTP Event Collector (SPLUNK_HEC_URL, SPLUNK_HEC_TOKEN). Forwarding runs in the
+// background once the analysis is saved and a failure is only logged.
+
+// SIEMSummary is what is forwarded for one analysis.
+type SIEMSummary struct {
+	AnalysisID         string         `json:"analysisId"`
+	Time               time.Time      `json:"time"`
+	APIKey             string         `json:"apiKey"`
+	Profile            string         `json:"profile,omitempty"`
+	From               string         `json:"from"`
+	Domain             string         `json:"domain"`
+	Subject            string         `json:"subject"`
+	OriginIP           string         `json:"originIp,omitempty"`
+	NormalPercentage   float64        `json:"normalPercentage"`
+	RenderedPercentage float64        `json:"renderedPercentage"`
+	Verdict            string         `json:"verdict"`          // "High Risk", "Suspicious" or "Looks Safe", as in the extension
+	Intent             string         `json:"intent,omitempty"` // Gemini's classification, e.g. credentialPhishing
+	FailedChecks       []string       `json:"failedChecks"`     // results that earned no points
+	Checks             map[string]int `json:"checks"`           // points of every scored result
+	MaliciousURLs      []string       `json:"maliciousUrls"`
+	MaliciousFiles     []string       `json:"maliciousFiles"` // SHA256 of flagged attachments
+	ImpersonatingHosts []string       `json:"impersonatingHosts"`
+}
+
+// siemEnabled reports whether any SIEM output is configured.
+func siemEnabled() bool {
+	return siemSyslogAddress != "" || splunkHECURL != ""
+}
+
+// siemVerdict grades the lower of the two percentages with the extension's thresholds.
+func siemVerdict(scores ScoreResult) string {
+	p := min(scores.NormalPercentage, scores.RenderedPercentage)
+	switch {
+	case scores.Suppressed != nil: // reported as a false positive too often to flag
+	case p < 40:
+		return "High Risk"
+	case p < 70:
+		return "Suspicious"
+	}
+	return "Looks Safe"
+}
+
+// summariseForSIEM condenses a finished analysis. The checks are read back through JSON, as they
+// would be from the results store, so the same code serves saved and live analyses.
+func summariseForSIEM(rec AnalysisRecord) SIEMSummary {
+	if b, err := json.Marshal(rec.Checks); err == nil {
+		var generic map[string]interface{}
+		if json.Unmarshal(b, &generic) == nil {
+			rec.Checks = generic
+		}
+	}
+	s := SIEMSummary{
+		AnalysisID:         rec.ID,
+		Time:               rec.CreatedAt.UTC(),
+		APIKey:             rec.APIKey,
+		Profile:            rec.Scores.Profile,
+		From:               rec.From,
+		Domain:             rec.Domain,
+		Subject:            rec.Subject,
+		NormalPercentage:   rec.Scores.NormalPercentage,
+		RenderedPercentage: rec.Scores.RenderedPercentage,
+		Verdict:            siemVerdict(rec.Scores),
+		FailedChecks:       []string{},
+		Checks:             map[string]int{},
+		MaliciousURLs:      []string{},
+		MaliciousFiles:     []string{},
+		ImpersonatingHosts: []string{},
+	}
+	var iocs IOCSummary
+	if decodeCheck(rec.Checks, "iocs", &iocs) {
+		s.OriginIP = iocs.OriginIP
+	}
+	for _, name := range []string{"textAnalysis", "renderedAnalysis"} {
+		var content ContentAnalysisResult
+		if decodeCheck(rec.Checks, name, &content) && content.Intent != nil {
+			s.Intent = content.Intent.Category
+			break
+		}
+	}
+	for name, v := range rec.Checks {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if n, ok := m["scoreImpact"].(float64); ok {
+			s.Checks[name] = int(n)
+			if n < 0 || n == 0 && !penaltyEvents[name] {
+				s.FailedChecks = append(s.FailedChecks, name)
+			}
+		}
+	}
+	sort.Strings(s.FailedChecks)
+	for _, ind := range exportIndicators(rec) {
+		switch ind.Kind {
+		case "url":
+			s.MaliciousURLs = append(s.MaliciousURLs, ind.Value)
+		case "file":
+			s.MaliciousFiles = append(s.MaliciousFiles, ind.Value)
+		case "domain":
+			s.ImpersonatingHosts = append(s.ImpersonatingHosts, ind.Value)
+		}
+	}
+	return s
+}
+
+// cefEscaper and cefExtEscaper escape CEF header fields and extension values.
+var (
+	cefEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// formatCEF renders s as an ArcSight CEF record.
+func formatCEF(s SIEMSummary) string {
+	severity := map[string]int{"High Risk": 8, "Suspicious": 5, "Looks Safe": 2}[s.Verdict]
+	signature := strings.ToLower(strings.ReplaceAll(s.Verdict, " ", "-"))
+	// key, custom-field label (or ""), value; empty values are left out with their label
+	ext := [][3]string{
+		{"rt", "", strconv.FormatInt(s.Time.UnixMilli(), 10)},
+		{"externalId", "", s.AnalysisID},
+		{"suser", "", s.From},
+		{"sourceDnsDomain", "", s.Domain},
+		{"msg", "", s.Subject},
+		{"src", "", s.OriginIP},
+		{"cn1", "normalPercentage", strconv.Itoa(int(s.NormalPercentage))},
+		{"cn2", "renderedPercentage", strconv.Itoa(int(s.RenderedPercentage))},
+		{"cs1", "failedChecks", strings.Join(s.FailedChecks, ",")},
+		{"cs2", "maliciousUrls", strings.Join(s.MaliciousURLs, " ")},
+		{"cs3", "maliciousFiles", strings.Join(s.MaliciousFiles, " ")},
+		{"cs4", "impersonatingHosts", strings.Join(s.ImpersonatingHosts, " ")},
+		{"cs5", "apiKey", s.APIKey},
+		{"cs6", "profile", s.Profile},
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|Email Checker|Email Checker|1.0|%s|%s|%d|",
+		cefEscaper.Replace(signature), cefEscaper.Replace(s.Verdict+" email"), severity)
+	var fields []string
+	for _, f := range ext {
+		if f[2] == "" {
+			continue
+		}
+		if f[1] != "" {
+			fields = append(fields, f[0]+"Label="+f[1])
+		}
+		fields = append(fields, f[0]+"="+cefExtEscaper.Replace(f[2]))
+	}
+	b.WriteString(strings.Join(fields, " "))
+	return b.String()
+}
+
+// syslogMessage wraps msg in an RFC 5424 header: facility local0, severity from the verdict.
+func syslogMessage(s SIEMSummary, msg string) string {
+	severity := map[string]int{"High Risk": 4, "Suspicious": 5, "Looks Safe": 6}[s.Verdict]
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "-"
+	}
+	return fmt.Sprintf("<%d>1 %s %s email-checker %d analysis - %s",
+		16*8+severity, s.Time.Format(time.RFC3339Nano), host, os.Getpid(), msg)
+}
+
+// sendSyslog delivers one message to SIEM_SYSLOG_ADDRESS: "udp:host:port", "tcp:host:port" or a
+// bare "host:port" (UDP). TCP uses octet-counted framing (RFC 6587).
+func sendSyslog(ctx context.Context, msg string) error {
+	network, addr := "udp", siemSyslogAddress
+	switch {
+	case strings.HasPrefix(addr, "tcp:"):
+		network, addr = "tcp", strings.TrimPrefix(addr, "tcp:")
+	case strings.HasPrefix(addr, "udp:"):
+		addr = strings.TrimPrefix(addr, "udp:")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(siemTimeout))
+	if network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	_, err = conn.Write([]byte(msg))
+	return err
+}
+
+// sendSplunkHEC posts the summary as one event to the HTTP Event Collector.
+func sendSplunkHEC(ctx context.Context, s SIEMSummary) error {
+	host, _ := os.Hostname()
+	body, err := json.Marshal(map[string]interface{}{
+		"time":       float64(s.Time.UnixMilli()) / 1000,
+		"host":       host,
+		"source":     "email-checker",
+		"sourcetype": splunkHECSourcetype,
+		"event":      s,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, splunkHECURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+splunkHECToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: siemTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("splunk HEC returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// forwardToSIEM sends the summary of rec to every configured output.
+func forwardToSIEM(rec AnalysisRecord) {
+	if !siemEnabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), siemTimeout)
+	defer cancel()
+	s := summariseForSIEM(rec)
+	if siemSyslogAddress != "" {
+		msg := formatCEF(s)
+		if siemFormat != "cef" {
+			b, err := json.Marshal(s)
+			if err != nil {
+				slog.Error("encoding SIEM summary failed", "analysis_id", s.AnalysisID, "err", err)
+				return
+			}
+			msg = string(b)
+		}
+		if err := sendSyslog(ctx, syslogMessage(s, msg)); err != nil {
+			slog.Error("forwarding analysis to syslog failed", "analysis_id", s.AnalysisID, "address", siemSyslogAddress, "err", err)
+		}
+	}
+	if splunkHECURL != "" {
+		if err := sendSplunkHEC(ctx, s); err != nil {
+			slog.Error("forwarding analysis to Splunk failed", "analysis_id", s.AnalysisID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A local SpamAssassin (spamd) or Rspamd gives a second opinion from a conventional rule-based
+// filter, which matters most when the Gemini checks are switched off. The .eml as received (not
+// the cleaned copy the other checks read) is sent to whichever of SPAMD_ADDRESS and RSPAMD_URL
+// is set; each engine's score, threshold and the rules that fired are reported, and a spam
+// verdict from either fails SpamEngineVerdict. Nothing leaves the machines the engines run on.
+
+// spamEngineMaxRules caps the rules listed per engine.
+const spamEngineMaxRules = 25
+
+// spamEngineEnabled reports whether SPAMD_ADDRESS or RSPAMD_URL is set.
+func spamEngineEnabled() bool {
+	return spamdAddress != "" || rspamdURL != ""
+}
+
+// SpamEngineRule is one rule or symbol that fired.
+type SpamEngineRule struct {
+	Name        string   `json:"name"`
+	Score       *float64 `json:"score,omitempty"` // Rspamd only; spamd's SYMBOLS reply has none
+	Description string   `json:"description,omitempty"`
+}
+
+// SpamEngineVerdict is one engine's answer.
+type SpamEngineVerdict struct {
+	Engine   string           `json:"engine"` // spamassassin or rspamd
+	Spam     bool             `json:"spam"`
+	Score    float64          `json:"score"`
+	Required float64          `json:"required"`
+	Action   string           `json:"action,omitempty"` // Rspamd's: no action, add header, reject...
+	Rules    []SpamEngineRule `json:"rules"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// SpamEngineResult is the spamEngineAnalysis event.
+type SpamEngineResult struct {
+	Engines     []SpamEngineVerdict `json:"engines"`
+	Spam        bool                `json:"spam"`
+	Message     string              `json:"message"`
+	ScoreImpact int                 `json:"scoreImpact"`
+	// Skipped is set when no engine gave a verdict; the check is then left out of the maximum
+	// score instead of costing the email its points.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// dialSpamd connects to SPAMD_ADDRESS: "unix:/path", a bare socket path, "tcp:host:port" or
+// "host:port".
+func dialSpamd(ctx context.Context) (net.Conn, error) {
+	network, addr := "tcp", spamdAddress
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "/"):
+		network = "unix"
+	default:
+		addr = strings.TrimPrefix(addr, "tcp:")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(spamEngineTimeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// spamdRequest sends one SPAMC request and returns the reply's headers and body.
+func spamdRequest(ctx context.Context, command string, message []byte) (map[string]string, string, error) {
+	conn, err := dialSpamd(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = conn.Close() }()
+	req := command + " SPAMC/1.5\r\n"
+	if message != nil {
+		req += fmt.Sprintf("Content-length: %d\r\n", len(message))
+	}
+	if _, err := conn.Write(append([]byte(req+"\r\n"), message...)); err != nil {
+		return nil, "", err
+	}
+	if tcp, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = tcp.CloseWrite()
+	}
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return nil, "", err
+	}
+	// "SPAMD/1.1 0 EX_OK"
+	if f := strings.Fields(status); len(f) < 3 || !strings.HasPrefix(f[0], "SPAMD/") || f[1] != "0" {
+		return nil, "", fmt.Errorf("spamd: %s", strings.TrimSpace(status))
+	}
+	headers := map[string]string{"status": strings.TrimSpace(status)}
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" || err != nil {
+			break
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			headers[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return headers, string(body), nil
+}
+
+var spamdSpamHeader = regexp.MustCompile(`(?i)^(true|false|yes|no)\s*;\s*(-?[\d.]+)\s*/\s*(-?[\d.]+)`)
+
+// checkSpamd asks spamd for the verdict and the names of the rules that fired.
+func checkSpamd(ctx context.Context, message []byte) (SpamEngineVerdict, error) {
+	defer trackDependency(ctx, "spamd", time.Now())
+	v := SpamEngineVerdict{Engine: "spamassassin", Rules: []SpamEngineRule{}}
+	headers, body, err := spamdRequest(ctx, "SYMBOLS", message)
+	if err != nil {
+		return v, fmt.Errorf("spamd: %w", err)
+	}
+	m := spamdSpamHeader.FindStringSubmatch(headers["spam"])
+	if m == nil {
+		return v, fmt.Errorf("spamd: unexpected Spam header %q", headers["spam"])
+	}
+	v.Spam = strings.EqualFold(m[1], "true") || strings.EqualFold(m[1], "yes")
+	v.Score, _ = strconv.ParseFloat(m[2], 64)
+	v.Required, _ = strconv.ParseFloat(m[3], 64)
+	for _, name := range strings.Split(body, ",") {
+		if name = strings.TrimSpace(name); name != "" && len(v.Rules) < spamEngineMaxRules {
+			v.Rules = append(v.Rules, SpamEngineRule{Name: name})
+		}
+	}
+	return v, nil
+}
+
+// checkRspamd posts the message to Rspamd's /checkv2 and returns its verdict, listing the
+// symbols with the largest scores first.
+func checkRspamd(ctx context.Context, message []byte) (SpamEngineVerdict, error) {
+	defer trackDependency(ctx, "rspamd", time.Now())
+	v := SpamEngineVerdict{Engine: "rspamd", Rules: []SpamEngineRule{}}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(rspamdURL, "/")+"/checkv2", bytes.NewReader(message))
+	if err != nil {
+		return v, err
+	}
+	if rspamdPassword != "" {
+		req.Header.Set("Password", rspamdPassword)
+	}
+	client := &http.Client{Timeout: spamEngineTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return v, fmt.Errorf("rspamd: %w", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if cerr := resp.Body.Close(); cerr != nil {
+		slog.WarnContext(ctx, "closing response body failed", "err", cerr)
+	}
+	if err != nil {
+		return v, fmt.Errorf("rspamd: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return v, fmt.Errorf("rspamd: unexpected status %s", resp.Status)
+	}
+	var reply struct {
+		Action        string  `json:"action"`
+		Score         float64 `json:"score"`
+		RequiredScore float64 `json:"required_score"`
+		Symbols       map[string]struct {
+			Score       float64 `json:"score"`
+			Description string  `json:"description"`
+		} `json:"symbols"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return v, fmt.Errorf("rspamd: %w", err)
+	}
+	v.Action, v.Score, v.Required = reply.Action, reply.Score, reply.RequiredScore
+	switch reply.Action {
+	case "reject", "add header", "rewrite subject":
+		v.Spam = true
+	}
+	for name, s := range reply.Symbols {
+		score := s.Score
+		v.Rules = append(v.Rules, SpamEngineRule{Name: name, Score: &score, Description: s.Description})
+	}
+	sort.Slice(v.Rules, func(i, j int) bool {
+		if *v.Rules[i].Score != *v.Rules[j].Score {
+			return *v.Rules[i].Score > *v.Rules[j].Score
+		}
+		return v.Rules[i].Name < v.Rules[j].Name
+	})
+	if len(v.Rules) > spamEngineMaxRules {
+		v.Rules = v.Rules[:spamEngineMaxRules]
+	}
+	return v, nil
+}
+
+// pingSpamd checks that spamd answers.
+func pingSpamd(ctx context.Context) error {
+	_, _, err := spamdRequest(ctx, "PING", nil)
+	return err
+}
+
+// pingRspamd checks that Rspamd's /ping answers.
+func pingRspamd(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(rspamdURL, "/")+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Timeout: spamEngineTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func performSpamEngineAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, ctx context.Context, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "SpamEngineVerdict" {
+			check = c
+			break
+		}
+	}
+	result := SpamEngineResult{Engines: []SpamEngineVerdict{}}
+	message, err := os.ReadFile(Email.rawFile)
+	if err != nil {
+		slog.ErrorContext(ctx, "reading eml for spam engines failed", "err", err)
+		result.Message = "The email could not be sent to the spam engines."
+		result.Skipped = true
+		ch <- CheckResult{EventName: "spamEngineAnalysis", Payload: result}
+		return
+	}
+	engines := []func(context.Context, []byte) (SpamEngineVerdict, error){}
+	if spamdAddress != "" {
+		engines = append(engines, checkSpamd)
+	}
+	if rspamdURL != "" {
+		engines = append(engines, checkRspamd)
+	}
+	var flagged, failed []string
+	for _, engine := range engines {
+		v, err := engine(ctx, message)
+		if err != nil {
+			slog.ErrorContext(ctx, "spam engine failed", "engine", v.Engine, "err", err)
+			v.Error = "The engine could not be reached."
+			failed = append(failed, v.Engine)
+		} else if v.Spam {
+			result.Spam = true
+			flagged = append(flagged, fmt.Sprintf("%s (%.1f / %.1f)", v.Engine, v.Score, v.Required))
+		}
+		result.Engines = append(result.Engines, v)
+	}
+	switch {
+	case result.Spam:
+		result.Message = "Spam engines classed the email as spam: " + strings.Join(flagged, ", ") + "."
+	case len(failed) == len(engines):
+		result.Message = "The spam engines could not be reached."
+		result.Skipped = true
+	default:
+		var scores []string
+		for _, v := range result.Engines {
+			if v.Error == "" {
+				scores = append(scores, fmt.Sprintf("%s %.1f / %.1f", v.Engine, v.Score, v.Required))
+			}
+		}
+		result.Message = "Not spam according to " + strings.Join(scores, ", ") + "."
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "spamEngineAnalysis", Payload: result}
+}
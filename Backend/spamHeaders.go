@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Most mail has been through a spam filter before it is checked here, and the filter wrote its
+// verdict into the headers: SpamAssassin's X-Spam-Status and X-Spam-Flag, Rspamd's X-Spam,
+// Exchange Online's X-MS-Exchange-Organization-SCL and X-Forefront-Antispam-Report, and Gmail's
+// X-Gm-Spam and X-Gm-Phishy. The sender can write any of these too, along with Received headers
+// of their own, so a verdict only counts (trusted) when it sits above the newest Received header
+// written by one of TRUSTED_MX_HOSTS, i.e. it was added by our own servers. Likewise, an
+// Authentication-Results header only counts when its authserv-id is one of TRUSTED_AUTHSERV_IDS.
+// With neither configured nothing is trusted. A trusted spam verdict fails UpstreamSpamVerdict;
+// untrusted ones and Microsoft's bulk level (BCL) are only reported.
+
+// headerField is one header of the raw message, in order.
+type headerField struct {
+	Name  string
+	Value string // unfolded
+}
+
+// readRawHeaders returns the header fields of an .eml file in the order they appear.
+func readRawHeaders(ctx context.Context, fileName string) []headerField {
+	f, err := os.Open(fileName)
+	if err != nil {
+		slog.WarnContext(ctx, "reading raw headers failed", "err", err)
+		return nil
+	}
+	defer func(f *os.File) {
+		if cerr := f.Close(); cerr != nil {
+			slog.WarnContext(ctx, "closing eml failed", "err", cerr)
+		}
+	}(f)
+	var fields []headerField
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			return fields // end of the header block
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += " " + strings.TrimSpace(string(line))
+		} else if name, value, ok := strings.Cut(string(line), ":"); ok {
+			fields = append(fields, headerField{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+		}
+		if err != nil {
+			return fields
+		}
+	}
+}
+
+// SpamVerdict is one upstream filter's header.
+type SpamVerdict struct {
+	Filter  string   `json:"filter"` // SpamAssassin, Rspamd, Microsoft or Google
+	Header  string   `json:"header"`
+	Value   string   `json:"value"`
+	Spam    bool     `json:"spam"`
+	Detail  string   `json:"detail,omitempty"` // e.g. "score 7.2, required 5.0" or "SCL 5"
+	Rules   []string `json:"rules,omitempty"`  // SpamAssassin tests that fired
+	Trusted bool     `json:"trusted"`          // added by one of TRUSTED_MX_HOSTS
+}
+
+var (
+	spamStatusScore = regexp.MustCompile(`(?i)\bscore=(-?[\d.]+)`)
+	spamStatusReq   = regexp.MustCompile(`(?i)\brequired=(-?[\d.]+)`)
+	spamStatusTests = regexp.MustCompile(`(?i)\btests=(.*?)(?:\s+[a-z_]+=|$)`)
+)
+
+// forefrontSpamCategories are the CAT values of X-Forefront-Antispam-Report that mean spam or worse.
+var forefrontSpamCategories = map[string]bool{
+	"SPM": true, "HSPM": true, "PHSH": true, "HPHSH": true, "HPHISH": true, "SPOOF": true, "MALW": true, "GIMP": true,
+}
+
+// parseSpamVerdict reads one header, or returns nil when it isn't an anti-spam verdict.
+func parseSpamVerdict(h headerField) *SpamVerdict {
+	v := &SpamVerdict{Header: h.Name, Value: h.Value}
+	if len(v.Value) > 300 {
+		v.Value = v.Value[:300] + "…"
+	}
+	value := strings.TrimSpace(h.Value)
+	switch name := strings.ToLower(h.Name); name {
+	case "x-spam-status":
+		v.Filter = "SpamAssassin"
+		v.Spam = strings.HasPrefix(strings.ToLower(value), "yes")
+		if m := spamStatusScore.FindStringSubmatch(value); m != nil {
+			v.Detail = "score " + m[1]
+			if r := spamStatusReq.FindStringSubmatch(value); r != nil {
+				v.Detail += ", required " + r[1]
+			}
+		}
+		if m := spamStatusTests.FindStringSubmatch(value); m != nil {
+			for _, t := range strings.Split(m[1], ",") {
+				if t = strings.TrimSpace(t); t != "" && t != "none" {
+					v.Rules = append(v.Rules, t)
+				}
+			}
+		}
+	case "x-spam-flag":
+		v.Filter = "SpamAssassin"
+		v.Spam = strings.EqualFold(value, "yes")
+	case "x-spam":
+		v.Filter = "Rspamd"
+		v.Spam = strings.EqualFold(value, "yes")
+	case "x-ms-exchange-organization-scl":
+		v.Filter = "Microsoft"
+		scl, err := strconv.Atoi(value)
+		if err != nil {
+			return nil
+		}
+		v.Detail = fmt.Sprintf("SCL %d", scl)
+		v.Spam = scl >= 5
+	case "x-forefront-antispam-report", "x-forefront-antispam-report-untrusted":
+		v.Filter = "Microsoft"
+		fields := map[string]string{}
+		for _, kv := range strings.Split(value, ";") {
+			if k, val, ok := strings.Cut(kv, ":"); ok {
+				fields[strings.ToUpper(strings.TrimSpace(k))] = strings.ToUpper(strings.TrimSpace(val))
+			}
+		}
+		var details []string
+		for _, k := range []string{"SFV", "CAT", "SCL"} {
+			if fields[k] != "" {
+				details = append(details, k+" "+fields[k])
+			}
+		}
+		v.Detail = strings.Join(details, ", ")
+		scl, _ := strconv.Atoi(fields["SCL"])
+		v.Spam = fields["SFV"] == "SPM" || forefrontSpamCategories[fields["CAT"]] || scl >= 5
+	case "x-microsoft-antispam":
+		v.Filter = "Microsoft"
+		for _, kv := range strings.Split(value, ";") {
+			if k, val, ok := strings.Cut(kv, ":"); ok && strings.EqualFold(strings.TrimSpace(k), "BCL") {
+				v.Detail = "BCL " + strings.TrimSpace(val) // bulk level: reported, never spam by itself
+			}
+		}
+		if v.Detail == "" {
+			return nil
+		}
+	case "x-gm-spam", "x-gm-phishy":
+		v.Filter = "Google"
+		v.Spam = value == "1"
+	default:
+		return nil
+	}
+	return v
+}
+
+var receivedBy = regexp.MustCompile(`(?i)\bby\s+([^\s;()\[\]]+)`)
+
+// ownReceived returns the index of the newest Received header written ("by") by one of
+// TRUSTED_MX_HOSTS, or -1. The headers above it were added by our own servers. Only the newest
+// counts because the sender can write a Received header naming our server further down.
+func ownReceived(headers []headerField) int {
+	for i, h := range headers {
+		if !strings.EqualFold(h.Name, "Received") {
+			continue
+		}
+		m := receivedBy.FindStringSubmatch(h.Value)
+		if m != nil && hostListed(trustedMXHosts, strings.TrimSuffix(m[1], ".")) {
+			return i
+		}
+	}
+	return -1
+}
+
+// hostListed reports whether host is one of hosts, ignoring case.
+func hostListed(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(strings.TrimSuffix(h, "."), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamVerdicts returns the anti-spam verdicts in the message's headers, marking as trusted
+// those our own servers added (see ownReceived). Microsoft's -Untrusted report is never trusted.
+func upstreamVerdicts(headers []headerField) []SpamVerdict {
+	trusted := ownReceived(headers)
+	var verdicts []SpamVerdict
+	for i, h := range headers {
+		if v := parseSpamVerdict(h); v != nil {
+			v.Trusted = i < trusted && !strings.HasSuffix(strings.ToLower(h.Name), "-untrusted")
+			verdicts = append(verdicts, *v)
+		}
+	}
+	return verdicts
+}
+
+var (
+	dmarcResult = regexp.MustCompile(`(?i)\bdmarc=(\w+)(?:[^;]*?\bheader\.from=([^\s;]+))?`)
+	dkimPass    = regexp.MustCompile(`(?i)\bdkim=pass\b[^;]*?\bheader\.[di]=([^\s;]+)`)
+)
+
+// trustedAuthResults returns the Authentication-Results headers written by our own servers: those
+// whose authserv-id, the name before the first ";", is one of TRUSTED_AUTHSERV_IDS. Where they sit
+// doesn't matter, since a receiving server removes headers carrying its own authserv-id from
+// incoming mail (RFC 8601).
+func trustedAuthResults(headers []headerField) []string {
+	var values []string
+	for _, h := range headers {
+		if !strings.EqualFold(h.Name, "Authentication-Results") {
+			continue
+		}
+		id, _, _ := strings.Cut(h.Value, ";")
+		if fields := strings.Fields(id); len(fields) > 0 && hostListed(trustedAuthservIDs, fields[0]) {
+			values = append(values, h.Value)
+		}
+	}
+	return values
+}
+
+// trustedDMARCPass returns the From domain a trusted Authentication-Results header reports as
+// passing DMARC, or "".
+func trustedDMARCPass(headers []headerField) string {
+	for _, v := range trustedAuthResults(headers) {
+		if m := dmarcResult.FindStringSubmatch(v); m != nil && strings.EqualFold(m[1], "pass") && m[2] != "" {
+			return strings.ToLower(strings.Trim(m[2], `"`))
+		}
+	}
+	return ""
+}
+
+// trustedDKIMDomains returns the signing domains (d=, or the domain of i=) of the DKIM signatures
+// a trusted Authentication-Results header reports as passing.
+func trustedDKIMDomains(headers []headerField) []string {
+	var domains []string
+	for _, v := range trustedAuthResults(headers) {
+		for _, m := range dkimPass.FindAllStringSubmatch(v, -1) {
+			d := strings.Trim(m[1], `"`)
+			if i := strings.LastIndexByte(d, '@'); i >= 0 {
+				d = d[i+1:]
+			}
+			domains = append(domains, strings.ToLower(d))
+		}
+	}
+	return domains
+}
+
+// SpamHeaderResult is the spamHeaderAnalysis event.
+type SpamHeaderResult struct {
+	Verdicts    []SpamVerdict `json:"verdicts"`
+	Spam        bool          `json:"spam"` // a trusted verdict says spam
+	Message     string        `json:"message"`
+	ScoreImpact int           `json:"scoreImpact"`
+}
+
+func performSpamHeaderAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "UpstreamSpamVerdict" {
+			check = c
+			break
+		}
+	}
+	result := SpamHeaderResult{Verdicts: Email.SpamVerdicts}
+	if result.Verdicts == nil {
+		result.Verdicts = []SpamVerdict{}
+	}
+	var flagged, untrusted []string
+	trusted := 0
+	for _, v := range result.Verdicts {
+		switch {
+		case v.Spam && v.Trusted:
+			result.Spam = true
+			flagged = append(flagged, v.Filter+" ("+v.Header+")")
+		case v.Spam:
+			untrusted = append(untrusted, v.Header)
+		}
+		if v.Trusted {
+			trusted++
+		}
+	}
+	switch {
+	case result.Spam:
+		result.Message = "Upstream spam filters marked this email as spam: " + strings.Join(flagged, ", ") + "."
+	case len(untrusted) > 0:
+		result.Message = "Spam verdicts not written by our own mail servers were ignored: " + strings.Join(untrusted, ", ") + "."
+		result.ScoreImpact = check.Impact
+	case trusted > 0:
+		result.Message = fmt.Sprintf("%d upstream spam filter verdict(s), none spam.", trusted)
+		result.ScoreImpact = check.Impact
+	default:
+		result.Message = "No upstream spam filter verdicts in the headers."
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "spamHeaderAnalysis", Payload: result}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Threat-intel platforms ingest an analysis's indicators as a STIX 2.1 bundle or a MISP event.
+// Only what the checks judged bad becomes an indicator: URLs with a malicious verdict, attachments
+// flagged by VirusTotal, ClamAV or the attachment policy, and a sender domain that impersonates a
+// known one. The MISP event also carries the email's other observables, not marked for detection.
+
+// stixNamespace is the namespace STIX 2.1 defines for deterministic identifiers; IDs derived from
+// the analysis and the value stay the same however often an analysis is exported.
+var stixNamespace = uuid.MustParse("00abedb4-aa42-466c-9c01-fed23315a9b7")
+
+// exportIndicator is one indicator of compromise found by the checks.
+type exportIndicator struct {
+	Kind    string // "url", "file" or "domain"
+	Value   string // the URL, the SHA256, or the domain
+	MD5     string
+	SHA1    string
+	Name    string // file name, for files
+	Reasons []string
+}
+
+// decodeCheck re-reads one stored check result into its result type.
+func decodeCheck(checks map[string]interface{}, name string, v interface{}) bool {
+	raw, ok := checks[name]
+	if !ok {
+		return false
+	}
+	b, err := json.Marshal(raw)
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
+// exportIndicators collects the indicators of rec, sorted by kind and value.
+func exportIndicators(rec AnalysisRecord) []exportIndicator {
+	var out []exportIndicator
+	var iocs IOCSummary
+	decodeCheck(rec.Checks, "iocs", &iocs)
+
+	var urlData URLAnalysisResult
+	if decodeCheck(rec.Checks, "urlAnalysis", &urlData) {
+		byURL := map[string]*exportIndicator{}
+		for _, v := range urlData.UrlVerdicts {
+			if !v.FinalDecision {
+				continue
+			}
+			ind, ok := byURL[v.URL]
+			if !ok {
+				out = append(out, exportIndicator{Kind: "url", Value: v.URL})
+				ind = &out[len(out)-1]
+				byURL[v.URL] = ind
+			}
+			reason := v.Source
+			if len(v.Cats) > 0 {
+				reason += ": " + strings.Join(v.Cats, ", ")
+			}
+			ind.Reasons = append(ind.Reasons, reason)
+		}
+	}
+
+	var exeData ExecutableAnalysisResult
+	if decodeCheck(rec.Checks, "executableAnalysis", &exeData) {
+		seen := map[string]bool{}
+		for _, f := range exeData.Files {
+			var reasons []string
+			if f.VTMalicious > 0 {
+				reasons = append(reasons, "VirusTotal "+f.DetectionRatio)
+			}
+			if f.ClamAV != "" {
+				reasons = append(reasons, "ClamAV "+f.ClamAV)
+			}
+			if f.DangerousExt && f.PolicySeverity != "low" {
+				reasons = append(reasons, "dangerous attachment type")
+			}
+			if len(reasons) == 0 || f.SHA256 == "" || seen[f.SHA256] {
+				continue
+			}
+			seen[f.SHA256] = true
+			ind := exportIndicator{Kind: "file", Value: f.SHA256, Name: f.FileName, Reasons: reasons}
+			for _, h := range iocs.Files {
+				if h.SHA256 == f.SHA256 {
+					ind.MD5, ind.SHA1 = h.MD5, h.SHA1
+				}
+			}
+			out = append(out, ind)
+		}
+	}
+
+	var domainData DomainAnalysisResult
+	if decodeCheck(rec.Checks, "domainAnalysis", &domainData) {
+		switch domainData.Status {
+		case "DomainImpersonation":
+			out = append(out, exportIndicator{Kind: "domain", Value: rec.Domain, Reasons: []string{"impersonates " + domainData.MatchedDomain}})
+		case "DeceptiveSubdomain":
+			if d := domainData.DeceptiveSubdomain; d != nil {
+				out = append(out, exportIndicator{Kind: "domain", Value: d.Host, Reasons: []string{"subdomain shows " + d.Shown}})
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind < out[j].Kind
+		}
+		return out[i].Value < out[j].Value
+	})
+	return out
+}
+
+// stixID derives a STIX identifier of the given type from the analysis and a value.
+func stixID(typ, analysisID, value string) string {
+	return typ + "--" + uuid.NewSHA1(stixNamespace, []byte(analysisID+"\x00"+typ+"\x00"+value)).String()
+}
+
+// stixQuote escapes a value for a single-quoted STIX pattern string.
+func stixQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// stixBundle converts rec into a STIX 2.1 bundle: the producing identity, one indicator per
+// finding and a report referencing them.
+func stixBundle(rec AnalysisRecord) map[string]interface{} {
+	created := rec.CreatedAt.UTC().Format("2006-01-02T15:04:05.000Z")
+	identity := stixID("identity", "", "Email Checker")
+	objects := []map[string]interface{}{{
+		"type": "identity", "spec_version": "2.1", "id": identity,
+		"created": created, "modified": created,
+		"name": "Email Checker", "identity_class": "system",
+	}}
+	var refs []string
+	for _, ind := range exportIndicators(rec) {
+		var pattern, name string
+		switch ind.Kind {
+		case "url":
+			pattern, name = "[url:value = "+stixQuote(ind.Value)+"]", "Malicious URL"
+		case "file":
+			parts := []string{"file:hashes.'SHA-256' = " + stixQuote(ind.Value)}
+			if ind.SHA1 != "" {
+				parts = append(parts, "file:hashes.'SHA-1' = "+stixQuote(ind.SHA1))
+			}
+			if ind.MD5 != "" {
+				parts = append(parts, "file:hashes.MD5 = "+stixQuote(ind.MD5))
+			}
+			pattern, name = "["+strings.Join(parts, " OR ")+"]", "Malicious attachment "+ind.Name
+		case "domain":
+			pattern, name = "[domain-name:value = "+stixQuote(ind.Value)+"]", "Impersonating domain"
+		}
+		id := stixID("indicator", rec.ID, ind.Kind+":"+ind.Value)
+		refs = append(refs, id)
+		objects = append(objects, map[string]interface{}{
+			"type": "indicator", "spec_version": "2.1", "id": id,
+			"created": created, "modified": created, "created_by_ref": identity,
+			"name": name, "description": strings.Join(ind.Reasons, "; "),
+			"pattern": pattern, "pattern_type": "stix", "valid_from": created,
+			"indicator_types": []string{"malicious-activity"},
+		})
+	}
+	if refs == nil {
+		refs = []string{identity} // a report must reference something
+	}
+	objects = append(objects, map[string]interface{}{
+		"type": "report", "spec_version": "2.1", "id": stixID("report", rec.ID, "report"),
+		"created": created, "modified": created, "created_by_ref": identity,
+		"name":         fmt.Sprintf("Email analysis %s: %s", rec.ID, rec.Subject),
+		"description":  fmt.Sprintf("Email from %s scored %.0f%%.", rec.From, rec.Scores.NormalPercentage),
+		"report_types": []string{"threat-report"}, "published": created, "object_refs": refs,
+	})
+	return map[string]interface{}{
+		"type": "bundle", "id": stixID("bundle", rec.ID, time.Now().UTC().Format(time.RFC3339Nano)), "objects": objects,
+	}
+}
+
+// mispEvent converts rec into a MISP event. The indicators are marked for detection (to_ids);
+// the email's other observables are included as context.
+func mispEvent(rec AnalysisRecord) map[string]interface{} {
+	var attributes []map[string]interface{}
+	seen := map[string]bool{}
+	add := func(typ, category, value, comment string, toIDs bool) {
+		if value == "" || seen[typ+"\x00"+value] {
+			return
+		}
+		seen[typ+"\x00"+value] = true
+		attributes = append(attributes, map[string]interface{}{
+			"uuid": uuid.NewSHA1(stixNamespace, []byte(rec.ID+"\x00"+typ+"\x00"+value)).String(),
+			"type": typ, "category": category, "value": value, "to_ids": toIDs, "comment": comment,
+		})
+	}
+	for _, ind := range exportIndicators(rec) {
+		comment := strings.Join(ind.Reasons, "; ")
+		switch ind.Kind {
+		case "url":
+			add("url", "Network activity", ind.Value, comment, true)
+		case "file":
+			add("sha256", "Payload delivery", ind.Value, comment, true)
+			add("sha1", "Payload delivery", ind.SHA1, comment, true)
+			add("md5", "Payload delivery", ind.MD5, comment, true)
+		case "domain":
+			add("domain", "Network activity", ind.Value, comment, true)
+		}
+	}
+	var iocs IOCSummary
+	if decodeCheck(rec.Checks, "iocs", &iocs) {
+		add("email-src", "Payload delivery", iocs.Sender, "", false)
+		add("email-subject", "Payload delivery", iocs.Subject, "", false)
+		add("ip-src", "Network activity", iocs.OriginIP, "delivering server", false)
+		for _, f := range iocs.Files {
+			add("filename|sha256", "Payload delivery", f.FileName+"|"+f.SHA256, "", false)
+		}
+		for _, u := range iocs.URLs {
+			add("url", "Network activity", u, "", false)
+		}
+		for _, d := range iocs.Domains {
+			add("domain", "Network activity", d, "", false)
+		}
+	}
+	if attributes == nil {
+		attributes = []map[string]interface{}{}
+	}
+	threatLevel := "3" // low
+	if len(exportIndicators(rec)) > 0 {
+		threatLevel = "2" // medium
+	}
+	return map[string]interface{}{"Event": map[string]interface{}{
+		"uuid":            uuid.NewSHA1(stixNamespace, []byte(rec.ID+"\x00event")).String(),
+		"info":            fmt.Sprintf("Email analysis %s: %s", rec.ID, rec.Subject),
+		"date":            rec.CreatedAt.UTC().Format("2006-01-02"),
+		"threat_level_id": threatLevel,
+		"analysis":        "2", // completed
+		"distribution":    "0", // this organisation only
+		"Attribute":       attributes,
+	}}
+}
+
+func stixHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	rec, ok := loadResult(w, r)
+	if !ok {
+		return
+	}
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "stix":
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="analysis-%s.stix.json"`, rec.ID))
+		writeJSON(w, http.StatusOK, stixBundle(rec))
+	case "misp":
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="analysis-%s.misp.json"`, rec.ID))
+		writeJSON(w, http.StatusOK, mispEvent(rec))
+	default:
+		slog.Debug("unknown export format", "format", format)
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be stix or misp"})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// POST /process-eml is the synchronous form of /process-eml-stream for mail gateways and scripts
+// that can't read an event stream: it takes the same body and query parameters, waits for the
+// analysis to finish and answers with its outcome. ?format=headers answers with header fields
+// ready to be added to the message (X-EmailChecker-Score, -Verdict, -Checks), folded as RFC 5322
+// requires; the default is JSON.
+
+// SyncAnalysisResult is the JSON answer of POST /process-eml.
+type SyncAnalysisResult struct {
+	AnalysisID string                 `json:"analysisId"`
+	Verdict    string                 `json:"verdict"`
+	Score      float64                `json:"score"` // the lower of the two percentages, which the verdict grades
+	Scores     ScoreResult            `json:"scores"`
+	Checks     map[string]goldenCheck `json:"checks"`
+}
+
+// mtaHeaderLimit is the line length RFC 5322 recommends headers be folded to.
+const mtaHeaderLimit = 78
+
+// foldHeader formats one header field, folding the value at spaces so no line is longer than
+// mtaHeaderLimit where that can be helped. Lines end with CRLF.
+func foldHeader(name, value string) string {
+	var b strings.Builder
+	line := name + ":"
+	for _, word := range strings.Fields(value) {
+		if len(line)+1+len(word) > mtaHeaderLimit && len(line) > len(name)+1 {
+			b.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + word
+	}
+	b.WriteString(line + "\r\n")
+	return b.String()
+}
+
+// mtaHeaders renders the result as header fields for a gateway to add to the message.
+func mtaHeaders(res SyncAnalysisResult) string {
+	names := make([]string, 0, len(res.Checks))
+	for name := range res.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]string, len(names))
+	for i, name := range names {
+		if c := res.Checks[name]; c.Points != nil {
+			checks[i] = fmt.Sprintf("%s=%d;", name, *c.Points)
+		} else {
+			checks[i] = fmt.Sprintf("%s=%s;", name, c.Status)
+		}
+	}
+	if len(checks) > 0 {
+		checks[len(checks)-1] = strings.TrimSuffix(checks[len(checks)-1], ";")
+	}
+
+	score := strconv.FormatFloat(res.Score, 'f', 2, 64)
+	if res.Scores.Suppressed != nil {
+		score += " (suppressed)"
+	}
+	return foldHeader("X-EmailChecker-Score", score) +
+		foldHeader("X-EmailChecker-Verdict", res.Verdict) +
+		foldHeader("X-EmailChecker-Checks", strings.Join(checks, " ")) +
+		foldHeader("X-EmailChecker-Analysis-ID", res.AnalysisID)
+}
+
+// processEMLHandler runs the analysis through streamEmailHandler and answers once it is done.
+func processEMLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "headers" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, `format must be "json" or "headers"`)
+		return
+	}
+
+	rec := httptest.NewRecorder()
+	streamEmailHandler(rec, r)
+	for _, h := range []string{"X-Request-ID", "X-Analysis-ID"} {
+		if v := rec.Header().Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if rec.Code != http.StatusOK {
+		// Validation failures are already JSON errors.
+		w.Header().Set("Content-Type", rec.Header().Get("Content-Type"))
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+		return
+	}
+	checks, final, err := readAnalysisStream(rec.Body.String())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	res := SyncAnalysisResult{
+		AnalysisID: final.AnalysisID,
+		Verdict:    siemVerdict(*final),
+		Score:      min(final.NormalPercentage, final.RenderedPercentage),
+		Scores:     *final,
+		Checks:     checks,
+	}
+	if format == "headers" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(mtaHeaders(res)))
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,10 @@
+-- A tiny company database for the golden corpus: the schema is companyDBSchema, these are the rows.
+-- The corpus senders use the reserved .example TLD, which never resolves, so the DNS and TLS
+-- lookups come out the same wherever the test runs.
+INSERT INTO websites (item, item_label, website, type_label, domain, subdomain, source) VALUES
+	('Q900001', 'Example Store', 'https://www.examplestore.example/', 'Business', 'examplestore.example', 'www', 'wikidata'),
+	('Q900002', 'Example Bank', 'https://www.examplebank.com/', 'Bank', 'examplebank.com', 'www', 'wikidata'),
+	('Q900003', 'PayPal', 'https://www.paypal.com/', 'Business', 'paypal.com', 'www', 'wikidata'),
+	('Q900004', 'Microsoft', 'https://www.microsoft.com/', 'Business', 'microsoft.com', 'www', 'wikidata');
+INSERT INTO allow_list (word) VALUES ('mail'), ('billing'), ('notice'), ('news'), ('office');
+INSERT INTO protected_brands (sld) VALUES ('examplebank'), ('paypal'), ('microsoft');
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// threatFeedStore keeps a local SQLite copy of public phishing URL feeds so links can be
+// checked offline, without any third-party scanning quota.
+type threatFeedStore struct {
+	db *sql.DB
+}
+
+// threatFeeds is nil when feed syncing is disabled or the feed database couldn't be opened.
+var threatFeeds *threatFeedStore
+
+func openThreatFeedStore(path string) (*threatFeedStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("open threat feed db: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS feed_urls (
+		url TEXT NOT NULL,
+		source TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (url, source)
+	)`); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("init threat feed db: %w", err)
+	}
+	return &threatFeedStore{db: db}, nil
+}
+
+// normaliseFeedURL reduces a URL to the form stored in the feed table so trivial differences
+// (case of scheme/host, trailing slash, fragment) don't prevent a match.
+func normaliseFeedURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return strings.TrimSuffix(raw, "/")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+// run syncs every feed immediately and then on each interval until the process exits.
+func (s *threatFeedStore) run(interval time.Duration) {
+	for {
+		s.syncAll(context.Background())
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (s *threatFeedStore) syncAll(ctx context.Context) {
+	feeds := []struct {
+		name  string
+		fetch func(context.Context) ([]string, error)
+	}{
+		{"openphish", fetchOpenPhish},
+		{"phishtank", fetchPhishTank},
+	}
+	for _, feed := range feeds {
+		urls, err := feed.fetch(ctx)
+		if err != nil {
+			slog.Error("threat feed sync failed", "feed", feed.name, "err", err)
+			continue
+		}
+		if err := s.replace(feed.name, urls); err != nil {
+			slog.Error("threat feed store failed", "feed", feed.name, "err", err)
+			continue
+		}
+		slog.Info("threat feed synced", "feed", feed.name, "urls", len(urls))
+	}
+}
+
+// replace swaps the stored URLs for one source in a single transaction.
+func (s *threatFeedStore) replace(source string, urls []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM feed_urls WHERE source = ?`, source); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO feed_urls (url, source, updated_at) VALUES (?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	now := time.Now().UTC()
+	for _, u := range urls {
+		if _, err := stmt.Exec(normaliseFeedURL(u), source, now); err != nil {
+			_ = stmt.Close()
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := stmt.Close(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// lookup returns the feed sources listing each of the given URLs; unlisted URLs are omitted.
+func (s *threatFeedStore) lookup(urls []string) (map[string][]string, error) {
+	hits := make(map[string][]string)
+	for _, u := range urls {
+		rows, err := s.db.Query(`SELECT source FROM feed_urls WHERE url = ?`, normaliseFeedURL(u))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var source string
+			if err := rows.Scan(&source); err == nil {
+				hits[u] = append(hits[u], source)
+			}
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return hits, nil
+}
+
+// feedVerdict builds the verdict reported for a URL found in a local phishing feed.
+func feedVerdict(u string, sources []string) Verdict {
+	return Verdict{
+		URL:             u,
+		Source:          "threatfeed",
+		Score:           100,
+		Cats:            append([]string{"phishing"}, sources...),
+		PlatformVerdict: true,
+		FinalDecision:   true,
+	}
+}
+
+func fetchFeedBody(ctx context.Context, feedURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", feedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := newClientWithDefaultHeaders()
+	client.Timeout = 2 * time.Minute
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// fetchOpenPhish downloads the OpenPhish community feed (one URL per line).
+func fetchOpenPhish(ctx context.Context) ([]string, error) {
+	body, err := fetchFeedBody(ctx, "https://openphish.com/feed.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		if err := Body.Close(); err != nil {
+			slog.WarnContext(ctx, "closing response body failed", "err", err)
+		}
+	}(body)
+
+	var urls []string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
+
+// fetchPhishTank downloads the PhishTank verified-online dump. An app key raises the rate limit.
+func fetchPhishTank(ctx context.Context) ([]string, error) {
+	feedURL := "https://data.phishtank.com/data/online-valid.json"
+	if phishTankAppKey != "" {
+		feedURL = "https://data.phishtank.com/data/" + url.PathEscape(phishTankAppKey) + "/online-valid.json"
+	}
+	body, err := fetchFeedBody(ctx, feedURL)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		if err := Body.Close(); err != nil {
+			slog.WarnContext(ctx, "closing response body failed", "err", err)
+		}
+	}(body)
+
+	var entries []struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decode phishtank feed: %w", err)
+	}
+	urls := make([]string, 0, len(entries))
+	for _, e := range entries {
+		urls = append(urls, e.URL)
+	}
+	return urls, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Every analysis reports where its time went in the "timings" section of finalScores: how long
+// each check took to deliver its result, and how long was spent waiting on each external
+// dependency. Dependencies are called concurrently, so their totals can add up to more than the
+// whole analysis took.
+
+// AnalysisTimings is the "timings" section of finalScores. Times are in milliseconds.
+type AnalysisTimings struct {
+	TotalMs      float64            `json:"totalMs"`
+	Checks       map[string]float64 `json:"checks"`       // by result event, from the start of the checks
+	Dependencies map[string]float64 `json:"dependencies"` // summed over every call, attached emails included
+}
+
+// timingRecorder collects the timings of one analysis.
+type timingRecorder struct {
+	start time.Time
+
+	mu     sync.Mutex
+	checks map[string]time.Duration
+	deps   map[string]time.Duration
+}
+
+type timingsKey struct{}
+
+func newTimingRecorder() *timingRecorder {
+	return &timingRecorder{start: time.Now(), checks: map[string]time.Duration{}, deps: map[string]time.Duration{}}
+}
+
+// withTimings returns a context whose dependency calls are added to t.
+func withTimings(ctx context.Context, t *timingRecorder) context.Context {
+	return context.WithValue(ctx, timingsKey{}, t)
+}
+
+// trackDependency adds the time since start to the named dependency of the analysis ctx belongs
+// to, for use as `defer trackDependency(ctx, "gemini", time.Now())`. Outside an analysis it does
+// nothing.
+func trackDependency(ctx context.Context, name string, start time.Time) {
+	if ctx == nil {
+		return
+	}
+	t, _ := ctx.Value(timingsKey{}).(*timingRecorder)
+	if t == nil {
+		return
+	}
+	d := time.Since(start)
+	t.mu.Lock()
+	t.deps[name] += d
+	t.mu.Unlock()
+}
+
+// checkDone records that the check reporting as event took until now since start. A nil
+// recorder (attached emails) ignores it.
+func (t *timingRecorder) checkDone(event string, start time.Time) {
+	if t == nil {
+		return
+	}
+	d := time.Since(start)
+	t.mu.Lock()
+	t.checks[event] = d
+	t.mu.Unlock()
+}
+
+// report returns the timings so far, with the database time accumulated by the checks.
+func (t *timingRecorder) report(dbReadNanos int64) *AnalysisTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report := &AnalysisTimings{
+		TotalMs:      millis(time.Since(t.start)),
+		Checks:       make(map[string]float64, len(t.checks)),
+		Dependencies: make(map[string]float64, len(t.deps)+1),
+	}
+	for name, d := range t.checks {
+		report.Checks[name] = millis(d)
+	}
+	for name, d := range t.deps {
+		report.Dependencies[name] = millis(d)
+	}
+	if dbReadNanos > 0 {
+		report.Dependencies["database"] = millis(time.Duration(dbReadNanos))
+	}
+	return report
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
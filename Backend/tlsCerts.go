@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// freshCertDays is how young a certificate must be to count as freshly issued. Phishing kits
+// are usually deployed within days of the lookalike domain and its free certificate.
+const freshCertDays = 14
+
+// TLSCertInfo describes the certificate a host presents on port 443.
+type TLSCertInfo struct {
+	Host             string    `json:"host"`
+	Issuer           string    `json:"issuer"`
+	Subject          string    `json:"subject"`
+	NotBefore        time.Time `json:"notBefore"`
+	NotAfter         time.Time `json:"notAfter"`
+	AgeDays          int       `json:"ageDays"`
+	Trusted          bool      `json:"trusted"` // chains to a system root and covers the host
+	LetsEncrypt      bool      `json:"letsEncrypt"`
+	Lookalike        bool      `json:"lookalike"` // host's domain resembles a known company domain
+	FreshLookalike   bool      `json:"freshLetsEncryptLookalike"`
+	Error            string    `json:"error,omitempty"`
+	VerificationNote string    `json:"verificationNote,omitempty"`
+}
+
+// fetchTLSCert connects to host:443 and reads the leaf certificate. Verification is done
+// separately so an untrusted or expired certificate is still reported rather than hidden
+// behind a handshake error.
+func fetchTLSCert(ctx context.Context, host string) TLSCertInfo {
+	info := TLSCertInfo{Host: host}
+	if host == "" {
+		info.Error = "no host"
+		return info
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{},
+		Config:    &tls.Config{ServerName: host, InsecureSkipVerify: true},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, "443"))
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	defer func() { _ = conn.Close() }()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		info.Error = "no certificate presented"
+		return info
+	}
+	leaf := certs[0]
+	info.Issuer = leaf.Issuer.CommonName
+	if len(leaf.Issuer.Organization) > 0 {
+		info.Issuer = leaf.Issuer.Organization[0] + " (" + leaf.Issuer.CommonName + ")"
+	}
+	info.Subject = leaf.Subject.CommonName
+	info.NotBefore = leaf.NotBefore
+	info.NotAfter = leaf.NotAfter
+	info.AgeDays = int(time.Since(leaf.NotBefore).Hours() / 24)
+	info.LetsEncrypt = strings.Contains(strings.ToLower(info.Issuer), "let's encrypt")
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates}); err != nil {
+		info.VerificationNote = err.Error()
+	} else {
+		info.Trusted = true
+	}
+	return info
+}
+
+// markLookalike records whether the certificate belongs to a lookalike domain and, if so,
+// whether it is the fresh Let's Encrypt certificate typical of a phishing site.
+func (c *TLSCertInfo) markLookalike(lookalike bool) {
+	c.Lookalike = lookalike
+	c.FreshLookalike = lookalike && c.Error == "" && c.LetsEncrypt && c.AgeDays <= freshCertDays
+}
+
+// inspectURLCerts fetches the certificate of every https host among urls, checking each host's
+// registrable domain against the company database for lookalikes.
+func inspectURLCerts(ctx context.Context, db CompanyStore, urls []string) []TLSCertInfo {
+	hosts := make(map[string]struct{})
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || !strings.EqualFold(u.Scheme, "https") || u.Hostname() == "" || isIPLiteralHost(u.Hostname()) {
+			continue
+		}
+		hosts[strings.ToLower(u.Hostname())] = struct{}{}
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		certs = []TLSCertInfo{}
+	)
+	for host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			info := fetchTLSCert(ctx, host)
+			lookalike := false
+			if db != nil {
+				if domain := registrableDomain(host); domain != "" {
+					if status, _, err := checkDomainReal(ctx, db, domain); err == nil {
+						lookalike = status == 0
+					}
+				}
+			}
+			info.markLookalike(lookalike)
+			mu.Lock()
+			certs = append(certs, info)
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	return certs
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The Tranco list ranks the million most popular registrable domains. A sender that is neither
+// a known company nor anywhere in the top million is far more likely to be a throwaway domain
+// than an unlisted but established business, so it scores lower than DomainNoSimilarity.
+
+const trancoURL = "https://tranco-list.eu/top-1m.csv.zip"
+
+// trancoList maps each listed domain to its rank, 1 being the most popular.
+type trancoList struct {
+	ranks   map[string]int
+	modTime time.Time // of the file the list was read from
+}
+
+// tranco is nil while the list is disabled or hasn't loaded.
+var tranco atomic.Pointer[trancoList]
+
+// DomainRank is the Tranco rank of a link's registrable domain; 0 means it isn't in the list.
+type DomainRank struct {
+	Domain string `json:"domain"`
+	Rank   int    `json:"rank"`
+}
+
+// trancoRank returns the rank of domain's registrable domain, and false when no list is loaded.
+func trancoRank(domain string) (int, bool) {
+	list := tranco.Load()
+	if list == nil {
+		return 0, false
+	}
+	if d := registrableDomain(domain); d != "" {
+		domain = d
+	}
+	return list.ranks[domain], true
+}
+
+// trancoRanks returns the rank of every distinct registrable domain among urls, sorted by
+// domain, or nil when no list is loaded.
+func trancoRanks(urls []string) []DomainRank {
+	list := tranco.Load()
+	if list == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	ranks := []DomainRank{}
+	for _, u := range urls {
+		d := registrableDomain(u)
+		if d == "" || seen[d] {
+			continue
+		}
+		seen[d] = true
+		ranks = append(ranks, DomainRank{Domain: d, Rank: list.ranks[d]})
+	}
+	sort.Slice(ranks, func(i, j int) bool { return ranks[i].Domain < ranks[j].Domain })
+	return ranks
+}
+
+// runTranco downloads the list when the cached file is missing or older than interval, loads
+// it, and repeats every interval. A zero interval only loads the cached file.
+func runTranco(path string, interval time.Duration) {
+	for {
+		info, err := os.Stat(path)
+		if interval > 0 && (err != nil || time.Since(info.ModTime()) > interval) {
+			if err := downloadTranco(context.Background(), path); err != nil {
+				slog.Error("tranco list download failed", "err", err)
+			}
+		}
+		if err := loadTranco(path); err != nil {
+			slog.Warn("tranco list not loaded", "err", err)
+		}
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// loadTranco reads the cached rank,domain CSV unless it is the file already loaded.
+func loadTranco(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if cur := tranco.Load(); cur != nil && cur.modTime.Equal(info.ModTime()) {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	list := &trancoList{ranks: make(map[string]int, 1_000_000), modTime: info.ModTime()}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rankStr, domain, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ",")
+		rank, err := strconv.Atoi(rankStr)
+		if !ok || err != nil || domain == "" {
+			continue
+		}
+		domain = strings.ToLower(domain)
+		if _, dup := list.ranks[domain]; !dup {
+			list.ranks[domain] = rank
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(list.ranks) == 0 {
+		return fmt.Errorf("%s has no domains", path)
+	}
+	tranco.Store(list)
+	slog.Info("tranco list loaded", "domains", len(list.ranks))
+	return nil
+}
+
+// downloadTranco fetches the current list and replaces the cached CSV with the one in the zip.
+func downloadTranco(ctx context.Context, path string) error {
+	body, err := fetchFeedBody(ctx, trancoURL)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = body.Close() }()
+	zipPath := path + ".zip"
+	defer func() { _ = os.Remove(zipPath) }()
+	zf, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zf, body); err != nil {
+		_ = zf.Close()
+		return err
+	}
+	if err := zf.Close(); err != nil {
+		return err
+	}
+
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = zr.Close() }()
+	for _, entry := range zr.File {
+		if !strings.HasSuffix(entry.Name, ".csv") {
+			continue
+		}
+		src, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		defer func() { _ = src.Close() }()
+		tmpPath := path + ".new"
+		dst, err := os.Create(tmpPath)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			_ = dst.Close()
+			_ = os.Remove(tmpPath)
+			return err
+		}
+		if err := dst.Close(); err != nil {
+			_ = os.Remove(tmpPath)
+			return err
+		}
+		return os.Rename(tmpPath, path)
+	}
+	return errors.New("tranco zip has no CSV")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/agnivade/levenshtein"
+)
+
+// Plain Levenshtein distance treats every one-character edit alike, so "paypa1" is as far from
+// "paypal" as "paypad", and two-character tricks like "rn" for "m" aren't one edit at all.
+// typoDistance weighs edits by how easily a reader misses them; lookalikes are flagged when
+// the weighted distance is within typoThreshold of a brand.
+
+const (
+	typoCostEdit       = 1.0  // any other insertion, deletion or substitution
+	typoCostAdjacent   = 0.5  // substituting a neighbouring key, e.g. paypak
+	typoCostDoubled    = 0.5  // doubling or undoubling a letter, e.g. gooogle, gogle
+	typoCostSwap       = 0.5  // swapping two neighbouring letters, e.g. apyapl
+	typoCostLookalike  = 0.25 // a character that looks the same, e.g. paypa1
+	typoShortBrandRune = 5    // brands this short only match cheap edits
+)
+
+// keyboardRows is the QWERTY layout; each row is shifted half a key right of the one above.
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// keyboardAdjacent holds each pair of neighbouring keys, in both orders.
+var keyboardAdjacent = func() map[[2]rune]bool {
+	adj := map[[2]rune]bool{}
+	link := func(a, b rune) { adj[[2]rune{a, b}], adj[[2]rune{b, a}] = true, true }
+	for r, row := range keyboardRows {
+		keys := []rune(row)
+		for i, k := range keys {
+			if i+1 < len(keys) {
+				link(k, keys[i+1])
+			}
+			if r+1 < len(keyboardRows) {
+				below := []rune(keyboardRows[r+1])
+				for _, j := range []int{i - 1, i} {
+					if j >= 0 && j < len(below) {
+						link(k, below[j])
+					}
+				}
+			}
+		}
+	}
+	return adj
+}()
+
+// lookalikeRunes holds each pair of characters commonly used in place of each other.
+var lookalikeRunes = func() map[[2]rune]bool {
+	pairs := map[[2]rune]bool{}
+	for _, p := range []string{"0o", "1l", "1i", "li", "5s", "3e", "4a", "8b", "9g", "6b", "7t", "2z"} {
+		a, b := rune(p[0]), rune(p[1])
+		pairs[[2]rune{a, b}], pairs[[2]rune{b, a}] = true, true
+	}
+	return pairs
+}()
+
+// lookalikeSequences are pairs of characters that read as one letter.
+var lookalikeSequences = map[string]rune{"rn": 'm', "vv": 'w', "cl": 'd'}
+
+// foldLookalikes replaces lookalike digits and letter pairs with the letters they imitate, so
+// "rnicr0soft" can be found in the brand index under "microsoft".
+func foldLookalikes(s string) string {
+	for seq, r := range lookalikeSequences {
+		s = strings.ReplaceAll(s, seq, string(r))
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '0':
+			return 'o'
+		case '1':
+			return 'l'
+		case '3':
+			return 'e'
+		case '4':
+			return 'a'
+		case '5':
+			return 's'
+		case '7':
+			return 't'
+		case '8':
+			return 'b'
+		case '9':
+			return 'g'
+		}
+		return r
+	}, s)
+}
+
+func substitutionCost(a, b rune) float64 {
+	switch {
+	case a == b:
+		return 0
+	case lookalikeRunes[[2]rune{a, b}]:
+		return typoCostLookalike
+	case keyboardAdjacent[[2]rune{a, b}]:
+		return typoCostAdjacent
+	}
+	return typoCostEdit
+}
+
+// indelCost is the cost of s[i] being extra (or missing): cheaper when it repeats a neighbour.
+func indelCost(s []rune, i int) float64 {
+	if (i > 0 && s[i-1] == s[i]) || (i+1 < len(s) && s[i+1] == s[i]) {
+		return typoCostDoubled
+	}
+	return typoCostEdit
+}
+
+// typoDistance is the weighted edit distance from the typed SLD to the brand.
+func typoDistance(typed, brand string) float64 {
+	a, b := []rune(typed), []rune(brand)
+	d := make([][]float64, len(a)+1)
+	for i := range d {
+		d[i] = make([]float64, len(b)+1)
+		if i > 0 {
+			d[i][0] = d[i-1][0] + indelCost(a, i-1)
+		}
+	}
+	for j := 1; j <= len(b); j++ {
+		d[0][j] = d[0][j-1] + indelCost(b, j-1)
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			best := min(
+				d[i-1][j]+indelCost(a, i-1),
+				d[i][j-1]+indelCost(b, j-1),
+				d[i-1][j-1]+substitutionCost(a[i-1], b[j-1]),
+			)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && a[i-1] != a[i-2] {
+				best = min(best, d[i-2][j-2]+typoCostSwap)
+			}
+			if i > 1 && lookalikeSequences[string(a[i-2:i])] == b[j-1] {
+				best = min(best, d[i-2][j-1]+typoCostLookalike) // rn typed for m
+			}
+			if j > 1 && lookalikeSequences[string(b[j-2:j])] == a[i-1] {
+				best = min(best, d[i-1][j-2]+typoCostLookalike) // m typed for rn
+			}
+			d[i][j] = best
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// typoThreshold is the largest weighted distance flagged as a typosquat of brand. Short brands
+// only match cheap edits: one arbitrary letter changed in a four-letter name is as likely to be
+// an unrelated domain as an imitation.
+func typoThreshold(brand string) float64 {
+	if utf8.RuneCountInString(brand) <= typoShortBrandRune {
+		return typoCostAdjacent
+	}
+	return typoCostEdit
+}
+
+// oneTypo reports whether a and b differ by one insertion, deletion, substitution or swap of
+// neighbouring characters.
+func oneTypo(a, b string) bool {
+	if levenshtein.ComputeDistance(a, b) <= 1 {
+		return true
+	}
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) != len(rb) {
+		return false
+	}
+	for i := range ra {
+		if ra[i] != rb[i] {
+			return i+1 < len(ra) && ra[i] == rb[i+1] && ra[i+1] == rb[i] && string(ra[i+2:]) == string(rb[i+2:])
+		}
+	}
+	return false
+}
+
+// isTyposquat reports whether typed imitates brand, with the weighted distance: one typo, or
+// any number of lookalike characters plus at most one typo, cheap enough for the brand's length.
+func isTyposquat(typed, brand string) (float64, bool) {
+	if typed == brand || (!oneTypo(typed, brand) && !oneTypo(foldLookalikes(typed), brand)) {
+		return 0, false
+	}
+	dist := typoDistance(typed, brand)
+	return dist, dist <= typoThreshold(brand)
+}
@@ -0,0 +1,377 @@
+// Email Checker dashboard: upload an .eml and watch the analysis stream in, or browse saved
+// analyses. Served by the backend at /ui, so every request goes to the same origin.
+'use strict';
+
+const $ = (id) => document.getElementById(id);
+const pageSize = 50;
+let historyOffset = 0;
+let selectedId = null;
+let currentJob = null; // analysis ID of the stream being shown, while it runs
+let lastFile = null; // the email analysed last, for a sanitised copy
+
+// --- Keys ---
+
+function headers() {
+    const h = {};
+    const apiKey = $('apiKey').value.trim();
+    const adminKey = $('adminKey').value.trim();
+    if (apiKey) h['X-API-Key'] = apiKey;
+    if (adminKey) h['X-Admin-Key'] = adminKey;
+    return h;
+}
+
+for (const id of ['apiKey', 'adminKey']) {
+    $(id).value = localStorage.getItem(id) || '';
+    $(id).addEventListener('change', () => localStorage.setItem(id, $(id).value.trim()));
+}
+
+// --- Tabs ---
+
+for (const button of document.querySelectorAll('nav button')) {
+    button.addEventListener('click', () => {
+        for (const b of document.querySelectorAll('nav button')) b.classList.toggle('active', b === button);
+        for (const tab of document.querySelectorAll('.tab')) tab.hidden = tab.id !== button.dataset.tab;
+        if (button.dataset.tab === 'history') loadHistory(0);
+    });
+}
+
+// --- Rendering ---
+
+function verdict(percentage) {
+    const p = Math.min(100, percentage);
+    if (p < 40) return { text: 'High Risk', cls: 'high-risk' };
+    if (p < 70) return { text: 'Suspicious', cls: 'suspicious' };
+    return { text: 'Looks Safe', cls: 'safe' };
+}
+
+function renderScore(container, scores) {
+    container.replaceChildren();
+    container.className = 'score';
+    for (const [label, pct] of [['Text', scores.normalPercentage], ['Rendered', scores.renderedPercentage]]) {
+        const v = verdict(pct || 0);
+        const div = document.createElement('div');
+        const strong = document.createElement('strong');
+        strong.className = v.cls;
+        strong.textContent = `${Math.round(pct || 0)}%`;
+        div.append(`${label}: `, strong, ` ${v.text}`);
+        container.append(div);
+    }
+    if (scores.suppressed) {
+        const note = document.createElement('div');
+        note.textContent = `Not flagged: ${scores.suppressed.sender} was reported as a false positive ` +
+            `${scores.suppressed.falsePositives} times.`;
+        container.append(note);
+    }
+    container.hidden = false;
+}
+
+// eventElement shows one event or stored check: its name, message and points, with the full
+// payload folded away.
+function eventElement(name, payload) {
+    const details = document.createElement('details');
+    const summary = document.createElement('summary');
+    const title = document.createElement('strong');
+    title.textContent = name;
+    summary.append(title);
+    if (payload && typeof payload === 'object') {
+        const message = payload.message || payload.summary || payload.error || payload.status;
+        if (typeof message === 'string' && message) {
+            const span = document.createElement('span');
+            span.className = 'message';
+            span.textContent = message;
+            summary.append(span);
+        }
+        if (typeof payload.scoreImpact === 'number') {
+            const points = document.createElement('span');
+            points.className = 'points';
+            points.textContent = (payload.scoreImpact >= 0 ? '+' : '') + payload.scoreImpact;
+            summary.append(points);
+        }
+    }
+    const pre = document.createElement('pre');
+    pre.textContent = JSON.stringify(payload, null, 2);
+    details.append(summary, pre);
+    return details;
+}
+
+function setStatus(text, isError) {
+    $('status').textContent = text;
+    $('status').className = isError ? 'error' : '';
+}
+
+async function errorText(response) {
+    try {
+        const body = await response.json();
+        return body.error || response.statusText;
+    } catch {
+        return response.statusText;
+    }
+}
+
+// --- Analyse ---
+
+function toBase64(buffer) {
+    const bytes = new Uint8Array(buffer);
+    let binary = '';
+    for (let i = 0; i < bytes.length; i += 0x8000) {
+        binary += String.fromCharCode.apply(null, bytes.subarray(i, i + 0x8000));
+    }
+    return btoa(binary);
+}
+
+// parseSSE splits the buffered stream into complete events and returns what is left over.
+function parseSSE(buffer, onEvent) {
+    const blocks = buffer.split('\n\n');
+    const rest = blocks.pop();
+    for (const block of blocks) {
+        let name = 'message';
+        const data = [];
+        for (const line of block.split('\n')) {
+            if (line.startsWith('event:')) name = line.slice(6).trim();
+            else if (line.startsWith('data:')) data.push(line.slice(5).trim());
+        }
+        if (data.length === 0) continue;
+        let payload = data.join('\n');
+        try {
+            payload = JSON.parse(payload);
+        } catch {
+            // not JSON: show as text
+        }
+        onEvent(name, payload);
+    }
+    return rest;
+}
+
+async function analyse(file) {
+    lastFile = file;
+    $('sanitize').hidden = false;
+    $('events').replaceChildren();
+    $('score').hidden = true;
+    setStatus(`Analysing ${file.name}…`);
+    let response;
+    try {
+        response = await fetch('../process-eml-stream', {
+            method: 'POST',
+            headers: { ...headers(), 'Content-Type': 'text/plain' },
+            body: toBase64(await file.arrayBuffer()),
+        });
+    } catch (err) {
+        setStatus(`Request failed: ${err.message}`, true);
+        return;
+    }
+    if (!response.ok) {
+        setStatus(`${response.status}: ${await errorText(response)}`, true);
+        return;
+    }
+    currentJob = response.headers.get('X-Analysis-ID');
+    // Only the key that started an analysis, or the admin key, may cancel it.
+    $('cancel').hidden = !currentJob || Object.keys(headers()).length === 0;
+    const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+    const progress = new Progress();
+    let buffer = '';
+    let count = 0;
+    for (;;) {
+        const { value, done } = await reader.read();
+        if (done) break;
+        buffer = parseSSE(buffer + value.replace(/\r\n/g, '\n'), (name, payload) => {
+            count++;
+            if (progress.update(name, payload)) {
+                setStatus(`Analysing ${file.name}… ${progress.running()}`);
+                return;
+            }
+            if (name === 'finalScores') {
+                renderScore($('score'), payload);
+                setStatus(`Done: ${count} events. Analysis ${payload.analysisId || ''}`);
+            } else if (name === 'cancelled') {
+                setStatus(`Cancelled: ${payload.reason}`, true);
+            } else {
+                setStatus(`Analysing ${file.name}… ${progress.running()}`);
+            }
+            $('events').append(eventElement(name, payload));
+        });
+    }
+    progress.finish();
+    currentJob = null;
+    $('cancel').hidden = true;
+}
+
+// The stream ends by itself once the server has stopped the checks.
+$('sanitize').addEventListener('click', async () => {
+    const response = await fetch('../sanitize-eml', {
+        method: 'POST',
+        headers: { ...headers(), 'Content-Type': 'text/plain' },
+        body: toBase64(await lastFile.arrayBuffer()),
+    });
+    if (!response.ok) {
+        alert(await errorText(response));
+        return;
+    }
+    const url = URL.createObjectURL(await response.blob());
+    const a = document.createElement('a');
+    a.href = url;
+    a.download = lastFile.name.replace(/\.eml$/i, '') + '-sanitised.eml';
+    a.click();
+    URL.revokeObjectURL(url);
+});
+
+$('cancel').addEventListener('click', async () => {
+    if (!currentJob) return;
+    const response = await fetch(`../jobs/${encodeURIComponent(currentJob)}`, { method: 'DELETE', headers: headers() });
+    if (!response.ok && response.status !== 409) setStatus(await errorText(response), true);
+});
+
+// Stage names shown while a slow check runs; the matching *Completed event ends the stage.
+const stageLabels = {
+    domainQuery: 'querying the company database',
+    rendering: 'rendering the email',
+    ocr: 'reading the screenshot',
+    gemini: 'asking Gemini',
+};
+
+// Progress follows the progress events of one analysis: the bar counts finished stages and
+// scanned URLs against those announced so far. update returns whether the event only reports
+// progress, rather than a result worth listing.
+class Progress {
+    constructor() {
+        this.stages = new Map();
+        this.done = 0;
+        this.total = 0;
+        $('progress').hidden = false;
+        $('progress').removeAttribute('value');
+    }
+
+    update(name, payload) {
+        const check = (payload && payload.check) || '';
+        const started = name.match(/^(\w+)Started$/);
+        const completed = name.match(/^(\w+)Completed$/);
+        if (name === 'urlScanStarted') {
+            this.total += payload.total || 0;
+        } else if (name === 'urlScanResult') {
+            this.done++;
+        } else if (started && started[1] in stageLabels) {
+            this.total++;
+            this.stages.set(`${started[1]}:${check}`, stageLabels[started[1]]);
+        } else if (completed && completed[1] in stageLabels) {
+            // ocrCompleted has no Started event: OCR follows rendering directly
+            if (!this.stages.delete(`${completed[1]}:${check}`)) this.total++;
+            this.done++;
+        } else {
+            return false;
+        }
+        if (this.total > 0) {
+            $('progress').max = this.total;
+            $('progress').value = this.done;
+        }
+        return name !== 'urlScanResult';
+    }
+
+    running() {
+        return [...new Set(this.stages.values())].join(', ');
+    }
+
+    finish() {
+        $('progress').hidden = true;
+    }
+}
+
+const drop = $('drop');
+drop.addEventListener('dragover', (e) => {
+    e.preventDefault();
+    drop.classList.add('over');
+});
+drop.addEventListener('dragleave', () => drop.classList.remove('over'));
+drop.addEventListener('drop', (e) => {
+    e.preventDefault();
+    drop.classList.remove('over');
+    if (e.dataTransfer.files.length > 0) analyse(e.dataTransfer.files[0]);
+});
+$('file').addEventListener('change', () => {
+    if ($('file').files.length > 0) analyse($('file').files[0]);
+    $('file').value = '';
+});
+
+// --- History ---
+
+async function loadHistory(offset) {
+    historyOffset = offset;
+    const response = await fetch(`../results?limit=${pageSize}&offset=${offset}`, { headers: headers() });
+    const body = $('analyses');
+    body.replaceChildren();
+    if (!response.ok) {
+        const row = body.insertRow();
+        const cell = row.insertCell();
+        cell.colSpan = 4;
+        cell.className = 'error';
+        cell.textContent = await errorText(response);
+        return;
+    }
+    const { analyses } = await response.json();
+    for (const a of analyses) {
+        const row = body.insertRow();
+        const pct = Math.min(a.normalPercentage, a.renderedPercentage);
+        const v = verdict(pct);
+        row.insertCell().textContent = new Date(a.createdAt).toLocaleString();
+        row.insertCell().textContent = a.from;
+        row.insertCell().textContent = a.subject;
+        const score = row.insertCell();
+        score.className = v.cls;
+        score.textContent = `${Math.round(pct)}% ${v.text}`;
+        row.addEventListener('click', () => showAnalysis(a.id));
+    }
+    $('older').disabled = analyses.length < pageSize;
+}
+
+async function showAnalysis(id) {
+    const response = await fetch(`../results/${encodeURIComponent(id)}`, { headers: headers() });
+    if (!response.ok) {
+        $('detailTitle').textContent = await errorText(response);
+        $('detail').hidden = false;
+        return;
+    }
+    const rec = await response.json();
+    selectedId = rec.id;
+    $('detailTitle').textContent = `${rec.subject || '(no subject)'} — ${rec.from}`;
+    renderScore($('detailScore'), rec.scores);
+    const checks = $('detailChecks');
+    checks.replaceChildren();
+    for (const name of Object.keys(rec.checks || {}).sort()) {
+        checks.append(eventElement(name, rec.checks[name]));
+    }
+    $('detail').hidden = false;
+    $('detail').scrollIntoView({ behavior: 'smooth' });
+}
+
+// download fetches an export with the keys in headers, which a plain link can't send.
+async function download(path, fileName) {
+    const response = await fetch(path, { headers: headers() });
+    if (!response.ok) {
+        alert(await errorText(response));
+        return;
+    }
+    const url = URL.createObjectURL(await response.blob());
+    const a = document.createElement('a');
+    a.href = url;
+    a.download = fileName;
+    a.click();
+    URL.revokeObjectURL(url);
+}
+
+$('refresh').addEventListener('click', () => loadHistory(0));
+$('older').addEventListener('click', () => loadHistory(historyOffset + pageSize));
+$('downloadReport').addEventListener('click', () =>
+    download(`../results/${selectedId}/report`, `analysis-${selectedId}.html`));
+$('downloadStix').addEventListener('click', () =>
+    download(`../results/${selectedId}/stix`, `analysis-${selectedId}.stix.json`));
+$('downloadMisp').addEventListener('click', () =>
+    download(`../results/${selectedId}/stix?format=misp`, `analysis-${selectedId}.misp.json`));
+$('reportWrong').addEventListener('click', async () => {
+    const falseNegative = confirm('Was this email malicious? OK = it should have been flagged, Cancel = it is legitimate.');
+    const reason = prompt('Why is the verdict wrong?');
+    if (!reason) return;
+    const response = await fetch(`../results/${selectedId}/feedback`, {
+        method: 'POST',
+        headers: { ...headers(), 'Content-Type': 'application/json' },
+        body: JSON.stringify({ kind: falseNegative ? 'false_negative' : 'false_positive', reason }),
+    });
+    alert(response.ok ? 'Thanks, your feedback was recorded.' : await errorText(response));
+});
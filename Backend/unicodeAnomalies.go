@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Unicode lets a sender make text read one way and match another: a right-to-left override
+// turns "invoice<U+202E>fdp.exe" into what looks like a PDF, a zero-width space splits
+// "Pay<U+200B>Pal" so filters miss it, a Cyrillic "а" in "Аpple" passes for Latin, and
+// mathematical or fullwidth letters (𝐏𝐚𝐲𝐏𝐚𝐥, ＰａｙＰａｌ) dodge keyword matching. Fullwidth letters
+// and digits are ordinary in Chinese, Japanese and Korean text, so they only count in Latin-script
+// text or inside a word with ASCII letters. The subject, From header and body are searched for each, with the exact sequences reported (invisible characters written as
+// <U+XXXX>). Zero-width characters in the body are scored by HiddenContent, so here they are
+// only listed.
+
+// UnicodeAnomaly is one suspicious sequence.
+type UnicodeAnomaly struct {
+	Field    string `json:"field"`    // subject, from or body
+	Kind     string `json:"kind"`     // bidiControl, zeroWidth, mixedScript, styledLetters or tagCharacters
+	Sequence string `json:"sequence"` // the word it is in, invisible characters escaped
+}
+
+// UnicodeAnomalyResult is the unicodeAnalysis event.
+type UnicodeAnomalyResult struct {
+	Anomalies   []UnicodeAnomaly `json:"anomalies"`
+	Counts      map[string]int   `json:"counts"` // per kind, including those past the list's cap
+	Message     string           `json:"message"`
+	ScoreImpact int              `json:"scoreImpact"`
+}
+
+const (
+	unicodeBidi   = "bidiControl"
+	unicodeZW     = "zeroWidth"
+	unicodeMixed  = "mixedScript"
+	unicodeStyled = "styledLetters"
+	unicodeTags   = "tagCharacters"
+
+	unicodeMaxAnomalies = 20
+)
+
+// confusableScripts are the scripts whose letters pass for Latin ones. A word mixing two of them
+// is suspicious; Japanese mixing Han and kana, or a word with digits, is not.
+var confusableScripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin}, {"Cyrillic", unicode.Cyrillic}, {"Greek", unicode.Greek},
+	{"Armenian", unicode.Armenian}, {"Cherokee", unicode.Cherokee},
+}
+
+// isBidiControl reports the embedding, override and isolate controls. The plain LRM/RLM marks
+// are common in right-to-left text and left out.
+func isBidiControl(r rune) bool {
+	return (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// isMathLetter reports mathematical alphanumeric letters and digits.
+func isMathLetter(r rune) bool {
+	return r >= 0x1d400 && r <= 0x1d7ff
+}
+
+// isFullwidthLetter reports fullwidth Latin letters and digits.
+func isFullwidthLetter(r rune) bool {
+	return (r >= 0xff10 && r <= 0xff19) || (r >= 0xff21 && r <= 0xff3a) || (r >= 0xff41 && r <= 0xff5a)
+}
+
+func isASCIILetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+// latinScriptText reports whether text is written in Latin script: it has ASCII letters and no
+// Chinese, Japanese or Korean characters.
+func latinScriptText(text string) bool {
+	ascii := false
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			return false
+		}
+		ascii = ascii || isASCIILetter(r)
+	}
+	return ascii
+}
+
+func isTagCharacter(r rune) bool {
+	return r >= 0xe0000 && r <= 0xe007f
+}
+
+// wordScripts returns the confusable scripts of a word's letters.
+func wordScripts(word string) []string {
+	var scripts []string
+	for _, s := range confusableScripts {
+		for _, r := range word {
+			if unicode.Is(s.table, r) {
+				scripts = append(scripts, s.name)
+				break
+			}
+		}
+	}
+	return scripts
+}
+
+// escapeInvisible writes the invisible characters of s as <U+XXXX>.
+func escapeInvisible(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if isBidiControl(r) || zeroWidthChars[r] || isTagCharacter(r) || r == '\u200e' || r == '\u200f' {
+			fmt.Fprintf(&b, "<U+%04X>", r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// findUnicodeAnomalies returns the anomalies of one field, word by word.
+func findUnicodeAnomalies(field, text string) []UnicodeAnomaly {
+	var found []UnicodeAnomaly
+	latin := latinScriptText(text)
+	for _, word := range strings.Fields(text) {
+		var bidi, tags, styled, fullwidth, ascii bool
+		for _, r := range word {
+			bidi = bidi || isBidiControl(r)
+			tags = tags || isTagCharacter(r)
+			styled = styled || isMathLetter(r)
+			fullwidth = fullwidth || isFullwidthLetter(r)
+			ascii = ascii || isASCIILetter(r)
+		}
+		styled = styled || (fullwidth && (latin || ascii))
+		seq := escapeInvisible(word)
+		if bidi {
+			found = append(found, UnicodeAnomaly{Field: field, Kind: unicodeBidi, Sequence: seq})
+		}
+		if tags {
+			found = append(found, UnicodeAnomaly{Field: field, Kind: unicodeTags, Sequence: seq})
+		}
+		if countZeroWidth(word) > 0 {
+			found = append(found, UnicodeAnomaly{Field: field, Kind: unicodeZW, Sequence: seq})
+		}
+		if styled {
+			found = append(found, UnicodeAnomaly{Field: field, Kind: unicodeStyled, Sequence: seq})
+		}
+		// Letters only, so "Москва/London" and "ΑΒΓ-123" aren't one mixed word.
+		for _, part := range strings.FieldsFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !zeroWidthChars[r] }) {
+			if scripts := wordScripts(part); len(scripts) > 1 {
+				found = append(found, UnicodeAnomaly{Field: field, Kind: unicodeMixed, Sequence: escapeInvisible(part) + " (" + strings.Join(scripts, "+") + ")"})
+			}
+		}
+	}
+	return found
+}
+
+var unicodeKindNames = map[string]string{
+	unicodeBidi:   "right-to-left override or embedding controls",
+	unicodeZW:     "zero-width characters inside words",
+	unicodeMixed:  "words mixing Latin with lookalike scripts",
+	unicodeStyled: "mathematical or fullwidth letters",
+	unicodeTags:   "invisible tag characters",
+}
+
+func performUnicodeAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, Email EmailData) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "UnicodeObfuscation" {
+			check = c
+			break
+		}
+	}
+	from := Email.From
+	if addr, err := mail.ParseAddress(Email.From); err == nil {
+		from = addr.Name + " " + addr.Address
+	}
+	var all []UnicodeAnomaly
+	all = append(all, findUnicodeAnomalies("subject", Email.Subject)...)
+	all = append(all, findUnicodeAnomalies("from", from)...)
+	all = append(all, findUnicodeAnomalies("body", Email.Text)...)
+
+	result := UnicodeAnomalyResult{Anomalies: []UnicodeAnomaly{}, Counts: map[string]int{}}
+	scored := false
+	for _, a := range all {
+		result.Counts[a.Kind]++
+		if len(result.Anomalies) < unicodeMaxAnomalies {
+			a.Sequence = redactPII(a.Sequence, Email)
+			result.Anomalies = append(result.Anomalies, a)
+		}
+		if !(a.Field == "body" && a.Kind == unicodeZW) {
+			scored = true
+		}
+	}
+	if len(all) == 0 {
+		result.Message = "No Unicode tricks in the subject, sender or body."
+		result.ScoreImpact = check.Impact
+	} else {
+		var kinds []string
+		for _, k := range []string{unicodeBidi, unicodeMixed, unicodeStyled, unicodeTags, unicodeZW} {
+			if n := result.Counts[k]; n > 0 {
+				kinds = append(kinds, fmt.Sprintf("%s (%d)", unicodeKindNames[k], n))
+			}
+		}
+		result.Message = "Found " + strings.Join(kinds, ", ") + "."
+		if !scored {
+			result.ScoreImpact = check.Impact // already scored by HiddenContent
+		}
+	}
+	ch <- CheckResult{EventName: "unicodeAnalysis", Payload: result}
+}
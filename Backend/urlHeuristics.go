@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/publicsuffix"
+)
+
+// LinkMismatch is an anchor whose visible text names one domain while its href goes to another.
+type LinkMismatch struct {
+	Text         string `json:"text"`
+	Href         string `json:"href"`
+	TextDomain   string `json:"textDomain"`
+	ActualDomain string `json:"actualDomain"`
+}
+
+// domainLikeText matches anchor text that looks like a bare URL or domain, e.g. "paypal.com" or "https://www.paypal.com/login".
+var domainLikeText = regexp.MustCompile(`(?i)^(?:https?://)?(?:[a-z0-9-]+\.)+[a-z]{2,63}(?::\d+)?(?:[/?#]\S*)?$`)
+
+// registrableDomain returns the eTLD+1 for a URL or bare host, or "" when it has none.
+func registrableDomain(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return ""
+	}
+	d, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return ""
+	}
+	return d
+}
+
+// findLinkMismatches flags anchors whose text is itself a URL/domain with a different registrable
+// domain than the link's real destination.
+func findLinkMismatches(htmlStr string) []LinkMismatch {
+	mismatches := []LinkMismatch{}
+	seen := make(map[string]struct{})
+	for _, l := range extractLinksFromHTML(htmlStr) {
+		text := strings.TrimSpace(l.Text)
+		href := html.UnescapeString(strings.TrimSpace(l.URL))
+		lowerHref := strings.ToLower(href)
+		if !strings.HasPrefix(lowerHref, "http://") && !strings.HasPrefix(lowerHref, "https://") {
+			continue
+		}
+		if !domainLikeText.MatchString(text) {
+			continue
+		}
+		textDomain := registrableDomain(text)
+		actualDomain := registrableDomain(href)
+		if textDomain == "" || actualDomain == "" || textDomain == actualDomain {
+			continue
+		}
+		key := text + "\x00" + href
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		mismatches = append(mismatches, LinkMismatch{Text: text, Href: href, TextDomain: textDomain, ActualDomain: actualDomain})
+	}
+	return mismatches
+}
+
+// URLHeuristicFinding lists the structural red flags found on one URL.
+type URLHeuristicFinding struct {
+	URL     string   `json:"url"`
+	Reasons []string `json:"reasons"`
+	Penalty int      `json:"penalty"`
+
+	Deceptive *DeceptiveSubdomain `json:"deceptive,omitempty"` // with the deceptive-subdomain reason
+}
+
+// maxSubdomainDepth is the number of labels allowed in front of the registrable domain before a
+// host is considered suspiciously deep (e.g. paypal.com.secure.login.account.evil.com).
+const maxSubdomainDepth = 4
+
+// urlHeuristicPenalties weighs each red flag against the URLHeuristics check impact.
+var urlHeuristicPenalties = map[string]int{
+	"javascript-scheme":   5,
+	"data-scheme":         3,
+	"userinfo":            3,
+	"ip-literal":          3,
+	"deep-subdomain":      1,
+	"deceptive-subdomain": 5,
+}
+
+// isIPLiteralHost reports whether host is an IP address, including the decimal ("3232235777")
+// and hex ("0xC0A80001") integer forms browsers still accept.
+func isIPLiteralHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if strings.HasPrefix(host, "0x") {
+		_, err := strconv.ParseUint(host[2:], 16, 32)
+		return err == nil
+	}
+	if _, err := strconv.ParseUint(host, 10, 32); err == nil {
+		return true
+	}
+	return false
+}
+
+// urlRedFlags returns the heuristic reasons that apply to a single URL.
+func urlRedFlags(raw string) []string {
+	lower := strings.ToLower(strings.TrimSpace(raw))
+	switch {
+	case strings.HasPrefix(lower, "javascript:"):
+		return []string{"javascript-scheme"}
+	case strings.HasPrefix(lower, "data:"):
+		return []string{"data-scheme"}
+	}
+	if strings.HasPrefix(lower, "www.") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+
+	var reasons []string
+	if u.User != nil {
+		// http://paypal.com@evil.com shows a trusted name but connects to evil.com
+		reasons = append(reasons, "userinfo")
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if isIPLiteralHost(host) {
+		return append(reasons, "ip-literal")
+	}
+	if d, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil && host != d {
+		depth := strings.Count(strings.TrimSuffix(host, "."+d), ".") + 1
+		if depth > maxSubdomainDepth {
+			reasons = append(reasons, "deep-subdomain")
+		}
+	}
+	return reasons
+}
+
+// linkHost returns the host of an http(s) or scheme-less www. link, or "".
+func linkHost(raw string) string {
+	if strings.HasPrefix(strings.ToLower(raw), "www.") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// findSuspiciousURLs runs the structural URL heuristics over every link in the email, and looks
+// up each host's subdomain in the company database for impersonated domains. Unlike the scan
+// list this includes javascript:/data: hrefs and the links skipped as sensitive, since nothing
+// here visits the URL.
+func findSuspiciousURLs(ctx context.Context, store CompanyStore, Email EmailData) []URLHeuristicFinding {
+	candidates := []string{}
+	for _, l := range extractLinksFromHTML(Email.HTML) {
+		candidates = append(candidates, html.UnescapeString(strings.TrimSpace(l.URL)))
+	}
+	links := append(getURL(Email.Text), formActionURLs(Email.HTML)...)
+	links = append(links, activeContentURLs(Email.HTML)...)
+	if Email.Padding != nil {
+		links = append(links, Email.Padding.URLs...)
+	}
+	for _, u := range links {
+		candidates = append(candidates, html.UnescapeString(strings.TrimSpace(u)))
+	}
+
+	findings := []URLHeuristicFinding{}
+	seen := make(map[string]struct{})
+	for _, u := range candidates {
+		if _, dup := seen[u]; dup || u == "" {
+			continue
+		}
+		seen[u] = struct{}{}
+		reasons := urlRedFlags(u)
+		var deceptive *DeceptiveSubdomain
+		if host := linkHost(u); host != "" {
+			if deceptive = findDeceptiveSubdomain(ctx, store, host); deceptive != nil {
+				reasons = append(reasons, "deceptive-subdomain")
+			}
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+		f := URLHeuristicFinding{URL: u, Reasons: reasons, Deceptive: deceptive}
+		for _, r := range reasons {
+			f.Penalty += urlHeuristicPenalties[r]
+		}
+		if r := []rune(f.URL); len(r) > 200 {
+			f.URL = string(r[:200]) + "…" // data: URIs can be enormous
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// URLListEntry is one operator-managed allow- or blocklist entry. A pattern containing "://"
+// is a URL prefix; anything else is a domain that also covers its subdomains.
+type URLListEntry struct {
+	Pattern   string    `json:"pattern"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	urlAllowList = "allow"
+	urlBlockList = "block"
+)
+
+func (s *resultsStore) urlListEntries(list string) ([]URLListEntry, error) {
+	rows, err := s.db.Query(`SELECT pattern, COALESCE(note, ''), created_at FROM url_lists WHERE list = ? ORDER BY pattern`, list)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			slog.Warn("closing url list rows failed", "err", err)
+		}
+	}(rows)
+	entries := []URLListEntry{}
+	for rows.Next() {
+		var e URLListEntry
+		if err := rows.Scan(&e.Pattern, &e.Note, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *resultsStore) addURLListEntry(list string, e URLListEntry) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO url_lists (list, pattern, note, created_at) VALUES (?, ?, ?, ?)`,
+		list, e.Pattern, e.Note, time.Now().UTC())
+	return err
+}
+
+func (s *resultsStore) removeURLListEntry(list, pattern string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM url_lists WHERE list = ? AND pattern = ?`, list, pattern)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// normaliseListPattern lower-cases domains and trims URL prefixes so duplicates collapse.
+func normaliseListPattern(p string) string {
+	p = strings.TrimSpace(p)
+	if strings.Contains(p, "://") {
+		return normaliseFeedURL(p)
+	}
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(p, ".")), "*.")
+}
+
+// urlListMatches reports whether rawURL is covered by a list pattern. A URL prefix must end
+// where a host, port or path segment does, so https://example.com doesn't cover
+// https://example.com.evil.net and https://example.com/pay doesn't cover https://example.com/payday.
+func urlListMatches(pattern, rawURL string) bool {
+	if strings.Contains(pattern, "://") {
+		u := normaliseFeedURL(rawURL)
+		if !strings.HasPrefix(u, pattern) {
+			return false
+		}
+		return len(u) == len(pattern) || strings.ContainsAny(pattern[len(pattern)-1:], "/?#") ||
+			strings.ContainsAny(u[len(pattern):len(pattern)+1], "/?#:")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// applyURLLists decides the URLs covered by the operator lists. Blocklisted URLs get a malicious
+// verdict, allowlisted ones a clean verdict; everything else is returned for normal scanning.
+// The blocklist wins when a URL is on both. The server-wide blocklist is consulted first, so a
+// tenant's allowlist can't let through what the operator blocked; then the profile's own lists,
+// then the server-wide allowlist.
+func applyURLLists(urls []string, p *Profile) (verdicts []Verdict, remaining []string) {
+	if results == nil {
+		return p.applyProfileURLLists(urls)
+	}
+	blocked, err := results.urlListEntries(urlBlockList)
+	if err != nil {
+		slog.Error("reading URL blocklist failed", "err", err)
+		return p.applyProfileURLLists(urls)
+	}
+	allowed, err := results.urlListEntries(urlAllowList)
+	if err != nil {
+		slog.Error("reading URL allowlist failed", "err", err)
+		allowed = nil
+	}
+
+	var unblocked []string
+urls:
+	for _, u := range urls {
+		for _, e := range blocked {
+			if urlListMatches(e.Pattern, u) {
+				verdicts = append(verdicts, Verdict{
+					URL: u, Source: "blocklist", Score: 100, Cats: []string{"blocklisted"},
+					PlatformVerdict: true, FinalDecision: true,
+				})
+				continue urls
+			}
+		}
+		unblocked = append(unblocked, u)
+	}
+	profileVerdicts, urls := p.applyProfileURLLists(unblocked)
+	verdicts = append(verdicts, profileVerdicts...)
+
+allowedURLs:
+	for _, u := range urls {
+		for _, e := range allowed {
+			if urlListMatches(e.Pattern, u) {
+				verdicts = append(verdicts, Verdict{URL: u, Source: "allowlist", Cats: []string{}})
+				continue allowedURLs
+			}
+		}
+		remaining = append(remaining, u)
+	}
+	return verdicts, remaining
+}
+
+// urlListHandler serves CRUD for one list: GET lists entries, POST {pattern, note} adds one,
+// DELETE ?pattern= removes one.
+func urlListHandler(list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if results == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "results store unavailable"})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			entries, err := results.urlListEntries(list)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"list": list, "entries": entries})
+		case http.MethodPost, http.MethodPut:
+			var e URLListEntry
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body must be JSON: {\"pattern\": \"...\", \"note\": \"...\"}"})
+				return
+			}
+			e.Pattern = normaliseListPattern(e.Pattern)
+			if e.Pattern == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "pattern is required"})
+				return
+			}
+			if err := results.addURLListEntry(list, e); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"list": list, "pattern": e.Pattern})
+		case http.MethodDelete:
+			pattern := normaliseListPattern(r.URL.Query().Get("pattern"))
+			removed, err := results.removeURLListEntry(list, pattern)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if !removed {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "pattern not found"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"list": list, "removed": pattern})
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Links that the lists, the threat feeds and Safe Browsing didn't decide are scanned by the
+// live scanners named in URL_SCANNERS (default virustotal), in order: when one fails, has no
+// key or is out of quota, the next one is asked, so URL analysis doesn't depend on a single
+// vendor. "heuristic" judges the link from its structure alone and never fails, so as the last
+// scanner it guarantees a verdict for every link.
+
+// URLScanner is a live URL scanning service.
+type URLScanner interface {
+	Name() string
+	Configured() bool // has the keys it needs
+	Scan(ctx context.Context, u string, req URLScanRequest) (*Verdict, error)
+}
+
+// URLScanRequest is what a scanner may need besides the URL.
+type URLScanRequest struct {
+	Options URLScanOptions // urlscan.io and Cloudflare submission parameters
+	Store   CompanyStore   // for the heuristic scanner's impersonation lookups
+}
+
+// knownURLScanners are the scanners URL_SCANNERS can name.
+var knownURLScanners = map[string]URLScanner{
+	"virustotal": virusTotalScanner{},
+	"urlscan":    urlscanScanner{},
+	"radar":      radarScanner{},
+	"heuristic":  heuristicScanner{},
+}
+
+var (
+	urlScanners   = []URLScanner{virusTotalScanner{}}
+	urlScanQuotas = map[string]*scanQuota{}
+)
+
+// parseURLScanners turns URL_SCANNERS into the scanners to ask, in order.
+func parseURLScanners(raw string) ([]URLScanner, error) {
+	var scanners []URLScanner
+	seen := map[string]bool{}
+	for _, name := range splitList(raw) {
+		name = strings.ToLower(name)
+		s, ok := knownURLScanners[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown URL scanner %q (virustotal, urlscan, radar or heuristic)", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			scanners = append(scanners, s)
+		}
+	}
+	if len(scanners) == 0 {
+		return nil, errors.New("no URL scanner named")
+	}
+	return scanners, nil
+}
+
+// urlScannerSelected reports whether URL_SCANNERS names the scanner.
+func urlScannerSelected(name string) bool {
+	for _, s := range urlScanners {
+		if s.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// scanURL asks the scanners in turn until one gives a verdict, each within its own quota.
+func scanURL(ctx context.Context, u string, req URLScanRequest, queued func(wait time.Duration)) (*Verdict, error) {
+	var errs []error
+	for _, s := range urlScanners {
+		if !s.Configured() {
+			errs = append(errs, fmt.Errorf("%s: no API key", s.Name()))
+			continue
+		}
+		v, err := scanWithinQuota(ctx, s, u, req, queued)
+		if err == nil && v != nil {
+			return v, nil
+		}
+		if err != nil {
+			slog.DebugContext(ctx, "URL scanner failed, trying the next one", "scanner", s.Name(), "url", u, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", s.Name(), err))
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// scanWithinQuota scans u with s once its quota admits it, retrying once after a 429.
+func scanWithinQuota(ctx context.Context, s URLScanner, u string, req URLScanRequest, queued func(wait time.Duration)) (*Verdict, error) {
+	quota := urlScanQuotas[s.Name()]
+	for attempt := 0; ; attempt++ {
+		if err := quota.admit(ctx, queued); err != nil {
+			return nil, err
+		}
+		v, err := s.Scan(ctx, u, req)
+		var limited *scanLimitError
+		if !errors.As(err, &limited) || quota == nil {
+			return v, err
+		}
+		quota.pause(time.Now().Add(limited.retryAfter))
+		if attempt > 0 {
+			return nil, fmt.Errorf("%w: %v", errScanQuota, err)
+		}
+	}
+}
+
+type virusTotalScanner struct{}
+
+func (virusTotalScanner) Name() string     { return "virustotal" }
+func (virusTotalScanner) Configured() bool { return VTotalAPIKey != "" }
+func (virusTotalScanner) Scan(ctx context.Context, u string, _ URLScanRequest) (*Verdict, error) {
+	return checkURLsVTotal(ctx, u)
+}
+
+type urlscanScanner struct{}
+
+func (urlscanScanner) Name() string     { return "urlscan" }
+func (urlscanScanner) Configured() bool { return URLScanAPIKey != "" }
+func (urlscanScanner) Scan(ctx context.Context, u string, req URLScanRequest) (*Verdict, error) {
+	return checkURLs(ctx, u, req.Options)
+}
+
+// radarScanner submits links to Cloudflare's URL Scanner (the scanner behind Cloudflare Radar).
+type radarScanner struct{}
+
+func (radarScanner) Name() string { return "radar" }
+func (radarScanner) Configured() bool {
+	return cloudflareAccountID != "" && cloudflareAPIToken != ""
+}
+
+func (radarScanner) Scan(ctx context.Context, u string, req URLScanRequest) (*Verdict, error) {
+	defer trackDependency(ctx, "urlScan", time.Now())
+	c := newClientWithDefaultHeaders()
+	c.Timeout = 20 * time.Second
+	base := "https://api.cloudflare.com/client/v4/accounts/" + url.PathEscape(cloudflareAccountID) + "/urlscanner/v2/"
+
+	// Cloudflare only has public and unlisted scans.
+	visibility := "Unlisted"
+	if req.Options.Visibility == "public" {
+		visibility = "Public"
+	}
+	submission, err := json.Marshal(struct {
+		URL        string `json:"url"`
+		Visibility string `json:"visibility"`
+		Country    string `json:"country,omitempty"`
+	}{u, visibility, strings.ToUpper(req.Options.Country)})
+	if err != nil {
+		return nil, fmt.Errorf("encode submit req: %w", err)
+	}
+	submitReq, err := http.NewRequestWithContext(ctx, "POST", base+"scan", bytes.NewReader(submission))
+	if err != nil {
+		return nil, fmt.Errorf("create submit req: %w", err)
+	}
+	submitReq.Header.Set("Authorization", "Bearer "+cloudflareAPIToken)
+	submitReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(submitReq)
+	if err != nil {
+		return nil, fmt.Errorf("submit scan: %w", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if cerr := resp.Body.Close(); cerr != nil {
+		slog.WarnContext(ctx, "closing response body failed", "err", cerr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read submit body: %w", err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, scanLimited("Cloudflare", resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("submit error: %s: %s", resp.Status, string(body))
+	}
+	var submitted struct {
+		UUID string `json:"uuid"`
+	}
+	if err := json.Unmarshal(body, &submitted); err != nil || submitted.UUID == "" {
+		return nil, fmt.Errorf("submit response without a scan id: %s", string(body))
+	}
+	slog.DebugContext(ctx, "Cloudflare scan submitted", "url", u, "uuid", submitted.UUID)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("polling cancelled: %w", ctx.Err())
+		case <-ticker.C:
+		}
+		pollReq, err := http.NewRequestWithContext(ctx, "GET", base+"result/"+url.PathEscape(submitted.UUID), nil)
+		if err != nil {
+			return nil, fmt.Errorf("create poll req: %w", err)
+		}
+		pollReq.Header.Set("Authorization", "Bearer "+cloudflareAPIToken)
+		pollResp, err := c.Do(pollReq)
+		if err != nil {
+			slog.WarnContext(ctx, "Cloudflare poll failed, retrying", "uuid", submitted.UUID, "err", err)
+			continue
+		}
+		body, err := io.ReadAll(pollResp.Body)
+		if cerr := pollResp.Body.Close(); cerr != nil {
+			slog.WarnContext(ctx, "closing response body failed", "err", cerr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read poll body: %w", err)
+		}
+		if pollResp.StatusCode == http.StatusNotFound {
+			continue // still scanning
+		}
+		if pollResp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("poll error: %s: %s", pollResp.Status, string(body))
+		}
+		var result struct {
+			Verdicts struct {
+				Overall struct {
+					Categories []string `json:"categories"`
+					Malicious  bool     `json:"malicious"`
+				} `json:"overall"`
+			} `json:"verdicts"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("decode result: %w", err)
+		}
+		overall := result.Verdicts.Overall
+		decision := overall.Malicious
+		for _, cat := range overall.Categories {
+			if cat == "phishing" || cat == "malware" {
+				decision = true
+			}
+		}
+		cats := overall.Categories
+		if cats == nil {
+			cats = []string{}
+		}
+		return &Verdict{
+			URL:             u,
+			Source:          "radar",
+			Cats:            cats,
+			Report:          "https://radar.cloudflare.com/scan/" + submitted.UUID,
+			PlatformVerdict: overall.Malicious,
+			FinalDecision:   decision,
+		}, nil
+	}
+}
+
+// heuristicScanner judges a link without visiting it or asking anyone: the link is treated as
+// malicious when it hides its real host (user@host, an IP address, a script or data URL) or
+// shows a known domain or brand in front of an unrelated one.
+type heuristicScanner struct{}
+
+// heuristicMalicious are the URL red flags the heuristic scanner treats as malicious; the others
+// (deep subdomains) only count towards the URLHeuristics check.
+var heuristicMalicious = map[string]bool{
+	"javascript-scheme": true, "data-scheme": true, "userinfo": true, "ip-literal": true, "deceptive-subdomain": true,
+}
+
+func (heuristicScanner) Name() string     { return "heuristic" }
+func (heuristicScanner) Configured() bool { return true }
+func (heuristicScanner) Scan(ctx context.Context, u string, req URLScanRequest) (*Verdict, error) {
+	reasons := urlRedFlags(u)
+	if host := linkHost(u); host != "" && findDeceptiveSubdomain(ctx, req.Store, host) != nil {
+		reasons = append(reasons, "deceptive-subdomain")
+	}
+	v := &Verdict{URL: u, Source: "heuristic", Cats: []string{}}
+	for _, r := range reasons {
+		v.Cats = append(v.Cats, r)
+		v.Score += urlHeuristicPenalties[r]
+		v.FinalDecision = v.FinalDecision || heuristicMalicious[r]
+	}
+	v.PlatformVerdict = v.FinalDecision
+	return v, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+// Each URL verdict is graded malicious, suspicious, unknown or clean, and the MaliciousURLFound
+// points shrink with the worst of them: a malicious link still costs all of them, each
+// suspicious one (a single VirusTotal engine, a positive urlscan.io score below 50, a heuristic
+// red flag) half, and links that couldn't be judged nothing. The counts are in
+// URLAnalysisResult.Severities.
+
+const (
+	severityMalicious  = "malicious"
+	severitySuspicious = "suspicious"
+	severityUnknown    = "unknown"
+	severityClean      = "clean"
+)
+
+// urlscanMaliciousScore is the urlscan.io overall score (-100 to 100) from which a link counts as
+// malicious without urlscan.io's own verdict.
+const urlscanMaliciousScore = 50
+
+// gradeVerdict grades a verdict according to the source that produced it.
+func gradeVerdict(v Verdict) string {
+	switch v.Source {
+	case "urlscan", "radar":
+		for _, c := range v.Cats {
+			if c == "phishing" || c == "malware" {
+				return severityMalicious
+			}
+		}
+		switch {
+		case v.PlatformVerdict || v.Score >= urlscanMaliciousScore:
+			return severityMalicious
+		case v.Score > 0 || len(v.Cats) > 0:
+			return severitySuspicious
+		}
+		return severityClean
+	case "virustotal":
+		// Cats has the category of every engine with an opinion, harmless ones included.
+		engines := 0
+		for _, c := range v.Cats {
+			if c == "malicious" {
+				engines++
+			}
+		}
+		switch {
+		case engines >= 2:
+			return severityMalicious
+		case v.Score > 0:
+			return severitySuspicious
+		}
+		return severityClean
+	case "heuristic":
+		// Nothing visited the link, so a clean structure doesn't make it clean.
+		if v.FinalDecision {
+			return severitySuspicious
+		}
+		return severityUnknown
+	}
+	// Lists, threat feeds and Safe Browsing only answer listed or not.
+	if v.FinalDecision {
+		return severityMalicious
+	}
+	return severityClean
+}
+
+// gradeVerdicts sets the severity of every verdict and counts them; unjudged is the number of
+// links that got no verdict at all.
+func gradeVerdicts(verdicts []Verdict, unjudged int) map[string]int {
+	counts := map[string]int{severityMalicious: 0, severitySuspicious: 0, severityUnknown: unjudged, severityClean: 0}
+	for i := range verdicts {
+		verdicts[i].Severity = gradeVerdict(verdicts[i])
+		counts[verdicts[i].Severity]++
+	}
+	return counts
+}
+
+// severityImpact is the share of impact left after the graded verdicts.
+func severityImpact(impact int, counts map[string]int) int {
+	if counts[severityMalicious] > 0 {
+		return 0
+	}
+	return max(impact-counts[severitySuspicious]*impact/2, 0)
+}
+
+// scanUpdate is the urlScanResult event for a verdict.
+func scanUpdate(v Verdict) URLScanUpdate {
+	return URLScanUpdate{URL: v.URL, FinalDecision: v.FinalDecision, Report: v.Report, Severity: gradeVerdict(v)}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// URLScanOptions are the urlscan.io submission parameters: who can see the scan (public,
+// unlisted or private) and the country it is run from (empty lets urlscan.io choose). The server
+// defaults come from URLSCAN_VISIBILITY and URLSCAN_COUNTRY; a request can override them with
+// ?urlscanVisibility= and ?urlscanCountry=.
+type URLScanOptions struct {
+	Visibility string `json:"visibility"`
+	Country    string `json:"country,omitempty"`
+}
+
+var urlscanDefaults = URLScanOptions{Visibility: "unlisted"}
+
+var urlscanVisibilities = map[string]bool{"public": true, "unlisted": true, "private": true}
+
+// checkURLScanOptions normalises o, or says which parameter is invalid.
+func checkURLScanOptions(o URLScanOptions) (URLScanOptions, error) {
+	o.Visibility = strings.ToLower(strings.TrimSpace(o.Visibility))
+	o.Country = strings.ToLower(strings.TrimSpace(o.Country))
+	if !urlscanVisibilities[o.Visibility] {
+		return o, fmt.Errorf("urlscan visibility must be public, unlisted or private, got %q", o.Visibility)
+	}
+	if o.Country != "" && !validCountryCode.MatchString(o.Country) {
+		return o, fmt.Errorf("urlscan country must be a two-letter ISO 3166-1 code, got %q", o.Country)
+	}
+	return o, nil
+}
+
+// requestedURLScanOptions applies the request's urlscanVisibility and urlscanCountry parameters
+// over the server defaults.
+func requestedURLScanOptions(r *http.Request) (URLScanOptions, error) {
+	o := urlscanDefaults
+	if v := r.URL.Query().Get("urlscanVisibility"); v != "" {
+		o.Visibility = v
+	}
+	if c := r.URL.Query().Get("urlscanCountry"); c != "" {
+		o.Country = c
+	}
+	return checkURLScanOptions(o)
+}
+
+// urlscanQueryValue quotes s for a urlscan.io search query, which follows the Elasticsearch
+// query string syntax.
+func urlscanQueryValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
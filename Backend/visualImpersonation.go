@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// The rendered screenshot is also shown to Gemini on its own with a single question: which brand
+// does this email look like it comes from? Logos, colours and layout are what a reader
+// recognises, and they are images the text analysis never reads. The brand's domains from the
+// company database and the aliases are compared with the sender's; a brand that is known but
+// doesn't own the sender's domain is visual impersonation, and costs the rendered score the
+// VisualImpersonation penalty, scaled by Gemini's confidence. Brands the database doesn't know
+// are reported but not penalised. The result is part of renderedAnalysis and is streamed on its
+// own as a visualImpersonation event.
+
+// VisualImpersonationResult is the visualImpersonation event.
+type VisualImpersonationResult struct {
+	BrandFound    bool        `json:"brandFound"`
+	Brand         string      `json:"brand,omitempty"`
+	Confidence    *float64    `json:"confidence,omitempty"`
+	Cues          string      `json:"cues,omitempty"`         // what Gemini recognised the brand by
+	BrandDomains  []string    `json:"brandDomains,omitempty"` // the brand's domains in the database and aliases
+	SenderMatches bool        `json:"senderMatches"`
+	Impersonation bool        `json:"impersonation"`
+	Message       string      `json:"message"`
+	ScoreImpact   int         `json:"scoreImpact"` // 0, or the (negative) VisualImpersonation impact scaled by confidence
+	AIStats       AICallStats `json:"aiStats"`
+	Error         string      `json:"error,omitempty"`
+}
+
+// visualBrandAnswer is Gemini's answer about the screenshot.
+type visualBrandAnswer struct {
+	BrandFound bool     `json:"brandFound"`
+	Brand      string   `json:"brand"`
+	Confidence *float64 `json:"confidence"`
+	Cues       string   `json:"cues"`
+}
+
+// askVisualBrand asks Gemini which brand the screenshots (the normal rendering first, then its
+// render variants) present the email as.
+func askVisualBrand(screenshotPaths []string, Email EmailData) (visualBrandAnswer, AICallStats, error) {
+	if !geminiEnabled {
+		return visualBrandAnswer{}, AICallStats{}, errGeminiDisabled
+	}
+	var contents []*genai.Content
+	for _, path := range screenshotPaths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return visualBrandAnswer{}, AICallStats{}, err
+		}
+		mime := http.DetectContentType(b)
+		if !strings.HasPrefix(mime, "image/") {
+			return visualBrandAnswer{}, AICallStats{}, fmt.Errorf("screenshot is %s, not an image", mime)
+		}
+		contents = append(contents, genai.NewContentFromBytes(b, mime, "user"))
+	}
+	question := "Which brand does this email visually present itself as, or impersonate?"
+	if len(contents) > 1 {
+		question = "These are the same email rendered normally, in dark mode or on a phone. " + question
+	}
+	contents = append(contents, genai.NewContentFromText(question, "user"))
+	ctx := Email.requestContext()
+	client, err := genai.NewClient(ctx, &genai.ClientConfig{APIKey: geminiKey, Backend: genai.BackendGeminiAPI})
+	if err != nil {
+		return visualBrandAnswer{}, AICallStats{}, err
+	}
+	cfg := &genai.GenerateContentConfig{
+		ResponseMIMEType: "application/json",
+		ResponseSchema: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"brandFound": {Type: genai.TypeBoolean},
+				"brand":      {Type: genai.TypeString},
+				"confidence": {Type: genai.TypeNumber, Minimum: genai.Ptr(0.0), Maximum: genai.Ptr(1.0)},
+				"cues":       {Type: genai.TypeString},
+			},
+			PropertyOrdering: []string{"brandFound", "brand", "confidence", "cues"},
+		},
+		SystemInstruction: genai.NewContentFromText(
+			"You look at screenshots of emails and say which brand a reader would believe the email is from, "+
+				"judging only by what is visible: logos, colours, typefaces, layout and product imagery. "+
+				"Ignore the sender address and any claims in the text about who sent it or which domain is official. "+
+				"Output ONLY valid JSON with the schema: {brandFound:boolean, brand:string, confidence:number, cues:string}. "+
+				"brand is the company or product name as commonly written, without legal suffixes; brandFound is false "+
+				"when the email shows no recognisable brand. confidence is how sure you are, from 0 (a guess) to 1 (certain). "+
+				"cues briefly lists what you recognised the brand by.",
+			"system",
+		),
+	}
+	model, fallback := Email.Profile.aiModels()
+	res, stats, err := generateWithRetry(ctx, client, model, fallback, contents, cfg)
+	if err != nil {
+		return visualBrandAnswer{}, stats, err
+	}
+	var answer visualBrandAnswer
+	if err := json.Unmarshal([]byte(strings.TrimSpace(res.Text())), &answer); err != nil {
+		return visualBrandAnswer{}, stats, fmt.Errorf("parse AI json: %w", err)
+	}
+	return answer, stats, nil
+}
+
+// checkVisualImpersonation asks about the screenshots and compares the brand with the sender.
+func checkVisualImpersonation(screenshotPaths []string, store CompanyStore, Email EmailData) VisualImpersonationResult {
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "VisualImpersonation" {
+			check = c
+			break
+		}
+	}
+	answer, stats, err := askVisualBrand(screenshotPaths, Email)
+	result := VisualImpersonationResult{AIStats: stats}
+	if err != nil {
+		Email.logger().Warn("visual brand check failed", "err", err)
+		result.Error = "Could not ask which brand the screenshot shows."
+		result.Message = result.Error
+		return result
+	}
+	result.BrandFound, result.Brand, result.Confidence, result.Cues = answer.BrandFound, answer.Brand, answer.Confidence, answer.Cues
+	if !answer.BrandFound || strings.TrimSpace(answer.Brand) == "" {
+		result.Message = "The rendered email doesn't show a recognisable brand."
+		return result
+	}
+
+	ctx := Email.requestContext()
+	domains, err := store.CompanyDomains(ctx, answer.Brand)
+	if err != nil {
+		Email.logger().Warn("looking up the visual brand failed", "brand", answer.Brand, "err", err)
+	}
+	aliased, err := aliasDomains(ctx, store, answer.Brand)
+	if err != nil {
+		Email.logger().Warn("reading organisation aliases failed", "err", err)
+	}
+	seen := map[string]bool{}
+	for _, d := range append(domains, aliased...) {
+		if d = strings.ToLower(d); !seen[d] {
+			seen[d] = true
+			result.BrandDomains = append(result.BrandDomains, d)
+		}
+	}
+	for _, d := range result.BrandDomains {
+		result.SenderMatches = result.SenderMatches || domainCovers(d, Email.Domain)
+	}
+	switch {
+	case result.SenderMatches:
+		result.Message = fmt.Sprintf("The email looks like %s and is sent from one of its domains.", answer.Brand)
+	case len(result.BrandDomains) == 0:
+		// An unknown brand can't be checked; a sender named after it is still worth saying.
+		result.SenderMatches = domainNamedAfter(Email.Domain, answer.Brand)
+		result.Message = fmt.Sprintf("The email looks like %s, which isn't in the company database.", answer.Brand)
+	default:
+		result.Impersonation = true
+		result.ScoreImpact = min(scaleByConfidence(check.Impact, answer.Confidence), 0)
+		result.Message = fmt.Sprintf("The email looks like %s but is sent from %s, which isn't one of its domains.", answer.Brand, Email.Domain)
+	}
+	return result
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// Operators can scan attachments and the HTML body against their own YARA signatures: every
+// .yar/.yara file in YARA_RULES_DIR. A binary built with -tags yara scans in-process through
+// libyara (yaraLib.go); otherwise the yara command compiles the rules for each email. An email
+// matching any rule loses the YARARuleMatch points.
+
+// YARAMatch is one rule and the parts of the email it matched.
+type YARAMatch struct {
+	Rule    string   `json:"rule"`
+	Targets []string `json:"targets"` // attachment file names, or "HTML body"
+}
+
+type YARAAnalysisResult struct {
+	Matches     []YARAMatch `json:"matches"`
+	Scanned     int         `json:"scanned"` // parts scanned, the HTML body included
+	Message     string      `json:"message"`
+	ScoreImpact int         `json:"scoreImpact"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// yaraTimeout bounds one yara run over all of an email's parts.
+const yaraTimeout = 30 * time.Second
+
+// yaraLibScan scans targets with the rule files in-process. It is set when libyara is linked
+// in (-tags yara); nil means the yara command is used. It returns the target names by rule.
+var yaraLibScan func(ctx context.Context, rules []string, targets map[string][]byte) (map[string][]string, error)
+
+// yaraEnabled reports whether a rules directory is configured.
+func yaraEnabled() bool {
+	return yaraRulesDir != ""
+}
+
+// yaraRuleFiles lists the rule files in dir, sorted.
+func yaraRuleFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if !e.IsDir() && (ext == ".yar" || ext == ".yara") {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// yaraOutputLine is one match printed by the yara command: the rule name, then the file.
+var yaraOutputLine = regexp.MustCompile(`^(\S+) (.+)$`)
+
+// scanYARA runs the rules over targets, which maps a display name to the content, with libyara
+// when it is linked in and otherwise with the yara command, using dir for the files it needs.
+// Matches are sorted by rule.
+func scanYARA(ctx context.Context, dir string, targets map[string][]byte) ([]YARAMatch, error) {
+	defer trackDependency(ctx, "yara", time.Now())
+	rules, err := yaraRuleFiles(yaraRulesDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no .yar or .yara files in %s", yaraRulesDir)
+	}
+	ctx, cancel := context.WithTimeout(ctx, yaraTimeout)
+	defer cancel()
+	var hits map[string][]string
+	if yaraLibScan != nil {
+		hits, err = yaraLibScan(ctx, rules, targets)
+	} else {
+		hits, err = scanYARACommand(ctx, dir, rules, targets)
+	}
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]YARAMatch, 0, len(hits))
+	for rule, names := range hits {
+		sort.Strings(names)
+		matches = append(matches, YARAMatch{Rule: rule, Targets: names})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Rule < matches[j].Rule })
+	return matches, nil
+}
+
+// scanYARACommand writes each target to its own file in dir and runs the yara command over them.
+func scanYARACommand(ctx context.Context, dir string, rules []string, targets map[string][]byte) (map[string][]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	byPath := map[string]string{}
+	for i, name := range names {
+		// Numbered files: attachment names can't be trusted as paths.
+		path := filepath.Join(dir, "part-"+strconv.Itoa(i))
+		if err := os.WriteFile(path, targets[name], 0o644); err != nil {
+			return nil, err
+		}
+		byPath[path] = name
+	}
+
+	args := append([]string{"--no-warnings", "--recursive"}, rules...)
+	cmd := exec.CommandContext(ctx, yaraCommand, append(args, dir)...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("yara: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	hits := map[string][]string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		m := yaraOutputLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m == nil {
+			continue
+		}
+		if name, ok := byPath[m[2]]; ok {
+			hits[m[1]] = append(hits[m[1]], name)
+		}
+	}
+	return hits, nil
+}
+
+// yaraTargets collects the decoded attachments and the raw HTML body of env by display name.
+func yaraTargets(env *enmime.Envelope) map[string][]byte {
+	targets := map[string][]byte{}
+	for i, p := range append(append(env.Attachments, env.Inlines...), env.OtherParts...) {
+		if len(p.Content) == 0 {
+			continue
+		}
+		name := p.FileName
+		if name == "" {
+			name = fmt.Sprintf("part %d (%s)", i+1, p.ContentType)
+		}
+		if _, dup := targets[name]; dup {
+			name = fmt.Sprintf("%s (%d)", name, i+1)
+		}
+		targets[name] = p.Content
+	}
+	if strings.TrimSpace(env.HTML) != "" {
+		targets["HTML body"] = []byte(env.HTML)
+	}
+	return targets
+}
+
+func performYARAAnalysis(wg *sync.WaitGroup, ch chan<- CheckResult, ctx context.Context, env *enmime.Envelope, sandboxDir string) {
+	defer wg.Done()
+	var check Check
+	for _, c := range activeChecks() {
+		if c.Name == "YARARuleMatch" {
+			check = c
+			break
+		}
+	}
+	targets := yaraTargets(env)
+	result := YARAAnalysisResult{Matches: []YARAMatch{}, Scanned: len(targets)}
+	if len(targets) == 0 {
+		result.Message = "No attachments or HTML body to scan."
+		result.ScoreImpact = check.Impact
+		ch <- CheckResult{EventName: "yaraAnalysis", Payload: result}
+		return
+	}
+	matches, err := scanYARA(ctx, filepath.Join(sandboxDir, "yara"), targets)
+	switch {
+	case err != nil:
+		slog.ErrorContext(ctx, "yara scan failed", "err", err)
+		result.Error = "YARA scan failed."
+		result.Message = "The YARA rules could not be run."
+	case len(matches) > 0:
+		result.Matches = matches
+		rules := make([]string, len(matches))
+		for i, m := range matches {
+			rules[i] = m.Rule
+		}
+		result.Message = fmt.Sprintf("%d YARA rule(s) matched: %s.", len(matches), strings.Join(rules, ", "))
+	default:
+		result.Message = "No YARA rules matched."
+		result.ScoreImpact = check.Impact
+	}
+	ch <- CheckResult{EventName: "yaraAnalysis", Payload: result}
+}
@@ -0,0 +1,96 @@
+//go:build yara
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+// With -tags yara the rules are compiled by libyara through go-yara and each part is scanned in
+// memory, so no yara process is started and nothing is written to disk. It needs libyara and its
+// headers (the libyara-dev package) and the module: go get github.com/hillu/go-yara/v4.
+
+func init() {
+	yaraLibScan = scanYARALib
+}
+
+// compiledYARA caches the compiled rules until a rule file is added, removed or changed.
+var compiledYARA struct {
+	mu    sync.Mutex
+	stamp string // each file's name, size and modification time
+	rules *yara.Rules
+}
+
+// yaraRules returns the compiled rules for the given files, compiling them again when needed.
+func yaraRules(files []string) (*yara.Rules, error) {
+	var stamp strings.Builder
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&stamp, "%s:%d:%d;", f, info.Size(), info.ModTime().UnixNano())
+	}
+	compiledYARA.mu.Lock()
+	defer compiledYARA.mu.Unlock()
+	if compiledYARA.rules != nil && compiledYARA.stamp == stamp.String() {
+		return compiledYARA.rules, nil
+	}
+	compiler, err := yara.NewCompiler()
+	if err != nil {
+		return nil, err
+	}
+	defer compiler.Destroy()
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		err = compiler.AddFile(f, "")
+		_ = f.Close()
+		if err != nil {
+			var problems []string
+			for _, e := range compiler.Errors {
+				problems = append(problems, fmt.Sprintf("%s:%d: %s", e.Filename, e.Line, e.Text))
+			}
+			return nil, fmt.Errorf("compiling %s: %w: %s", name, err, strings.Join(problems, "; "))
+		}
+	}
+	rules, err := compiler.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	// Rules from before the change may still be scanning; go-yara frees them once unused.
+	compiledYARA.rules, compiledYARA.stamp = rules, stamp.String()
+	return rules, nil
+}
+
+func scanYARALib(ctx context.Context, files []string, targets map[string][]byte) (map[string][]string, error) {
+	rules, err := yaraRules(files)
+	if err != nil {
+		return nil, err
+	}
+	hits := map[string][]string{}
+	for name, content := range targets {
+		deadline, _ := ctx.Deadline()
+		timeout := time.Until(deadline)
+		if err := ctx.Err(); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("yara: %w", context.DeadlineExceeded)
+		}
+		var matches yara.MatchRules
+		if err := rules.ScanMem(content, 0, timeout, &matches); err != nil {
+			return nil, fmt.Errorf("yara: %s: %w", name, err)
+		}
+		for _, m := range matches {
+			hits[m.Rule] = append(hits[m.Rule], name)
+		}
+	}
+	return hits, nil
+}